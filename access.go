@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// accessRule matches senders by address, an IP or a CIDR, or by the name of
+// a paired peer presenting its certificate.
+type accessRule struct {
+	network *net.IPNet
+	peer    string
+}
+
+// parseAccessRule takes an IP, a CIDR or otherwise a paired peer name.
+func parseAccessRule(s string) accessRule {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return accessRule{network: n}
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return accessRule{network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}
+	}
+	return accessRule{peer: s}
+}
+
+func (r accessRule) matches(ip net.IP, peer string) bool {
+	if r.network != nil {
+		return ip != nil && r.network.Contains(ip)
+	}
+	return peer != "" && r.peer == peer
+}
+
+// accessList decides which senders may reach the receiver at all, whatever
+// key they have, for join --allow and --deny. A nil list lets everyone in.
+type accessList struct {
+	allow []accessRule
+	deny  []accessRule
+}
+
+// newAccessList returns nil when neither list has rules.
+func newAccessList(allow, deny []string) *accessList {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	a := &accessList{}
+	for _, s := range allow {
+		a.allow = append(a.allow, parseAccessRule(s))
+	}
+	for _, s := range deny {
+		a.deny = append(a.deny, parseAccessRule(s))
+	}
+	return a
+}
+
+// permits reports whether the sender at addr, verified as the paired peer
+// if not empty, gets in: a matching deny rule keeps it out, and with allow
+// rules it has to match one of them. Loopback is always let in so the local
+// commands keep working.
+func (a *accessList) permits(addr, peer string) bool {
+	if a == nil {
+		return true
+	}
+	ip := net.ParseIP(remoteHost(addr))
+	if ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, r := range a.deny {
+		if r.matches(ip, peer) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, r := range a.allow {
+		if r.matches(ip, peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// permitsConn checks the sender of a connection, identified by the paired
+// certificate it presented over TLS, state being nil for a plain one.
+func (o receiverOptions) permitsConn(addr string, state *tls.ConnectionState) bool {
+	if o.access == nil {
+		return true
+	}
+	if o.access.permits(addr, o.paired.identify(state)) {
+		return true
+	}
+	debugLog("Refusing %s, it isn't allowed by --allow and --deny", addr)
+	return false
+}
+
+// accessMiddleware answers 403 to the senders the access list keeps out,
+// before any endpoint sees their request.
+func accessMiddleware(opts receiverOptions, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !opts.permitsConn(r.RemoteAddr, requestTLS(r)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			opts.audit.auditRequest(r, authDenied, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// activityTracker ends an ad-hoc receiver once it has been idle for too long
+// or has completed enough transfers. A nil tracker does nothing.
+type activityTracker struct {
+	mu           sync.Mutex
+	idle         time.Duration
+	maxTransfers int
+	active       int
+	transfers    int
+	timer        *time.Timer
+	done         chan string
+	stopped      bool
+}
+
+// newActivityTracker returns nil when neither limit is set.
+func newActivityTracker(idle time.Duration, maxTransfers int) *activityTracker {
+	if idle <= 0 && maxTransfers <= 0 {
+		return nil
+	}
+	t := &activityTracker{
+		idle:         idle,
+		maxTransfers: maxTransfers,
+		done:         make(chan string, 1),
+	}
+	if idle > 0 {
+		t.timer = time.AfterFunc(idle, func() {
+			t.stop(fmt.Sprintf("no transfer in %v", idle))
+		})
+	}
+	return t
+}
+
+// Done is closed with the reason once the receiver should exit.
+func (t *activityTracker) Done() <-chan string {
+	if t == nil {
+		return nil
+	}
+	return t.done
+}
+
+func (t *activityTracker) begin() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active++
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+func (t *activityTracker) end(ok bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.active--
+	if ok {
+		t.transfers++
+	}
+	reached := t.maxTransfers > 0 && t.transfers >= t.maxTransfers
+	if t.active == 0 && t.timer != nil && !reached {
+		t.timer.Reset(t.idle)
+	}
+	active := t.active
+	t.mu.Unlock()
+	// let concurrent transfers finish before exiting
+	if reached && active == 0 {
+		t.stop(fmt.Sprintf("%d transfers completed", t.maxTransfers))
+	}
+}
+
+func (t *activityTracker) stop(reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped || t.active > 0 {
+		return
+	}
+	t.stopped = true
+	t.done <- reason
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const defaultNetworkCheck = 5 * time.Second
+
+// advertiser keeps the mDNS registration of the receiver alive across
+// network changes. zeroconf binds to the interfaces present when registering,
+// so after a Wi-Fi reconnect or a new interface peers would stop seeing the
+// node until it's restarted.
+type advertiser struct {
+	name string
+	port int
+	txt  []string
+	// linkLocal only advertises the link-scoped addresses
+	linkLocal bool
+
+	mu     sync.Mutex
+	server *zeroconf.Server
+	// network is the signature of the interfaces the registration is bound to
+	network string
+}
+
+func advertise(name string, port int, txt []string, linkLocal bool) (*advertiser, error) {
+	a := &advertiser{name: name, port: port, txt: txt, linkLocal: linkLocal, network: networkSignature()}
+	server, err := a.register()
+	if err != nil {
+		return nil, err
+	}
+	a.server = server
+	return a, nil
+}
+
+func (a *advertiser) register() (*zeroconf.Server, error) {
+	if !a.linkLocal {
+		// All available ip addresses will be appended to the entry automatically
+		return zeroconf.Register(a.name, service, domain, a.port, a.txt, nil)
+	}
+	ips := linkScopedIPs()
+	if len(ips) == 0 {
+		return nil, errors.New("no link-local or unique local address to advertise")
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return zeroconf.RegisterProxy(a.name, service, domain, a.port, host, ips, a.txt, nil)
+}
+
+// watch re-registers whenever the interfaces or their addresses change,
+// checking every interval, until stop is closed.
+func (a *advertiser) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		network := networkSignature()
+		a.mu.Lock()
+		changed := network != a.network
+		a.mu.Unlock()
+		if !changed {
+			continue
+		}
+		debugLog("The network changed to %s", network)
+		if err := a.refresh(network); err != nil {
+			// try again on the next check
+			fmt.Fprintf(infoOut, "Failed to refresh the advertisement after a network change: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(infoOut, "Refreshed the advertisement of %s after a network change\n", a.name)
+	}
+}
+
+func (a *advertiser) refresh(network string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.server != nil {
+		a.server.Shutdown()
+		a.server = nil
+	}
+	server, err := a.register()
+	if err != nil {
+		return err
+	}
+	a.server = server
+	a.network = network
+	return nil
+}
+
+func (a *advertiser) shutdown() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.server != nil {
+		a.server.Shutdown()
+		a.server = nil
+	}
+}
+
+// networkSignature describes the interfaces mDNS can be announced on, the
+// up and multicast capable ones, with their addresses.
+func networkSignature() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		debugLog("Failed to list the network interfaces: %v", err)
+		return ""
+	}
+	var parts []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		var ips []string
+		for _, addr := range addrs {
+			ips = append(ips, addr.String())
+		}
+		sort.Strings(ips)
+		parts = append(parts, iface.Name+"="+strings.Join(ips, ","))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The auth results of an audit entry.
+const (
+	authOK = "ok"
+	// authRejected is a wrong or missing passkey
+	authRejected = "rejected"
+	// authLockedOut is an address locked out after too many wrong passkeys
+	authLockedOut = "locked-out"
+	// authDenied is a sender --allow and --deny keep out
+	authDenied = "denied"
+)
+
+// auditRefused is the outcome of an attempt refused before any upload.
+const auditRefused = "refused"
+
+// auditEntry is a line of the audit log: a transfer attempt, accepted or not.
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Address string    `json:"address,omitempty"`
+	// Sender is the name the sender claimed
+	Sender string `json:"sender,omitempty"`
+	Inbox  string `json:"inbox,omitempty"`
+	// Path is the endpoint of an HTTP request refused before its files were
+	// read
+	Path string `json:"path,omitempty"`
+	File string `json:"file,omitempty"`
+	// Size is the announced size, Bytes what was received
+	Size    int64  `json:"size,omitempty"`
+	Bytes   int64  `json:"bytes"`
+	Auth    string `json:"auth"`
+	Outcome string `json:"outcome"`
+	Status  int    `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// auditLog appends every transfer attempt to a JSON lines file, for join
+// --audit-log. Unlike the history it records the attempts refused for their
+// passkey or address, and nothing ever rewrites it. A nil log records
+// nothing.
+type auditLog struct {
+	mu   sync.Mutex
+	file string
+}
+
+func newAuditLog(file string) *auditLog {
+	if file == "" {
+		return nil
+	}
+	return &auditLog{file: file}
+}
+
+// record appends the entry, only logging on failure so a broken audit log
+// never fails a transfer.
+func (a *auditLog) record(e auditEntry) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if err := a.append(e); err != nil {
+		debugLog("Failed to record the attempt in the audit log %s: %v", a.file, err)
+	}
+}
+
+func (a *auditLog) append(e auditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(a.file), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// auditRequest records an HTTP request refused with the status before it
+// reached an upload.
+func (a *auditLog) auditRequest(r *http.Request, auth string, status int) {
+	if a == nil {
+		return
+	}
+	e := auditEntry{
+		Address: remoteHost(r.RemoteAddr),
+		Sender:  r.Header.Get(senderHeader),
+		Path:    r.URL.Path,
+		File:    r.Header.Get(fileNameHeader),
+		Auth:    auth,
+		Outcome: auditRefused,
+		Status:  status,
+	}
+	if r.ContentLength > 0 {
+		e.Size = r.ContentLength
+	}
+	a.record(e)
+}
+
+// auditUpload records the outcome of an upload that got past the auth.
+func (a *auditLog) auditUpload(opts receiverOptions, u upload, bytes int64, err error) {
+	if a == nil {
+		return
+	}
+	e := auditEntry{
+		Address: u.address,
+		Sender:  u.sender,
+		Inbox:   opts.name,
+		File:    u.name,
+		Bytes:   bytes,
+		Auth:    authOK,
+		Outcome: statusOK,
+		Status:  uploadStatus(err),
+	}
+	if u.size > 0 {
+		e.Size = u.size
+	}
+	if err != nil {
+		e.Outcome = statusFailed
+		if errors.Is(err, errUploadStalled) {
+			e.Outcome = statusStalled
+		}
+		e.Error = err.Error()
+	}
+	a.record(e)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	pacePath = "/pace"
+	// paceInterval is how often a sender asks the receiver for its pace
+	paceInterval = time.Second
+	// paceSampleBytes is how much of an upload makes up one rate sample
+	paceSampleBytes = 1 << 20
+	// paceSmoothing weighs a new rate sample against the previous rate
+	paceSmoothing = 0.3
+)
+
+// paceAdvice is the receiver's answer to `GET /pace`: the rate each sender
+// should keep to, in bytes per second, 0 for no limit.
+type paceAdvice struct {
+	Rate   int64 `json:"rate"`
+	Active int   `json:"active"`
+}
+
+// loadMeter measures how fast the receiver stores uploads, from the time it
+// spends on the payload between reads of the body: disk writes, hashing and
+// extraction but not the network. A nil meter measures nothing.
+type loadMeter struct {
+	mu     sync.Mutex
+	active int
+	// rate is the smoothed store rate in bytes per second, 0 until measured
+	rate float64
+}
+
+func newLoadMeter() *loadMeter {
+	return &loadMeter{}
+}
+
+func (m *loadMeter) begin() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active++
+}
+
+func (m *loadMeter) end() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active--
+}
+
+func (m *loadMeter) sample(n int64, busy time.Duration) {
+	if busy <= 0 {
+		return
+	}
+	rate := float64(n) / busy.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rate == 0 {
+		m.rate = rate
+		return
+	}
+	m.rate = paceSmoothing*rate + (1-paceSmoothing)*m.rate
+}
+
+// advice splits the store rate between the uploads in progress.
+func (m *loadMeter) advice() paceAdvice {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a := paceAdvice{Active: m.active}
+	if m.rate > 0 {
+		a.Rate = int64(m.rate / float64(max(m.active, 1)))
+	}
+	return a
+}
+
+// meter returns r reporting its store rate to the meter.
+func (m *loadMeter) meter(r io.Reader) io.Reader {
+	if m == nil {
+		return r
+	}
+	return &meteredReader{r: r, m: m}
+}
+
+type meteredReader struct {
+	r io.Reader
+	m *loadMeter
+	// last is when the previous read returned, the time since then was
+	// spent on its bytes
+	last  time.Time
+	bytes int64
+	busy  time.Duration
+}
+
+func (mr *meteredReader) Read(p []byte) (int, error) {
+	if !mr.last.IsZero() {
+		mr.busy += time.Since(mr.last)
+	}
+	if mr.bytes >= paceSampleBytes {
+		mr.m.sample(mr.bytes, mr.busy)
+		mr.bytes, mr.busy = 0, 0
+	}
+	n, err := mr.r.Read(p)
+	mr.bytes += int64(n)
+	mr.last = time.Now()
+	return n, err
+}
+
+// paceHandler serves the pace advice of the receiver to senders holding the
+// key of the inbox given by the `inbox` query parameter.
+func paceHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		inbox, ok := opts.inbox(r.URL.Query().Get("inbox"))
+		if !ok {
+			http.Error(w, "Unknown inbox", http.StatusNotFound)
+			return
+		}
+		if !inbox.authorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(opts.load.advice())
+	}
+}
+
+// throttle holds a sender to a rate that can change during the upload. A nil
+// throttle doesn't slow anything down.
+type throttle struct {
+	mu sync.Mutex
+	// rate is in bytes per second, 0 for no limit
+	rate float64
+	next time.Time
+}
+
+func (t *throttle) setRate(rate int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if float64(rate) != t.rate {
+		debugLog("The receiver asks for %d bytes/s", rate)
+	}
+	t.rate = float64(rate)
+}
+
+// wait sleeps until n more bytes may be sent.
+func (t *throttle) wait(n int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	now := time.Now()
+	if t.rate <= 0 || t.next.Before(now) {
+		t.next = now
+	}
+	if t.rate > 0 {
+		t.next = t.next.Add(time.Duration(float64(n) / t.rate * float64(time.Second)))
+	}
+	due := t.next
+	t.mu.Unlock()
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	tr.t.wait(n)
+	return n, err
+}
+
+// followPace polls the receiver's pace advice into the throttle until the
+// returned function is called. Receivers without the endpoint are left
+// alone.
+func followPace(t *throttle, opts sendOptions) (stop func()) {
+	client := opts.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	url := opts.url(pacePath)
+	if opts.inbox != "" {
+		url += "?inbox=" + opts.inbox
+	}
+	poll := func() error {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(passKeyHeader, opts.key)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("server returned status: %s", resp.Status)
+		}
+		var a paceAdvice
+		if err := json.NewDecoder(resp.Body).Decode(&a); err != nil {
+			return err
+		}
+		t.setRate(a.Rate)
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(paceInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := poll(); err != nil {
+					debugLog("Stopped following the receiver's pace: %v", err)
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
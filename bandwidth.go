@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// bandwidthChunk is the most a single read or write takes from the
+	// bucket at once, so large buffers still go out smoothly
+	bandwidthChunk = 16 << 10
+	// bandwidthBurst is how long the bucket may save up for
+	bandwidthBurst = 250 * time.Millisecond
+)
+
+// bandwidthLimit is a token bucket capping the bytes per second every
+// connection of this process carries, both ways and all together. A nil
+// bandwidthLimit limits nothing.
+type bandwidthLimit struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// bandwidth is set by --limit, nil for no limit.
+var bandwidth *bandwidthLimit
+
+// parseRate parses a rate such as 10MB/s or 512KiB/s into bytes per second.
+func parseRate(s string) (int64, error) {
+	size, err := parseSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return size, nil
+}
+
+// applyBandwidthLimit caps the traffic of the process at the rate, empty or
+// 0 for no limit.
+func applyBandwidthLimit(rate string) error {
+	if rate == "" {
+		return nil
+	}
+	n, err := parseRate(rate)
+	if err != nil || n == 0 {
+		return err
+	}
+	bandwidth = newBandwidthLimit(n)
+	fmt.Fprintf(infoOut, "Limiting the bandwidth to %s/s\n", formatBytes(n))
+	return nil
+}
+
+func newBandwidthLimit(rate int64) *bandwidthLimit {
+	burst := max(float64(rate)*bandwidthBurst.Seconds(), bandwidthChunk)
+	return &bandwidthLimit{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take sleeps until n bytes may go through. The bucket goes into debt for
+// more than it holds, which the callers after pay back.
+func (b *bandwidthLimit) take(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// conn returns conn held to the limit, or as is with none.
+func (b *bandwidthLimit) conn(conn net.Conn) net.Conn {
+	if b == nil {
+		return conn
+	}
+	_, datagram := conn.(net.PacketConn)
+	return &limitedConn{Conn: conn, limit: b, datagram: datagram}
+}
+
+// reader returns r held to the limit, or as is with none.
+func (b *bandwidthLimit) reader(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &limitedReader{r: r, limit: b}
+}
+
+type limitedReader struct {
+	r     io.Reader
+	limit *bandwidthLimit
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunk {
+		p = p[:bandwidthChunk]
+	}
+	n, err := lr.r.Read(p)
+	lr.limit.take(n)
+	return n, err
+}
+
+// limitedConn is a connection held to a bandwidthLimit.
+type limitedConn struct {
+	net.Conn
+	limit *bandwidthLimit
+	// datagram is set for a connected UDP socket, whose writes can't be
+	// split
+	datagram bool
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunk && !c.datagram {
+		p = p[:bandwidthChunk]
+	}
+	n, err := c.Conn.Read(p)
+	c.limit.take(n)
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	if c.datagram {
+		c.limit.take(len(p))
+		return c.Conn.Write(p)
+	}
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), bandwidthChunk)]
+		c.limit.take(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the connection when it supports it.
+func (c *limitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// planUploads splits the sources into the ones sent on their own and the small
+// regular files packed together into a single batch archive. Batching only
+// kicks in when there are at least two small files with distinct names.
+func planUploads(srcs []string, threshold int64) (singles, batch []string, err error) {
+	seen := map[string]bool{}
+	for _, src := range srcs {
+		fi, err := os.Stat(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		name := filepath.Base(src)
+		if threshold <= 0 || !fi.Mode().IsRegular() || fi.Size() >= threshold || seen[name] {
+			singles = append(singles, src)
+			continue
+		}
+		seen[name] = true
+		batch = append(batch, src)
+	}
+	if len(batch) < 2 {
+		return append(batch, singles...), nil, nil
+	}
+	return singles, batch, nil
+}
+
+// batchNames returns the names of the files in a batch, their base names.
+func batchNames(files []string) []string {
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = filepath.Base(f)
+	}
+	return names
+}
+
+// zipTarFiles packs the regular files, by base name, into a temporary tarball
+// compressed with the codec.
+func zipTarFiles(files []string, codec string) (string, error) {
+	return zipTarNamed(files, batchNames(files), codec)
+}
+
+// zipTarNamed packs the regular files into a temporary tarball compressed
+// with the codec, each under the slash separated name at the same index.
+func zipTarNamed(files, names []string, codec string) (string, error) {
+	file, err := os.CreateTemp("", "ftr-batch-*"+tarballExt(codec))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if err := writeBatch(file, files, names, codec); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// writeBatch writes the tarball of the regular files compressed with the
+// codec to w, each under the slash separated name at the same index.
+func writeBatch(w io.Writer, files, names []string, codec string) error {
+	gw, err := newCompressor(w, codec)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(gw)
+	for i, src := range files {
+		if err := addFileToTar(tw, src, names[i]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func addFileToTar(tw *tar.Writer, src, name string) error {
+	f, err := os.Open(longPath(src))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Typeflag = tar.TypeReg
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	debugLog("Adding file %s to the batch", src)
+	_, err = io.Copy(tw, f)
+	return err
+}
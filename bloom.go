@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+)
+
+const (
+	// bloomBitsPerEntry and bloomHashes give a false positive rate of
+	// about 1%
+	bloomBitsPerEntry = 10
+	bloomHashes       = 7
+)
+
+// bloomFilter is a compact set of manifest entries with false positives but
+// no false negatives.
+type bloomFilter struct {
+	Bits   []byte `json:"bits"`
+	Hashes int    `json:"hashes"`
+}
+
+func newBloomFilter(entries []manifestEntry) bloomFilter {
+	n := max(len(entries)*bloomBitsPerEntry, 64)
+	f := bloomFilter{Bits: make([]byte, (n+7)/8), Hashes: bloomHashes}
+	for _, e := range entries {
+		for _, i := range f.indexes(e) {
+			f.Bits[i/8] |= 1 << (i % 8)
+		}
+	}
+	return f
+}
+
+// indexes returns the bits of the entry, derived from a single SHA-256 by
+// double hashing.
+func (f bloomFilter) indexes(e manifestEntry) []uint64 {
+	sum := sha256.Sum256([]byte(e.Path + "\x00" + e.SHA256))
+	h1 := binary.BigEndian.Uint64(sum[:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16])
+	m := uint64(len(f.Bits)) * 8
+	idx := make([]uint64, f.Hashes)
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) % m
+	}
+	return idx
+}
+
+// contains reports whether the entry may be in the set. An empty filter
+// holds nothing.
+func (f bloomFilter) contains(e manifestEntry) bool {
+	if len(f.Bits) == 0 {
+		return false
+	}
+	for _, i := range f.indexes(e) {
+		if f.Bits[i/8]&(1<<(i%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// manifestDigest returns a SHA-256 over the entries, independent of their
+// order, so two trees with the same files have the same digest.
+func manifestDigest(entries []manifestEntry) string {
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		lines[i] = e.Path + "\x00" + e.SHA256 + "\n"
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, l := range lines {
+		h.Write([]byte(l))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
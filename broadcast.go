@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// broadcastTargets returns the peers of a `send --all` or `send --peers`: every
+// peer discovered within the timeout but this host, or the comma-separated list
+// whose members with wildcards are matched against the discovered peers.
+func broadcastTargets(all bool, list string, timeout time.Duration) ([]string, error) {
+	if !all {
+		return expandPeers(list, timeout)
+	}
+	discovered, err := browsePeers(timeout)
+	if err != nil {
+		return nil, err
+	}
+	self := getDefaultName()
+	var peers []string
+	for _, peer := range discovered {
+		if peer != self {
+			peers = append(peers, peer)
+		}
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers found in %v", timeout)
+	}
+	return peers, nil
+}
+
+// peerStatus is the outcome of a broadcast for one peer.
+type peerStatus struct {
+	peer    string
+	err     error
+	elapsed time.Duration
+}
+
+// broadcast runs send for up to limit peers at once, all of them with a
+// limit of 0, and returns their outcomes in the order of the peers.
+func broadcast(peers []string, limit int, send func(peer string) error) []peerStatus {
+	statuses := make([]peerStatus, len(peers))
+	if limit <= 0 {
+		limit = len(peers)
+	}
+	slots := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			start := time.Now()
+			err := send(peer)
+			statuses[i] = peerStatus{peer: peer, err: err, elapsed: time.Since(start)}
+		}()
+	}
+	wg.Wait()
+	return statuses
+}
+
+// printPeerStatus writes a line per peer of a broadcast and returns the number
+// of peers that failed.
+func printPeerStatus(w io.Writer, statuses []peerStatus) int {
+	failed := 0
+	for _, s := range statuses {
+		if s.err != nil {
+			failed++
+			fmt.Fprintf(w, "%-20s failed  %v\n", s.peer, s.err)
+			continue
+		}
+		fmt.Fprintf(w, "%-20s ok      %s\n", s.peer, formatDuration(s.elapsed))
+	}
+	fmt.Fprintf(w, "%d of %d peers succeeded\n", len(statuses)-failed, len(statuses))
+	return failed
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const listPath = "/list"
+
+// offeredEntry is a file or directory `ftr browse` shows, named by the path
+// `ftr get` pulls it with.
+type offeredEntry struct {
+	Name    string    `json:"name"`
+	Dir     bool      `json:"dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// list returns the offered files, or the content of the offered directory
+// at p.
+func (o offeredFiles) list(p string) ([]offeredEntry, error) {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	var entries []offeredEntry
+	add := func(name string, fi os.FileInfo) {
+		e := offeredEntry{Name: name, Dir: fi.IsDir(), ModTime: fi.ModTime()}
+		if !e.Dir {
+			e.Size = fi.Size()
+		}
+		entries = append(entries, e)
+	}
+	if p == "" {
+		for _, name := range o.names() {
+			fi, err := os.Stat(o[name])
+			if err != nil {
+				debugLog("Not listing the offered %s: %v", o[name], err)
+				continue
+			}
+			add(name, fi)
+		}
+		return entries, nil
+	}
+	src, ok := o.resolve(p)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	dirEntries, err := os.ReadDir(src)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirEntries {
+		fi, err := d.Info()
+		if err != nil {
+			continue
+		}
+		add(path.Join(p, d.Name()), fi)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Dir != b.Dir {
+			return a.Dir
+		}
+		return a.Name < b.Name
+	})
+	return entries, nil
+}
+
+// listHandler lists the offered files, or with ?path= the content of an
+// offered directory, as JSON.
+func listHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		entries, err := opts.offered.list(r.URL.Query().Get("path"))
+		if err != nil {
+			http.Error(w, "Directory not offered", http.StatusNotFound)
+			return
+		}
+		if entries == nil {
+			entries = []offeredEntry{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
+
+func runBrowse(args []string) {
+	browseCmd := flag.NewFlagSet("browse", flag.ExitOnError)
+	browseCmd.SetOutput(os.Stdout)
+	key := browseCmd.String("key", "", "pre-shared passkey, defaults to the one of the peer in the [keys] config section")
+	debug := browseCmd.Bool("debug", false, "enable debug log")
+	jsonOutput := browseCmd.Bool("json", false, "print the files as JSON")
+	configFile := browseCmd.String("config", defaultConfigFile(), "the path to the config file")
+	lookupTimeout := browseCmd.Duration("lookup-timeout", defaultLookupTimeoutMs*time.Millisecond, "how long to browse for the peer per attempt")
+	lookupRetries := browseCmd.Int("lookup-retries", defaultLookupRetries, "the number of times to retry a failed peer lookup")
+	applyUnits := unitFlags(browseCmd)
+	if err := browseCmd.Parse(args); err != nil {
+		exitWithError(1, "Browse command failed: %v", err)
+	}
+	debugMode = *debug
+	applyUnits()
+	pos := browseCmd.Args()
+	if len(pos) != 1 {
+		fmt.Println("Usage: ftr browse [--key <key>] <peer>[:<dir>]")
+		os.Exit(1)
+	}
+	peer, dir, _ := strings.Cut(pos[0], ":")
+	cfg := mustLoadConfig(*configFile)
+
+	e, err := findPeer(peer, *lookupTimeout, *lookupRetries)
+	if err != nil {
+		exitWithError(1, "Failed to find the peer: %v", err)
+	}
+	tlsConfig := peerTLS(peer, e.Text)
+	u := peerURL(tlsConfig, peerAddr(e), e.Port, listPath) + "?" + url.Values{"path": {dir}}.Encode()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		exitWithError(1, "Failed to create the http request: %v", err)
+	}
+	req.Header.Set(passKeyHeader, peerKey(browseCmd, cfg, peer, "", *key))
+	req.Header.Set(senderHeader, getDefaultName())
+	resp, err := tlsClient(tlsConfig).Do(req)
+	if err != nil {
+		exitWithError(1, "Failed to send the request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		exitWithError(1, "The peer refused the listing: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var entries []offeredEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		exitWithError(1, "Failed to decode the listing: %v", err)
+	}
+	if *jsonOutput {
+		if err := json.NewEncoder(os.Stdout).Encode(entries); err != nil {
+			exitWithError(1, "Failed to encode the listing: %v", err)
+		}
+		return
+	}
+	fmt.Printf("%-40s %-12s %-16s\n", "Name", "Size", "Modified")
+	for _, e := range entries {
+		size := formatBytes(e.Size)
+		name := e.Name
+		if e.Dir {
+			size = "-"
+			name += "/"
+		}
+		fmt.Printf("%-40s %-12s %-16s\n", name, size, e.ModTime.Local().Format("2006-01-02 15:04"))
+	}
+}
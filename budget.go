@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"runtime"
+	"runtime/debug"
+	"sync"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+const defaultCopyBufferSize = "32KiB"
+
+// The CPU and memory budget of the process, set once by join before it
+// starts serving so ftr can share a NAS or a router with other services.
+var (
+	// codecThreads caps the goroutines of a single Reed-Solomon codec, 0
+	// for the library default; zstd decoders run on one already
+	codecThreads int
+	// copyBuffers are the buffers uploads are copied through, reused so
+	// concurrent transfers don't each allocate their own
+	copyBufferSize = 32 << 10
+	copyBuffers    = sync.Pool{New: func() any {
+		b := make([]byte, copyBufferSize)
+		return &b
+	}}
+)
+
+// applyBudget caps the OS threads running Go code and the codec goroutines
+// to threads, the copy buffers to bufferSize and the Go heap to a soft limit
+// of maxMemory. Zero values keep the defaults.
+func applyBudget(threads int, bufferSize, maxMemory int64) {
+	if threads > 0 {
+		runtime.GOMAXPROCS(threads)
+		codecThreads = threads
+	}
+	if bufferSize > 0 {
+		copyBufferSize = int(bufferSize)
+	}
+	if maxMemory > 0 {
+		debug.SetMemoryLimit(maxMemory)
+	}
+	debugLog("Running with %d threads, %d byte copy buffers and a memory limit of %d bytes",
+		runtime.GOMAXPROCS(0), copyBufferSize, debug.SetMemoryLimit(-1))
+}
+
+// codecOptions caps the goroutines of a Reed-Solomon codec to codecThreads.
+func codecOptions() []reedsolomon.Option {
+	if codecThreads <= 0 {
+		return nil
+	}
+	return []reedsolomon.Option{reedsolomon.WithMaxGoroutines(codecThreads)}
+}
+
+// copyPooled is io.Copy through a buffer of the pool.
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// extractionSlots bounds how many directories and batches are extracted at
+// once; the uploads beyond that wait for a slot. A nil value doesn't limit.
+type extractionSlots chan struct{}
+
+func newExtractionSlots(n int) extractionSlots {
+	if n <= 0 {
+		return nil
+	}
+	return make(extractionSlots, n)
+}
+
+func (s extractionSlots) acquire() {
+	if s != nil {
+		s <- struct{}{}
+	}
+}
+
+func (s extractionSlots) release() {
+	if s != nil {
+		<-s
+	}
+}
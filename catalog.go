@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	historyPath = "/history"
+	// defaultCatalogLimit is the page size of the history catalog
+	defaultCatalogLimit = 100
+	maxCatalogLimit     = 1000
+	// catalogTotalHeader and catalogNextOffsetHeader page CSV exports
+	catalogTotalHeader      = "X-Ftr-Total"
+	catalogNextOffsetHeader = "X-Ftr-Next-Offset"
+)
+
+// historyFilter selects the entries of the history catalog.
+type historyFilter struct {
+	since, until time.Time
+	peer         string
+	status       string
+	direction    string
+}
+
+// parseCatalogTime accepts an RFC 3339 time or a plain date, in local time.
+func parseCatalogTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, s, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("%q is neither an RFC 3339 time nor a YYYY-MM-DD date", s)
+	}
+	return t, nil
+}
+
+func parseHistoryFilter(q url.Values) (historyFilter, error) {
+	f := historyFilter{peer: q.Get("peer"), status: q.Get("status"), direction: q.Get("direction")}
+	var err error
+	if v := q.Get("since"); v != "" {
+		if f.since, err = parseCatalogTime(v); err != nil {
+			return f, fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.until, err = parseCatalogTime(v); err != nil {
+			return f, fmt.Errorf("invalid until: %v", err)
+		}
+		// a plain date includes the whole day
+		if !strings.Contains(v, "T") {
+			f.until = f.until.AddDate(0, 0, 1)
+		}
+	}
+	return f, nil
+}
+
+func (f historyFilter) match(e historyEntry) bool {
+	return (f.since.IsZero() || !e.Time.Before(f.since)) &&
+		(f.until.IsZero() || e.Time.Before(f.until)) &&
+		(f.peer == "" || e.Peer == f.peer) &&
+		(f.status == "" || e.Status == f.status) &&
+		(f.direction == "" || e.Direction == f.direction)
+}
+
+// historyPage is a page of the history catalog. NextOffset is set while
+// there are more entries to fetch.
+type historyPage struct {
+	Total      int            `json:"total"`
+	Offset     int            `json:"offset"`
+	Limit      int            `json:"limit"`
+	NextOffset *int           `json:"next_offset,omitempty"`
+	Entries    []historyEntry `json:"entries"`
+}
+
+// historyHandler serves the history ledger of the receiver to the holders of
+// its key, oldest first, for collecting the records of many receivers:
+//
+//	GET /history?since=2024-05-01&until=2024-05-31&peer=nas&status=failed
+//	GET /history?offset=100&limit=100
+//	GET /history?format=csv&limit=0
+//
+// A limit of 0 returns every matching entry.
+func historyHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		filter, err := parseHistoryFilter(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		offset, limit := 0, defaultCatalogLimit
+		if v := q.Get("offset"); v != "" {
+			if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+				http.Error(w, "Invalid offset", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+		format := q.Get("format")
+		if format != "" && format != "json" && format != "csv" {
+			http.Error(w, "Unsupported format", http.StatusBadRequest)
+			return
+		}
+		// paging through JSON stays bounded, an export may take everything
+		if format != "csv" && (limit == 0 || limit > maxCatalogLimit) {
+			limit = maxCatalogLimit
+		}
+
+		var entries []historyEntry
+		if opts.historyFile != "" {
+			all, err := readHistory(opts.historyFile)
+			if err != nil {
+				http.Error(w, "Failed to read the history", http.StatusInternalServerError)
+				return
+			}
+			for _, e := range all {
+				if filter.match(e) {
+					entries = append(entries, e)
+				}
+			}
+		}
+		page := historyPage{Total: len(entries), Offset: offset, Limit: limit, Entries: []historyEntry{}}
+		if offset < len(entries) {
+			end := len(entries)
+			if limit > 0 && offset+limit < end {
+				end = offset + limit
+				page.NextOffset = &end
+			}
+			page.Entries = entries[offset:end]
+		}
+
+		if format == "csv" {
+			// a CSV export has no envelope, the paging goes in headers
+			w.Header().Set(catalogTotalHeader, strconv.Itoa(page.Total))
+			if page.NextOffset != nil {
+				w.Header().Set(catalogNextOffsetHeader, strconv.Itoa(*page.NextOffset))
+			}
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="history.csv"`)
+			if err := writeHistoryCSV(w, page.Entries); err != nil {
+				debugLog("Failed to write the history export: %v", err)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+func writeHistoryCSV(w io.Writer, entries []historyEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "direction", "peer", "file", "bytes", "duration_ms", "status", "error", "sha256", "path", "duplicate", "skipped"})
+	for _, e := range entries {
+		path := e.Path
+		if path == "" {
+			path = strings.Join(e.Paths, ";")
+		}
+		cw.Write([]string{
+			e.Time.Format(time.RFC3339), e.Direction, e.Peer, e.File,
+			strconv.FormatInt(e.Bytes, 10), strconv.FormatInt(e.DurationMs, 10),
+			e.Status, e.Error, e.Hash, path,
+			strconv.FormatBool(e.Duplicate), strconv.FormatBool(e.Skipped),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	chunkedUploadsPath   = "/uploads"
+	chunkedUploadPrefix  = "/upload/"
+	chunkedStagingDir    = ".ftr-chunks"
+	minChunkSize         = 64 << 10
+	maxChunkSize         = 64 << 20
+	chunkedUploadIdleTTL = 24 * time.Hour
+	// maxChunks bounds the bitmap of an upload, a 64 GiB file at the
+	// smallest chunk size
+	maxChunks = 1 << 20
+)
+
+// chunkedUploadRequest opens a chunked upload. The payload is split into
+// chunks of ChunkSize bytes, the last one possibly shorter.
+type chunkedUploadRequest struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+	// Hash is the optional SHA-256 of the payload checked on completion
+	Hash  string `json:"sha256,omitempty"`
+	Inbox string `json:"inbox,omitempty"`
+	// OnConflict is the conflict policy the sender asks for
+	OnConflict string `json:"on_conflict,omitempty"`
+	fileMeta
+}
+
+// chunkedUpload is an upload whose chunks may arrive out of order and in
+// parallel. They are written in place into a staging file and tracked in a
+// bitmap until the upload is completed.
+type chunkedUpload struct {
+	ID       string `json:"id"`
+	Received []bool `json:"received"`
+	chunkedUploadRequest
+
+	mu     sync.Mutex
+	opts   receiverOptions
+	sender string
+	// address is where the upload was opened from, unknown once restored
+	address string
+	// node is the fingerprint of the sender's node key. The upload belongs
+	// to it wherever it connects from, so a roaming sender can carry on.
+	node     string
+	file     *os.File
+	path     string
+	lastUsed time.Time
+	done     bool
+	// writes are the chunks being written, waited for before the staging
+	// file is read or closed
+	writes sync.WaitGroup
+}
+
+func (c *chunkedUpload) chunks() int64 {
+	n := c.Size / c.ChunkSize
+	if c.Size%c.ChunkSize != 0 {
+		n++
+	}
+	return n
+}
+
+// validChunking reports whether the upload can be split as the request asks
+// within the limits of the receiver. A payload smaller than one chunk may
+// come in a smaller one.
+func validChunking(req chunkedUploadRequest) bool {
+	if req.Size <= 0 || req.ChunkSize <= 0 || req.ChunkSize > maxChunkSize {
+		return false
+	}
+	if req.ChunkSize < minChunkSize && req.ChunkSize < req.Size {
+		return false
+	}
+	return (&chunkedUpload{chunkedUploadRequest: req}).chunks() <= maxChunks
+}
+
+// chunkLen returns the expected length of chunk n.
+func (c *chunkedUpload) chunkLen(n int64) int64 {
+	if n == c.chunks()-1 {
+		return c.Size - n*c.ChunkSize
+	}
+	return c.ChunkSize
+}
+
+func (c *chunkedUpload) missing() []int64 {
+	var missing []int64
+	for n, ok := range c.Received {
+		if !ok {
+			missing = append(missing, int64(n))
+		}
+	}
+	return missing
+}
+
+// chunkedUploadState is what's kept of a chunked upload next to its staging
+// file, so a restarted receiver can carry on with it.
+type chunkedUploadState struct {
+	ID       string               `json:"id"`
+	Received []bool               `json:"received"`
+	Request  chunkedUploadRequest `json:"request"`
+	Sender   string               `json:"sender"`
+	Node     string               `json:"node,omitempty"`
+}
+
+// save writes the state of the upload next to its staging file. The caller
+// holds c.mu.
+func (c *chunkedUpload) save() error {
+	data, err := json.Marshal(chunkedUploadState{
+		ID:       c.ID,
+		Received: c.Received,
+		Request:  c.chunkedUploadRequest,
+		Sender:   c.sender,
+		Node:     c.node,
+	})
+	if err != nil {
+		return err
+	}
+	state := strings.TrimSuffix(c.path, ".part") + ".json"
+	tmp := state + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, state)
+}
+
+// chunkedUploads tracks the open chunked uploads of the receiver.
+type chunkedUploads struct {
+	mu      sync.Mutex
+	uploads map[string]*chunkedUpload
+}
+
+func newChunkedUploads() *chunkedUploads {
+	return &chunkedUploads{uploads: map[string]*chunkedUpload{}}
+}
+
+func (u *chunkedUploads) open(opts receiverOptions, req chunkedUploadRequest, sender, address, node string) (*chunkedUpload, error) {
+	u.expire()
+	staging := filepath.Join(opts.dropDir, chunkedStagingDir)
+	if err := os.MkdirAll(staging, 0700); err != nil {
+		return nil, err
+	}
+	c := &chunkedUpload{
+		ID:                   newTransferID(),
+		chunkedUploadRequest: req,
+		opts:                 opts,
+		sender:               sender,
+		address:              address,
+		node:                 node,
+		lastUsed:             time.Now(),
+	}
+	c.path = filepath.Join(staging, c.ID+".part")
+	f, err := os.Create(c.path)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(req.Size); err != nil {
+		f.Close()
+		os.Remove(c.path)
+		return nil, err
+	}
+	c.file = f
+	c.Received = make([]bool, c.chunks())
+	if err := c.save(); err != nil {
+		f.Close()
+		os.Remove(c.path)
+		return nil, err
+	}
+	u.mu.Lock()
+	u.uploads[c.ID] = c
+	u.mu.Unlock()
+	return c, nil
+}
+
+// reserved returns the space the open uploads of the inbox will take once
+// completed.
+func (u *chunkedUploads) reserved(inbox string) int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var total int64
+	for _, c := range u.uploads {
+		if c.opts.name == inbox {
+			total += c.Size
+		}
+	}
+	return total
+}
+
+func (u *chunkedUploads) get(id string) (*chunkedUpload, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c, ok := u.uploads[id]
+	return c, ok
+}
+
+func (u *chunkedUploads) remove(c *chunkedUpload) {
+	u.mu.Lock()
+	delete(u.uploads, c.ID)
+	u.mu.Unlock()
+	c.mu.Lock()
+	c.done = true
+	c.mu.Unlock()
+	c.writes.Wait()
+	c.file.Close()
+	os.Remove(c.path)
+	os.Remove(strings.TrimSuffix(c.path, ".part") + ".json")
+}
+
+// restore picks the chunked uploads of the inbox a previous run of the
+// receiver left in its staging dir back up.
+func (u *chunkedUploads) restore(opts receiverOptions) error {
+	staging := filepath.Join(opts.dropDir, chunkedStagingDir)
+	states, err := filepath.Glob(filepath.Join(staging, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		data, err := os.ReadFile(state)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(state)
+		if err != nil {
+			return err
+		}
+		var s chunkedUploadState
+		if err := json.Unmarshal(data, &s); err != nil || s.Request.Inbox != opts.name {
+			continue
+		}
+		c := &chunkedUpload{
+			ID:                   s.ID,
+			Received:             s.Received,
+			chunkedUploadRequest: s.Request,
+			opts:                 opts,
+			sender:               s.Sender,
+			node:                 s.Node,
+			path:                 filepath.Join(staging, s.ID+".part"),
+			lastUsed:             fi.ModTime(),
+		}
+		if !validChunking(s.Request) {
+			debugLog("Dropping the chunked upload %s with invalid chunks", s.ID)
+			os.Remove(state)
+			continue
+		}
+		f, err := os.OpenFile(c.path, os.O_RDWR, 0)
+		if err != nil || int64(len(c.Received)) != c.chunks() {
+			debugLog("Dropping the chunked upload %s without its staging file", s.ID)
+			os.Remove(state)
+			continue
+		}
+		c.file = f
+		u.mu.Lock()
+		u.uploads[c.ID] = c
+		u.mu.Unlock()
+		debugLog("Restored the chunked upload %s of %s with %d chunks missing", c.ID, c.Name, len(c.missing()))
+	}
+	return nil
+}
+
+// expire drops the uploads nobody touched for a day.
+func (u *chunkedUploads) expire() {
+	u.mu.Lock()
+	var stale []*chunkedUpload
+	for _, c := range u.uploads {
+		c.mu.Lock()
+		if time.Since(c.lastUsed) > chunkedUploadIdleTTL {
+			stale = append(stale, c)
+		}
+		c.mu.Unlock()
+	}
+	u.mu.Unlock()
+	for _, c := range stale {
+		debugLog("Dropping the stale chunked upload %s of %s", c.ID, c.Name)
+		u.remove(c)
+	}
+}
+
+// chunkedUploadsHandler opens chunked uploads with `POST /uploads`. The
+// passkey must match the target inbox.
+func chunkedUploadsHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if opts.control.isClosing() {
+			http.Error(w, "The receiver is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		var req chunkedUploadRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "Invalid chunked upload request", http.StatusBadRequest)
+			return
+		}
+		inbox, ok := opts.inbox(req.Inbox)
+		if !ok {
+			http.Error(w, "Unknown inbox", http.StatusNotFound)
+			return
+		}
+		if !inbox.authorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch req.Type {
+		case "":
+			req.Type = fileTypeFile
+		case fileTypeFile, fileTypeDir, fileTypeBatch:
+		default:
+			http.Error(w, "Invalid file type", http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" || !validChunking(req) {
+			http.Error(w, "Invalid chunked upload request", http.StatusBadRequest)
+			return
+		}
+		if inbox.ephemeral {
+			http.Error(w, "Chunked uploads need a drop dir", http.StatusBadRequest)
+			return
+		}
+		if inbox.maxSize > 0 && req.Size > inbox.maxSize {
+			http.Error(w, "File exceeds the maximum upload size", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// the whole payload is staged up front, so it has to fit in the
+		// quota along with the other uploads in progress now rather than
+		// be refused once it's all sent
+		if inbox.quota > 0 {
+			used, err := quotaUsage(inbox)
+			if err != nil {
+				http.Error(w, "Failed to check the drop dir quota", http.StatusInternalServerError)
+				return
+			}
+			if req.Size > inbox.quota-used-opts.chunked.reserved(inbox.name) {
+				http.Error(w, "Drop dir quota exceeded", http.StatusInsufficientStorage)
+				return
+			}
+		}
+		c, err := opts.chunked.open(inbox, req, senderName(r), remoteHost(r.RemoteAddr), r.Header.Get(nodeHeader))
+		if err != nil {
+			http.Error(w, "Failed to create the upload on server", http.StatusInternalServerError)
+			return
+		}
+		debugLog("Opened the chunked upload %s of %s in %d chunks", c.ID, c.Name, c.chunks())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// chunkedUploadHandler serves a chunked upload:
+//
+//	GET  /upload/<id>            the upload and its bitmap of received chunks
+//	PUT  /upload/<id>/chunk/<n>  stores chunk n
+//	POST /upload/<id>/complete   verifies and delivers the upload
+//	DELETE /upload/<id>          aborts it
+func chunkedUploadHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, chunkedUploadPrefix), "/")
+		c, ok := opts.chunked.get(parts[0])
+		if !ok {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+		if !c.opts.authorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if c.node != "" && r.Header.Get(nodeHeader) != c.node {
+			http.Error(w, "The upload belongs to another node", http.StatusForbidden)
+			return
+		}
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(c)
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			opts.chunked.remove(c)
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 3 && parts[1] == "chunk" && r.Method == http.MethodPut:
+			n, err := strconv.ParseInt(parts[2], 10, 64)
+			if err != nil || n < 0 || n >= c.chunks() {
+				http.Error(w, "Invalid chunk number", http.StatusBadRequest)
+				return
+			}
+			if err := putChunk(c, n, r.Body); err != nil {
+				http.Error(w, err.Error(), uploadStatus(err))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 2 && parts[1] == "complete" && r.Method == http.MethodPost:
+			job, err := completeChunkedUpload(opts.chunked, c)
+			if job != nil {
+				w.Header().Set(transferIDHeader, job.ID)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), uploadStatus(err))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+	}
+}
+
+// putChunk writes chunk n at its offset of the staging file. Chunks are
+// independent, so several may be written at once.
+func putChunk(c *chunkedUpload, n int64, body io.Reader) error {
+	want := c.chunkLen(n)
+	data, err := io.ReadAll(io.LimitReader(body, want+1))
+	if err != nil {
+		return newUploadError(http.StatusBadRequest, "Failed to read the chunk")
+	}
+	if int64(len(data)) != want {
+		return newUploadError(http.StatusBadRequest, fmt.Sprintf("Chunk %d must be %d bytes", n, want))
+	}
+	c.mu.Lock()
+	if c.done {
+		c.mu.Unlock()
+		return newUploadError(http.StatusConflict, "Upload already completed")
+	}
+	c.lastUsed = time.Now()
+	c.writes.Add(1)
+	c.mu.Unlock()
+	defer c.writes.Done()
+	if _, err := c.file.WriteAt(data, n*c.ChunkSize); err != nil {
+		return newUploadError(http.StatusInternalServerError, "Failed to save the chunk on server")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Received[n] = true
+	if err := c.save(); err != nil {
+		debugLog("Failed to save the state of the chunked upload %s: %v", c.ID, err)
+	}
+	return nil
+}
+
+// completeChunkedUpload checks every chunk arrived and the payload matches
+// its hash, then delivers it like any other upload.
+func completeChunkedUpload(uploads *chunkedUploads, c *chunkedUpload) (*transferJob, error) {
+	c.mu.Lock()
+	if c.done {
+		c.mu.Unlock()
+		return nil, newUploadError(http.StatusConflict, "Upload already completed")
+	}
+	if missing := c.missing(); len(missing) > 0 {
+		c.mu.Unlock()
+		return nil, newUploadError(http.StatusConflict, fmt.Sprintf("%d chunks missing, the first is %d", len(missing), missing[0]))
+	}
+	c.done = true
+	c.mu.Unlock()
+	// a chunk sent again may still be being written over its first copy
+	c.writes.Wait()
+
+	if c.Hash != "" {
+		hash, err := hashFile(c.path)
+		if err != nil {
+			return nil, newUploadError(http.StatusInternalServerError, "Failed to verify the upload on server")
+		}
+		if !strings.EqualFold(hash, c.Hash) {
+			uploads.remove(c)
+			return nil, newUploadError(http.StatusUnprocessableEntity, "Checksum mismatch")
+		}
+	}
+	defer uploads.remove(c)
+	if _, err := c.file.Seek(0, io.SeekStart); err != nil {
+		return nil, newUploadError(http.StatusInternalServerError, "Failed to read the upload on server")
+	}
+	return receiveUpload(c.opts, upload{
+		name:       c.Name,
+		fileType:   c.Type,
+		size:       c.Size,
+		sender:     c.sender,
+		address:    c.address,
+		body:       c.file,
+		extract:    true,
+		onConflict: c.OnConflict,
+		meta:       c.fileMeta,
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// clipboardCommands returns the commands that read, or write with write set,
+// the clipboard of the desktop, in order of preference.
+func clipboardCommands(write bool) [][]string {
+	switch runtime.GOOS {
+	case "darwin":
+		if write {
+			return [][]string{{"pbcopy"}}
+		}
+		return [][]string{{"pbpaste"}}
+	case "windows":
+		if write {
+			return [][]string{{"clip"}}
+		}
+		return [][]string{{"powershell", "-NoProfile", "-Command", "Get-Clipboard -Raw"}}
+	}
+	var cmds [][]string
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		if write {
+			cmds = append(cmds, []string{"wl-copy"})
+		} else {
+			cmds = append(cmds, []string{"wl-paste", "--no-newline"})
+		}
+	}
+	if write {
+		return append(cmds, []string{"xclip", "-selection", "clipboard", "-in"}, []string{"xsel", "--clipboard", "--input"})
+	}
+	return append(cmds, []string{"xclip", "-selection", "clipboard", "-out"}, []string{"xsel", "--clipboard", "--output"})
+}
+
+// readClipboard returns the text in the clipboard, with the first clipboard
+// tool installed.
+func readClipboard() ([]byte, error) {
+	for _, c := range clipboardCommands(false) {
+		if _, err := exec.LookPath(c[0]); err != nil {
+			continue
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command(c[0], c[1:]...)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s failed: %v: %s", c[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return out, nil
+	}
+	return nil, errors.New("no clipboard tool found")
+}
+
+// writeClipboard puts the text in the clipboard, with the first clipboard
+// tool installed.
+func writeClipboard(text []byte) error {
+	for _, c := range clipboardCommands(true) {
+		if _, err := exec.LookPath(c[0]); err != nil {
+			continue
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command(c[0], c[1:]...)
+		cmd.Stdin = bytes.NewReader(text)
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s failed: %v: %s", c[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+	return errors.New("no clipboard tool found")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The codecs archives of directories and batches are compressed with. gzip
+// is what every receiver extracts, zstd is much faster on large trees.
+const (
+	codecGzip = "gzip"
+	codecZstd = "zstd"
+	// codecStore is a gzip stream without compression, for archives of
+	// files that are compressed already
+	codecStore = "store"
+
+	// codecsTXTPrefix advertises the codecs a receiver extracts, missing on
+	// receivers that only know gzip
+	codecsTXTPrefix = "codecs="
+)
+
+// supportedCodecs are the codecs receivers extract, in order of preference.
+var supportedCodecs = []string{codecZstd, codecGzip}
+
+// tarballExts are the extensions of the archives receivers extract.
+var tarballExts = []string{".tar.gz", ".tgz", ".tar.zst", ".tzst"}
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// advertisedCodecs returns the codecs the peer extracts, only gzip for
+// receivers older than the codecs record.
+func advertisedCodecs(text []string) []string {
+	for _, t := range text {
+		if v, ok := strings.CutPrefix(t, codecsTXTPrefix); ok {
+			return strings.Split(v, ",")
+		}
+	}
+	return []string{codecGzip}
+}
+
+// peerCodec returns the preferred codec the peer extracts.
+func peerCodec(text []string) string {
+	codecs := advertisedCodecs(text)
+	for _, c := range supportedCodecs {
+		if slices.Contains(codecs, c) {
+			return c
+		}
+	}
+	return codecGzip
+}
+
+// tarballExt returns the extension of an archive compressed with the codec.
+func tarballExt(codec string) string {
+	if codec == codecZstd {
+		return ".tar.zst"
+	}
+	return ".tar.gz"
+}
+
+// newCompressor compresses what's written to it into w with the codec, at
+// the level power saving allows.
+func newCompressor(w io.Writer, codec string) (io.WriteCloser, error) {
+	switch codec {
+	case codecStore:
+		return gzip.NewWriterLevel(w, gzip.NoCompression)
+	case codecZstd:
+	default:
+		return gzip.NewWriterLevel(w, gzipLevel)
+	}
+	opts := []zstd.EOption{zstd.WithEncoderLevel(zstdLevel)}
+	if codecThreads > 0 {
+		opts = append(opts, zstd.WithEncoderConcurrency(codecThreads))
+	}
+	return zstd.NewWriter(w, opts...)
+}
+
+// newDecompressor decompresses the archive read from r, telling the codecs
+// apart by their magic numbers so it needs no word from the sender.
+func newDecompressor(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err == nil && bytes.Equal(magic, zstdMagic) {
+		dec, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	}
+	return gzip.NewReader(br)
+}
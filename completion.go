@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// completionBrowseTimeout bounds the mDNS browse completing peer names, short
+// so pressing tab doesn't stall the shell.
+const completionBrowseTimeout = 700 * time.Millisecond
+
+// subcommands are the subcommands completed after ftr.
+var subcommands = []string{
+	"browse", "completion", "dict", "diff", "get", "guest-code", "help",
+	"history", "identity", "join", "list", "open", "pack", "pair", "paste",
+	"receive", "relay", "request", "request-link", "send", "service", "stats",
+	"sync", "unpack", "verify", "whois",
+}
+
+// subcommandArgs are the fixed first arguments of the subcommands taking one.
+var subcommandArgs = map[string][]string{
+	"completion": {"bash", "zsh", "fish"},
+	"dict":       {"train", "add", "list"},
+	"identity":   {"export", "import"},
+	"service":    {"install", "uninstall"},
+}
+
+// peerSubcommands are the subcommands whose arguments name peers.
+var peerSubcommands = []string{"browse", "get", "pair", "paste", "request", "send"}
+
+const bashCompletion = `_ftr() {
+    local cur=${COMP_WORDS[COMP_CWORD]}
+    local IFS=$'\n'
+    COMPREPLY=($(ftr __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+    if [[ $COMP_CWORD -gt 1 && $cur != -* ]]; then
+        COMPREPLY+=($(compgen -f -- "$cur"))
+    fi
+}
+complete -o filenames -F _ftr ftr
+`
+
+const zshCompletion = `#compdef ftr
+_ftr() {
+    local -a candidates
+    candidates=(${(f)"$(ftr __complete "${(@)words[2,CURRENT]}" 2>/dev/null)"})
+    compadd -a candidates
+    if (( CURRENT > 2 )) && [[ $PREFIX != -* ]]; then
+        _files
+    fi
+}
+compdef _ftr ftr
+`
+
+const fishCompletion = `function __ftr_complete
+    set -l tokens (commandline -opc) (commandline -ct)
+    ftr __complete $tokens[2..-1] 2>/dev/null
+end
+complete -c ftr -f -a '(__ftr_complete)'
+complete -c ftr -n 'test (count (commandline -opc)) -gt 1' -F
+`
+
+// runCompletion prints the completion script of the shell, which calls back
+// into `ftr __complete` for the candidates.
+func runCompletion(args []string) {
+	completionCmd := flag.NewFlagSet("completion", flag.ExitOnError)
+	completionCmd.SetOutput(os.Stdout)
+	if err := completionCmd.Parse(args); err != nil {
+		exitWithError(1, "Completion command failed: %v", err)
+	}
+	if completionCmd.NArg() != 1 {
+		fmt.Println("Usage: ftr completion bash|zsh|fish")
+		os.Exit(1)
+	}
+	switch shell := completionCmd.Arg(0); shell {
+	case "bash":
+		fmt.Print(bashCompletion)
+	case "zsh":
+		fmt.Print(zshCompletion)
+	case "fish":
+		fmt.Print(fishCompletion)
+	default:
+		exitWithError(1, "Unsupported shell: %s, use bash, zsh or fish", shell)
+	}
+}
+
+// runComplete prints the candidates for the last of the words following ftr
+// on the command line, one per line. Files are left to the shell.
+func runComplete(words []string) {
+	if len(words) == 0 {
+		return
+	}
+	cur := words[len(words)-1]
+	var candidates []string
+	switch sub := words[0]; {
+	case len(words) == 1:
+		candidates = subcommands
+	case strings.HasPrefix(cur, "-"):
+		for name := range subcommandFlags(sub) {
+			candidates = append(candidates, "--"+name)
+		}
+		sort.Strings(candidates)
+	case takesValue(sub, words[len(words)-2]):
+		// the value of a flag, at best a path
+	case len(words) == 2 && subcommandArgs[sub] != nil:
+		candidates = subcommandArgs[sub]
+	case slices.Contains(peerSubcommands, sub):
+		candidates = completionPeers()
+	}
+	for _, c := range candidates {
+		if strings.HasPrefix(c, cur) {
+			fmt.Println(c)
+		}
+	}
+}
+
+// subcommandFlags returns the flags of the subcommand, and whether each takes
+// a value, from the usage it prints for -h.
+func subcommandFlags(sub string) map[string]bool {
+	if !slices.Contains(subcommands, sub) || sub == "help" {
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil
+	}
+	out, _ := exec.Command(self, sub, "-h").Output()
+	flags := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// flags are listed as "  -name" or "  -name type", their usage
+		// on the next line is indented with a tab
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "  -") {
+			continue
+		}
+		fields := strings.Fields(line)
+		flags[strings.TrimPrefix(fields[0], "-")] = len(fields) > 1
+	}
+	return flags
+}
+
+// takesValue reports whether word is a flag of the subcommand followed by its
+// value.
+func takesValue(sub, word string) bool {
+	name, ok := strings.CutPrefix(word, "-")
+	if !ok || strings.Contains(word, "=") {
+		return false
+	}
+	return subcommandFlags(sub)[strings.TrimPrefix(name, "-")]
+}
+
+// completionPeers returns the peers found by a short browse along with the
+// ones in the peer cache, which answer even when the browse comes back empty.
+func completionPeers() []string {
+	peers, err := browsePeers(completionBrowseTimeout)
+	if err != nil {
+		debugLog("Failed to browse the peers to complete: %v", err)
+	}
+	if cache, err := readPeerCache(defaultPeerCacheFile()); err == nil {
+		for peer := range cache {
+			if !slices.Contains(peers, peer) {
+				peers = append(peers, peer)
+			}
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
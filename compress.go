@@ -0,0 +1,154 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The --compress modes of send.
+const (
+	compressNone = "none"
+	compressFast = "fast"
+	compressBest = "best"
+)
+
+const (
+	// compressedShare is the share of already compressed bytes above which
+	// an archive is stored rather than compressed again
+	compressedShare = 0.8
+	// sampleMinSize is the size from which files of unknown types are
+	// sampled, smaller ones don't weigh on the compression time
+	sampleMinSize = 256 << 10
+	sampleSize    = 64 << 10
+	// sampleRatio is the compressed size of a sample, relative to its size,
+	// above which the file is taken to be compressed already
+	sampleRatio = 0.95
+)
+
+// compressedExts are the file types that are compressed already.
+var compressedExts = []string{
+	".7z", ".aac", ".apk", ".avi", ".br", ".bz2", ".docx", ".epub", ".flac",
+	".gif", ".gz", ".heic", ".jar", ".jpeg", ".jpg", ".lz4", ".m4a", ".m4v",
+	".mkv", ".mov", ".mp3", ".mp4", ".odt", ".ogg", ".opus", ".png", ".pptx",
+	".rar", ".tgz", ".webm", ".webp", ".xlsx", ".xz", ".zip", ".zst",
+}
+
+// applyCompression sets the compression levels of the archives for the
+// --compress mode, the default levels being left as is for an empty one.
+// It returns the codec to use instead of the one of the peer, if any.
+func applyCompression(mode string) (string, error) {
+	switch mode {
+	case "":
+	case compressNone:
+		return codecStore, nil
+	case compressFast:
+		gzipLevel, zstdLevel = gzip.BestSpeed, zstd.SpeedFastest
+	case compressBest:
+		gzipLevel, zstdLevel = gzip.BestCompression, zstd.SpeedBestCompression
+	default:
+		return "", fmt.Errorf("unsupported compression %s, use none, fast or best", mode)
+	}
+	return "", nil
+}
+
+// parseCodec parses a --codec of the form <codec>[:<level>], gzip levels
+// going from 1 to 9 and zstd ones from 1 to 22, and sets the level of the
+// codec. It returns the codec.
+func parseCodec(s string) (string, error) {
+	name, levelStr, hasLevel := strings.Cut(s, ":")
+	if name != codecGzip && name != codecZstd {
+		return "", fmt.Errorf("unsupported codec %s, use gzip or zstd", name)
+	}
+	if !hasLevel {
+		return name, nil
+	}
+	level, err := strconv.Atoi(levelStr)
+	if err != nil {
+		return "", fmt.Errorf("invalid level %s", levelStr)
+	}
+	switch {
+	case name == codecGzip && level >= gzip.BestSpeed && level <= gzip.BestCompression:
+		gzipLevel = level
+	case name == codecZstd && level >= 1 && level <= 22:
+		zstdLevel = zstd.EncoderLevelFromZstd(level)
+	default:
+		return "", fmt.Errorf("level %d is out of range for %s", level, name)
+	}
+	return name, nil
+}
+
+// incompressible reports whether the regular file looks compressed already,
+// by its extension or else by how well a sample of it compresses.
+func incompressible(path string, size int64) bool {
+	if slices.Contains(compressedExts, strings.ToLower(filepath.Ext(path))) {
+		return true
+	}
+	if size < sampleMinSize {
+		return false
+	}
+	f, err := os.Open(longPath(path))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	counter := &countingWriter{w: io.Discard}
+	fw, err := flate.NewWriter(counter, flate.BestSpeed)
+	if err != nil {
+		return false
+	}
+	n, err := io.CopyN(fw, f, sampleSize)
+	if err != nil && err != io.EOF {
+		return false
+	}
+	if err := fw.Close(); err != nil || n == 0 {
+		return false
+	}
+	return float64(counter.n) >= float64(n)*sampleRatio
+}
+
+// mostlyCompressed reports whether most of the bytes of the sources, files
+// or directories, are compressed already, so compressing their archive would
+// only cost CPU.
+func mostlyCompressed(srcs ...string) bool {
+	var total, compressed int64
+	for _, src := range srcs {
+		err := filepath.WalkDir(longPath(src), func(path string, d os.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			total += info.Size()
+			if incompressible(path, info.Size()) {
+				compressed += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			debugLog("Failed to check how compressible %s is: %v", src, err)
+			return false
+		}
+	}
+	return total > 0 && float64(compressed) >= float64(total)*compressedShare
+}
+
+// archiveCodec returns the codec to archive the sources with: the one given,
+// or storing them when they're mostly compressed already.
+func archiveCodec(codec string, srcs ...string) string {
+	if codec == codecStore || !mostlyCompressed(srcs...) {
+		return codec
+	}
+	debugLog("Storing the archive of %s uncompressed, most of it is compressed already", strings.Join(srcs, ", "))
+	return codecStore
+}
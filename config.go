@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const configFileName = "config"
+
+// config is a parsed INI-style configuration file:
+//
+//	[section.name]
+//	key = value
+//
+// Keys outside of any section belong to the "" section.
+type config struct {
+	sections map[string]map[string]string
+}
+
+func defaultConfigFile() string {
+	dir, err := stateDir()
+	if err != nil {
+		exitWithError(1, "Failed to get the state dir: %v", err)
+	}
+	return filepath.Join(dir, configFileName)
+}
+
+// loadConfig parses the config file at path. A missing file yields an empty
+// config.
+func loadConfig(path string) (*config, error) {
+	cfg := &config{sections: map[string]map[string]string{}}
+	if path == "" {
+		return cfg, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%s:%d: malformed section header", path, lineNo)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if _, ok := cfg.sections[section]; !ok {
+				cfg.sections[section] = map[string]string{}
+			}
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNo)
+		}
+		if cfg.sections[section] == nil {
+			cfg.sections[section] = map[string]string{}
+		}
+		cfg.sections[section][strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), `"`)
+	}
+	return cfg, scanner.Err()
+}
+
+func mustLoadConfig(path string) *config {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		exitWithError(1, "Failed to load the config %s: %v", path, err)
+	}
+	return cfg
+}
+
+// section returns the key/values of the named section, or nil.
+func (c *config) section(name string) map[string]string {
+	return c.sections[name]
+}
+
+// subsections returns the sorted names following prefix for every section
+// named "<prefix>.<name>".
+func (c *config) subsections(prefix string) []string {
+	var names []string
+	for s := range c.sections {
+		if name, ok := strings.CutPrefix(s, prefix+"."); ok && name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseSize parses a human-readable size such as "512", "10MB" or "4GiB".
+// Decimal units (KB, MB, ...) are powers of 1000, binary units (KiB, MiB, ...)
+// and bare letters (K, M, ...) are powers of 1024.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) && r != '.' })
+	num, unit := s, ""
+	if i >= 0 {
+		num, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	var mult float64
+	switch strings.ToUpper(unit) {
+	case "", "B":
+		mult = 1
+	case "KB":
+		mult = 1e3
+	case "MB":
+		mult = 1e6
+	case "GB":
+		mult = 1e9
+	case "TB":
+		mult = 1e12
+	case "K", "KIB":
+		mult = 1 << 10
+	case "M", "MIB":
+		mult = 1 << 20
+	case "G", "GIB":
+		mult = 1 << 30
+	case "T", "TIB":
+		mult = 1 << 40
+	default:
+		return 0, fmt.Errorf("invalid size unit %q", unit)
+	}
+	return int64(n * mult), nil
+}
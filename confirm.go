@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	offersPath = "/offers"
+	// confirmTXT is advertised by receivers in confirm mode
+	confirmTXT = "confirm=1"
+	// offerTTL is how long an accepted offer waits for its payload
+	offerTTL = 10 * time.Minute
+	// sealChunkSize is the plaintext size of a sealed chunk
+	sealChunkSize = 64 << 10
+	// sealFinal flags the last chunk in its length prefix
+	sealFinal = 1 << 31
+)
+
+// offer announces an upload to a receiver in confirm mode, which shows the
+// fingerprint of PublicKey and the hash to the user before accepting it.
+type offer struct {
+	Inbox     string `json:"inbox,omitempty"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	Sender    string `json:"sender"`
+	PublicKey []byte `json:"public_key"`
+}
+
+// offerReply accepts an offer. The payload is posted to /offers/<ID>
+// encrypted with the key both sides derive from their X25519 exchange.
+type offerReply struct {
+	ID        string `json:"id"`
+	PublicKey []byte `json:"public_key"`
+}
+
+type approvedOffer struct {
+	offer
+	key []byte
+	// mac is the proof of the shared key expected with the payload of a
+	// PAKE upload
+	mac []byte
+	// proof is the receiver's MAC of a PAKE upload, given once the sender
+	// proved the key
+	proof   []byte
+	expires time.Time
+}
+
+// offerApprovals holds the accepted offers waiting for their payload. Each
+// one is used once.
+type offerApprovals struct {
+	mu     sync.Mutex
+	offers map[string]*approvedOffer
+}
+
+func newOfferApprovals() *offerApprovals {
+	return &offerApprovals{offers: map[string]*approvedOffer{}}
+}
+
+func (a *offerApprovals) add(id string, o *approvedOffer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for id, o := range a.offers {
+		if now.After(o.expires) {
+			delete(a.offers, id)
+		}
+	}
+	a.offers[id] = o
+}
+
+func (a *offerApprovals) get(id string) (*approvedOffer, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	o, ok := a.offers[id]
+	if !ok || time.Now().After(o.expires) {
+		return nil, false
+	}
+	return o, true
+}
+
+func (a *offerApprovals) take(id string) (*approvedOffer, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	o, ok := a.offers[id]
+	if !ok || time.Now().After(o.expires) {
+		return nil, false
+	}
+	delete(a.offers, id)
+	return o, true
+}
+
+// transferKey derives the key of one accepted offer. Everything the user
+// approved goes into it, so a payload for any other file, or from anyone
+// without the sender's private key, fails to decrypt.
+func transferKey(shared []byte, id string, o offer, receiverPub []byte) ([]byte, error) {
+	var info bytes.Buffer
+	info.WriteString("ftr-confirm")
+	for _, s := range []string{o.Inbox, o.Name, o.Type, o.SHA256, o.Sender} {
+		info.WriteByte(0)
+		info.WriteString(s)
+	}
+	binary.Write(&info, binary.BigEndian, o.Size)
+	info.Write(o.PublicKey)
+	info.Write(receiverPub)
+	return hkdf.Key(sha256.New, shared, []byte(id), info.String(), 32)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(aead cipher.AEAD, n uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
+}
+
+// sealStream encrypts src into dst as a sequence of AES-GCM chunks, each the
+// big-endian uint32 plaintext length, with sealFinal set on the last one, and
+// the ciphertext. The length prefix is authenticated so chunks can't be
+// dropped, reordered or cut short.
+func sealStream(dst io.Writer, src io.Reader, key []byte) error {
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, sealChunkSize)
+	for n := uint64(0); ; n++ {
+		size, err := io.ReadFull(src, buf)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return err
+		}
+		prefix := uint32(size)
+		if final {
+			prefix |= sealFinal
+		}
+		hdr := binary.BigEndian.AppendUint32(nil, prefix)
+		if _, err := dst.Write(aead.Seal(hdr, chunkNonce(aead, n), buf[:size], hdr)); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// openedReader decrypts a sealed stream and checks that the plaintext hashes
+// to the approved SHA-256 before reporting the end of it.
+type openedReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	n      uint64
+	buf    []byte
+	done   bool
+	hasher hash.Hash
+	want   string
+}
+
+func openStream(r io.Reader, key []byte, wantHash string) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &openedReader{r: r, aead: aead, hasher: sha256.New(), want: wantHash}, nil
+}
+
+func (o *openedReader) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.done {
+			if hex.EncodeToString(o.hasher.Sum(nil)) != o.want {
+				return 0, errors.New("the payload doesn't match the approved hash")
+			}
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+func (o *openedReader) next() error {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(o.r, hdr); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	prefix := binary.BigEndian.Uint32(hdr)
+	size := int(prefix &^ sealFinal)
+	if size > sealChunkSize {
+		return errors.New("sealed chunk too large")
+	}
+	ciphertext := make([]byte, size+o.aead.Overhead())
+	if _, err := io.ReadFull(o.r, ciphertext); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	plain, err := o.aead.Open(ciphertext[:0], chunkNonce(o.aead, o.n), ciphertext, hdr)
+	if err != nil {
+		return errors.New("failed to decrypt the payload")
+	}
+	o.n++
+	o.done = prefix&sealFinal != 0
+	o.hasher.Write(plain)
+	o.buf = plain
+	return nil
+}
+
+// offersHandler serves the uploads of a receiver in confirm mode:
+//
+//	POST /offers       announce a file and wait for the user to accept it
+//	POST /offers/<id>  deliver the encrypted payload of an accepted offer
+func offersHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, offersPath), "/")
+		if id == "" {
+			handleOffer(w, r, opts)
+			return
+		}
+		approved, ok := opts.offers.get(id)
+		if !ok {
+			http.Error(w, "Offer not found or expired", http.StatusNotFound)
+			return
+		}
+		inbox, _ := opts.inbox(approved.Inbox)
+		if !inbox.authorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// the payload can only be delivered once
+		if _, ok := opts.offers.take(id); !ok {
+			http.Error(w, "Offer not found or expired", http.StatusNotFound)
+			return
+		}
+		body, err := openStream(r.Body, approved.key, approved.SHA256)
+		if err != nil {
+			http.Error(w, "Failed to set up the decryption", http.StatusInternalServerError)
+			return
+		}
+		job, err := receiveUpload(inbox, upload{
+			name:        approved.Name,
+			fileType:    approved.Type,
+			size:        approved.Size,
+			sender:      approved.Sender,
+			address:     remoteHost(r.RemoteAddr),
+			body:        body,
+			extract:     wantsExtract(r.Header),
+			onConflict:  conflictHint(r.Header),
+			meta:        metaFromHeader(r.Header),
+			approved:    true,
+			setDeadline: http.NewResponseController(w).SetReadDeadline,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), uploadStatus(err))
+			return
+		}
+		w.Header().Set(transferIDHeader, job.ID)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func handleOffer(w http.ResponseWriter, r *http.Request, opts receiverOptions) {
+	var o offer
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&o); err != nil || o.Name == "" {
+		http.Error(w, "Invalid offer", http.StatusBadRequest)
+		return
+	}
+	inbox, ok := opts.inbox(o.Inbox)
+	if !ok {
+		http.Error(w, "Unknown inbox", http.StatusNotFound)
+		return
+	}
+	if !inbox.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	senderPub, err := ecdh.X25519().NewPublicKey(o.PublicKey)
+	if err != nil {
+		http.Error(w, "Invalid offer", http.StatusBadRequest)
+		return
+	}
+	if o.Sender == "" {
+		o.Sender = senderName(r)
+	}
+
+	question := fmt.Sprintf("%s (fingerprint %s) offers %s (%s, %s, SHA-256 %s). Accept?",
+		o.Sender, fingerprint(o.PublicKey), filepath.Base(o.Name), o.Type, formatBytes(o.Size), o.SHA256)
+	if !confirm(question, defaultPromptTimeout) {
+		recordHistory(opts.historyFile, historyEntry{
+			Direction: directionReceive,
+			Peer:      o.Sender,
+			File:      filepath.Base(o.Name),
+			Hash:      o.SHA256,
+			Status:    statusFailed,
+			Error:     "Offer declined",
+		})
+		http.Error(w, "Offer declined", http.StatusForbidden)
+		return
+	}
+
+	// a fresh key pair per offer keeps the transfer keys independent
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		http.Error(w, "Failed to accept the offer", http.StatusInternalServerError)
+		return
+	}
+	shared, err := eph.ECDH(senderPub)
+	if err != nil {
+		http.Error(w, "Invalid offer", http.StatusBadRequest)
+		return
+	}
+	id := newTransferID()
+	key, err := transferKey(shared, id, o, eph.PublicKey().Bytes())
+	if err != nil {
+		http.Error(w, "Failed to accept the offer", http.StatusInternalServerError)
+		return
+	}
+	opts.offers.add(id, &approvedOffer{offer: o, key: key, expires: time.Now().Add(offerTTL)})
+	debugLog("Accepted the offer %s of %s from %s", id, o.Name, o.Sender)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(offerReply{ID: id, PublicKey: eph.PublicKey().Bytes()})
+}
+
+// postConfirmed offers the file at src to a receiver in confirm mode and,
+// once the user there accepts it, uploads it encrypted with the key bound to
+// the approval.
+func postConfirmed(src, fileType, hash string, opts sendOptions) error {
+	nodeKey, err := loadNodeKey()
+	if err != nil {
+		return fmt.Errorf("failed to load the node key: %v", err)
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("failed to stat the source file: %v", err)
+	}
+	o := offer{
+		Inbox:     opts.inbox,
+		Name:      filepath.Base(src),
+		Type:      fileType,
+		Size:      fi.Size(),
+		SHA256:    hash,
+		Sender:    getDefaultName(),
+		PublicKey: nodeKey.PublicKey().Bytes(),
+	}
+	body, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	client := opts.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	base := opts.url(offersPath)
+	req, err := http.NewRequest(http.MethodPost, base, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create the http request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(passKeyHeader, opts.key)
+	req.Header.Set(senderHeader, o.Sender)
+	fmt.Fprintf(infoOut, "Waiting for the peer to accept %s, your fingerprint is %s\n", o.Name, fingerprint(o.PublicKey))
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send the offer: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusForbidden {
+		return errors.New("the peer declined the file")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to send the offer, server returned status: %s", resp.Status)
+	}
+	var reply offerReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("failed to decode the reply to the offer: %v", err)
+	}
+	receiverPub, err := ecdh.X25519().NewPublicKey(reply.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid key in the reply to the offer: %v", err)
+	}
+	shared, err := nodeKey.ECDH(receiverPub)
+	if err != nil {
+		return fmt.Errorf("failed to agree on the transfer key: %v", err)
+	}
+	key, err := transferKey(shared, reply.ID, o, reply.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to derive the transfer key: %v", err)
+	}
+
+	file, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open the source file: %v", err)
+	}
+	defer file.Close()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(sealStream(pw, &progressReader{r: file, p: opts.progress}, key))
+	}()
+	defer pr.Close()
+	req, err = http.NewRequest(http.MethodPost, base+"/"+reply.ID, &throttledReader{r: pr, t: opts.throttle})
+	if err != nil {
+		return fmt.Errorf("failed to create the http request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(passKeyHeader, opts.key)
+	req.Header.Set(senderHeader, o.Sender)
+	if !opts.extract {
+		req.Header.Set(extractHeader, "no")
+	}
+	if opts.onConflict != "" {
+		req.Header.Set(onConflictHeader, opts.onConflict)
+	}
+	opts.meta.setHeader(req.Header)
+	resp, err = client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send the file: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to send the file, server returned status: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
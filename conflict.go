@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The policies for an upload whose name is already taken in the drop dir.
+const (
+	// conflictFail refuses the upload with 409 Conflict
+	conflictFail = "fail"
+	// conflictOverwrite replaces the existing file once the upload completed
+	conflictOverwrite = "overwrite"
+	// conflictRename stores the upload as "name (1).ext", "name (2).ext", ...
+	conflictRename = "rename"
+	// conflictSkip keeps the existing file and discards the upload
+	conflictSkip = "skip"
+)
+
+// onConflictHeader carries the policy the sender would like for its upload.
+const onConflictHeader = "X-Ftr-On-Conflict"
+
+func parseConflictPolicy(s string) (string, error) {
+	switch s {
+	case conflictFail, conflictOverwrite, conflictRename, conflictSkip:
+		return s, nil
+	}
+	return "", fmt.Errorf("unsupported conflict policy %q, use fail, overwrite, rename or skip", s)
+}
+
+// conflictHint returns the policy the sender of the request asks for, if any.
+func conflictHint(header http.Header) string {
+	return header.Get(onConflictHeader)
+}
+
+// conflictPolicy returns the policy applying to an upload: the one the sender
+// hints at, if valid, or else the receiver's. A sender can't have files
+// overwritten on a receiver that doesn't overwrite them itself.
+func conflictPolicy(opts receiverOptions, hint string) string {
+	policy := opts.onConflict
+	if policy == "" {
+		policy = conflictFail
+	}
+	if hint, err := parseConflictPolicy(hint); err == nil {
+		if hint != conflictOverwrite || policy == conflictOverwrite {
+			return hint
+		}
+		debugLog("Ignoring the request to overwrite, the receiver doesn't allow it")
+	}
+	return policy
+}
+
+// freeName returns the first of name, "name (1).ext", "name (2).ext", ...
+// that doesn't exist in dir. A tarball is numbered along with the directory
+// it extracts to, so both names are checked.
+func freeName(dir, name string) string {
+	base, ext := name, filepath.Ext(name)
+	for _, e := range tarballExts {
+		if strings.HasSuffix(name, e) {
+			ext = e
+		}
+	}
+	base = strings.TrimSuffix(name, ext)
+	taken := func(n string) bool {
+		if _, err := os.Lstat(filepath.Join(dir, n)); err == nil {
+			return true
+		}
+		if d, err := tarballDir(n); err == nil {
+			_, err := os.Lstat(filepath.Join(dir, d))
+			return err == nil
+		}
+		return false
+	}
+	candidate := name
+	for i := 1; taken(candidate); i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	return candidate
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+const (
+	joinLogFileName = "join.log"
+	// daemonEnv marks the receiver started in the background by join
+	// --daemon, so it doesn't start another one
+	daemonEnv = "FTR_DAEMON"
+
+	systemdUnitName = "ftr.service"
+	launchdLabel    = "io.github.charleszheng44.ftr"
+)
+
+func defaultJoinLogFile() string {
+	dir, err := stateDir()
+	if err != nil {
+		exitWithError(1, "Failed to get the state dir: %v", err)
+	}
+	return filepath.Join(dir, joinLogFileName)
+}
+
+func openLogFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+}
+
+// logToFile sends the output of the receiver to the log file.
+func logToFile(path string) {
+	f, err := openLogFile(path)
+	if err != nil {
+		exitWithError(1, "Failed to open the log file: %v", err)
+	}
+	os.Stdout, os.Stderr = f, f
+	infoOut = f
+}
+
+// inDaemon reports whether this is the receiver join --daemon started.
+func inDaemon() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// daemonize starts the receiver again in the background, detached from the
+// terminal and logging to logFile, and returns its pid. key is passed on for
+// the daemon to use the passkey the caller shows rather than draw its own.
+func daemonize(args []string, key, logFile string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	f, err := openLogFile(logFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	cmd := exec.Command(exe, append(append([]string{"join"}, args...), "--key", key)...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout, cmd.Stderr = f, f
+	cmd.SysProcAttr = detachedProcAttr()
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+	return pid, cmd.Process.Release()
+}
+
+// flagGiven reports whether the join arguments set the flag.
+func flagGiven(args []string, name string) bool {
+	for _, a := range args {
+		if a == "--" {
+			return false
+		}
+		a = strings.TrimLeft(a, "-")
+		if a == name || strings.HasPrefix(a, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceUnit is what a unit or agent file runs.
+type serviceUnit struct {
+	Exe     string
+	Args    []string
+	LogFile string
+	Label   string
+}
+
+var systemdUnit = template.Must(template.New("systemd").Parse(`[Unit]
+Description=ftr receiver
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ExecStart={{printf "%q" .Exe}}{{range .Args}} {{printf "%q" .}}{{end}}
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=default.target
+`))
+
+var launchdAgent = template.Must(template.New("launchd").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{.Label}}</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>{{html .Exe}}</string>
+{{- range .Args}}
+		<string>{{html .}}</string>
+{{- end}}
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardOutPath</key>
+	<string>{{html .LogFile}}</string>
+	<key>StandardErrorPath</key>
+	<string>{{html .LogFile}}</string>
+</dict>
+</plist>
+`))
+
+// serviceFile returns where the user service of the platform is installed.
+func serviceFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	switch runtime.GOOS {
+	case "linux":
+		dir := os.Getenv("XDG_CONFIG_HOME")
+		if dir == "" {
+			dir = filepath.Join(home, ".config")
+		}
+		return filepath.Join(dir, "systemd", "user", systemdUnitName), nil
+	case "darwin":
+		return filepath.Join(home, "Library", "LaunchAgents", launchdLabel+".plist"), nil
+	}
+	return "", fmt.Errorf("services aren't supported on %s", runtime.GOOS)
+}
+
+// serviceCommands returns the commands enabling or disabling the installed
+// service right away and at login.
+func serviceCommands(file string, enable bool) [][]string {
+	switch {
+	case runtime.GOOS == "darwin" && enable:
+		return [][]string{{"launchctl", "load", "-w", file}}
+	case runtime.GOOS == "darwin":
+		return [][]string{{"launchctl", "unload", "-w", file}}
+	case enable:
+		return [][]string{{"systemctl", "--user", "daemon-reload"}, {"systemctl", "--user", "enable", "--now", systemdUnitName}}
+	}
+	return [][]string{{"systemctl", "--user", "disable", "--now", systemdUnitName}}
+}
+
+// runServiceCommands runs the commands, printing them for the user to run
+// when one fails.
+func runServiceCommands(cmds [][]string) {
+	for i, c := range cmds {
+		out, err := exec.Command(c[0], c[1:]...).CombinedOutput()
+		if err == nil {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Failed to run %s: %v: %s\n", strings.Join(c, " "), err, strings.TrimSpace(string(out)))
+		fmt.Fprintln(os.Stderr, "Finish with:")
+		for _, c := range cmds[i:] {
+			fmt.Fprintf(os.Stderr, "    %s\n", strings.Join(c, " "))
+		}
+		os.Exit(1)
+	}
+}
+
+func runService(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: ftr service install [--print] <join flags>... | uninstall")
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "install":
+		runServiceInstall(args[1:])
+	case "uninstall":
+		runServiceUninstall(args[1:])
+	default:
+		exitWithError(1, "Unrecognized service subcommand: %s", args[0])
+	}
+}
+
+func runServiceInstall(args []string) {
+	// the arguments are join's, but for --print first
+	printOnly := len(args) > 0 && (args[0] == "--print" || args[0] == "-print")
+	if printOnly {
+		args = args[1:]
+	}
+	if !flagGiven(args, "key") {
+		exitWithError(1, "The service needs a --key, it would otherwise draw another one on every start")
+	}
+	if flagGiven(args, "daemon") {
+		exitWithError(1, "The service manager keeps the receiver in the background, drop --daemon")
+	}
+	unit := serviceUnit{Args: append([]string{"join"}, args...), Label: launchdLabel}
+	unit.LogFile = defaultJoinLogFile()
+	if !flagGiven(args, "log-file") {
+		unit.Args = append(unit.Args, "--log-file", unit.LogFile)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		exitWithError(1, "Failed to locate the ftr binary: %v", err)
+	}
+	if unit.Exe, err = filepath.EvalSymlinks(exe); err != nil {
+		exitWithError(1, "Failed to locate the ftr binary: %v", err)
+	}
+	file, err := serviceFile()
+	if err != nil {
+		exitWithError(1, "Failed to install the service: %v", err)
+	}
+
+	tmpl := systemdUnit
+	if runtime.GOOS == "darwin" {
+		tmpl = launchdAgent
+	}
+	var out io.Writer = os.Stdout
+	if !printOnly {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			exitWithError(1, "Failed to install the service: %v", err)
+		}
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			exitWithError(1, "Failed to install the service: %v", err)
+		}
+		out = f
+	}
+	if err := tmpl.Execute(out, unit); err != nil {
+		exitWithError(1, "Failed to write the service file: %v", err)
+	}
+	if printOnly {
+		return
+	}
+	if err := out.(*os.File).Close(); err != nil {
+		exitWithError(1, "Failed to write the service file: %v", err)
+	}
+	fmt.Printf("Installed %s\n", file)
+	runServiceCommands(serviceCommands(file, true))
+	fmt.Printf("The receiver runs in the background and at every login, logging to %s\n", unit.LogFile)
+	if runtime.GOOS == "linux" {
+		fmt.Println("To keep it running without a login session, e.g. after a reboot, run: loginctl enable-linger")
+	}
+}
+
+func runServiceUninstall(args []string) {
+	if len(args) > 0 {
+		fmt.Println("Usage: ftr service uninstall")
+		os.Exit(1)
+	}
+	file, err := serviceFile()
+	if err != nil {
+		exitWithError(1, "Failed to uninstall the service: %v", err)
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		exitWithError(1, "The service isn't installed")
+	}
+	runServiceCommands(serviceCommands(file, false))
+	if err := os.Remove(file); err != nil {
+		exitWithError(1, "Failed to remove %s: %v", file, err)
+	}
+	fmt.Printf("Uninstalled %s\n", file)
+}
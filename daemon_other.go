@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "syscall"
+
+// detachedProcAttr has nothing to add here; the daemon outlives the console
+// as it isn't attached to its stdio.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return nil
+}
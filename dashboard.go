@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dashboardPath        = "/dashboard"
+	passKeyCookie        = "ftr_key"
+	dashboardHistorySize = 20
+)
+
+// receiverControl is the state of a running receiver changed from the
+// dashboard: whether uploads are paused, rotated keys and the peers seen,
+// and whether it's shutting down. A nil control is never paused and keeps
+// the configured keys.
+type receiverControl struct {
+	mu      sync.Mutex
+	paused  bool
+	closing bool
+	// keys are the rotated passkeys by inbox name, "" for the default inbox
+	keys  map[string]string
+	peers map[string]time.Time
+}
+
+func newReceiverControl() *receiverControl {
+	return &receiverControl{keys: map[string]string{}, peers: map[string]time.Time{}}
+}
+
+func (c *receiverControl) key(inbox, configured string) string {
+	if c == nil {
+		return configured
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if k, ok := c.keys[inbox]; ok {
+		return k
+	}
+	return configured
+}
+
+// rotate replaces the passkey of the inbox with a random one.
+func (c *receiverControl) rotate(inbox string) string {
+	key := randomPassKey(12)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys[inbox] = key
+	return key
+}
+
+func (c *receiverControl) isPaused() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
+
+func (c *receiverControl) setPaused(paused bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = paused
+}
+
+// close refuses the uploads to come while the receiver shuts down.
+func (c *receiverControl) close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closing = true
+}
+
+func (c *receiverControl) isClosing() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
+}
+
+func (c *receiverControl) seen(peer string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peers[peer] = time.Now()
+}
+
+type peerSeen struct {
+	Peer     string    `json:"peer"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func (c *receiverControl) recentPeers() []peerSeen {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	peers := make([]peerSeen, 0, len(c.peers))
+	for p, t := range c.peers {
+		peers = append(peers, peerSeen{Peer: p, LastSeen: t})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].LastSeen.After(peers[j].LastSeen) })
+	return peers
+}
+
+// requestKey returns the passkey of the request from the header, or the
+// dashboard cookie for browsers.
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get(passKeyHeader); key != "" {
+		return key
+	}
+	if c, err := r.Cookie(passKeyCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+func setKeyCookie(w http.ResponseWriter, key string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     passKeyCookie,
+		Value:    key,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+type inboxUsage struct {
+	Name    string `json:"name"`
+	DropDir string `json:"drop_dir"`
+	Used    int64  `json:"used"`
+	Quota   int64  `json:"quota,omitempty"`
+}
+
+type dashboardStatus struct {
+	Paused      bool `json:"paused"`
+	Maintenance bool `json:"maintenance"`
+	// Queued is the number of uploads waiting for the end of maintenance
+	Queued    int            `json:"queued"`
+	Inboxes   []inboxUsage   `json:"inboxes"`
+	Transfers []transferJob  `json:"transfers"`
+	Peers     []peerSeen     `json:"peers"`
+	History   []historyEntry `json:"history"`
+}
+
+func collectDashboardStatus(opts receiverOptions) dashboardStatus {
+	status := dashboardStatus{
+		Paused:      opts.control.isPaused(),
+		Maintenance: opts.queue.inMaintenance(),
+		Queued:      opts.queue.size(),
+		Transfers:   opts.transfers.snapshot(),
+		Peers:       opts.control.recentPeers(),
+	}
+	for _, inbox := range append([]receiverOptions{opts}, opts.inboxes...) {
+		if inbox.ephemeral {
+			continue
+		}
+		used, err := quotaUsage(inbox)
+		if err != nil {
+			debugLog("Failed to compute the size of %s: %v", inbox.dropDir, err)
+		}
+		status.Inboxes = append(status.Inboxes, inboxUsage{
+			Name:    inbox.name,
+			DropDir: inbox.dropDir,
+			Used:    used,
+			Quota:   inbox.quota,
+		})
+	}
+	if opts.historyFile != "" {
+		entries, err := readHistory(opts.historyFile)
+		if err != nil {
+			debugLog("Failed to read the history: %v", err)
+		}
+		if len(entries) > dashboardHistorySize {
+			entries = entries[len(entries)-dashboardHistorySize:]
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			status.History = append(status.History, entries[i])
+		}
+	}
+	return status
+}
+
+// dashboardHandler serves the dashboard page, asking for the passkey first.
+// The posted login form is turned into a cookie so the page's API calls are
+// authenticated too, and the passkey never shows up in a URL.
+func dashboardHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			key := r.PostFormValue("key")
+			if !keyMatches(key, opts.key()) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			setKeyCookie(w, key)
+			next := r.PostFormValue("next")
+			if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+				next = dashboardPath
+			}
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		if !keyMatches(requestKey(r), opts.key()) {
+			serveLogin(w, dashboardPath)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(dashboardPage))
+	}
+}
+
+// dashboardAPIHandler serves the status polled by the dashboard and its
+// actions. It must be behind the auth middleware.
+func dashboardAPIHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := r.URL.Path[len(dashboardPath+"/"):]
+		if action == "status" && r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(collectDashboardStatus(opts))
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch action {
+		case "pause":
+			opts.control.setPaused(true)
+			fmt.Fprintln(infoOut, "Paused receiving from the dashboard")
+		case "resume":
+			opts.control.setPaused(false)
+			fmt.Fprintln(infoOut, "Resumed receiving from the dashboard")
+		case "maintenance":
+			opts.queue.setMaintenance(true)
+			fmt.Fprintln(infoOut, "Entered maintenance from the dashboard, queueing uploads")
+		case "reopen":
+			opts.queue.setMaintenance(false)
+			fmt.Fprintf(infoOut, "Reopened from the dashboard, %d queued uploads proceed\n", opts.queue.size())
+		case "rotate-key":
+			name := r.URL.Query().Get("inbox")
+			if _, ok := opts.inbox(name); !ok {
+				http.Error(w, "Unknown inbox", http.StatusNotFound)
+				return
+			}
+			key := opts.control.rotate(name)
+			fmt.Fprintf(infoOut, "Rotated the key of inbox %q from the dashboard\n", name)
+			if name == "" {
+				// the dashboard is logged in with the default key
+				setKeyCookie(w, key)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"inbox": name, "key": key})
+			return
+		default:
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// serveLogin asks a browser for the passkey, coming back to next once logged
+// in.
+func serveLogin(w http.ResponseWriter, next string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	loginPage.Execute(w, next)
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>ftr</title></head>
+<body style="font-family: sans-serif">
+<form method="post" action="/dashboard">
+<input type="hidden" name="next" value="{{.}}">
+<label>Passkey <input type="password" name="key" autofocus></label>
+<button>Log in</button>
+</form>
+</body></html>
+`))
+
+const dashboardPage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>ftr dashboard</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+td, th { padding: 0.2em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+</style></head>
+<body>
+<h1>ftr</h1>
+<p>Receiving: <b id="state"></b>
+<button onclick="act('pause')">Pause</button>
+<button onclick="act('resume')">Resume</button>
+<button onclick="act('maintenance')">Maintenance</button>
+<button onclick="act('reopen')">Reopen</button></p>
+<h2>Inboxes</h2>
+<table id="inboxes"></table>
+<h2>Transfers</h2>
+<table id="transfers"></table>
+<h2>Peers</h2>
+<table id="peers"></table>
+<h2>Recent history</h2>
+<table id="history"></table>
+<script>
+function esc(v) {
+  return String(v == null ? "" : v).replace(/[&<>"]/g, c => ({"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"})[c]);
+}
+function fill(id, head, rows) {
+  document.getElementById(id).innerHTML = "<tr>" + head.map(h => "<th>" + h + "</th>").join("") + "</tr>" +
+    rows.map(r => "<tr>" + r.map(c => "<td>" + c + "</td>").join("") + "</tr>").join("");
+}
+async function act(action, query) {
+  const resp = await fetch("/dashboard/" + action + (query || ""), {method: "POST"});
+  if (action == "rotate-key" && resp.ok) {
+    const r = await resp.json();
+    alert("New key of " + (r.inbox || "the default inbox") + ": " + r.key);
+  }
+  refresh();
+}
+async function refresh() {
+  const resp = await fetch("/dashboard/status");
+  if (!resp.ok) { location.reload(); return; }
+  const s = await resp.json();
+  document.getElementById("state").textContent = s.paused ? "paused" :
+    s.maintenance ? "maintenance, " + s.queued + " queued" : "on";
+  fill("inboxes", ["Inbox", "Drop dir", "Used", "Quota", ""], (s.inboxes || []).map(i => [
+    esc(i.name || "default"), esc(i.drop_dir), esc(i.used), esc(i.quota || "-"),
+    "<button onclick=\"act('rotate-key', '?inbox=" + encodeURIComponent(i.name) + "')\">Rotate key</button>"]));
+  fill("transfers", ["File", "Sender", "State", "Bytes", ""], (s.transfers || []).slice().reverse().map(t => [
+    esc(t.file), esc(t.sender), esc(t.state), esc(t.bytes),
+    t.state == "receiving" ? "<button onclick=\"cancelJob('" + esc(t.id) + "')\">Cancel</button>" : ""]));
+  fill("peers", ["Peer", "Last seen"], (s.peers || []).map(p => [esc(p.peer), esc(new Date(p.last_seen).toLocaleString())]));
+  fill("history", ["Time", "Direction", "Peer", "File", "Bytes", "Status"], (s.history || []).map(e => [
+    esc(new Date(e.time).toLocaleString()), esc(e.direction), esc(e.peer), esc(e.file), esc(e.bytes), esc(e.error || e.status)]));
+}
+async function cancelJob(id) {
+  await fetch("/transfers/" + id, {method: "DELETE"});
+  refresh();
+}
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body></html>
+`
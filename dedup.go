@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultDedupWindow = 10 * time.Minute
+
+// receipt is a file received recently.
+type receipt struct {
+	path string
+	size int64
+	at   time.Time
+}
+
+// receiptIndex remembers the hashes of the files received within the window
+// so a sender retrying an upload that did land doesn't leave a second copy.
+// A nil index disables the suppression.
+type receiptIndex struct {
+	window time.Duration
+
+	mu       sync.Mutex
+	receipts map[string]receipt
+}
+
+func newReceiptIndex(window time.Duration) *receiptIndex {
+	if window <= 0 {
+		return nil
+	}
+	return &receiptIndex{window: window, receipts: map[string]receipt{}}
+}
+
+func receiptKey(dropDir, hash string) string {
+	return dropDir + "\x00" + hash
+}
+
+// add records the file at path with the given hash.
+func (x *receiptIndex) add(dropDir, hash, path string, size int64) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	now := time.Now()
+	for k, r := range x.receipts {
+		if now.Sub(r.at) > x.window {
+			delete(x.receipts, k)
+		}
+	}
+	x.receipts[receiptKey(dropDir, hash)] = receipt{path: path, size: size, at: now}
+}
+
+// lookup returns the path of an identical file received into dropDir within
+// the window that is still in place.
+func (x *receiptIndex) lookup(dropDir, hash string, size int64) (string, bool) {
+	if x == nil {
+		return "", false
+	}
+	x.mu.Lock()
+	r, ok := x.receipts[receiptKey(dropDir, hash)]
+	x.mu.Unlock()
+	if !ok || time.Since(r.at) > x.window || r.size != size {
+		return "", false
+	}
+	fi, err := os.Stat(r.path)
+	if err != nil || fi.Size() != size {
+		return "", false
+	}
+	return r.path, true
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	dictDirName = "dicts"
+	dictExt     = ".dict"
+	dictsPath   = "/dicts"
+	// dictHeader names the dictionary an upload is zstd compressed with
+	dictHeader         = "X-Ftr-Dict"
+	defaultDictMaxSize = "112KiB"
+	// dictSampleSize splits the training files into samples of this size
+	dictSampleSize = 64 << 10
+	// dictMaxUpload bounds a dictionary pushed by a peer
+	dictMaxUpload = 1 << 20
+)
+
+var dictIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// zstdDict is a trained zstd dictionary, known to peers by the prefix of its
+// SHA-256.
+type zstdDict struct {
+	id   string
+	data []byte
+}
+
+func newZstdDict(data []byte) (*zstdDict, error) {
+	if _, err := zstd.InspectDictionary(data); err != nil {
+		return nil, fmt.Errorf("not a zstd dictionary: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	return &zstdDict{id: hex.EncodeToString(sum[:8]), data: data}, nil
+}
+
+func defaultDictDir() string {
+	dir, err := stateDir()
+	if err != nil {
+		exitWithError(1, "Failed to get the state dir: %v", err)
+	}
+	return filepath.Join(dir, dictDirName)
+}
+
+func loadDict(dir, id string) (*zstdDict, error) {
+	if !dictIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("invalid dictionary id %q", id)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, id+dictExt))
+	if err != nil {
+		return nil, err
+	}
+	return newZstdDict(data)
+}
+
+func saveDict(dir string, d *zstdDict) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, d.id+dictExt), d.data, 0600)
+}
+
+// listDicts returns the ids of the dictionaries in dir.
+func listDicts(dir string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+dictExt))
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, m := range matches {
+		id := strings.TrimSuffix(filepath.Base(m), dictExt)
+		if dictIDPattern.MatchString(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// resolveDict loads the dictionary given to `send --dict`, either a file or
+// the id of a dictionary in the local store.
+func resolveDict(dir, ref string) (*zstdDict, error) {
+	if data, err := os.ReadFile(ref); err == nil {
+		return newZstdDict(data)
+	}
+	d, err := loadDict(dir, ref)
+	if err != nil {
+		return nil, fmt.Errorf("no dictionary file or id %s: %v", ref, err)
+	}
+	return d, nil
+}
+
+// compressWithDict writes the zstd compression of src with the dictionary to
+// a file of the same name in a new temp dir and returns its path.
+func compressWithDict(src string, d *zstdDict) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	dir, err := os.MkdirTemp("", "ftr-zst-")
+	if err != nil {
+		return "", err
+	}
+	out, err := os.Create(filepath.Join(dir, filepath.Base(src)))
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	enc, err := zstd.NewWriter(out, zstd.WithEncoderDict(d.data), zstd.WithEncoderLevel(zstdLevel))
+	if err == nil {
+		if _, err = io.Copy(enc, in); err == nil {
+			err = enc.Close()
+		}
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// dictReader decompresses the body of an upload compressed with the
+// dictionary id from dir.
+func dictReader(dir, id string, body io.Reader) (*zstd.Decoder, error) {
+	if dir == "" {
+		return nil, newUploadError(http.StatusPreconditionFailed, "Compression dictionaries are not supported")
+	}
+	d, err := loadDict(dir, id)
+	if err != nil {
+		return nil, newUploadError(http.StatusPreconditionFailed, "Unknown compression dictionary")
+	}
+	dec, err := zstd.NewReader(body, zstd.WithDecoderDicts(d.data), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, newUploadError(http.StatusInternalServerError, "Failed to set up the decompression")
+	}
+	return dec, nil
+}
+
+// dictsHandler lets senders negotiate dictionaries: `GET /dicts` lists the ids
+// the receiver holds and `PUT /dicts/<id>` hands it a missing one. The key of
+// the inbox given by the `inbox` query parameter is required.
+func dictsHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inbox, ok := opts.inbox(r.URL.Query().Get("inbox"))
+		if !ok {
+			http.Error(w, "Unknown inbox", http.StatusNotFound)
+			return
+		}
+		if !inbox.authorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, dictsPath), "/")
+		switch {
+		case r.Method == http.MethodGet && id == "":
+			ids, err := listDicts(opts.dictDir)
+			if err != nil {
+				http.Error(w, "Failed to list the dictionaries", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(ids)
+		case r.Method == http.MethodPut && id != "":
+			data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, dictMaxUpload))
+			if err != nil {
+				http.Error(w, "Dictionary too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			d, err := newZstdDict(data)
+			if err != nil || d.id != id {
+				http.Error(w, "Invalid dictionary", http.StatusBadRequest)
+				return
+			}
+			if err := saveDict(opts.dictDir, d); err != nil {
+				http.Error(w, "Failed to save the dictionary", http.StatusInternalServerError)
+				return
+			}
+			debugLog("Stored the dictionary %s from %s", id, senderName(r))
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// negotiateDict makes sure the peer holds the dictionary, pushing it if
+// needed.
+func negotiateDict(d *zstdDict, opts sendOptions) error {
+	client := opts.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	url := opts.url(dictsPath)
+	query := ""
+	if opts.inbox != "" {
+		query = "?inbox=" + opts.inbox
+	}
+	req, err := http.NewRequest(http.MethodGet, url+query, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(passKeyHeader, opts.key)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to list the dictionaries of the peer: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to list the dictionaries of the peer: %s", resp.Status)
+	}
+	var ids []string
+	if err := json.NewDecoder(resp.Body).Decode(&ids); err != nil {
+		return fmt.Errorf("failed to decode the dictionaries of the peer: %v", err)
+	}
+	for _, id := range ids {
+		if id == d.id {
+			debugLog("The peer already holds the dictionary %s", d.id)
+			return nil
+		}
+	}
+
+	debugLog("Pushing the dictionary %s to the peer", d.id)
+	req, err = http.NewRequest(http.MethodPut, url+"/"+d.id+query, bytes.NewReader(d.data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(passKeyHeader, opts.key)
+	req.Header.Set(senderHeader, getDefaultName())
+	resp, err = client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push the dictionary: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to push the dictionary: %s", resp.Status)
+	}
+	return nil
+}
+
+// dictSamples reads the files under the paths and splits them into training
+// samples.
+func dictSamples(paths []string) ([][]byte, error) {
+	var samples [][]byte
+	for _, p := range paths {
+		err := filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			for len(data) > 0 {
+				n := min(len(data), dictSampleSize)
+				samples = append(samples, data[:n])
+				data = data[n:]
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+func runDict(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: ftr dict train|add|list [flags] [args]")
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "train":
+		runDictTrain(args[1:])
+	case "add":
+		runDictAdd(args[1:])
+	case "list":
+		runDictList(args[1:])
+	default:
+		exitWithError(1, "Unrecognized dict subcommand: %s", args[0])
+	}
+}
+
+func runDictTrain(args []string) {
+	trainCmd := flag.NewFlagSet("dict train", flag.ExitOnError)
+	trainCmd.SetOutput(os.Stdout)
+	dir := trainCmd.String("dict-dir", defaultDictDir(), "the dir the dictionaries are kept in")
+	maxSize := trainCmd.String("max-size", defaultDictMaxSize, "the largest dictionary to build")
+	debug := trainCmd.Bool("debug", false, "enable debug log")
+	if err := trainCmd.Parse(args); err != nil {
+		exitWithError(1, "Dict train command failed: %v", err)
+	}
+	debugMode = *debug
+	if trainCmd.NArg() == 0 {
+		fmt.Println("Usage: ftr dict train [--max-size <size>] <sample>...")
+		os.Exit(1)
+	}
+	size, err := parseSize(*maxSize)
+	if err != nil || size <= 0 {
+		exitWithError(1, "Invalid --max-size: %s", *maxSize)
+	}
+
+	samples, err := dictSamples(trainCmd.Args())
+	if err != nil {
+		exitWithError(1, "Failed to read the samples: %v", err)
+	}
+	debugLog("Training a dictionary of up to %d bytes on %d samples", size, len(samples))
+	data, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: int(size), HashBytes: 6})
+	if err != nil {
+		exitWithError(1, "Failed to train the dictionary: %v", err)
+	}
+	d, err := newZstdDict(data)
+	if err != nil {
+		exitWithError(1, "Failed to train the dictionary: %v", err)
+	}
+	if err := saveDict(*dir, d); err != nil {
+		exitWithError(1, "Failed to save the dictionary: %v", err)
+	}
+	fmt.Printf("Trained dictionary %s (%s)\n", d.id, formatBytes(int64(len(d.data))))
+	fmt.Printf("Send with: ftr send --dict %s <path> <peer>\n", d.id)
+}
+
+func runDictAdd(args []string) {
+	addCmd := flag.NewFlagSet("dict add", flag.ExitOnError)
+	addCmd.SetOutput(os.Stdout)
+	dir := addCmd.String("dict-dir", defaultDictDir(), "the dir the dictionaries are kept in")
+	if err := addCmd.Parse(args); err != nil {
+		exitWithError(1, "Dict add command failed: %v", err)
+	}
+	if addCmd.NArg() != 1 {
+		fmt.Println("Usage: ftr dict add <file>")
+		os.Exit(1)
+	}
+	data, err := os.ReadFile(addCmd.Arg(0))
+	if err != nil {
+		exitWithError(1, "Failed to read the dictionary: %v", err)
+	}
+	d, err := newZstdDict(data)
+	if err != nil {
+		exitWithError(1, "Failed to add the dictionary: %v", err)
+	}
+	if err := saveDict(*dir, d); err != nil {
+		exitWithError(1, "Failed to save the dictionary: %v", err)
+	}
+	fmt.Printf("Added dictionary %s\n", d.id)
+}
+
+func runDictList(args []string) {
+	listCmd := flag.NewFlagSet("dict list", flag.ExitOnError)
+	listCmd.SetOutput(os.Stdout)
+	dir := listCmd.String("dict-dir", defaultDictDir(), "the dir the dictionaries are kept in")
+	if err := listCmd.Parse(args); err != nil {
+		exitWithError(1, "Dict list command failed: %v", err)
+	}
+	ids, err := listDicts(*dir)
+	if err != nil {
+		exitWithError(1, "Failed to list the dictionaries: %v", err)
+	}
+	for _, id := range ids {
+		fi, err := os.Stat(filepath.Join(*dir, id+dictExt))
+		if err != nil {
+			continue
+		}
+		fmt.Printf("%-18s %8d  %s\n", id, fi.Size(), fi.ModTime().Format("2006-01-02 15:04"))
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const manifestPath = "/manifest"
+
+// manifestEntry is a regular file of a directory tree, by its slash separated
+// path relative to the root.
+type manifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// buildManifest lists and hashes the regular files under root. A missing
+// root is an empty tree.
+func buildManifest(root string) ([]manifestEntry, error) {
+	entries := []manifestEntry{}
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return entries, nil
+	}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && d.Name() == journalDir {
+			// the journals of the extractions in progress
+			return filepath.SkipDir
+		}
+		if err != nil || !d.Type().IsRegular() || isProvenanceFile(p) {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hash, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, manifestEntry{Path: filepath.ToSlash(rel), Size: info.Size(), SHA256: hash})
+		return nil
+	})
+	return entries, err
+}
+
+// maxManifestProbeSize bounds the body of a manifest probe, the Bloom filter
+// of a tree of a few million files
+const maxManifestProbeSize = 16 << 20
+
+// manifestProbe is what a sender knows of its tree, posted to skip the full
+// manifest exchange when the trees are mostly the same.
+type manifestProbe struct {
+	Digest string      `json:"digest"`
+	Filter bloomFilter `json:"filter"`
+}
+
+// manifestDelta answers a probe. When the digests differ, Entries are the
+// remote entries the sender surely lacks, and Matched and MatchedDigest the
+// count and digest of the others, which the sender picks out of its own tree
+// with Filter, the Bloom filter of the remote tree.
+type manifestDelta struct {
+	Unchanged     bool            `json:"unchanged,omitempty"`
+	Entries       []manifestEntry `json:"entries,omitempty"`
+	Filter        bloomFilter     `json:"filter"`
+	Matched       int             `json:"matched"`
+	MatchedDigest string          `json:"matched_digest"`
+}
+
+func newManifestDelta(entries []manifestEntry, probe manifestProbe) manifestDelta {
+	if manifestDigest(entries) == probe.Digest {
+		return manifestDelta{Unchanged: true}
+	}
+	delta := manifestDelta{Filter: newBloomFilter(entries)}
+	var matched []manifestEntry
+	for _, e := range entries {
+		if probe.Filter.contains(e) {
+			matched = append(matched, e)
+		} else {
+			delta.Entries = append(delta.Entries, e)
+		}
+	}
+	delta.Matched = len(matched)
+	delta.MatchedDigest = manifestDigest(matched)
+	return delta
+}
+
+// remoteManifest rebuilds the remote manifest from the delta to the local
+// one, or returns false when a false positive of a filter makes it ambiguous.
+func (d manifestDelta) remoteManifest(local []manifestEntry) ([]manifestEntry, bool) {
+	if d.Unchanged {
+		return local, true
+	}
+	sent := map[string]bool{}
+	for _, e := range d.Entries {
+		sent[e.Path] = true
+	}
+	var matched []manifestEntry
+	for _, l := range local {
+		if !sent[l.Path] && d.Filter.contains(l) {
+			matched = append(matched, l)
+		}
+	}
+	if len(matched) != d.Matched || manifestDigest(matched) != d.MatchedDigest {
+		return nil, false
+	}
+	return append(append([]manifestEntry{}, d.Entries...), matched...), true
+}
+
+// manifestHandler serves the manifest of a dir in the drop dir of the inbox
+// given by the `inbox` query parameter, to senders holding its key:
+//
+//	GET /manifest?path=<dir relative to the drop dir>
+//
+// A POST with a manifestProbe gets a manifestDelta instead.
+func manifestHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		inbox, ok := opts.inbox(r.URL.Query().Get("inbox"))
+		if !ok {
+			http.Error(w, "Unknown inbox", http.StatusNotFound)
+			return
+		}
+		if !inbox.authorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if inbox.ephemeral {
+			http.Error(w, "The inbox keeps no files", http.StatusNotFound)
+			return
+		}
+		entries, err := buildManifest(resolveSharePath(inbox.dropDir, r.URL.Query().Get("path")))
+		if err != nil {
+			http.Error(w, "Failed to build the manifest", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodGet {
+			json.NewEncoder(w).Encode(entries)
+			return
+		}
+		var probe manifestProbe
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxManifestProbeSize)).Decode(&probe); err != nil {
+			http.Error(w, "Invalid manifest probe", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(newManifestDelta(entries, probe))
+	}
+}
+
+// fetchManifest returns the manifest of dir on the peer. With the local
+// manifest it first probes with its digest and Bloom filter, so trees that
+// are the same cost a few kilobytes, and only falls back to the full
+// manifest for an older peer or an ambiguous delta.
+func fetchManifest(addr string, port int, tlsConfig *tls.Config, key, inbox, dir string, local []manifestEntry) ([]manifestEntry, error) {
+	q := url.Values{"path": {dir}}
+	if inbox != "" {
+		q.Set("inbox", inbox)
+	}
+	u := peerURL(tlsConfig, addr, port, manifestPath+"?"+q.Encode())
+	client := tlsClient(tlsConfig)
+	do := func(method string, body io.Reader, v any) (int, error) {
+		req, err := http.NewRequest(method, u, body)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set(passKeyHeader, key)
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, fmt.Errorf("server returned status: %s", resp.Status)
+		}
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+	}
+
+	if local != nil {
+		probe, err := json.Marshal(manifestProbe{Digest: manifestDigest(local), Filter: newBloomFilter(local)})
+		if err != nil {
+			return nil, err
+		}
+		var delta manifestDelta
+		code, err := do(http.MethodPost, bytes.NewReader(probe), &delta)
+		switch {
+		case code == http.StatusMethodNotAllowed:
+			debugLog("The peer doesn't take manifest probes, fetching the full manifest")
+		case err != nil:
+			return nil, err
+		default:
+			if remote, ok := delta.remoteManifest(local); ok {
+				return remote, nil
+			}
+			debugLog("The manifest delta is ambiguous, fetching the full manifest")
+		}
+	}
+	var entries []manifestEntry
+	if _, err := do(http.MethodGet, nil, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+const (
+	diffAdded   = "+"
+	diffUpdated = "~"
+	diffMissing = "-"
+)
+
+// manifestDiff is a file that differs between the local and remote trees.
+type manifestDiff struct {
+	Change string `json:"change"`
+	Path   string `json:"path"`
+	// LocalSize and RemoteSize are -1 on the side without the file
+	LocalSize  int64 `json:"local_size"`
+	RemoteSize int64 `json:"remote_size"`
+}
+
+// diffManifests returns what sending local would add or update on the remote
+// side, and what only the remote side has, sorted by path.
+func diffManifests(local, remote []manifestEntry) []manifestDiff {
+	remoteByPath := map[string]manifestEntry{}
+	for _, e := range remote {
+		remoteByPath[e.Path] = e
+	}
+	var diffs []manifestDiff
+	for _, l := range local {
+		r, ok := remoteByPath[l.Path]
+		delete(remoteByPath, l.Path)
+		switch {
+		case !ok:
+			diffs = append(diffs, manifestDiff{Change: diffAdded, Path: l.Path, LocalSize: l.Size, RemoteSize: -1})
+		case r.SHA256 != l.SHA256:
+			diffs = append(diffs, manifestDiff{Change: diffUpdated, Path: l.Path, LocalSize: l.Size, RemoteSize: r.Size})
+		}
+	}
+	for _, r := range remoteByPath {
+		diffs = append(diffs, manifestDiff{Change: diffMissing, Path: r.Path, LocalSize: -1, RemoteSize: r.Size})
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Path < diffs[j].Path })
+	return diffs
+}
+
+func runDiff(args []string) {
+	diffCmd := flag.NewFlagSet("diff", flag.ExitOnError)
+	diffCmd.SetOutput(os.Stdout)
+	key := diffCmd.String("key", "", "pre-shared passkey of the peer")
+	inbox := diffCmd.String("inbox", "", "the inbox on the peer to compare with, empty for the default one")
+	asJSON := diffCmd.Bool("json", false, "print the differences as JSON")
+	debug := diffCmd.Bool("debug", false, "enable debug log")
+	lookupTimeout := diffCmd.Duration("lookup-timeout", defaultLookupTimeoutMs*time.Millisecond, "how long to browse for the peer per attempt")
+	lookupRetries := diffCmd.Int("lookup-retries", defaultLookupRetries, "the number of times to retry a failed peer lookup")
+	peerCacheTTL := diffCmd.Duration("peer-cache-ttl", defaultPeerCacheTTLSec*time.Second, "reuse the address of a peer found within this long, 0 to always look it up")
+	if err := diffCmd.Parse(args); err != nil {
+		exitWithError(1, "Diff command failed: %v", err)
+	}
+	debugMode = *debug
+	peer, remoteDir, ok := strings.Cut(diffCmd.Arg(1), ":")
+	if diffCmd.NArg() != 2 || !ok || peer == "" {
+		fmt.Println("Usage: ftr diff --key <key> <localdir> <peer>:<remotedir>")
+		os.Exit(1)
+	}
+	localDir := diffCmd.Arg(0)
+
+	local, err := buildManifest(localDir)
+	if err != nil {
+		exitWithError(1, "Failed to list %s: %v", localDir, err)
+	}
+	peerCacheFile := defaultPeerCacheFile()
+	p, cached, err := resolvePeer(peer, peerCacheFile, *peerCacheTTL, *lookupTimeout, *lookupRetries)
+	if err != nil {
+		exitWithError(1, "Failed to find the peer: %v", err)
+	}
+	remote, err := fetchManifest(p.Addr, p.Port, peerTLS(peer, p.Text), *key, *inbox, remoteDir, local)
+	if err != nil {
+		if cached {
+			evictPeer(peerCacheFile, peer)
+		}
+		exitWithError(1, "Failed to get the manifest of %s: %v", diffCmd.Arg(1), err)
+	}
+
+	diffs := diffManifests(local, remote)
+	if *asJSON {
+		if diffs == nil {
+			diffs = []manifestDiff{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(diffs); err != nil {
+			exitWithError(1, "Failed to encode the differences: %v", err)
+		}
+	} else {
+		counts := map[string]int{}
+		for _, d := range diffs {
+			counts[d.Change]++
+			fmt.Printf("%s %s\n", d.Change, d.Path)
+		}
+		fmt.Printf("%d to add, %d to update, %d only on %s\n", counts[diffAdded], counts[diffUpdated], counts[diffMissing], peer)
+	}
+	// like diff(1), differences exit with 1
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+}
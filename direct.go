@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	infoPath = "/info"
+	// directProbeTimeout bounds the request for the info of a receiver
+	// addressed with --to
+	directProbeTimeout = 5 * time.Second
+)
+
+// peerInfo is what a receiver advertises over mDNS, its name and TXT
+// records, which it also serves at /info for senders that address it
+// directly and for the relay.
+type peerInfo struct {
+	Name string   `json:"name"`
+	TXT  []string `json:"txt"`
+}
+
+// infoHandler serves the peerInfo of the receiver to anyone, as mDNS does.
+func infoHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(opts.advertised)
+	}
+}
+
+// probeDirect asks the receiver at the host:port given with --to for its
+// peerInfo, in place of discovering it. Plain HTTP is only used when the
+// receiver doesn't speak TLS at all and the name it answers with has no
+// pinned certificate; the certificate itself is checked once the upload
+// starts. A receiver too old to serve /info is known by its address and gets
+// no more than it supports.
+func probeDirect(hostport string) (peerInfo, cachedPeer, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, portStr = hostport, strconv.Itoa(defaultPort)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return peerInfo{}, cachedPeer{}, fmt.Errorf("invalid port %s", portStr)
+	}
+	p := cachedPeer{Addr: host, Port: port}
+
+	get := func(tlsConfig *tls.Config) (int, peerInfo, error) {
+		var info peerInfo
+		client := &http.Client{Timeout: directProbeTimeout}
+		if tlsConfig != nil {
+			client = tlsClient(tlsConfig)
+			client.Timeout = directProbeTimeout
+		}
+		resp, err := client.Get(peerURL(tlsConfig, host, port, infoPath))
+		if err != nil {
+			return 0, info, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&info)
+		}
+		return resp.StatusCode, info, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: directProbeTimeout}, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	var recordErr tls.RecordHeaderError
+	switch {
+	case err == nil:
+		conn.Close()
+	case errors.As(err, &recordErr):
+		debugLog("%s doesn't serve HTTPS, trying HTTP", hostport)
+	default:
+		return peerInfo{}, p, err
+	}
+	secure := err == nil
+	var tlsConfig *tls.Config
+	if secure {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	code, info, err := get(tlsConfig)
+	switch {
+	case err != nil:
+		return peerInfo{}, p, err
+	case code == http.StatusNotFound:
+		debugLog("%s doesn't serve %s, assuming what it supports", hostport, infoPath)
+		info = peerInfo{Name: hostport}
+		if secure {
+			info.TXT = []string{tlsTXT}
+		}
+	case code != http.StatusOK:
+		return peerInfo{}, p, fmt.Errorf("server returned status: %d %s", code, http.StatusText(code))
+	}
+	if info.Name == "" {
+		info.Name = hostport
+	}
+	if !secure && hasPin(info.Name) {
+		return peerInfo{}, p, fmt.Errorf("%s answers as %s, whose certificate is pinned, but doesn't serve HTTPS", hostport, info.Name)
+	}
+	// a receiver answering over TLS gets HTTPS whatever its TXT records say
+	if secure && !slices.Contains(info.TXT, tlsTXT) {
+		info.TXT = append(info.TXT, tlsTXT)
+	}
+	p.Text = info.TXT
+	return info, p, nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// setDSCP is a no-op where the traffic class can't be set per socket.
+func setDSCP(conn *net.TCPConn, dscp int) error {
+	debugLog("Ignoring dscp %d, only supported on Unix", dscp)
+	return nil
+}
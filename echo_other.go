@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import "os"
+
+// noEcho can't turn off the echo here; set $FTR_PASSPHRASE instead of
+// typing secrets.
+func noEcho(f *os.File) (func(), bool) {
+	return nil, false
+}
@@ -0,0 +1,27 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// noEcho turns off the echo of the terminal f and returns the function
+// turning it back on, or false if f isn't a terminal.
+func noEcho(f *os.File) (func(), bool) {
+	fd := int(f.Fd())
+	old, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, false
+	}
+	t := *old
+	t.Lflag &^= unix.ECHO
+	t.Lflag |= unix.ICANON | unix.ISIG
+	t.Iflag |= unix.ICRNL
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &t); err != nil {
+		return nil, false
+	}
+	return func() { unix.IoctlSetTermios(fd, ioctlSetTermios, old) }, true
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// noEcho turns off the echo of the console f and returns the function
+// turning it back on, or false if f isn't a console.
+func noEcho(f *os.File) (func(), bool) {
+	h := windows.Handle(f.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(h, &mode); err != nil {
+		return nil, false
+	}
+	raw := mode&^windows.ENABLE_ECHO_INPUT | windows.ENABLE_PROCESSED_INPUT | windows.ENABLE_LINE_INPUT
+	if err := windows.SetConsoleMode(h, raw); err != nil {
+		return nil, false
+	}
+	return func() { windows.SetConsoleMode(h, mode) }, true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// ephemeralMaxSize caps the payloads held in memory when --max-size sets no
+// lower limit, so a sender can't exhaust the memory of the receiver.
+const ephemeralMaxSize = 256 << 20
+
+// ephemeralOutMu serializes payloads written to stdout so concurrent uploads
+// don't interleave.
+var ephemeralOutMu sync.Mutex
+
+// receiveEphemeral reads the uploaded file into memory and hands it to the
+// configured command, or stdout, without ever writing it to disk.
+func receiveEphemeral(opts receiverOptions, u upload, entry *historyEntry) error {
+	entry.File = filepath.Base(u.name)
+	limit := opts.maxSize
+	if limit <= 0 {
+		limit = ephemeralMaxSize
+	}
+	if u.size > limit {
+		return newUploadError(http.StatusRequestEntityTooLarge, "File exceeds the maximum upload size")
+	}
+	var buf bytes.Buffer
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(&buf, hasher), io.LimitReader(u.body, limit+1))
+	if err != nil {
+		return newUploadError(http.StatusBadRequest, "Failed to receive the file")
+	}
+	if n > limit {
+		return newUploadError(http.StatusRequestEntityTooLarge, "File exceeds the maximum upload size")
+	}
+	entry.Bytes = n
+	entry.Hash = hex.EncodeToString(hasher.Sum(nil))
+	if err := checkHash(u, entry.Hash); err != nil {
+		return err
+	}
+	debugLog("Received %d bytes of %s in memory", n, entry.File)
+
+	if err := deliverEphemeral(&buf, opts.ephemeralCmd, entry.File, u.fileType, u.sender); err != nil {
+		debugLog("Failed to deliver %s: %v", entry.File, err)
+		return newUploadError(http.StatusInternalServerError, "Failed to deliver the file on server")
+	}
+	return nil
+}
+
+func deliverEphemeral(payload io.Reader, command, fileName, fileType, sender string) error {
+	if command == "" {
+		ephemeralOutMu.Lock()
+		defer ephemeralOutMu.Unlock()
+		_, err := io.Copy(os.Stdout, payload)
+		return err
+	}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = payload
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"FTR_FILE_NAME="+fileName,
+		"FTR_FILE_TYPE="+fileType,
+		"FTR_SENDER="+sender,
+	)
+	return cmd.Run()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	eventsPath = "/events"
+	// eventBacklog is how many past events a reconnecting client can catch
+	// up on with Last-Event-ID
+	eventBacklog = 100
+	// eventKeepalive keeps idle streams from being cut by proxies
+	eventKeepalive = 15 * time.Second
+	// eventBuffer is how far a subscriber may fall behind before it's dropped
+	eventBuffer = 64
+
+	eventStarted  = "started"
+	eventReceived = "received"
+	eventFailed   = "failed"
+)
+
+// receiveEvent is a change to the drop dir of an inbox, streamed to local
+// tools so they don't have to poll it.
+type receiveEvent struct {
+	ID       uint64    `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Transfer string    `json:"transfer"`
+	Inbox    string    `json:"inbox,omitempty"`
+	Sender   string    `json:"sender"`
+	File     string    `json:"file"`
+	// Paths are where the upload ended up, a directory or the files of a
+	// batch, absent in ephemeral mode
+	Paths     []string `json:"paths,omitempty"`
+	Bytes     int64    `json:"bytes,omitempty"`
+	Hash      string   `json:"hash,omitempty"`
+	Duplicate bool     `json:"duplicate,omitempty"`
+	Skipped   bool     `json:"skipped,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// eventHub fans the receive events of all inboxes out to the subscribed
+// streams. A nil hub drops them.
+type eventHub struct {
+	mu     sync.Mutex
+	nextID uint64
+	recent []receiveEvent
+	subs   map[chan receiveEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{nextID: 1, subs: map[chan receiveEvent]struct{}{}}
+}
+
+func (h *eventHub) publish(e receiveEvent) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e.ID = h.nextID
+	h.nextID++
+	e.Time = time.Now()
+	h.recent = append(h.recent, e)
+	if len(h.recent) > eventBacklog {
+		h.recent = h.recent[1:]
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			// a stalled client loses its stream rather than blocking uploads
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the events after lastID still in the backlog and a
+// channel of the ones to come, closed when the subscriber falls behind.
+func (h *eventHub) subscribe(lastID uint64) ([]receiveEvent, chan receiveEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var missed []receiveEvent
+	for _, e := range h.recent {
+		if e.ID > lastID {
+			missed = append(missed, e)
+		}
+	}
+	ch := make(chan receiveEvent, eventBuffer)
+	h.subs[ch] = struct{}{}
+	return missed, ch
+}
+
+func (h *eventHub) unsubscribe(ch chan receiveEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// eventsHandler streams the receive events as server-sent events, with the
+// event type as the SSE event name and the JSON encoded event as its data.
+// Clients resume after a disconnect with the Last-Event-ID header.
+func eventsHandler(h *eventHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+		missed, ch := h.subscribe(lastID)
+		defer h.unsubscribe(ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		write := func(e receiveEvent) error {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+			return err
+		}
+		for _, e := range missed {
+			if err := write(e); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		keepalive := time.NewTicker(eventKeepalive)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e, ok := <-ch:
+				if !ok {
+					return
+				}
+				if err := write(e); err != nil {
+					return
+				}
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
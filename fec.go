@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// The UDP transport protects blocks of the payload with Reed-Solomon parity
+// so lossy links don't need a round trip per lost packet. Every block is
+// split into dataShards shards of shardSize bytes plus parityShards parity
+// shards, and any dataShards of them rebuild the block. Each datagram starts
+// with its type; all but hello carry the 16-byte session id next:
+//
+//	hello  fecHello JSON, answered by accept or status with an error
+//	data   block uint32, shard uint16, shard bytes
+//	done   answered by status, listing the blocks still missing
+//	probe  padding up to the probed size, answered by probe with its size
+//
+// Shards fill a datagram of the path MTU, found by probing it before the
+// hello; a fixed size would fragment on VPNs or waste jumbo frames.
+const (
+	transportUDP = "udp"
+
+	fecMsgHello  byte = 1
+	fecMsgAccept byte = 2
+	fecMsgData   byte = 3
+	fecMsgDone   byte = 4
+	fecMsgStatus byte = 5
+	fecMsgProbe  byte = 6
+
+	fecIDLen             = 16
+	fecShardSize         = 1200
+	fecDataOverhead      = 1 + fecIDLen + 6
+	fecMaxMTU            = 9000
+	fecMinMTU            = 576
+	fecMaxShardSize      = fecMaxMTU - 28 - fecDataOverhead
+	defaultFECData       = 10
+	defaultFECParity     = 4
+	defaultUDPRateMbps   = 100
+	fecReplyTimeout      = time.Second
+	fecMaxRounds         = 30
+	fecMaxMissingReport  = 2000
+	fecCompletionTimeout = 10 * time.Minute
+)
+
+// fecHello opens an upload over UDP, authenticated like a raw upload.
+type fecHello struct {
+	rawHeader
+	Hash         string `json:"sha256"`
+	DataShards   int    `json:"data_shards"`
+	ParityShards int    `json:"parity_shards"`
+	ShardSize    int    `json:"shard_size"`
+}
+
+// fecReport answers hello and done.
+type fecReport struct {
+	Missing  []int64 `json:"missing,omitempty"`
+	Pending  bool    `json:"pending,omitempty"`
+	Complete bool    `json:"complete,omitempty"`
+	Probed   int     `json:"probed,omitempty"`
+	Code     int     `json:"code,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// fecSession is an upload being received over UDP. Decoded blocks are stored
+// as the chunks of a chunked upload.
+type fecSession struct {
+	upload *chunkedUpload
+	enc    reedsolomon.Encoder
+	hello  fecHello
+
+	mu     sync.Mutex
+	shards map[int64][][]byte
+	// result is set once the upload was delivered
+	completing bool
+	result     *fecReport
+}
+
+type fecServer struct {
+	opts     receiverOptions
+	conn     net.PacketConn
+	mu       sync.Mutex
+	sessions map[string]*fecSession
+}
+
+// serveFEC receives UDP uploads on conn, bound to the receiver port.
+func serveFEC(opts receiverOptions, conn net.PacketConn) error {
+	s := &fecServer{opts: opts, conn: simulation.packetConn(conn), sessions: map[string]*fecSession{}}
+	buf := make([]byte, 64<<10)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		// UDP senders present no certificate, only their address counts
+		if n == 0 || (opts.linkLocal && !onLink(addr)) || !opts.permitsConn(addr.String(), nil) {
+			continue
+		}
+		pkt := append([]byte(nil), buf[:n]...)
+		switch pkt[0] {
+		case fecMsgHello:
+			s.hello(addr, pkt[1:])
+		case fecMsgData:
+			s.data(pkt[1:])
+		case fecMsgDone:
+			s.done(addr, pkt[1:])
+		case fecMsgProbe:
+			if len(pkt) > fecIDLen {
+				s.reply(addr, fecMsgProbe, string(pkt[1:1+fecIDLen]), fecReport{Probed: len(pkt)})
+			}
+		}
+	}
+}
+
+func (s *fecServer) reply(addr net.Addr, typ byte, id string, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	pkt := append([]byte{typ}, id...)
+	if _, err := s.conn.WriteTo(append(pkt, body...), addr); err != nil {
+		debugLog("Failed to answer %s: %v", addr, err)
+	}
+}
+
+func (s *fecServer) hello(addr net.Addr, body []byte) {
+	var h fecHello
+	// a hello is resent until accepted, the nonce is the id it's answered with
+	if len(body) < fecIDLen || json.Unmarshal(body[fecIDLen:], &h) != nil {
+		return
+	}
+	nonce := string(body[:fecIDLen])
+	fail := func(code int, msg string) {
+		s.reply(addr, fecMsgStatus, nonce, fecReport{Code: code, Error: msg})
+	}
+	s.mu.Lock()
+	_, ok := s.sessions[nonce]
+	s.mu.Unlock()
+	if ok {
+		s.reply(addr, fecMsgAccept, nonce, fecReport{})
+		return
+	}
+
+	refuse := func(auth string, code int, msg string) {
+		s.opts.audit.record(auditEntry{
+			Address: remoteHost(addr.String()),
+			Sender:  h.Sender,
+			Inbox:   h.Inbox,
+			File:    h.Name,
+			Size:    h.Size,
+			Auth:    auth,
+			Outcome: auditRefused,
+			Status:  code,
+		})
+		fail(code, msg)
+	}
+	if _, locked := s.opts.guard.lockedOut(addr.String()); locked {
+		refuse(authLockedOut, http.StatusTooManyRequests, "Too many wrong passkeys, try again later")
+		return
+	}
+	inbox, ok := s.opts.inbox(h.Inbox)
+	if !ok {
+		fail(http.StatusNotFound, "Unknown inbox")
+		return
+	}
+	// the source address of a datagram is easily spoofed, so wrong keys
+	// over UDP don't count towards a lockout, nor does the right one lift it
+	if !inbox.authorizedConn(nil, h.Sender, h.Key) {
+		logger.Warn("Wrong passkey over UDP", "address", remoteHost(addr.String()), "peer", h.Sender)
+		refuse(authRejected, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if h.DataShards <= 0 || h.ParityShards < 0 || h.DataShards+h.ParityShards > 256 ||
+		h.ShardSize <= 0 || h.ShardSize > fecMaxShardSize || h.Size <= 0 || inbox.ephemeral {
+		fail(http.StatusBadRequest, "Invalid UDP upload")
+		return
+	}
+	enc, err := reedsolomon.New(h.DataShards, max(h.ParityShards, 1), codecOptions()...)
+	if err != nil {
+		fail(http.StatusBadRequest, "Invalid UDP upload")
+		return
+	}
+	sender := h.Sender
+	if sender == "" {
+		sender = remoteHost(addr.String())
+	}
+	c, err := s.opts.chunked.open(inbox, chunkedUploadRequest{
+		Name:       h.Name,
+		Type:       h.Type,
+		Size:       h.Size,
+		ChunkSize:  int64(h.DataShards * h.ShardSize),
+		Hash:       h.Hash,
+		OnConflict: h.OnConflict,
+		fileMeta:   h.fileMeta,
+	}, sender, remoteHost(addr.String()), "")
+	if err != nil {
+		fail(http.StatusInternalServerError, "Failed to create the file on server")
+		return
+	}
+	sess := &fecSession{upload: c, enc: enc, hello: h, shards: map[int64][][]byte{}}
+	s.mu.Lock()
+	// forget the abandoned sessions whose upload expired
+	for id, old := range s.sessions {
+		old.mu.Lock()
+		_, open := s.opts.chunked.get(old.upload.ID)
+		if !open && !old.completing && old.result == nil {
+			delete(s.sessions, id)
+		}
+		old.mu.Unlock()
+	}
+	s.sessions[nonce] = sess
+	s.mu.Unlock()
+	debugLog("Receiving %s over UDP from %s in %d blocks", h.Name, addr, c.chunks())
+	s.reply(addr, fecMsgAccept, nonce, fecReport{})
+}
+
+func (s *fecServer) session(body []byte) (string, *fecSession, []byte) {
+	if len(body) < fecIDLen {
+		return "", nil, nil
+	}
+	id := string(body[:fecIDLen])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return id, s.sessions[id], body[fecIDLen:]
+}
+
+func (s *fecServer) data(body []byte) {
+	_, sess, body := s.session(body)
+	if sess == nil || len(body) < 6 {
+		return
+	}
+	block := int64(binary.BigEndian.Uint32(body))
+	shard := int(binary.BigEndian.Uint16(body[4:]))
+	payload := body[6:]
+	h := sess.hello
+	c := sess.upload
+	if block >= c.chunks() || shard >= h.DataShards+h.ParityShards || len(payload) != h.ShardSize {
+		return
+	}
+
+	sess.mu.Lock()
+	c.mu.Lock()
+	have := c.Received[block]
+	c.mu.Unlock()
+	if have || sess.result != nil || sess.completing {
+		sess.mu.Unlock()
+		return
+	}
+	shards := sess.shards[block]
+	if shards == nil {
+		shards = make([][]byte, h.DataShards+max(h.ParityShards, 1))
+		sess.shards[block] = shards
+	}
+	shards[shard] = payload
+	got := 0
+	for _, sh := range shards {
+		if sh != nil {
+			got++
+		}
+	}
+	if got < h.DataShards {
+		sess.mu.Unlock()
+		return
+	}
+	delete(sess.shards, block)
+	sess.mu.Unlock()
+
+	if err := sess.enc.ReconstructData(shards); err != nil {
+		debugLog("Failed to rebuild block %d of %s: %v", block, h.Name, err)
+		return
+	}
+	data := bytes.Join(shards[:h.DataShards], nil)[:c.chunkLen(block)]
+	if err := putChunk(c, block, bytes.NewReader(data)); err != nil {
+		debugLog("Failed to store block %d of %s: %v", block, h.Name, err)
+	}
+}
+
+func (s *fecServer) done(addr net.Addr, body []byte) {
+	id, sess, _ := s.session(body)
+	if sess == nil {
+		s.reply(addr, fecMsgStatus, id, fecReport{Code: http.StatusNotFound, Error: "Upload not found"})
+		return
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.result != nil {
+		s.reply(addr, fecMsgStatus, id, *sess.result)
+		return
+	}
+	if sess.completing {
+		s.reply(addr, fecMsgStatus, id, fecReport{Pending: true})
+		return
+	}
+	c := sess.upload
+	c.mu.Lock()
+	missing := c.missing()
+	c.mu.Unlock()
+	if len(missing) > 0 {
+		if len(missing) > fecMaxMissingReport {
+			missing = missing[:fecMaxMissingReport]
+		}
+		s.reply(addr, fecMsgStatus, id, fecReport{Missing: missing})
+		return
+	}
+	sess.completing = true
+	s.reply(addr, fecMsgStatus, id, fecReport{Pending: true})
+	go func() {
+		_, err := completeChunkedUpload(s.opts.chunked, c)
+		report := &fecReport{Complete: err == nil, Code: uploadStatus(err)}
+		if err != nil {
+			report.Error = err.Error()
+		}
+		sess.mu.Lock()
+		sess.completing = false
+		sess.result = report
+		sess.mu.Unlock()
+		// keep the result around for a late done, then forget the session
+		time.AfterFunc(time.Minute, func() {
+			s.mu.Lock()
+			delete(s.sessions, id)
+			s.mu.Unlock()
+		})
+	}()
+}
+
+// postUDP uploads the file at src over UDP with forward error correction.
+// The returned bool reports whether the failure is worth retrying.
+func postUDP(src, fileType, hash string, opts sendOptions) (bool, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return false, fmt.Errorf("failed to open the source file: %v", err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat the source file: %v", err)
+	}
+	if fi.Size() == 0 {
+		return false, errors.New("empty files can't be sent over udp")
+	}
+	dataShards, parityShards := opts.fecData, opts.fecParity
+	enc, err := reedsolomon.New(dataShards, max(parityShards, 1))
+	if err != nil {
+		return false, fmt.Errorf("invalid fec settings: %v", err)
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort(opts.addr, strconv.Itoa(opts.port)))
+	if err != nil {
+		return true, fmt.Errorf("failed to connect to the peer: %v", err)
+	}
+	defer conn.Close()
+	var shardSize int
+	if opts.udpMTU > 0 {
+		shardSize = opts.udpMTU - ipOverhead(conn.RemoteAddr()) - fecDataOverhead
+	} else {
+		shardSize = probeShardSize(conn)
+	}
+	// probing needs the socket itself
+	conn = bandwidth.conn(simulation.conn(conn))
+	debugLog("Sending over UDP in shards of %d bytes", shardSize)
+
+	id := newTransferID()
+	hello, err := json.Marshal(fecHello{
+		rawHeader: rawHeader{
+			Key:        opts.key,
+			Inbox:      opts.inbox,
+			Name:       filepath.Base(src),
+			Type:       fileType,
+			Sender:     getDefaultName(),
+			Size:       fi.Size(),
+			NoExtract:  !opts.extract,
+			OnConflict: opts.onConflict,
+			fileMeta:   opts.meta,
+		},
+		Hash:         hash,
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		ShardSize:    shardSize,
+	})
+	if err != nil {
+		return false, err
+	}
+	typ, report, err := fecRequest(conn, append(append([]byte{fecMsgHello}, id...), hello...), id)
+	if err != nil {
+		return true, fmt.Errorf("the peer didn't answer: %v", err)
+	}
+	if typ != fecMsgAccept {
+		return report.Code >= http.StatusInternalServerError,
+			fmt.Errorf("failed to send the file, server returned status: %d %s", report.Code, report.Error)
+	}
+
+	blockSize := int64(dataShards * shardSize)
+	blocks := (fi.Size() + blockSize - 1) / blockSize
+	pace := newPacer(opts.udpRateMbps)
+	sendBlock := func(n int64) error {
+		buf := make([]byte, blockSize)
+		read, err := file.ReadAt(buf, n*blockSize)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		clear(buf[read:])
+		shards, err := enc.Split(buf)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(shards); err != nil {
+			return err
+		}
+		for i, shard := range shards {
+			if i >= dataShards+parityShards {
+				break
+			}
+			pkt := make([]byte, 0, 1+fecIDLen+6+len(shard))
+			pkt = append(pkt, fecMsgData)
+			pkt = append(pkt, id...)
+			pkt = binary.BigEndian.AppendUint32(pkt, uint32(n))
+			pkt = binary.BigEndian.AppendUint16(pkt, uint16(i))
+			pkt = append(pkt, shard...)
+			pace(len(pkt))
+			if _, err := conn.Write(pkt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for n := int64(0); n < blocks; n++ {
+		if err := sendBlock(n); err != nil {
+			return true, fmt.Errorf("failed to send the file: %v", err)
+		}
+		opts.progress.add(int(min(blockSize, fi.Size()-n*blockSize)))
+	}
+	deadline := time.Now().Add(fecCompletionTimeout)
+	for round := 0; time.Now().Before(deadline); {
+		_, report, err := fecRequest(conn, append([]byte{fecMsgDone}, id...), id)
+		if err != nil {
+			return true, fmt.Errorf("the peer didn't answer: %v", err)
+		}
+		switch {
+		case report.Error != "":
+			return report.Code >= http.StatusInternalServerError,
+				fmt.Errorf("failed to send the file, server returned status: %d %s", report.Code, report.Error)
+		case report.Complete:
+			return false, nil
+		case report.Pending:
+			time.Sleep(fecReplyTimeout / 4)
+			continue
+		}
+		if round++; round > fecMaxRounds {
+			return true, fmt.Errorf("%d blocks still missing after %d rounds", len(report.Missing), fecMaxRounds)
+		}
+		debugLog("Resending %d blocks lost despite the parity", len(report.Missing))
+		for _, n := range report.Missing {
+			if err := sendBlock(n); err != nil {
+				return true, fmt.Errorf("failed to send the file: %v", err)
+			}
+		}
+	}
+	return true, errors.New("timed out waiting for the peer to store the file")
+}
+
+// fecProbeMTUs are the MTUs tried on the path: jumbo frames, Ethernet,
+// WireGuard and the IPv6 minimum.
+var fecProbeMTUs = []int{fecMaxMTU, 1500, 1420, 1280}
+
+// ipOverhead is the size of the IP and UDP headers of a datagram to addr.
+func ipOverhead(addr net.Addr) int {
+	if a, ok := addr.(*net.UDPAddr); ok && a.IP.To4() == nil {
+		return 48
+	}
+	return 28
+}
+
+// probeShardSize sends a probe of every candidate MTU at once, unfragmented,
+// and returns the shard size filling the largest one the peer received. It
+// falls back to fecShardSize when the path can't be probed or the peer
+// doesn't answer probes.
+func probeShardSize(conn net.Conn) int {
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		return fecShardSize
+	}
+	overhead := ipOverhead(conn.RemoteAddr())
+	if err := setDontFragment(udp, overhead != 28); err != nil {
+		debugLog("Not probing the path MTU: %v", err)
+		return fecShardSize
+	}
+	id := newTransferID()
+	buf := make([]byte, 64<<10)
+	best := 0
+	for attempt := 0; attempt < 2 && best == 0; attempt++ {
+		for _, mtu := range fecProbeMTUs {
+			pkt := make([]byte, mtu-overhead)
+			pkt[0] = fecMsgProbe
+			copy(pkt[1:], id)
+			// larger than the local interface fails right away, skip it
+			if _, err := conn.Write(pkt); err != nil {
+				debugLog("Probe of %d bytes not sent: %v", len(pkt), err)
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(fecReplyTimeout / 2))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if n < 1+fecIDLen || buf[0] != fecMsgProbe || string(buf[1:1+fecIDLen]) != id {
+				continue
+			}
+			var report fecReport
+			if json.Unmarshal(buf[1+fecIDLen:n], &report) == nil {
+				best = max(best, report.Probed)
+			}
+		}
+	}
+	if best == 0 {
+		debugLog("The peer didn't answer the MTU probes")
+		return fecShardSize
+	}
+	return min(best-fecDataOverhead, fecMaxShardSize)
+}
+
+// fecRequest sends the datagram until a reply for the session arrives.
+func fecRequest(conn net.Conn, pkt []byte, id string) (byte, fecReport, error) {
+	buf := make([]byte, 64<<10)
+	var lastErr error
+	for attempt := 0; attempt < 5; attempt++ {
+		if _, err := conn.Write(pkt); err != nil {
+			return 0, fecReport{}, err
+		}
+		conn.SetReadDeadline(time.Now().Add(fecReplyTimeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				lastErr = err
+				break
+			}
+			if n < 1+fecIDLen || string(buf[1:1+fecIDLen]) != id {
+				continue
+			}
+			var report fecReport
+			if err := json.Unmarshal(buf[1+fecIDLen:n], &report); err != nil {
+				continue
+			}
+			return buf[0], report, nil
+		}
+	}
+	return 0, fecReport{}, lastErr
+}
+
+// newPacer returns a function that sleeps as needed to keep the sending rate
+// under rateMbps, 0 for no limit.
+func newPacer(rateMbps int) func(n int) {
+	if rateMbps <= 0 {
+		return func(int) {}
+	}
+	bytesPerSec := float64(rateMbps) * 1e6 / 8
+	start := time.Now()
+	var sent float64
+	return func(n int) {
+		sent += float64(n)
+		due := start.Add(time.Duration(sent / bytesPerSec * float64(time.Second)))
+		if d := time.Until(due); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
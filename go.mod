@@ -2,11 +2,17 @@ module charleszheng44/filetransfer
 
 go 1.25.0
 
+require (
+	github.com/grandcat/zeroconf v1.0.0
+	github.com/klauspost/compress v1.20.1
+	github.com/klauspost/reedsolomon v1.14.2
+	golang.org/x/sys v0.30.0
+)
+
 require (
 	github.com/cenkalti/backoff v2.2.1+incompatible // indirect
-	github.com/grandcat/zeroconf v1.0.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.3.0 // indirect
 	github.com/miekg/dns v1.1.27 // indirect
 	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550 // indirect
 	golang.org/x/net v0.0.0-20200114155413-6afb5195e5aa // indirect
-	golang.org/x/sys v0.0.0-20190924154521-2837fb4f24fe // indirect
 )
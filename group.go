@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	groupSection = "groups"
+	// groupPrefix marks a send target as a group rather than a peer
+	groupPrefix = "@"
+)
+
+// expandGroup returns the members of the named group of the `[groups]` config
+// section, in order and without repeats. A member with wildcards is a name
+// pattern matched against the peers discovered within the timeout, so the
+// group follows whoever is on the network:
+//
+//	[groups]
+//	lab = node1,node2,node3
+//	render = render-*
+func expandGroup(cfg *config, name string, timeout time.Duration) ([]string, error) {
+	value, ok := cfg.section(groupSection)[name]
+	if !ok {
+		return nil, fmt.Errorf("group %s not found", name)
+	}
+	members, err := expandPeers(value, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("group %s: %v", name, err)
+	}
+	return members, nil
+}
+
+// expandPeers returns the peers of a comma-separated list, in order and
+// without repeats, matching the members with wildcards against the peers
+// discovered within the timeout.
+func expandPeers(list string, timeout time.Duration) ([]string, error) {
+	var discovered []string
+	var members []string
+	seen := map[string]bool{}
+	add := func(peer string) {
+		if !seen[peer] {
+			seen[peer] = true
+			members = append(members, peer)
+		}
+	}
+	for _, m := range strings.Split(list, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		if !strings.ContainsAny(m, "*?[") {
+			add(m)
+			continue
+		}
+		if discovered == nil {
+			var err error
+			if discovered, err = browsePeers(timeout); err != nil {
+				return nil, err
+			}
+		}
+		for _, peer := range discovered {
+			ok, err := filepath.Match(m, peer)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %v", m, err)
+			}
+			if ok {
+				add(peer)
+			}
+		}
+	}
+	if len(members) == 0 {
+		return nil, errors.New("no peers match")
+	}
+	return members, nil
+}
+
+// browsePeers returns the names of the peers found within the timeout, sorted.
+func browsePeers(timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	entries := make(chan *zeroconf.ServiceEntry)
+	if err := peerNet.Browse(ctx, entries); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	seen := map[string]bool{}
+	for {
+		select {
+		case <-ctx.Done():
+			sort.Strings(names)
+			return names, nil
+		case e, ok := <-entries:
+			if !ok {
+				sort.Strings(names)
+				return names, nil
+			}
+			if !seen[e.Instance] {
+				seen[e.Instance] = true
+				names = append(names, e.Instance)
+			}
+		}
+	}
+}
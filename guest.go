@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	guestCodesPath      = "/guest-codes"
+	guestCodeLength     = 10
+	defaultGuestTTL     = 15 * time.Minute
+	defaultGuestMaxSize = "100MB"
+	guestRequestTimeout = 10 * time.Second
+	// guestRequestSlack leaves room for the multipart framing around the
+	// files of a guest upload
+	guestRequestSlack = 64 << 10
+)
+
+// guestCode authorizes a single upload to the default inbox without the
+// passkey.
+type guestCode struct {
+	Code    string    `json:"code"`
+	Expires time.Time `json:"expires"`
+	MaxSize int64     `json:"max_size"`
+}
+
+// guestCodes holds the unused guest codes. A nil store accepts none.
+type guestCodes struct {
+	mu    sync.Mutex
+	codes map[string]guestCode
+}
+
+func newGuestCodes() *guestCodes {
+	return &guestCodes{codes: map[string]guestCode{}}
+}
+
+// mint creates a code valid for ttl that allows an upload of up to maxSize
+// bytes.
+func (g *guestCodes) mint(ttl time.Duration, maxSize int64) guestCode {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for code, c := range g.codes {
+		if now.After(c.Expires) {
+			delete(g.codes, code)
+		}
+	}
+	c := guestCode{Code: randomPassKey(guestCodeLength), Expires: now.Add(ttl), MaxSize: maxSize}
+	g.codes[c.Code] = c
+	return c
+}
+
+// claim uses up the code, reporting whether it was valid.
+func (g *guestCodes) claim(code string) (guestCode, bool) {
+	if g == nil || code == "" {
+		return guestCode{}, false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c, ok := g.codes[code]
+	if !ok {
+		return guestCode{}, false
+	}
+	delete(g.codes, code)
+	if time.Now().After(c.Expires) {
+		return guestCode{}, false
+	}
+	return c, true
+}
+
+// guestOptions restricts the inbox to what the guest code allows.
+func guestOptions(opts receiverOptions, c guestCode) receiverOptions {
+	if opts.maxSize <= 0 || c.MaxSize < opts.maxSize {
+		opts.maxSize = c.MaxSize
+	}
+	return opts
+}
+
+// guestMiddleware lets a request carrying a guest code instead of the passkey
+// upload once, within the size the code allows.
+func guestMiddleware(opts receiverOptions, authed http.Handler) (http.Handler, error) {
+	if opts.guests == nil {
+		return authed, nil
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opts.authorized(r) {
+			authed.ServeHTTP(w, r)
+			return
+		}
+		c, ok := opts.guests.claim(requestKey(r))
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		debugLog("Accepting an upload from %s with a guest code", senderName(r))
+		// the code covers the whole request, whatever number of files it has
+		r.Body = http.MaxBytesReader(w, r.Body, c.MaxSize+guestRequestSlack)
+		handler, err := getFileDropHandler(guestOptions(opts, c))
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}), nil
+}
+
+type guestCodeRequest struct {
+	TTL     string `json:"ttl"`
+	MaxSize int64  `json:"max_size"`
+}
+
+// guestCodesHandler mints guest codes for `ftr guest-code`.
+func guestCodesHandler(g *guestCodes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req guestCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid guest code request", http.StatusBadRequest)
+			return
+		}
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 || req.MaxSize <= 0 {
+			http.Error(w, "Invalid guest code request", http.StatusBadRequest)
+			return
+		}
+		c := g.mint(ttl, req.MaxSize)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+func runGuestCode(args []string) {
+	guestCmd := flag.NewFlagSet("guest-code", flag.ExitOnError)
+	guestCmd.SetOutput(os.Stdout)
+	key := guestCmd.String("key", "", "the passkey of the local receiver")
+	port := guestCmd.Int("port", defaultPort, "the port of the local receiver")
+	ttl := guestCmd.Duration("ttl", defaultGuestTTL, "how long the code stays valid")
+	maxSize := guestCmd.String("max-size", defaultGuestMaxSize, "the largest upload the code allows")
+	debug := guestCmd.Bool("debug", false, "enable debug log")
+	applyUnits := unitFlags(guestCmd)
+	if err := guestCmd.Parse(args); err != nil {
+		exitWithError(1, "Guest-code command failed: %v", err)
+	}
+	debugMode = *debug
+	applyUnits()
+	size, err := parseSize(*maxSize)
+	if err != nil || size <= 0 {
+		exitWithError(1, "Invalid --max-size: %s", *maxSize)
+	}
+
+	body, err := json.Marshal(guestCodeRequest{TTL: ttl.String(), MaxSize: size})
+	if err != nil {
+		exitWithError(1, "Failed to encode the request: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d%s", *port, guestCodesPath), bytes.NewReader(body))
+	if err != nil {
+		exitWithError(1, "Failed to create the request: %v", err)
+	}
+	req.Header.Set(passKeyHeader, *key)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Timeout: guestRequestTimeout}).Do(req)
+	if err != nil {
+		exitWithError(1, "Failed to reach the receiver: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		exitWithError(1, "The receiver refused to mint a code: %s %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var c guestCode
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		exitWithError(1, "Failed to decode the guest code: %v", err)
+	}
+	fmt.Printf("Guest code: %s (valid until %s, up to %s)\n", c.Code, c.Expires.Local().Format(time.Kitchen), formatBytes(c.MaxSize))
+	fmt.Printf("Send with: ftr send --key %s <path> <peer>\n", c.Code)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	historyFileName  = "history.jsonl"
+	directionSend    = "send"
+	directionReceive = "receive"
+	statusOK         = "ok"
+	statusFailed     = "failed"
+	// statusStalled is a receipt aborted as nothing arrived for too long
+	statusStalled = "stalled"
+)
+
+// historyEntry is a single line of the transfer ledger.
+type historyEntry struct {
+	Time       time.Time `json:"time"`
+	Direction  string    `json:"direction"`
+	Peer       string    `json:"peer"`
+	File       string    `json:"file"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs int64     `json:"duration_ms"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	// Path is where a received file was stored, to verify it later, or the
+	// shared file a peer fetched
+	Path string `json:"path,omitempty"`
+	// Paths are where a received directory, batch or duplicate ended up
+	Paths []string `json:"paths,omitempty"`
+	// Duplicate marks a receipt dropped as identical to a recent one
+	Duplicate bool `json:"duplicate,omitempty"`
+	// Skipped marks an upload discarded as its name was taken, under the
+	// skip conflict policy
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+var historyMu sync.Mutex
+
+// stateDir returns the directory ftr keeps its local state in.
+func stateDir() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	if u.HomeDir == "" {
+		return "", fmt.Errorf("HomeDir of the current user is empty")
+	}
+	return filepath.Join(u.HomeDir, ".ftr"), nil
+}
+
+func defaultHistoryFile() string {
+	dir, err := stateDir()
+	if err != nil {
+		exitWithError(1, "Failed to get the state dir: %v", err)
+	}
+	return filepath.Join(dir, historyFileName)
+}
+
+func appendHistory(file string, e historyEntry) error {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// recordHistory appends the entry to the ledger, only logging on failure so a
+// broken ledger never fails a transfer.
+func recordHistory(file string, e historyEntry) {
+	if file == "" {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if err := appendHistory(file, e); err != nil {
+		debugLog("Failed to record the transfer in %s: %v", file, err)
+	}
+}
+
+func readHistory(file string) ([]historyEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []historyEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("failed to parse the history entry %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+func runHistory(args []string) {
+	historyCmd := flag.NewFlagSet("history", flag.ExitOnError)
+	historyCmd.SetOutput(os.Stdout)
+	historyFile := historyCmd.String("history-file", defaultHistoryFile(), "the path to the transfer history ledger")
+	peer := historyCmd.String("peer", "", "only show the transfers with this peer")
+	direction := historyCmd.String("direction", "", "only show the transfers in this direction (send or receive)")
+	status := historyCmd.String("status", "", "only show the transfers with this result (ok, failed or stalled)")
+	since := historyCmd.String("since", "", "only show the transfers from this date or RFC 3339 time on")
+	until := historyCmd.String("until", "", "only show the transfers up to this date, included, or before this RFC 3339 time")
+	limit := historyCmd.Int("limit", 0, "show at most this many of the latest transfers, 0 for all")
+	jsonOutput := historyCmd.Bool("json", false, "print the transfers as JSON")
+	applyUnits := unitFlags(historyCmd)
+	if err := historyCmd.Parse(args); err != nil {
+		exitWithError(1, "History command failed: %v", err)
+	}
+	applyUnits()
+	if historyCmd.NArg() > 0 {
+		fmt.Println("Usage: ftr history [--peer <peer>] [--since <date>] [--until <date>] [--json]")
+		os.Exit(1)
+	}
+	// the same filter as the /history catalog of a receiver
+	filter, err := parseHistoryFilter(url.Values{
+		"peer":      {*peer},
+		"direction": {*direction},
+		"status":    {*status},
+		"since":     {*since},
+		"until":     {*until},
+	})
+	if err != nil {
+		exitWithError(1, "Invalid filter: %v", err)
+	}
+
+	entries, err := readHistory(*historyFile)
+	if err != nil {
+		exitWithError(1, "Failed to read the history: %v", err)
+	}
+	matched := []historyEntry{}
+	for _, e := range entries {
+		if filter.match(e) {
+			matched = append(matched, e)
+		}
+	}
+	if *limit > 0 && len(matched) > *limit {
+		matched = matched[len(matched)-*limit:]
+	}
+	if *jsonOutput {
+		if err := json.NewEncoder(os.Stdout).Encode(matched); err != nil {
+			exitWithError(1, "Failed to encode the history: %v", err)
+		}
+		return
+	}
+	fmt.Printf("%-16s %-7s %-20s %-30s %-10s %-8s %s\n", "Time", "Dir", "Peer", "File", "Size", "Status", "SHA-256")
+	for _, e := range matched {
+		hash := e.Hash
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		fmt.Printf("%-16s %-7s %-20s %-30s %-10s %-8s %s\n",
+			e.Time.Local().Format("2006-01-02 15:04"), e.Direction, e.Peer, e.File, formatBytes(e.Bytes), e.Status, hash)
+	}
+}
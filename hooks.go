@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// receiveHook is the JSON payload posted to the --webhook of the receiver
+// for every received file.
+type receiveHook struct {
+	Transfer string `json:"transfer"`
+	Inbox    string `json:"inbox,omitempty"`
+	Sender   string `json:"sender"`
+	File     string `json:"file"`
+	// Paths are where the upload ended up, a directory or the files of a
+	// batch, absent in ephemeral mode
+	Paths []string `json:"paths,omitempty"`
+	Size  int64    `json:"size"`
+	Hash  string   `json:"hash,omitempty"`
+}
+
+// hookCommand returns the shell command running the --on-receive template
+// for the path. {path} is replaced with a reference to FTR_PATH rather than
+// the path itself, so no file name a sender picks is ever parsed by the
+// shell.
+func hookCommand(template, path string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/c", strings.ReplaceAll(template, "{path}", `"%FTR_PATH%"`))
+	} else {
+		cmd = exec.Command("sh", "-c", strings.ReplaceAll(template, "{path}", `"$FTR_PATH"`))
+	}
+	cmd.Env = append(os.Environ(), "FTR_PATH="+path)
+	return cmd
+}
+
+// runReceiveHooks runs the --on-receive command for every path of a received
+// upload and posts it to the --webhook, one after the other and without
+// holding up the upload. Failures are logged.
+func runReceiveHooks(opts receiverOptions, hook receiveHook) {
+	if opts.onReceive == "" && opts.webhook == "" {
+		return
+	}
+	go func() {
+		if opts.onReceive != "" {
+			for _, p := range hook.Paths {
+				cmd := hookCommand(opts.onReceive, p)
+				cmd.Env = append(cmd.Env,
+					"FTR_SENDER="+hook.Sender,
+					"FTR_FILE_NAME="+hook.File,
+					"FTR_SIZE="+strconv.FormatInt(hook.Size, 10),
+					"FTR_HASH="+hook.Hash,
+					"FTR_TRANSFER="+hook.Transfer,
+				)
+				cmd.Stdout = os.Stderr
+				cmd.Stderr = os.Stderr
+				if err := cmd.Run(); err != nil {
+					logger.Warn("The --on-receive command failed", "transfer", hook.Transfer, "path", p, "error", err)
+				}
+			}
+		}
+		if opts.webhook != "" {
+			if err := postWebhook(opts.webhook, hook); err != nil {
+				logger.Warn("Failed to post the received file to the webhook", "transfer", hook.Transfer, "url", opts.webhook, "error", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+const (
+	identityMagic      = "FTRID1"
+	identitySaltSize   = 16
+	identityIterations = 600000
+	passphraseEnv      = "FTR_PASSPHRASE"
+)
+
+// identityFiles are the files of the state dir that make up the identity of
+// a node, as opposed to local records such as the history.
+var identityFiles = []string{configFileName, nodeKeyFileName, tlsCertFileName, tlsKeyFileName, knownPeersFileName, pairedPeersFileName}
+
+// sealIdentity encrypts the bundle with AES-256-GCM under a key derived from
+// the passphrase. The output is the magic, the salt, the nonce and the
+// ciphertext.
+func sealIdentity(bundle []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, identitySaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := identityCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte(identityMagic), salt...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, bundle, []byte(identityMagic)), nil
+}
+
+func openIdentity(data []byte, passphrase string) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(identityMagic)) {
+		return nil, errors.New("not an ftr identity file")
+	}
+	data = data[len(identityMagic):]
+	if len(data) < identitySaltSize {
+		return nil, errors.New("truncated identity file")
+	}
+	salt, data := data[:identitySaltSize], data[identitySaltSize:]
+	gcm, err := identityCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("truncated identity file")
+	}
+	nonce, data := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	bundle, err := gcm.Open(nil, nonce, data, []byte(identityMagic))
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted identity file")
+	}
+	return bundle, nil
+}
+
+func identityCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, identityIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// bundleIdentity tars the identity files present in dir.
+func bundleIdentity(dir string) ([]byte, []string, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	var names []string
+	for _, name := range identityFiles {
+		src := filepath.Join(dir, name)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := addFileToTar(tw, src, name); err != nil {
+			return nil, nil, err
+		}
+		names = append(names, name)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), names, nil
+}
+
+// unbundleIdentity writes the identity files of the bundle into dir. Unless
+// force is set, existing files are left alone and the import fails.
+func unbundleIdentity(bundle []byte, dir string, force bool) ([]string, error) {
+	tr := tar.NewReader(bytes.NewReader(bundle))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return names, err
+		}
+		if header.Typeflag != tar.TypeReg || !slices.Contains(identityFiles, header.Name) {
+			return names, fmt.Errorf("unexpected entry %s in the identity file", header.Name)
+		}
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if !force {
+			flags |= os.O_EXCL
+		}
+		dst := filepath.Join(dir, header.Name)
+		f, err := os.OpenFile(dst, flags, 0600)
+		if err != nil {
+			return names, err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return names, err
+		}
+		if err := f.Close(); err != nil {
+			return names, err
+		}
+		names = append(names, header.Name)
+	}
+}
+
+// identityPassphrase reads the passphrase from $FTR_PASSPHRASE or the
+// terminal, without echoing it. With confirm it's typed twice, so a typo
+// doesn't seal the identity with a passphrase nobody knows.
+func identityPassphrase(confirm bool) string {
+	if p := os.Getenv(passphraseEnv); p != "" {
+		return p
+	}
+	p, tty, err := readPassword("Passphrase: ")
+	if err != nil {
+		exitWithError(1, "Failed to read the passphrase: %v", err)
+	}
+	if p == "" {
+		exitWithError(1, "The passphrase must not be empty")
+	}
+	if confirm && tty {
+		again, _, err := readPassword("Repeat the passphrase: ")
+		if err != nil {
+			exitWithError(1, "Failed to read the passphrase: %v", err)
+		}
+		if again != p {
+			exitWithError(1, "The passphrases don't match")
+		}
+	}
+	return p
+}
+
+func runIdentity(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: ftr identity export|import [flags] <file>")
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "export":
+		runIdentityExport(args[1:])
+	case "import":
+		runIdentityImport(args[1:])
+	default:
+		exitWithError(1, "Unrecognized identity subcommand: %s", args[0])
+	}
+}
+
+func runIdentityExport(args []string) {
+	exportCmd := flag.NewFlagSet("identity export", flag.ExitOnError)
+	exportCmd.SetOutput(os.Stdout)
+	debug := exportCmd.Bool("debug", false, "enable debug log")
+	if err := exportCmd.Parse(args); err != nil {
+		exitWithError(1, "Identity export command failed: %v", err)
+	}
+	debugMode = *debug
+	if exportCmd.NArg() != 1 {
+		fmt.Println("Usage: ftr identity export <file>")
+		os.Exit(1)
+	}
+
+	dir, err := stateDir()
+	if err != nil {
+		exitWithError(1, "Failed to get the state dir: %v", err)
+	}
+	bundle, names, err := bundleIdentity(dir)
+	if err != nil {
+		exitWithError(1, "Failed to bundle the identity: %v", err)
+	}
+	if len(names) == 0 {
+		exitWithError(1, "Nothing to export in %s", dir)
+	}
+	sealed, err := sealIdentity(bundle, identityPassphrase(true))
+	if err != nil {
+		exitWithError(1, "Failed to encrypt the identity: %v", err)
+	}
+	if err := os.WriteFile(exportCmd.Arg(0), sealed, 0600); err != nil {
+		exitWithError(1, "Failed to write the identity file: %v", err)
+	}
+	fmt.Printf("Exported %v to %s\n", names, exportCmd.Arg(0))
+}
+
+func runIdentityImport(args []string) {
+	importCmd := flag.NewFlagSet("identity import", flag.ExitOnError)
+	importCmd.SetOutput(os.Stdout)
+	debug := importCmd.Bool("debug", false, "enable debug log")
+	force := importCmd.Bool("force", false, "overwrite the existing identity files")
+	if err := importCmd.Parse(args); err != nil {
+		exitWithError(1, "Identity import command failed: %v", err)
+	}
+	debugMode = *debug
+	if importCmd.NArg() != 1 {
+		fmt.Println("Usage: ftr identity import [--force] <file>")
+		os.Exit(1)
+	}
+
+	sealed, err := os.ReadFile(importCmd.Arg(0))
+	if err != nil {
+		exitWithError(1, "Failed to read the identity file: %v", err)
+	}
+	bundle, err := openIdentity(sealed, identityPassphrase(false))
+	if err != nil {
+		exitWithError(1, "Failed to decrypt the identity: %v", err)
+	}
+	dir, err := stateDir()
+	if err != nil {
+		exitWithError(1, "Failed to get the state dir: %v", err)
+	}
+	names, err := unbundleIdentity(bundle, dir, *force)
+	if errors.Is(err, os.ErrExist) {
+		exitWithError(1, "The identity already exists in %s, use --force to overwrite it", dir)
+	}
+	if err != nil {
+		exitWithError(1, "Failed to import the identity: %v", err)
+	}
+	fmt.Printf("Imported %v into %s\n", names, dir)
+}
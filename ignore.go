@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreFile lists the paths a directory send leaves out of the archive, in
+// gitignore syntax, relative to the dir it's in.
+const ignoreFile = ".ftrignore"
+
+// excludePatterns are the --exclude patterns, in gitignore syntax relative to
+// the directory sent.
+var excludePatterns []string
+
+// patternList is a flag taking several patterns, repeated or comma separated.
+type patternList []string
+
+func (l *patternList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *patternList) Set(s string) error {
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			*l = append(*l, p)
+		}
+	}
+	return nil
+}
+
+// ignoreRule is a line of an ignore file.
+type ignoreRule struct {
+	// base is the archive path of the dir the rule applies below, empty for
+	// the top-level one
+	base    string
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreRules decides which paths of a directory are left out of its archive:
+// the --exclude patterns and the rules of the .ftrignore files found on the
+// way. A nil ignoreRules leaves nothing out.
+type ignoreRules struct {
+	excludes []ignoreRule
+	rules    []ignoreRule
+}
+
+func newIgnoreRules(excludes []string) *ignoreRules {
+	r := &ignoreRules{}
+	for _, p := range excludes {
+		if rule, ok := parseIgnoreRule("", p); ok {
+			r.excludes = append(r.excludes, rule)
+		}
+	}
+	return r
+}
+
+// load reads the .ftrignore of the directory at dir, whose archive path is
+// base, if it has one.
+func (r *ignoreRules) load(dir, base string) error {
+	if r == nil {
+		return nil
+	}
+	f, err := os.Open(longPath(filepath.Join(dir, ignoreFile)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	debugLog("Reading the ignore rules of %s", dir)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(base, scanner.Text()); ok {
+			r.rules = append(r.rules, rule)
+		}
+	}
+	return scanner.Err()
+}
+
+// ignored reports whether the entry at the archive path name is left out. An
+// --exclude always wins, otherwise the last matching rule decides, a negated
+// one taking the entry back in.
+func (r *ignoreRules) ignored(name string, isDir bool) bool {
+	if r == nil {
+		return false
+	}
+	for _, rule := range r.excludes {
+		if rule.matches(name, isDir) {
+			return true
+		}
+	}
+	ignored := false
+	for _, rule := range r.rules {
+		if rule.matches(name, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+func (rule ignoreRule) matches(name string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	rel := name
+	if rule.base != "" {
+		var ok bool
+		if rel, ok = strings.CutPrefix(name, rule.base+"/"); !ok {
+			return false
+		}
+	}
+	return rule.re.MatchString(rel)
+}
+
+// parseIgnoreRule parses a line of gitignore syntax found in the dir at the
+// archive path base. It reports false for blank lines and comments.
+func parseIgnoreRule(base, line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || line[0] == '#' {
+		return ignoreRule{}, false
+	}
+	rule := ignoreRule{base: base}
+	if line[0] == '!' {
+		rule.negate = true
+		line = line[1:]
+	} else if line[0] == '\\' && len(line) > 1 && (line[1] == '#' || line[1] == '!') {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	// a pattern with a slash is anchored to the dir of the ignore file,
+	// otherwise it matches names at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	expr := globRegexp(line)
+	if !anchored {
+		expr = "(.*/)?" + expr
+	}
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		debugLog("Ignoring the invalid ignore pattern %q: %v", line, err)
+		return ignoreRule{}, false
+	}
+	rule.re = re
+	return rule, true
+}
+
+// globRegexp translates a gitignore glob into a regular expression: * and ?
+// don't match slashes, ** matches any number of dirs.
+func globRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
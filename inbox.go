@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const inboxSectionPrefix = "inbox"
+
+var inboxNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func inboxPath(name string) string {
+	return "/upload/" + name
+}
+
+// loadInboxes builds the options of every `[inbox.<name>]` section in the
+// config. Inboxes start from the options of the default inbox, sharing its
+// port, history ledger, pairings, lockout, access list, audit log and
+// request policy, and have their own key, drop dir and policies:
+//
+//	[inbox.work]
+//	key = secret
+//	dropdir = /home/me/work-inbox
+//	quota = 10GB
+//	max-size = 1GB
+//	on-conflict = rename
+//
+// Guest codes and request links only ever fill the default inbox.
+func loadInboxes(cfg *config, defaults receiverOptions) ([]receiverOptions, error) {
+	var inboxes []receiverOptions
+	for _, name := range cfg.subsections(inboxSectionPrefix) {
+		if !inboxNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid inbox name %q", name)
+		}
+		sec := cfg.section(inboxSectionPrefix + "." + name)
+		inbox := defaults
+		inbox.name = name
+		inbox.passKey = sec["key"]
+		inbox.dropDir = sec["dropdir"]
+		inbox.quota, inbox.quotaDir = 0, ""
+		inbox.inboxes = nil
+		inbox.guests, inbox.links = nil, nil
+		if inbox.passKey == "" {
+			return nil, fmt.Errorf("inbox %s: key is required", name)
+		}
+		if inbox.dropDir == "" {
+			return nil, fmt.Errorf("inbox %s: dropdir is required", name)
+		}
+		var err error
+		if v, ok := sec["on-conflict"]; ok {
+			if inbox.onConflict, err = parseConflictPolicy(v); err != nil {
+				return nil, fmt.Errorf("inbox %s: %v", name, err)
+			}
+		}
+		if v, ok := sec["quota"]; ok {
+			if inbox.quota, err = parseSize(v); err != nil {
+				return nil, fmt.Errorf("inbox %s: %v", name, err)
+			}
+		}
+		if v, ok := sec["max-size"]; ok {
+			if inbox.maxSize, err = parseSize(v); err != nil {
+				return nil, fmt.Errorf("inbox %s: %v", name, err)
+			}
+		}
+		inboxes = append(inboxes, inbox)
+	}
+	return inboxes, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// sha256Header carries the SHA-256 of the file the sender computed, which
+// the receiver checks the payload against before keeping it.
+const sha256Header = "X-Ftr-Sha256"
+
+// checkHash reports whether the payload hashed to the hash the sender
+// announced, if any, and logs a mismatch.
+func checkHash(u upload, hash string) error {
+	if u.hash == "" || strings.EqualFold(u.hash, hash) {
+		return nil
+	}
+	logger.Warn("Rejected an upload corrupted in transit", "peer", u.sender, "file", u.name, "sha256", hash, "expected", u.hash)
+	return newUploadError(http.StatusUnprocessableEntity, "Checksum mismatch")
+}
+
+// retryableStatus reports whether an upload refused with the status is worth
+// another attempt: the receiver failed, or the payload was corrupted on the
+// way. A full quota isn't going to empty itself.
+func retryableStatus(code int) bool {
+	if code == http.StatusInsufficientStorage {
+		return false
+	}
+	return code >= http.StatusInternalServerError || code == http.StatusUnprocessableEntity
+}
+
+// statusError describes an upload refused with the status.
+func statusError(code int, status string) error {
+	if code == http.StatusUnprocessableEntity {
+		return fmt.Errorf("the file arrived corrupted, the peer computed another SHA-256 (%s)", status)
+	}
+	return fmt.Errorf("failed to send the file, server returned status: %s", status)
+}
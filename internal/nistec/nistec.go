@@ -0,0 +1,12 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nistec implements the P-256 prime order group with constant time
+// field arithmetic from fiat-crypto.
+//
+// It is the portable implementation of crypto/internal/fips140/nistec from Go
+// 1.27, as republished by filippo.io/nistec, trimmed to P-256 and to the
+// operations SPAKE2 needs. Unlike crypto/elliptic it works on opaque points
+// and never goes through math/big.
+package nistec
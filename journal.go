@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// journalDir holds the journals of the extractions in progress in a drop dir.
+// A journal left behind is an extraction a crash interrupted.
+const journalDir = ".ftr-journal"
+
+// journalRecord is a line of an extraction journal. The first one names the
+// upload; every entry then gets one before its file is created and another,
+// with Done set, once the file is complete and synced to disk.
+type journalRecord struct {
+	Upload string `json:"upload,omitempty"`
+	Entry  string `json:"entry,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+// extractJournal records the steps of an extraction so that after a crash
+// the receiver knows which entries are complete. A nil journal records
+// nothing.
+type extractJournal struct {
+	file *os.File
+}
+
+// openExtractJournal starts the journal of extracting the upload into the
+// drop dir.
+func openExtractJournal(dropDir, upload string) (*extractJournal, error) {
+	dir := filepath.Join(dropDir, journalDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(dir, newTransferID()+".jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	j := &extractJournal{file: f}
+	if err := j.append(journalRecord{Upload: upload}); err != nil {
+		j.close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// append writes the record and syncs it, so it's on disk before the step it
+// announces happens.
+func (j *extractJournal) append(rec journalRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// begin records that the file of the entry is about to be written.
+func (j *extractJournal) begin(entry, path string) error {
+	if j == nil {
+		return nil
+	}
+	return j.append(journalRecord{Entry: entry, Path: path})
+}
+
+// complete syncs the file of the entry and records it as complete.
+func (j *extractJournal) complete(entry string, f *os.File, n int64) error {
+	if j == nil {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return j.append(journalRecord{Entry: entry, Path: f.Name(), Bytes: n, Done: true})
+}
+
+// close ends the journal of an extraction that finished, successfully or
+// not; either way the caller has dealt with its files.
+func (j *extractJournal) close() {
+	if j == nil {
+		return
+	}
+	j.file.Close()
+	os.Remove(j.file.Name())
+}
+
+// recoverExtractions goes through the journals interrupted extractions left
+// in the drop dir. Entries recorded as complete, and still of their recorded
+// size, are kept; the files of the others are partial and removed.
+func recoverExtractions(dropDir string) error {
+	journals, err := filepath.Glob(filepath.Join(dropDir, journalDir, "*.jsonl"))
+	if err != nil {
+		return err
+	}
+	for _, journal := range journals {
+		upload, kept, removed, err := recoverExtraction(journal)
+		if err != nil {
+			return fmt.Errorf("failed to recover %s: %v", journal, err)
+		}
+		fmt.Fprintf(infoOut, "Recovered the interrupted extraction of %s: kept %d complete files, removed %d partial ones\n", upload, kept, removed)
+		if err := os.Remove(journal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func recoverExtraction(journal string) (upload string, kept, removed int, err error) {
+	f, err := os.Open(journal)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer f.Close()
+
+	// begun maps the path of every entry to whether it completed
+	begun := map[string]bool{}
+	var order []string
+	sizes := map[string]int64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec journalRecord
+		// the last line may be torn by the crash
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		switch {
+		case rec.Upload != "":
+			upload = rec.Upload
+		case rec.Path == "":
+		case rec.Done:
+			begun[rec.Path] = true
+			sizes[rec.Path] = rec.Bytes
+		default:
+			if _, ok := begun[rec.Path]; !ok {
+				order = append(order, rec.Path)
+			}
+			begun[rec.Path] = false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", 0, 0, err
+	}
+	for _, p := range order {
+		if begun[p] {
+			if fi, err := os.Stat(p); err == nil && fi.Size() == sizes[p] {
+				kept++
+				continue
+			}
+		}
+		debugLog("Removing the partial file %s", p)
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return "", 0, 0, err
+		}
+		removed++
+	}
+	return upload, kept, removed, nil
+}
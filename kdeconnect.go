@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	kdeConnectPeer         = "kdeconnect"
+	kdeConnectPollInterval = 2 * time.Second
+	// KDE Connect writes incoming files with this suffix until complete
+	kdeConnectPartSuffix = ".part"
+)
+
+// bridgeKDEConnect feeds the files that KDE Connect (or GSConnect) receives
+// to the receiver, so phones already paired with the desktop can push files
+// into the drop dir. Point KDE Connect's "save files in" setting at dir.
+// They go through the same checks, limits and hooks as any upload, and are
+// removed from dir once received.
+func bridgeKDEConnect(dir string, opts receiverOptions) {
+	fmt.Fprintf(infoOut, "Bridging files received by KDE Connect in %s\n", dir)
+	// a file is taken once its size is unchanged across two polls
+	sizes := map[string]int64{}
+	// refused are the files the receiver refused, by the size they had,
+	// left alone until they change
+	refused := map[string]int64{}
+	for {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			debugLog("Failed to read the KDE Connect dir %s: %v", dir, err)
+		}
+		seen := map[string]bool{}
+		for _, e := range entries {
+			name := e.Name()
+			if !e.Type().IsRegular() || strings.HasSuffix(name, kdeConnectPartSuffix) || strings.HasPrefix(name, ".") {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			seen[name] = true
+			if size, ok := refused[name]; ok && size == info.Size() {
+				continue
+			}
+			delete(refused, name)
+			if prev, ok := sizes[name]; !ok || prev != info.Size() {
+				sizes[name] = info.Size()
+				continue
+			}
+			delete(sizes, name)
+			err = receiveKDEConnectFile(filepath.Join(dir, name), info.Size(), opts)
+			// a paused or closing receiver takes it on a later poll
+			if err != nil && uploadStatus(err) != http.StatusServiceUnavailable {
+				refused[name] = info.Size()
+			}
+		}
+		for name := range sizes {
+			if !seen[name] {
+				delete(sizes, name)
+			}
+		}
+		for name := range refused {
+			if !seen[name] {
+				delete(refused, name)
+			}
+		}
+		time.Sleep(kdeConnectPollInterval)
+	}
+}
+
+// receiveKDEConnectFile receives the file at src as an upload from KDE
+// Connect, removing it once it's in the drop dir.
+func receiveKDEConnectFile(src string, size int64, opts receiverOptions) error {
+	f, err := os.Open(src)
+	if err != nil {
+		debugLog("Failed to open %s: %v", src, err)
+		return err
+	}
+	defer f.Close()
+	_, err = receiveUpload(opts, upload{
+		name:     filepath.Base(src),
+		fileType: fileTypeFile,
+		size:     size,
+		sender:   kdeConnectPeer,
+		body:     f,
+		extract:  true,
+		// KDE Connect accepted it from a paired device already
+		approved: true,
+		meta:     statMeta(src),
+	})
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := os.Remove(src); err != nil {
+		debugLog("Failed to remove %s: %v", src, err)
+	}
+	fmt.Fprintf(infoOut, "Received %s from KDE Connect\n", filepath.Base(src))
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// kioskProfile is the builtin profile of join for a shared drop box, e.g.
+// in a common room: anyone knowing the key may drop plainly named, small
+// files, which are quarantined, and nothing can be taken out or changed.
+const kioskProfile = "kiosk"
+
+// builtinProfiles are the profiles of each command used when the config has
+// no `[profile.<name>]` section of the name, as flag values.
+var builtinProfiles = map[string]map[string]map[string]string{
+	"join": {
+		kioskProfile: {
+			"confirm":            "false",
+			"quarantine":         "true",
+			"strict-names":       "true",
+			"reject-executables": "true",
+			"max-size":           "100MB",
+			"drop-only":          "true",
+			"on-conflict":        conflictRename,
+			"request-policy":     policyDeny,
+		},
+	},
+}
+
+const maxStrictNameLength = 128
+
+var strictNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 ._()+-]*$`)
+
+// reservedNames are the device names Windows won't open as files, whatever
+// their extension.
+var reservedNames = []string{
+	"con", "prn", "aux", "nul",
+	"com1", "com2", "com3", "com4", "com5", "com6", "com7", "com8", "com9",
+	"lpt1", "lpt2", "lpt3", "lpt4", "lpt5", "lpt6", "lpt7", "lpt8", "lpt9",
+}
+
+var executableExts = []string{
+	".apk", ".app", ".bat", ".cmd", ".com", ".deb", ".dmg", ".exe", ".jar",
+	".lnk", ".msi", ".pkg", ".ps1", ".rpm", ".scr", ".sh", ".vbs",
+}
+
+// executableMagic are the first bytes of PE, ELF and Mach-O binaries and of
+// scripts.
+var executableMagic = [][]byte{
+	[]byte("MZ"),
+	[]byte("\x7fELF"),
+	{0xfe, 0xed, 0xfa, 0xce},
+	{0xfe, 0xed, 0xfa, 0xcf},
+	{0xce, 0xfa, 0xed, 0xfe},
+	{0xcf, 0xfa, 0xed, 0xfe},
+	{0xca, 0xfe, 0xba, 0xbe},
+	[]byte("#!"),
+}
+
+// strictName reports whether the name is plain enough to drop on a shared
+// box: short, in a safe charset, not hidden and not a device name.
+func strictName(name string) bool {
+	if len(name) > maxStrictNameLength || !strictNamePattern.MatchString(name) || strings.HasSuffix(name, ".") {
+		return false
+	}
+	base, _, _ := strings.Cut(strings.ToLower(name), ".")
+	return !slices.Contains(reservedNames, strings.TrimSpace(base))
+}
+
+func executableName(name string) bool {
+	return slices.Contains(executableExts, strings.ToLower(filepath.Ext(name)))
+}
+
+// screenUpload enforces the name and content policies of the inbox on the
+// upload, returning the body to read it from.
+func screenUpload(opts receiverOptions, u upload, fileName string) (io.Reader, error) {
+	if opts.strictNames {
+		if u.fileType == fileTypeDir || u.fileType == fileTypeBatch {
+			return nil, newUploadError(http.StatusForbidden, "Only single files are accepted")
+		}
+		if !strictName(fileName) {
+			return nil, newUploadError(http.StatusBadRequest, "File name not allowed, use letters, digits, spaces and ._()+- only")
+		}
+	}
+	if !opts.rejectExecutables || u.fileType == fileTypeDir || u.fileType == fileTypeBatch {
+		return u.body, nil
+	}
+	if executableName(fileName) {
+		return nil, newUploadError(http.StatusUnsupportedMediaType, "Executable files are not accepted")
+	}
+	// renaming an executable doesn't get it past its first bytes
+	br := bufio.NewReader(u.body)
+	head, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, newUploadError(http.StatusBadRequest, "Failed to read the file on server")
+	}
+	for _, magic := range executableMagic {
+		if bytes.HasPrefix(head, magic) {
+			return nil, newUploadError(http.StatusUnsupportedMediaType, "Executable files are not accepted")
+		}
+	}
+	return br, nil
+}
+
+// dropOnlyPaths are the endpoints to list, pull or manage what was received
+// and the receiver itself, which a drop-only receiver doesn't serve.
+var dropOnlyPaths = []string{
+	"/transfers", historyPath, "/request", getPath, listPath, guestCodesPath, requestLinksPath, requestLinkPrefix, dashboardPath,
+	portalPath, manifestPath, syncPath, eventsPath,
+}
+
+// dropOnlyMiddleware answers 404 on the dropOnlyPaths, leaving only the
+// upload endpoints.
+func dropOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, p := range dropOnlyPaths {
+			prefix := strings.TrimSuffix(p, "/")
+			if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
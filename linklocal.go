@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+)
+
+// linkScoped reports whether the address never leaves the link: loopback,
+// IPv4 and IPv6 link-local and IPv6 unique local (fc00::/7) addresses.
+func linkScoped(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	return ip.To4() == nil && len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
+
+// linkScopedNets returns the link-scoped addresses of the interfaces that are
+// up, with their prefixes.
+func linkScopedNets() []*net.IPNet {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		debugLog("Failed to list the network interfaces: %v", err)
+		return nil
+	}
+	var nets []*net.IPNet
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && linkScoped(n.IP) {
+				nets = append(nets, n)
+			}
+		}
+	}
+	return nets
+}
+
+// linkScopedIPs returns the link-scoped addresses to advertise, leaving out
+// loopback ones.
+func linkScopedIPs() []string {
+	var ips []string
+	for _, n := range linkScopedNets() {
+		if !n.IP.IsLoopback() {
+			ips = append(ips, n.IP.String())
+		}
+	}
+	return ips
+}
+
+// onLink reports whether the peer at addr reached the receiver without going
+// through a gateway: from a link-local or loopback address, or from a unique
+// local one in the prefix of one of the receiver's.
+func onLink(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	if !linkScoped(ip) {
+		return false
+	}
+	for _, n := range linkScopedNets() {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// linkLocalListener drops the connections of peers that aren't on the link,
+// for join --link-local.
+type linkLocalListener struct {
+	net.Listener
+}
+
+func (l linkLocalListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if onLink(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		debugLog("Refusing the connection of %s, it isn't on the link", conn.RemoteAddr())
+		conn.Close()
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The --links modes of send, for the symlinks in the directories it archives.
+const (
+	// linksSkip leaves symlinks out with a warning
+	linksSkip = "skip"
+	// linksPreserve archives the links themselves
+	linksPreserve = "preserve"
+	// linksFollow archives what the links point to in their place
+	linksFollow = "follow"
+)
+
+// linkMode is how archives of directories treat symlinks, set by --links.
+var linkMode = linksSkip
+
+// applyLinkMode sets how archives treat symlinks, the default for an empty
+// mode.
+func applyLinkMode(mode string) error {
+	switch mode {
+	case "":
+	case linksSkip, linksPreserve, linksFollow:
+		linkMode = mode
+	default:
+		return fmt.Errorf("unsupported mode %s, use skip, preserve or follow", mode)
+	}
+	return nil
+}
+
+// addSymlink adds the symlink at path to the tarball as name, as the link
+// mode says. walking holds the real paths of the directories being archived,
+// a link to one of them or to one of their parents being skipped rather than
+// followed forever, and ignore applies to what a followed one holds.
+func addSymlink(tw *tar.Writer, path, name string, walking []string, ignore *ignoreRules) error {
+	switch linkMode {
+	case linksPreserve:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		debugLog("Adding symlink %s -> %s to the tarball", path, target)
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeSymlink,
+			Name:     name,
+			Linkname: filepath.ToSlash(target),
+			Mode:     0777,
+		})
+	case linksFollow:
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping the symlink %s, its target can't be read: %v\n", path, err)
+			return nil
+		}
+		if !info.IsDir() {
+			debugLog("Adding the target of symlink %s to the tarball", path)
+			return addRegularFile(tw, path, name, info)
+		}
+		real, err := realPath(path)
+		if err != nil {
+			return err
+		}
+		for _, dir := range walking {
+			if dir == real || strings.HasPrefix(dir, real+string(filepath.Separator)) {
+				fmt.Fprintf(os.Stderr, "Skipping the symlink %s, following it would loop\n", path)
+				return nil
+			}
+		}
+		debugLog("Following symlink %s to the directory %s", path, real)
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if err := addDir(tw, header); err != nil {
+			return err
+		}
+		return addTree(tw, real, name, append(walking, real), ignore)
+	default:
+		fmt.Fprintf(os.Stderr, "Skipping the symlink %s, send with --links preserve or follow to include it\n", path)
+		return nil
+	}
+}
+
+// realPath returns the absolute path of p with every symlink resolved.
+func realPath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// addRegularFile adds the file at path to the tarball as name.
+func addRegularFile(tw *tar.Writer, path, name string, info os.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Typeflag = tar.TypeReg
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// throughSymlink rejects tar entries whose parent directories in dst are
+// symlinks, which could take the entry, or the target of a link it
+// creates, outside of dst.
+func throughSymlink(dst, name string) error {
+	dir := dst
+	elems := strings.Split(path.Dir(name), "/")
+	for _, elem := range elems {
+		if elem == "." {
+			continue
+		}
+		dir = filepath.Join(dir, elem)
+		fi, err := os.Lstat(longPath(dir))
+		if err != nil {
+			return nil
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("unsafe tar entry %q goes through a symlink", name)
+		}
+	}
+	return nil
+}
+
+// safeLinkTarget returns the target of the symlink entry, cleaned, or an
+// error if it's absolute or points outside of the dir the archive is
+// extracted into.
+func safeLinkTarget(name, target string) (string, error) {
+	target = path.Clean(entryName(target))
+	if path.IsAbs(target) || filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return "", fmt.Errorf("the symlink %q points to the absolute path %q", name, target)
+	}
+	resolved := path.Join(path.Dir(name), target)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return "", fmt.Errorf("the symlink %q points outside of the archive to %q", name, target)
+	}
+	return target, nil
+}
+
+// extractSymlink creates the symlink entry at linkPath, handling an existing
+// file there with the conflict policy, and returns where it created it. An
+// unsafe target is skipped with a warning rather than failing the whole
+// extraction, leaving the path empty like a skipped conflict.
+func extractSymlink(header *tar.Header, linkPath, onConflict string) (string, error) {
+	target, err := safeLinkTarget(header.Name, header.Linkname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Skipping a tar entry: %v\n", err)
+		return "", nil
+	}
+	if err := os.MkdirAll(filepath.Dir(linkPath), 0755); err != nil {
+		return "", err
+	}
+	if fi, err := os.Lstat(linkPath); err == nil {
+		switch {
+		case onConflict == conflictSkip:
+			debugLog("Skipping the tar entry %s, the file already exists", header.Name)
+			return "", nil
+		case onConflict == conflictRename:
+			linkPath = filepath.Join(filepath.Dir(linkPath), freeName(filepath.Dir(linkPath), filepath.Base(linkPath)))
+		case onConflict == conflictOverwrite && !fi.IsDir():
+			if err := os.Remove(linkPath); err != nil {
+				return "", err
+			}
+		}
+	}
+	debugLog("Creating symlink %s -> %s for the tar entry", header.Name, target)
+	if err := os.Symlink(filepath.FromSlash(target), linkPath); err != nil {
+		return "", err
+	}
+	return linkPath, nil
+}
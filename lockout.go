@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// authFreeFailures are the wrong passkeys an address may send before it's
+	// locked out
+	authFreeFailures = 5
+	// authBaseLockout is the first lockout, doubling with every further
+	// failure up to authMaxLockout
+	authBaseLockout = time.Second
+	authMaxLockout  = 15 * time.Minute
+	// authFailureTTL is how long the failures of an address are remembered
+	// after the last one
+	authFailureTTL = time.Hour
+	// authMaxAddrs bounds the addresses tracked before the stale ones are
+	// dropped
+	authMaxAddrs = 1024
+)
+
+// keyMatches compares a passkey in constant time, so the time taken tells
+// nothing about how much of it was right.
+func keyMatches(given, key string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1
+}
+
+type authFailures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// authGuard counts the wrong passkeys per address and locks an address out
+// for exponentially longer once it sent too many, so a short key can't be
+// guessed. A nil guard never locks anyone out.
+type authGuard struct {
+	mu    sync.Mutex
+	addrs map[string]*authFailures
+}
+
+func newAuthGuard() *authGuard {
+	return &authGuard{addrs: map[string]*authFailures{}}
+}
+
+// lockedOut returns how long the address is still locked out for, if it is.
+func (g *authGuard) lockedOut(addr string) (time.Duration, bool) {
+	if g == nil {
+		return 0, false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.addrs[remoteHost(addr)]
+	if !ok {
+		return 0, false
+	}
+	left := time.Until(f.until)
+	return left, left > 0
+}
+
+// fail records a wrong passkey from the sender at addr and logs it.
+func (g *authGuard) fail(addr, sender string) {
+	if g == nil {
+		return
+	}
+	host := remoteHost(addr)
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.addrs[host]
+	if !ok || now.Sub(f.last) > authFailureTTL {
+		if len(g.addrs) >= authMaxAddrs {
+			g.prune(now)
+		}
+		f = &authFailures{}
+		g.addrs[host] = f
+	}
+	f.count++
+	f.last = now
+	if f.count <= authFreeFailures {
+		logger.Warn("Wrong passkey", "address", host, "peer", sender, "failures", f.count)
+		return
+	}
+	lockout := authMaxLockout
+	if shift := f.count - authFreeFailures - 1; shift < 20 {
+		lockout = min(authBaseLockout<<shift, authMaxLockout)
+	}
+	f.until = now.Add(lockout)
+	logger.Warn("Wrong passkey, locking the address out", "address", host, "peer", sender, "failures", f.count, "lockout", lockout)
+}
+
+// succeed forgets the failures of the address once it got the key right.
+func (g *authGuard) succeed(addr string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.addrs, remoteHost(addr))
+}
+
+func (g *authGuard) prune(now time.Time) {
+	for host, f := range g.addrs {
+		if now.Sub(f.last) > authFailureTTL {
+			delete(g.addrs, host)
+		}
+	}
+}
+
+// knownKey reports whether the key is the one of the default inbox or
+// another inbox.
+func (o receiverOptions) knownKey(key string) bool {
+	if keyMatches(key, o.key()) {
+		return true
+	}
+	for _, inbox := range o.inboxes {
+		if keyMatches(key, inbox.key()) {
+			return true
+		}
+	}
+	return false
+}
+
+// guardMiddleware answers 429 to locked out addresses before any endpoint
+// sees their request, and counts the requests presenting a wrong passkey or
+// PAKE MAC that were answered 401 as failures.
+func guardMiddleware(opts receiverOptions, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if left, ok := opts.guard.lockedOut(r.RemoteAddr); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(left.Seconds())+1))
+			http.Error(w, "Too many wrong passkeys, try again later", http.StatusTooManyRequests)
+			opts.audit.auditRequest(r, authLockedOut, http.StatusTooManyRequests)
+			return
+		}
+		key := requestKey(r)
+		if key == "" && r.Method == http.MethodPost && r.URL.Path == dashboardPath {
+			// the dashboard login posts the key in a form, parsed once
+			// and kept for the handler
+			key = r.PostFormValue("key")
+		}
+		// a PAKE upload proves the key with a MAC instead of sending it
+		attempt := key != "" || r.Header.Get(pakeConfirmHeader) != ""
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		switch {
+		case sw.status == http.StatusUnauthorized && attempt:
+			opts.guard.fail(r.RemoteAddr, senderName(r))
+			opts.audit.auditRequest(r, authRejected, sw.status)
+		case sw.status == http.StatusUnauthorized && r.Method != http.MethodGet:
+			// a browser asked for the dashboard login isn't an attempt
+			opts.audit.auditRequest(r, authRejected, sw.status)
+		case key != "" && opts.knownKey(key):
+			opts.guard.succeed(r.RemoteAddr)
+		}
+	})
+}
+
+// statusWriter remembers the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps the event stream working through the wrapper.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// logLevel is the least severe level logged: warnings for the commands
+// talking to the user, --log-level for the receiver. --debug logs
+// everything anyway.
+var logLevel = func() *slog.LevelVar {
+	l := new(slog.LevelVar)
+	l.Set(slog.LevelWarn)
+	return l
+}()
+
+// debugLeveler lowers the log level to debug with --debug, which every
+// command sets on its own.
+type debugLeveler struct{}
+
+func (debugLeveler) Level() slog.Level {
+	if debugMode {
+		return slog.LevelDebug
+	}
+	return logLevel.Level()
+}
+
+// logger is the structured log. Transfers are logged with the peer,
+// transfer, inbox, file and bytes fields.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: debugLeveler{}}))
+
+// setupLogging logs to w at the level and in the format, text or json, and
+// turns the lines printed to infoOut into info records too, so the output of
+// the receiver is parseable as a whole.
+func setupLogging(level, format string, w io.Writer) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unsupported log level %s, use debug, info, warn or error", level)
+	}
+	logLevel.Set(l)
+	if l <= slog.LevelDebug {
+		debugMode = true
+	}
+	opts := &slog.HandlerOptions{Level: debugLeveler{}}
+	switch format {
+	case "text":
+		logger = slog.New(slog.NewTextHandler(w, opts))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(w, opts))
+	default:
+		return fmt.Errorf("unsupported log format %s, use text or json", format)
+	}
+	infoOut = &logWriter{}
+	return nil
+}
+
+// logWriter logs every line written to it as an info record.
+type logWriter struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		logger.Info(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// logUpload logs the outcome of the upload of a job.
+func logUpload(job *transferJob, err error) {
+	attrs := []any{"peer", job.Sender, "transfer", job.ID, "inbox", job.Inbox, "file", job.File, "bytes", job.Bytes}
+	if err != nil {
+		logger.Warn("Failed to receive an upload", append(attrs, "error", err)...)
+		return
+	}
+	logger.Info("Received an upload", attrs...)
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// longPath returns p unchanged, only Windows limits the path length.
+func longPath(p string) string {
+	return p
+}
@@ -2,23 +2,23 @@ package main
 
 import (
 	"archive/tar"
-	"bytes"
-	"compress/gzip"
 	"context"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"math/big"
-	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/grandcat/zeroconf"
@@ -33,13 +33,22 @@ const (
 	letters                = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	passKeyHeader          = "X-Ftr-Passkey"
 	fileTypeHeader         = "X-Ftr-File-Type"
+	senderHeader           = "X-Ftr-Sender"
+	fileTypeFile           = "file"
+	fileTypeDir            = "dir"
+	fileTypeBatch          = "batch"
+	extractHeader          = "X-Ftr-Extract"
 )
 
 var debugMode bool
 
+// infoOut receives informational messages that are not part of a command's
+// primary output.
+var infoOut io.Writer = os.Stdout
+
 func debugLog(format string, v ...any) {
 	if debugMode {
-		log.Printf(format, v...)
+		logger.Debug(fmt.Sprintf(format, v...))
 	}
 }
 
@@ -59,11 +68,57 @@ func main() {
 	case "join":
 		runJoin()
 	case "list":
-		runList()
+		runList(args[2:])
+	case "service":
+		runService(args[2:])
+	case "whois":
+		runWhois(args[2:])
 	case "help":
 		runHelp()
 	case "send":
 		runSend(args[2:])
+	case "stats":
+		runStats(args[2:])
+	case "history":
+		runHistory(args[2:])
+	case "receive":
+		runReceive(args[2:])
+	case "request":
+		runRequest(args[2:])
+	case "get":
+		runGet(args[2:])
+	case "browse":
+		runBrowse(args[2:])
+	case "verify":
+		runVerify(args[2:])
+	case "identity":
+		runIdentity(args[2:])
+	case "guest-code":
+		runGuestCode(args[2:])
+	case "dict":
+		runDict(args[2:])
+	case "open":
+		runOpen(args[2:])
+	case "relay":
+		runRelay(args[2:])
+	case "diff":
+		runDiff(args[2:])
+	case "sync":
+		runSync(args[2:])
+	case "request-link":
+		runRequestLink(args[2:])
+	case "pair":
+		runPair(args[2:])
+	case "pack":
+		runPack(args[2:])
+	case "unpack":
+		runUnpack(args[2:])
+	case "paste":
+		runPaste(args[2:])
+	case "completion":
+		runCompletion(args[2:])
+	case "__complete":
+		runComplete(args[2:])
 	default:
 		exitWithError(1, "Unrecognized subcommand: %s", subCommand)
 	}
@@ -104,8 +159,36 @@ func runHelp() {
 	fmt.Println(
 		"Usage:\n",
 		"    Join the network: `ftr join --name <name> --port <port> --dropdir <path-to-dir> --key <key>`\n",
-		"    List all peers: `ftr list `\n",
-		"    Send file to peer: `ftr send --key <key> file peer`",
+		"    Run the receiver in the background: `ftr join --daemon --key <key>`\n",
+		"    Run a locked-down drop box: `ftr join --profile kiosk --key <key>`\n",
+		"    Start the receiver at login: `ftr service install --key <key> [join flags]` / `ftr service uninstall`\n",
+		"    List all peers: `ftr list [--json]`\n",
+		"    Send file to peer: `ftr send --key <key> file peer`\n",
+		"    Send file to a group from the config: `ftr send --key <key> file @group`\n",
+		"    Send stdin to peer: `ftr send --key <key> --name <name> - peer`\n",
+		"    Send the clipboard or stdin as a text snippet: `ftr paste --key <key> peer`\n",
+		"    Send file to a receiver by its address, without discovery: `ftr send --key <key> --to host:port file`\n",
+		"    Send file to several peers at once: `ftr send --key <key> --all|--peers a,b file`\n",
+		"    Show usage statistics: `ftr stats [--json]`\n",
+		"    Show past transfers: `ftr history [--peer <peer>] [--since <time>] [--until <time>] [--json]`\n",
+		"    Receive a file from stdin: `ftr receive --stdin --name <name>`\n",
+		"    Ask a peer for a shared file: `ftr request --key <key> peer path`\n",
+		"    Pull a file a peer offers: `ftr get --key <key> peer:name[/path]`\n",
+		"    List the files a peer offers: `ftr browse --key <key> peer[:dir]`\n",
+		"    Verify received files against the history: `ftr verify <path>... | --all`\n",
+		"    Show where a received file came from: `ftr whois <file>`\n",
+		"    Move the node identity to another machine: `ftr identity export|import <file>`\n",
+		"    Let a visitor upload once: `ftr guest-code --key <key> --ttl 15m`\n",
+		"    Train a compression dictionary: `ftr dict train <sample>...`\n",
+		"    Open the last received file: `ftr open [--print] [--from <peer>] [<pattern>]`\n",
+		"    Compare a dir with one on a peer: `ftr diff --key <key> localdir peer:remotedir`\n",
+		"    Relay for peers mDNS can't reach: `ftr relay --key <relay-key>`, then `--relay <host:port> --relay-key <relay-key>` on join and send\n",
+		"    Update a peer's copy of a dir: `ftr sync --key <key> [--delete] localdir peer:remotedir`\n",
+		"    Collect files from a browser: `ftr request-link --key <key> --dir <subdir>`\n",
+		"    Pair with a peer to authenticate by certificate: `ftr pair [--remove] <peer> [<fingerprint>]`\n",
+		"    Create an archive as send would: `ftr pack [--output <file>] [--links <mode>] <dir> | <file>...`\n",
+		"    Check or extract an archive: `ftr unpack [--list] [--dest <dir>] <archive>`\n",
+		"    Print a shell completion script: `ftr completion bash|zsh|fish`",
 	)
 }
 
@@ -122,36 +205,286 @@ func runJoin() {
 	joinCmd.SetOutput(os.Stdout)
 	name := joinCmd.String("name", getDefaultName(), "the name for the host")
 	debug := joinCmd.Bool("debug", false, "enable debug log")
-	port := joinCmd.Int("port", defaultPort, "the port the server will listen at")
+	port := joinCmd.Int("port", defaultPort, "the port the server will listen at, 0 for any free one; a busy default port falls back to a free one")
 	dropDir := joinCmd.String("dropdir", defaultDropDir(), "the path to the default drop dir")
 	passKey := joinCmd.String("key", randomPassKey(6), "the pre-shared key used to authn the file transfer")
+	historyFile := joinCmd.String("history-file", defaultHistoryFile(), "the path to the transfer history ledger, empty to disable")
+	configFile := joinCmd.String("config", defaultConfigFile(), "the path to the config file")
+	ephemeral := joinCmd.Bool("ephemeral", false, "keep received files in memory and write them to stdout or --ephemeral-cmd instead of the drop dir")
+	ephemeralCmd := joinCmd.String("ephemeral-cmd", "", "the shell command each received file is piped to in ephemeral mode")
+	quarantine := joinCmd.Bool("quarantine", true, "set the com.apple.quarantine attribute on received files (macOS only)")
+	keepArchive := joinCmd.Bool("keep-archive", false, "keep the tarball of a received directory after extracting it")
+	autoExtract := joinCmd.Bool("auto-extract", true, "extract received directories, otherwise keep the .tar.gz as is")
+	onConflict := joinCmd.String("on-conflict", conflictFail, "what to do with an upload whose name is taken (fail, overwrite, rename or skip)")
+	snapshots := joinCmd.Int("snapshots", 0, "keep this many dated snapshots of a directory received repeatedly, 0 to extract over the previous copy")
+	dedupWindow := joinCmd.Duration("dedup-window", defaultDedupWindow, "treat a file identical to one received this recently as delivered, 0 to always store it")
+	maintenance := joinCmd.Bool("maintenance", false, "start in maintenance, queueing uploads until reopened from the dashboard")
+	idleExit := joinCmd.Duration("idle-exit", 0, "exit after no transfer happened for this long, 0 to never exit")
+	maxTransfers := joinCmd.Int("max-transfers", 0, "exit after this many successful transfers, 0 for no limit")
+	shareDir := joinCmd.String("share-dir", "", "the dir peers may request files from with ftr request")
+	offer := joinCmd.String("offer", "", "comma-separated files or dirs peers may pull by their base names with ftr get, on top of the [offered] config section")
+	requestPolicy := joinCmd.String("request-policy", policyPrompt, "how to handle file requests from peers (prompt, allow or deny)")
+	confirmMode := joinCmd.Bool("confirm", false, "ask before accepting each upload, showing the sender fingerprint and file hash, and encrypt it with a key bound to the approval")
+	extractJobs := joinCmd.Int("extract-jobs", 0, "extract at most this many received directories and batches at once, 0 for no limit")
+	threads := joinCmd.Int("threads", 0, "run Go code and each compression or erasure codec on at most this many threads, 0 for all CPUs")
+	bufferSize := joinCmd.String("buffer-size", defaultCopyBufferSize, "the size of the pooled buffers uploads are copied through")
+	maxMemory := joinCmd.String("max-memory", "0", "a soft limit on the memory the receiver uses, 0 for no limit")
+	stallTimeout := joinCmd.Duration("stall-timeout", defaultStallTimeout, "abort an upload nothing arrived for this long and remove what was staged, 0 to wait indefinitely")
+	journal := joinCmd.Bool("journal", true, "journal extractions so files left partial by a crash are removed on the next start")
+	drainTimeout := joinCmd.Duration("drain-timeout", defaultDrainTimeout, "on SIGINT or SIGTERM, how long to let the transfers in flight finish before cancelling them")
+	networkCheck := joinCmd.Duration("network-check", defaultNetworkCheck, "how often to check for network changes that need the advertisement refreshed, 0 to never")
+	serveTLS := joinCmd.Bool("tls", true, "serve HTTPS with a self-signed certificate that senders pin on first contact")
+	allowPlain := joinCmd.Bool("allow-plain", true, "with --tls, still accept unencrypted connections from other hosts, for browsers and older senders")
+	kdeConnectDir := joinCmd.String("kdeconnect-dir", "", "receive the files KDE Connect/GSConnect saves in this dir into the drop dir")
+	provenance := joinCmd.Bool("provenance", false, "write a .ftrmeta sidecar with the sender, time and transfer id next to every received file")
+	notify := joinCmd.Bool("notify", false, "show a desktop notification with the sender, name and size of every received file")
+	onReceive := joinCmd.String("on-receive", "", "run this shell command for every received file, {path} standing for its path")
+	webhook := joinCmd.String("webhook", "", "post the sender, path, size and hash of every received file as JSON to this URL")
+	allowSync := joinCmd.Bool("allow-sync", false, "let senders holding the key overwrite and delete files in the drop dir with ftr sync")
+	force := joinCmd.Bool("force", false, "replicate to the [replicate] targets on battery or in power-save mode too, instead of deferring it")
+	daemon := joinCmd.Bool("daemon", false, "run the receiver in the background, detached from the terminal")
+	logFile := joinCmd.String("log-file", "", "write the output to this file, defaults to ~/.ftr/join.log with --daemon")
+	logLevelName := joinCmd.String("log-level", "info", "the least severe messages to log: debug, info, warn or error")
+	logFormat := joinCmd.String("log-format", "text", "the format of the log: text or json")
+	profile := joinCmd.String("profile", "", "apply the settings of the named [profile.<name>] config section, or of the builtin kiosk profile")
+	maxSize := joinCmd.String("max-size", "0", "the largest upload accepted, 0 for no limit")
+	quota := joinCmd.String("quota", "0", "the most the drop dir may hold, uploads that would take it over are refused, 0 for no limit")
+	strictNames := joinCmd.Bool("strict-names", false, "only accept single files with short, plain names in a safe charset")
+	rejectExecutables := joinCmd.Bool("reject-executables", false, "refuse single files that are programs or scripts, by extension or by content")
+	limit := joinCmd.String("limit", "", "cap the bandwidth of all uploads and downloads together, e.g. 10MB/s, empty for no limit")
+	auditFile := joinCmd.String("audit-log", "", "append every transfer attempt, accepted or refused, to this JSON lines file")
+	var allow, deny patternList
+	joinCmd.Var(&allow, "allow", "only let in senders from these IPs or CIDRs or paired peers presenting their certificate, repeatable or comma separated")
+	joinCmd.Var(&deny, "deny", "keep out senders from these IPs or CIDRs or paired peers, repeatable or comma separated, over --allow")
+	linkLocal := joinCmd.Bool("link-local", false, "only advertise link-local and unique local addresses and refuse peers that aren't on the link")
+	pasteMode := joinCmd.String("paste", pasteFile, "what to do with text snippets sent with ftr paste (file, print or clipboard), on top of the per-sender [paste] config section")
+	relay := joinCmd.String("relay", "", "also register with the relay at this host:port, so senders that can't discover or reach the receiver go through it")
+	relayKey := joinCmd.String("relay-key", "", "the key of the relay given with --relay")
+	dropOnly := joinCmd.Bool("drop-only", false, "only serve uploads, disabling the endpoints to list, pull or manage files and the dashboard")
+	applyUnits := unitFlags(joinCmd)
+	applySimulation := simulationFlags(joinCmd)
 	if err := joinCmd.Parse(os.Args[2:]); err != nil {
 		exitWithError(1, "Join command failed: %v", err)
 	}
+	cfg := mustLoadConfig(*configFile)
+	if *profile != "" {
+		if _, err := applyProfile(joinCmd, cfg, *profile); err != nil {
+			exitWithError(1, "Failed to apply the profile: %v", err)
+		}
+	}
+	if *logFile == "" && *daemon {
+		*logFile = defaultJoinLogFile()
+	}
+	if *logFile != "" && *ephemeral && *ephemeralCmd == "" {
+		exitWithError(1, "The received files go to stdout in ephemeral mode, add --ephemeral-cmd to log to a file")
+	}
+	if *daemon && !inDaemon() {
+		pid, err := daemonize(os.Args[2:], *passKey, *logFile)
+		if err != nil {
+			exitWithError(1, "Failed to start the receiver in the background: %v", err)
+		}
+		fmt.Printf("Started the receiver in the background with pid %d and key %s, logging to %s\n", pid, *passKey, *logFile)
+		return
+	}
+	if *logFile != "" && !inDaemon() {
+		logToFile(*logFile)
+	}
 
 	debugMode = *debug
-	// All available ip addresses will be appended to the entry automatically
-	rvrSvr, err := zeroconf.Register(
-		*name, service, domain, *port,
-		// the meta info used as the TXT record
-		[]string{*dropDir}, nil,
-	)
+	logOut := infoOut
+	if *ephemeral && *ephemeralCmd == "" {
+		// the payloads own stdout
+		logOut = os.Stderr
+	}
+	if err := setupLogging(*logLevelName, *logFormat, logOut); err != nil {
+		exitWithError(1, "Invalid logging: %v", err)
+	}
+	applyUnits()
+	copyBufferBytes, err := parseSize(*bufferSize)
+	if err != nil {
+		exitWithError(1, "Invalid buffer size: %v", err)
+	}
+	memoryLimit, err := parseSize(*maxMemory)
+	if err != nil {
+		exitWithError(1, "Invalid memory limit: %v", err)
+	}
+	applyBudget(*threads, copyBufferBytes, memoryLimit)
+	maxUploadSize, err := parseSize(*maxSize)
+	if err != nil {
+		exitWithError(1, "Invalid --max-size: %s", *maxSize)
+	}
+	quotaSize, err := parseSize(*quota)
+	if err != nil {
+		exitWithError(1, "Invalid --quota: %s", *quota)
+	}
+	opts := receiverOptions{
+		port:              *port,
+		dropDir:           *dropDir,
+		passKey:           *passKey,
+		historyFile:       *historyFile,
+		ephemeral:         *ephemeral || *ephemeralCmd != "",
+		ephemeralCmd:      *ephemeralCmd,
+		quarantine:        *quarantine,
+		keepArchive:       *keepArchive,
+		snapshots:         *snapshots,
+		autoExtract:       *autoExtract,
+		onConflict:        *onConflict,
+		receipts:          newReceiptIndex(*dedupWindow),
+		dictDir:           defaultDictDir(),
+		guests:            newGuestCodes(),
+		links:             newRequestLinks(),
+		control:           newReceiverControl(),
+		queue:             newUploadQueue(*maintenance),
+		chunked:           newChunkedUploads(),
+		activity:          newActivityTracker(*idleExit, *maxTransfers),
+		transfers:         newTransferManager(),
+		load:              newLoadMeter(),
+		events:            newEventHub(),
+		shareDir:          *shareDir,
+		requestPolicy:     *requestPolicy,
+		confirm:           *confirmMode,
+		offers:            newOfferApprovals(),
+		pakes:             newOfferApprovals(),
+		extractions:       newExtractionSlots(*extractJobs),
+		journal:           *journal,
+		stallTimeout:      *stallTimeout,
+		provenance:        *provenance,
+		notify:            *notify,
+		onReceive:         *onReceive,
+		webhook:           *webhook,
+		allowSync:         *allowSync,
+		paired:            newPairings(defaultPairedPeersFile()),
+		maxSize:           maxUploadSize,
+		quota:             quotaSize,
+		strictNames:       *strictNames,
+		rejectExecutables: *rejectExecutables,
+		dropOnly:          *dropOnly,
+		linkLocal:         *linkLocal,
+		access:            newAccessList(allow, deny),
+		guard:             newAuthGuard(),
+		audit:             newAuditLog(*auditFile),
+	}
+	switch opts.requestPolicy {
+	case policyAllow, policyDeny, policyPrompt:
+	default:
+		exitWithError(1, "Unsupported request policy: %s", opts.requestPolicy)
+	}
+	if _, err := parseConflictPolicy(opts.onConflict); err != nil {
+		exitWithError(1, "Invalid --on-conflict: %v", err)
+	}
+	portSet := false
+	joinCmd.Visit(func(f *flag.Flag) { portSet = portSet || f.Name == "port" })
+	ln, err := listenReceiver(*port, !portSet)
 	if err != nil {
 		exitWithError(1, "Failed to start the receiver server: %v", err)
 	}
-	defer rvrSvr.Shutdown()
-	fmt.Printf("Advertise within the network with name %s, port %d and key %s\n", *name, *port, *passKey)
+	opts.port = ln.Addr().(*net.TCPAddr).Port
+	applySimulation()
+	if err := applyBandwidthLimit(*limit); err != nil {
+		exitWithError(1, "Invalid --limit: %v", err)
+	}
+	opts.tcp = mustLoadTCPTuning(cfg)
+	replicas, err := loadReplicaTargets(cfg)
+	if err != nil {
+		exitWithError(1, "Invalid replication configuration: %v", err)
+	}
+	opts.replicator = newReplicator(replicas, opts.historyFile, opts.tcp, *force)
+	if opts.offered, err = loadOffered(cfg, *offer); err != nil {
+		exitWithError(1, "Invalid offered files: %v", err)
+	}
+	if opts.paste, err = loadPasteModes(cfg, *pasteMode); err != nil {
+		exitWithError(1, "Invalid paste modes: %v", err)
+	}
+	var tlsFingerprint string
+	if *serveTLS {
+		cert, err := loadTLSCert()
+		if err != nil {
+			exitWithError(1, "Failed to load the TLS certificate: %v", err)
+		}
+		opts.tls = newReceiverTLS(cert, *allowPlain)
+		tlsFingerprint = certFingerprint(cert.Certificate[0])
+	}
+	// the inboxes start from the options of the default one
+	inboxes, err := loadInboxes(cfg, opts)
+	if err != nil {
+		exitWithError(1, "Invalid inbox configuration: %v", err)
+	}
+	opts.inboxes = inboxes
+
+	// the meta info used as the TXT record
+	txt := []string{*dropDir}
+	if len(inboxes) > 0 {
+		var names []string
+		for _, inbox := range inboxes {
+			names = append(names, inbox.name)
+		}
+		txt = append(txt, "inboxes="+strings.Join(names, ","))
+	}
+	if opts.confirm {
+		txt = append(txt, confirmTXT)
+	}
+	if opts.tls != nil {
+		txt = append(txt, tlsTXT)
+	}
+	txt = append(txt, pakeTXT, versionTXTPrefix+protocolVersion, codecsTXTPrefix+strings.Join(supportedCodecs, ","))
+	if node := nodeFingerprint(); node != "" {
+		txt = append(txt, nodeTXTPrefix+node)
+	}
+	relayAt, err := newRelayEndpoint(*relay, *relayKey)
+	if err != nil {
+		exitWithError(1, "Invalid relay: %v", err)
+	}
+	if relayAt != nil && opts.tls == nil {
+		exitWithError(1, "--relay needs --tls, senders only go through a relay over HTTPS")
+	}
+	opts.relay = relayAt
+	opts.advertised = peerInfo{Name: *name, TXT: txt}
+	adv, err := advertise(*name, opts.port, txt, opts.linkLocal)
+	if err != nil {
+		exitWithError(1, "Failed to start the receiver server: %v", err)
+	}
+	defer adv.shutdown()
+	if *networkCheck > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go adv.watch(*networkCheck, stop)
+	}
+	logger.Info("Advertising within the network", "name", *name, "port", opts.port, "key", *passKey)
+	if opts.tls != nil {
+		logger.Info("Serving HTTPS", "fingerprint", tlsFingerprint)
+	}
 	errChan := make(chan error)
-	go startReceiverServer(*port, *dropDir, *passKey, errChan)
-	if err := <-errChan; err != nil {
-		exitWithError(1, "Receiver server error: %v", err)
+	for _, inbox := range inboxes {
+		logger.Info("Serving an inbox", "inbox", inbox.name, "path", inboxPath(inbox.name), "dropdir", inbox.dropDir)
+	}
+	for _, name := range opts.offered.names() {
+		logger.Info("Offering a file", "path", opts.offered[name], "name", name)
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	server := &http.Server{}
+	go startReceiverServer(opts, ln, server, errChan)
+	if *kdeConnectDir != "" {
+		go bridgeKDEConnect(*kdeConnectDir, opts)
+	}
+	select {
+	case err := <-errChan:
+		if err != nil {
+			adv.shutdown()
+			exitWithError(1, "Receiver server error: %v", err)
+		}
+	case reason := <-opts.activity.Done():
+		logger.Info("Shutting down", "reason", reason)
+	case sig := <-sigs:
+		logger.Info("Shutting down", "signal", sig)
+		drainReceiver(opts, adv, server, *drainTimeout, sigs)
 	}
 }
 
 func mkDirIfNotExist(dir string) error {
 	if _, err := os.Stat(dir); err != nil {
 		if os.IsNotExist(err) {
-			fmt.Printf("The directory %s does not exist, creating it\n", dir)
+			fmt.Fprintf(infoOut, "The directory %s does not exist, creating it\n", dir)
 			return os.MkdirAll(dir, 0755)
 		}
 		return err
@@ -170,32 +503,80 @@ func isDirectory(header http.Header) bool {
 		return false
 	}
 
-	if fileType == "dir" {
+	if fileType == fileTypeDir {
 		return true
 	}
 
-	if fileType == "file" {
+	if fileType == fileTypeFile {
 		return false
 	}
 
 	return false
 }
 
-func zipTar(src string) (string, error) {
-	tarball := src + ".tar.gz"
-	file, err := os.Create(tarball)
+func isBatch(header http.Header) bool {
+	return header != nil && header.Get(fileTypeHeader) == fileTypeBatch
+}
+
+// wantsExtract reports whether the sender is fine with its directory being
+// extracted, which is the default.
+func wantsExtract(header http.Header) bool {
+	return header == nil || !strings.EqualFold(header.Get(extractHeader), "no")
+}
+
+// zipTar writes the tarball of the directory src, compressed with the codec,
+// into a new temp dir, leaving the source untouched as it may be read-only.
+// The caller removes the tarball's dir.
+func zipTar(src, codec string) (string, error) {
+	dir, err := os.MkdirTemp("", "ftr-dir-")
+	if err != nil {
+		return "", err
+	}
+	tarball := filepath.Join(dir, sourceName(src)+tarballExt(codec))
+	file, err := os.Create(longPath(tarball))
 	if err != nil {
+		os.RemoveAll(dir)
 		return "", err
 	}
 	defer file.Close()
 
-	gw := gzip.NewWriter(file)
-	defer gw.Close()
+	if err := writeTarball(file, src, codec); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return tarball, nil
+}
 
+// writeTarball writes the tarball of the directory src to w, compressed with
+// the codec.
+func writeTarball(w io.Writer, src, codec string) error {
+	gw, err := newCompressor(w, codec)
+	if err != nil {
+		return err
+	}
 	tw := tar.NewWriter(gw)
-	defer tw.Close()
 
-	err = filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+	root := longPath(src)
+	var walking []string
+	if real, err := realPath(root); err == nil {
+		walking = []string{real}
+	}
+	err = addTree(tw, root, "", walking, newIgnoreRules(excludePatterns))
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// addTree adds what's below the directory root to the tarball, named after
+// their path relative to root under prefix, leaving out what the ignore rules
+// say. walking holds the real paths of the directories being archived, for
+// the symlinks followed into others.
+func addTree(tw *tar.Writer, root, prefix string, walking []string, ignore *ignoreRules) error {
+	return filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
 		// return on any error
 		if err != nil {
 			return err
@@ -206,16 +587,31 @@ func zipTar(src string) (string, error) {
 			return err
 		}
 
-		relPath, err := filepath.Rel(src, path)
+		relPath, err := filepath.Rel(root, path)
 		if err != nil {
 			return err
 		}
 		// ignore the top-level directory
 		if relPath == "." {
 			debugLog("Ignoring the top-level directory %s", path)
+			return ignore.load(path, prefix)
+		}
+		name := archiveName(relPath)
+		if prefix != "" {
+			name = prefix + "/" + name
+		}
+		if ignore.ignored(name, d.IsDir()) {
+			debugLog("Excluding %s from the tarball", path)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
-		name := filepath.ToSlash(relPath)
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return addSymlink(tw, path, name, walking, ignore)
+		}
+
 		// create tar header for current entry
 		header, err := tar.FileInfoHeader(info, "")
 		if err != nil {
@@ -223,345 +619,286 @@ func zipTar(src string) (string, error) {
 		}
 		header.Name = name
 
-		// ignore the file if it's a symlink
-		if info.Mode()&os.ModeSymlink != 0 {
-			return nil
-		}
-
 		if d.IsDir() {
 			debugLog("Adding directory %s to the tarball", path)
-			header.Typeflag = tar.TypeDir
-
-			// ensure the directory can be accessible on the receiver side
-			if header.Mode&0400 == 0 {
-				header.Mode |= 0100
-			}
-			if header.Mode&0040 == 0 {
-				header.Mode |= 0010
-			}
-			if header.Mode&0004 == 0 {
-				header.Mode |= 0001
+			if err := addDir(tw, header); err != nil {
+				return err
 			}
-			return tw.WriteHeader(header)
+			return ignore.load(path, name)
 		}
 
 		// for regular files
 		debugLog("Adding file %s to the tarball", path)
-		header.Typeflag = tar.TypeReg
-		if err := tw.WriteHeader(header); err != nil {
-			return err
-		}
-
-		f, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		if _, err := io.Copy(tw, f); err != nil {
+		if err := addRegularFile(tw, path, name, info); err != nil {
 			return err
 		}
 		debugLog("Added file %s to the tarball successfully", path)
 		return nil
 	})
-	return tarball, err
 }
 
-func unzipUntar(src string) error {
-	var dst string
-	if strings.HasSuffix(src, ".tar.gz") {
-		dst = strings.TrimSuffix(src, ".tar.gz")
-	} else if strings.HasSuffix(src, ".tgz") {
-		dst = strings.TrimSuffix(src, ".tgz")
-	} else {
-		return errors.New("the file is not a tarball")
+// addDir adds the header of a directory to the tarball.
+func addDir(tw *tar.Writer, header *tar.Header) error {
+	header.Typeflag = tar.TypeDir
+
+	// ensure the directory can be accessible on the receiver side
+	if header.Mode&0400 == 0 {
+		header.Mode |= 0100
 	}
+	if header.Mode&0040 == 0 {
+		header.Mode |= 0010
+	}
+	if header.Mode&0004 == 0 {
+		header.Mode |= 0001
+	}
+	return tw.WriteHeader(header)
+}
 
-	file, err := os.Open(src)
-	if err != nil {
-		return err
+// tarballDir returns the name of the directory a tarball name unpacks into.
+func tarballDir(name string) (string, error) {
+	for _, ext := range tarballExts {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext), nil
+		}
+	}
+	return "", errors.New("the file is not a tarball")
+}
+
+// sourceName returns the name a file or directory is sent under, its base
+// name, or the drive letter for the root of a Windows drive such as C:\.
+func sourceName(src string) string {
+	p := filepath.Clean(src)
+	vol := filepath.VolumeName(p)
+	name := filepath.Base(p[len(vol):])
+	if name == string(filepath.Separator) || name == "." {
+		name = strings.Trim(filepath.Base(vol), `\/:?.`)
+	}
+	if name == "" {
+		return "root"
+	}
+	return name
+}
+
+// archiveName returns the tar entry name of the path rel, relative to the
+// root of the archive: forward slashes and no drive letter on every
+// platform, so archives made on Windows extract the same on Linux and macOS.
+func archiveName(rel string) string {
+	name := filepath.ToSlash(rel[len(filepath.VolumeName(rel)):])
+	return strings.TrimLeft(name, "/")
+}
+
+// entryName returns the tar entry name with backslashes taken as separators,
+// as Windows tools write them.
+func entryName(name string) string {
+	return strings.ReplaceAll(name, `\`, "/")
+}
+
+// checkEntryName rejects tar entry names that would land outside of the dir
+// the archive is extracted into.
+func checkEntryName(name string) error {
+	if name == "" || path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return fmt.Errorf("unsafe tar entry name %q", name)
+	}
+	// a drive letter is only a volume name on Windows
+	if len(name) >= 2 && name[1] == ':' && ('a' <= name[0]|0x20 && name[0]|0x20 <= 'z') {
+		return fmt.Errorf("unsafe tar entry name %q", name)
+	}
+	for _, elem := range strings.Split(entryName(name), "/") {
+		if elem == ".." {
+			return fmt.Errorf("unsafe tar entry name %q", name)
+		}
 	}
+	return nil
+}
 
-	gr, err := gzip.NewReader(file)
+// extractTarball unpacks the compressed tarball read from r into dst and returns
+// the paths of the regular files and symlinks it created. Those that already
+// exist in dst are handled by the conflict policy, conflictFail failing the
+// extraction with fs.ErrExist. Symlinks pointing outside of dst are skipped
+// and entries under a symlink refused. Every regular file is recorded in the
+// journal, if any.
+func extractTarball(r io.Reader, dst string, onConflict string, journal *extractJournal) ([]string, error) {
+	gr, err := newDecompressor(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer gr.Close()
 	tr := tar.NewReader(gr)
 
+	var files []string
+
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			return files, err
+		}
+		header.Name = entryName(header.Name)
+		if err := checkEntryName(header.Name); err != nil {
+			return files, err
+		}
+		if err := throughSymlink(dst, header.Name); err != nil {
+			return files, err
 		}
 		switch header.Typeflag {
 		case tar.TypeDir:
 			debugLog("Creating directory %s for the tar entry", header.Name)
-			dirPath := filepath.Join(dst, header.Name)
+			dirPath := longPath(filepath.Join(dst, header.Name))
 			if err := os.MkdirAll(dirPath, 0755); err != nil {
-				return err
+				return files, err
 			}
 		case tar.TypeReg:
 			debugLog("Creating file %s for the tar entry", header.Name)
-			filePath := filepath.Join(dst, header.Name)
-			if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
-				return err
+			filePath := longPath(filepath.Join(dst, header.Name))
+			if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+				return files, err
+			}
+			flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+			if onConflict != conflictOverwrite {
+				flags |= os.O_EXCL
+			}
+			if _, err := os.Lstat(filePath); err == nil {
+				switch onConflict {
+				case conflictSkip:
+					debugLog("Skipping the tar entry %s, the file already exists", header.Name)
+					continue
+				case conflictRename:
+					filePath = filepath.Join(filepath.Dir(filePath), freeName(filepath.Dir(filePath), filepath.Base(filePath)))
+				}
 			}
-			outFile, err := os.Create(filePath)
+			if err := journal.begin(header.Name, filePath); err != nil {
+				return files, err
+			}
+			outFile, err := os.OpenFile(filePath, flags, 0666)
 			if err != nil {
-				return err
+				return files, err
+			}
+			n, err := copyPooled(outFile, tr)
+			if err == nil {
+				err = journal.complete(header.Name, outFile, n)
 			}
-			if _, err := io.Copy(outFile, tr); err != nil {
+			if err != nil {
 				outFile.Close()
-				return err
+				return files, err
 			}
 			outFile.Close()
+			tarMeta(header).restore(filePath, false)
+			files = append(files, filePath)
+		case tar.TypeSymlink:
+			linkPath, err := extractSymlink(header, longPath(filepath.Join(dst, header.Name)), onConflict)
+			if err != nil {
+				return files, err
+			}
+			if linkPath != "" {
+				files = append(files, linkPath)
+			}
 		default:
-			return fmt.Errorf("Unrecognized tar entry type: %v", header.Typeflag)
+			return files, fmt.Errorf("Unrecognized tar entry type: %v", header.Typeflag)
 		}
 	}
-	return nil
+	return files, nil
 }
 
-func getFileDropHandler(dropDir string) (http.HandlerFunc, error) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		file, header, err := r.FormFile("file")
-		if err != nil {
-			http.Error(w, "Failed to get the file from form", http.StatusBadRequest)
-			return
-		}
-		debugLog("Receiving file %s", header.Filename)
-		fileName := filepath.Base(header.Filename)
-		if fileName == "" || fileName == "." || fileName == ".." {
-			http.Error(w, "Invalid file name", http.StatusBadRequest)
-			return
-		}
-		defer file.Close()
-
-		dstPath := filepath.Join(dropDir, fileName)
-		if _, err := os.Stat(dstPath); err == nil {
-			http.Error(w, "File already exists", http.StatusConflict)
-			return
-		}
-
-		dst, err := os.Create(path.Join(dropDir, fileName))
-		if err != nil {
-			http.Error(w, "Failed to create the file on server", http.StatusInternalServerError)
-			return
-		}
-		debugLog("Saving the file to %s", dstPath)
-		defer dst.Close()
-
-		written, err := io.Copy(dst, file)
-		if err != nil {
-			http.Error(w, "Failed to save the file on server", http.StatusInternalServerError)
-			return
-		}
-		debugLog("Saved %d bytes to %s", written, dstPath)
-
-		// untar if the file is a tarball of a directory
-		if isDirectory(r.Header) {
-			debugLog("The received file is a directory, unzipping and untarring it")
-			// untar the file
-			if err := unzipUntar(dstPath); err != nil {
-				http.Error(w, "Failed to unzip and untar the file on server", http.StatusInternalServerError)
-				return
-			}
-			if err := os.Remove(dstPath); err != nil {
-				http.Error(w, "Failed to remove the tarball file on server", http.StatusInternalServerError)
-				return
-			}
-			debugLog("Unzipped and untarred the file %s successfully", dstPath)
-		}
-
-	}, nil
+// listedPeer is a peer `ftr list --json` discovered, with the time it took
+// to answer the browse.
+type listedPeer struct {
+	Instance  string   `json:"instance"`
+	Hostname  string   `json:"hostname"`
+	IPv4      []string `json:"ipv4"`
+	IPv6      []string `json:"ipv6"`
+	Port      int      `json:"port"`
+	DropDir   string   `json:"dropdir"`
+	TXT       []string `json:"txt"`
+	LatencyMs int64    `json:"latency_ms"`
 }
 
-func authMiddleware(passKey string, next http.Handler) (http.Handler, error) {
-	if passKey == "" {
-		return nil, errors.New("the passkey is empty")
+func newListedPeer(e *zeroconf.ServiceEntry, latency time.Duration) listedPeer {
+	p := listedPeer{
+		Instance:  e.Instance,
+		Hostname:  e.HostName,
+		IPv4:      []string{},
+		IPv6:      []string{},
+		Port:      e.Port,
+		TXT:       e.Text,
+		LatencyMs: latency.Milliseconds(),
 	}
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		key := r.Header.Get(passKeyHeader)
-		if key != passKey {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		next.ServeHTTP(w, r)
-	}), nil
-}
-
-func startReceiverServer(port int, dropDir, passKey string, errChan chan<- error) {
-	debugLog("Starting the receiver server at port %d, drop dir %s and passkey %s", port, dropDir, passKey)
-	if err := mkDirIfNotExist(dropDir); err != nil {
-		errChan <- fmt.Errorf("failed to create the drop dir %s: %v", dropDir, err)
-		return
+	for _, ip := range e.AddrIPv4 {
+		p.IPv4 = append(p.IPv4, ip.String())
 	}
-	debugLog("The drop dir %s is ready", dropDir)
-
-	handler, err := getFileDropHandler(dropDir)
-	if err != nil {
-		errChan <- fmt.Errorf("failed to get the file drop handler: %v", err)
-		return
+	for _, ip := range e.AddrIPv6 {
+		p.IPv6 = append(p.IPv6, ip.String())
 	}
-
-	handlerWithAuth, err := authMiddleware(passKey, handler)
-	if err != nil {
-		errChan <- fmt.Errorf("failed to get the auth middleware: %v", err)
-		return
+	if len(e.Text) > 0 {
+		p.DropDir = e.Text[0]
+	}
+	if p.TXT == nil {
+		p.TXT = []string{}
 	}
+	return p
+}
 
-	// Start the HTTP server at all interfaces with the specified port
-	if err := http.ListenAndServe(
-		fmt.Sprintf("0.0.0.0:%d", port),
-		handlerWithAuth,
-	); err != nil {
-		errChan <- fmt.Errorf("failed to start the http server: %v", err)
-		return
+// firstOr returns the first of the values, or def when there are none.
+func firstOr(values []string, def string) string {
+	if len(values) == 0 {
+		return def
 	}
+	return values[0]
 }
 
-func runList() {
+func runList(args []string) {
 	listCmd := flag.NewFlagSet("list", flag.ExitOnError)
 	listCmd.SetOutput(os.Stdout)
-	resolver, err := zeroconf.NewResolver(nil)
-	if err != nil {
-		exitWithError(1, "Failed to get the resolver: %v", err)
+	jsonOutput := listCmd.Bool("json", false, "print the peers as JSON once the browse is over")
+	if err := listCmd.Parse(args); err != nil {
+		exitWithError(1, "List command failed: %v", err)
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), defaultListTimeoutSecs*time.Second)
 	defer cancel()
 
 	entries := make(chan *zeroconf.ServiceEntry)
+	start := time.Now()
+	peers := []listedPeer{}
+	done := make(chan struct{})
 
 	go func() {
-		fmt.Printf(
-			"%-20s %-15s %-5s %-20s\n",
-			"Instance", "IPv4", "Port", "DropDir",
-		)
+		defer close(done)
+		if !*jsonOutput {
+			fmt.Printf(
+				"%-20s %-15s %-25s %-5s %-20s\n",
+				"Instance", "IPv4", "IPv6", "Port", "DropDir",
+			)
+		}
+		seen := map[string]bool{}
 		for e := range entries {
+			if *jsonOutput {
+				if !seen[e.Instance] {
+					seen[e.Instance] = true
+					peers = append(peers, newListedPeer(e, time.Since(start)))
+				}
+				continue
+			}
+			p := newListedPeer(e, 0)
 			fmt.Printf(
-				"%-20s %-15s %-5d %-20s\n",
-				e.Instance, e.AddrIPv4[0], e.Port, e.Text[0],
+				"%-20s %-15s %-25s %-5d %-20s\n",
+				e.Instance, firstOr(p.IPv4, "-"), firstOr(p.IPv6, "-"), e.Port, p.DropDir,
 			)
 		}
 	}()
 
-	if err := resolver.Browse(ctx, service, domain, entries); err != nil {
+	if err := peerNet.Browse(ctx, entries); err != nil {
 		exitWithError(1, "Failed to list peers: %v", err)
 	}
 	<-ctx.Done()
-}
-
-func sendFile(src, key, addr string, port int) error {
-	fi, err := os.Stat(src)
-	if err != nil {
-		return fmt.Errorf("failed to stat the source file: %v", err)
-	}
-	if fi.IsDir() {
-		debugLog("The source %s is a directory, zipping and tarring it", src)
-		src, err = zipTar(src)
-		if err != nil {
-			return fmt.Errorf("failed to zip and tar the source directory: %v", err)
-		}
-		defer os.Remove(src)
-	}
-
-	file, err := os.Open(src)
-	if err != nil {
-		return fmt.Errorf("failed to open the source file: %v", err)
-	}
-	defer file.Close()
-
-	body := &bytes.Buffer{}
-	w := multipart.NewWriter(body)
-	part, err := w.CreateFormFile("file", path.Base(src))
-	if err != nil {
-		return fmt.Errorf("failed to create form file: %v", err)
-	}
-	if _, err := io.Copy(part, file); err != nil {
-		return fmt.Errorf("failed to copy the file content to form: %v", err)
-	}
-	if err := w.Close(); err != nil {
-		return fmt.Errorf("failed to close the multipart writer: %v", err)
-	}
-
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s:%d/upload", addr, port), body)
-	if err != nil {
-		return fmt.Errorf("failed to create the http request: %v", err)
-	}
-	req.Header.Set("Content-Type", w.FormDataContentType())
-	req.Header.Set(passKeyHeader, key)
-	req.Header.Set(fileTypeHeader, "file")
-	if fi.IsDir() {
-		req.Header.Set(fileTypeHeader, "dir")
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send the http request: %v", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to send the file, server returned status: %s", resp.Status)
-	}
-	fmt.Println("File sent successfully")
-	return nil
-}
-
-func runSend(args []string) {
-	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
-	sendCmd.SetOutput(os.Stdout)
-	key := sendCmd.String("key", "", "pre-shared passkey")
-	debug := sendCmd.Bool("debug", false, "enable debug log")
-	if err := sendCmd.Parse(args); err != nil {
-		exitWithError(1, "Send command failed: %v", err)
-	}
-	debugMode = *debug
-	pos := sendCmd.Args()
-	if len(pos) != 2 {
-		fmt.Println("Usage: ftr send --key <key> <path> <peer>")
-		os.Exit(1)
-	}
-
-	src, peer := pos[0], pos[1]
-	debugLog("Sending file %s to peer %s with key %s", src, peer, *key)
-
-	resolver, err := zeroconf.NewResolver(nil)
-	if err != nil {
-		exitWithError(1, "failed to get the peer resolver: %v", err)
+	if !*jsonOutput {
+		return
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), defaultLookupTimeoutMs*time.Millisecond)
-	defer cancel()
-
-	entries := make(chan *zeroconf.ServiceEntry)
-	go func() {
-		if err := resolver.Browse(ctx, service, domain, entries); err != nil {
-			exitWithError(1, "Failed to find the peer: %v", err)
-		}
-	}()
-
-	for {
-		select {
-		case <-ctx.Done():
-			exitWithError(1, "Failed to find the peer %s in %dms", peer, defaultLookupTimeoutMs)
-		case e := <-entries:
-			if e.Instance != peer {
-				continue
-			}
-			fmt.Printf("Found the peer %s with ip %s and port %d\n", e.HostName, e.AddrIPv4[0], e.Port)
-			fmt.Println("Start sending the file...")
-			if err := sendFile(src, *key, e.AddrIPv4[0].String(), e.Port); err != nil {
-				exitWithError(1, "Failed to send the file: %v", err)
-			}
-			return
-		}
+	// the resolver closes entries once the browse is over
+	<-done
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(peers); err != nil {
+		exitWithError(1, "Failed to encode the peers: %v", err)
 	}
 }
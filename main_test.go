@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestArchiveName(t *testing.T) {
+	windows := runtime.GOOS == "windows"
+	tests := []struct {
+		rel, want, wantWindows string
+	}{
+		{"f.txt", "f.txt", "f.txt"},
+		{"dir/sub/f.txt", "dir/sub/f.txt", "dir/sub/f.txt"},
+		// a backslash is part of the name everywhere but on Windows
+		{`dir\sub\f.txt`, `dir\sub\f.txt`, "dir/sub/f.txt"},
+		{`C:\Users\me\Docs`, `C:\Users\me\Docs`, "Users/me/Docs"},
+		{`\\server\share\f.txt`, `\\server\share\f.txt`, "f.txt"},
+	}
+	for _, tt := range tests {
+		want := tt.want
+		if windows {
+			want = tt.wantWindows
+		}
+		if got := archiveName(tt.rel); got != want {
+			t.Errorf("archiveName(%q) = %q, want %q", tt.rel, got, want)
+		}
+	}
+}
+
+func TestEntryName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"dir/sub/f.txt", "dir/sub/f.txt"},
+		{`dir\sub\f.txt`, "dir/sub/f.txt"},
+		{`dir/sub\f.txt`, "dir/sub/f.txt"},
+		{`C:\Users\me\Docs`, "C:/Users/me/Docs"},
+	}
+	for _, tt := range tests {
+		if got := entryName(tt.name); got != tt.want {
+			t.Errorf("entryName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckEntryName(t *testing.T) {
+	for _, name := range []string{"f.txt", "dir/sub/f.txt", `dir\sub\f.txt`, "a..b/f.txt"} {
+		if err := checkEntryName(name); err != nil {
+			t.Errorf("checkEntryName(%q) = %v, want nil", name, err)
+		}
+	}
+	for _, name := range []string{
+		"",
+		"/etc/passwd",
+		`\Windows\System32`,
+		`C:\Users\me\Docs`,
+		"C:/Users/me/Docs",
+		"c:f.txt",
+		"../f.txt",
+		`dir\..\..\f.txt`,
+		"dir/../../f.txt",
+	} {
+		if err := checkEntryName(entryName(name)); err == nil {
+			t.Errorf("checkEntryName(%q) accepted an unsafe name", name)
+		}
+	}
+}
+
+// tarball returns a gzipped tarball of the regular files named by the keys
+// of files.
+func tarball(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTarballRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "dir", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"top.txt": "top", "dir/sub/f.txt": "nested"}
+	for name, content := range want {
+		if err := os.WriteFile(filepath.Join(src, filepath.FromSlash(name)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := writeTarball(&buf, src, codecGzip); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newDecompressor(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(r)
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(h.Name, `\`) || strings.HasPrefix(h.Name, "/") || filepath.VolumeName(h.Name) != "" {
+			t.Errorf("entry %q isn't a relative name with forward slashes", h.Name)
+		}
+		names = append(names, strings.TrimSuffix(h.Name, "/"))
+	}
+	r.Close()
+	for _, name := range []string{"top.txt", "dir", "dir/sub", "dir/sub/f.txt"} {
+		if !slices.Contains(names, name) {
+			t.Errorf("no entry %q in %q", name, names)
+		}
+	}
+
+	dst := t.TempDir()
+	if _, err := extractTarball(bytes.NewReader(buf.Bytes()), dst, conflictFail, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range want {
+		got, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil || string(got) != content {
+			t.Errorf("extracted %s = %q, %v, want %q", name, got, err, content)
+		}
+	}
+}
+
+func TestExtractTarballBackslashes(t *testing.T) {
+	dst := t.TempDir()
+	data := tarball(t, map[string]string{`dir\sub\f.txt`: "from windows"})
+	if _, err := extractTarball(bytes.NewReader(data), dst, conflictFail, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dst, "dir", "sub", "f.txt"))
+	if err != nil || string(got) != "from windows" {
+		t.Errorf("extracted dir/sub/f.txt = %q, %v", got, err)
+	}
+
+	for _, name := range []string{`C:\Users\me\Docs\f.txt`, "/tmp/f.txt", `..\f.txt`} {
+		data := tarball(t, map[string]string{name: "escape"})
+		if _, err := extractTarball(bytes.NewReader(data), t.TempDir(), conflictFail, nil); err == nil {
+			t.Errorf("extracted the unsafe entry %q", name)
+		}
+	}
+}
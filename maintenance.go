@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	queuePath        = "/queue/"
+	queueTokenHeader = "X-Ftr-Queue-Token"
+	// queuePollInterval is how often a queued sender asks whether the
+	// receiver reopened
+	queuePollInterval = 5 * time.Second
+	// queueTokenTTL drops the place of a sender that stopped polling
+	queueTokenTTL = 4 * queuePollInterval
+
+	queueStateQueued = "queued"
+	queueStateOpen   = "open"
+)
+
+// errRequeued ends an upload attempt that waited for the receiver to reopen,
+// to be made again without counting as a retry.
+var errRequeued = errors.New("the receiver reopened")
+
+// uploadQueue parks the uploads that arrive while the receiver is in
+// maintenance. Their senders get a token instead of a refusal and poll with
+// it until the receiver reopens, then upload again. A nil queue is never in
+// maintenance.
+type uploadQueue struct {
+	mu     sync.Mutex
+	closed bool
+	nextID uint64
+	// parked holds the last poll of every token, order the tokens by arrival
+	parked map[string]time.Time
+	order  []string
+}
+
+func newUploadQueue(maintenance bool) *uploadQueue {
+	return &uploadQueue{closed: maintenance, parked: map[string]time.Time{}}
+}
+
+func (q *uploadQueue) inMaintenance() bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+func (q *uploadQueue) setMaintenance(on bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = on
+}
+
+// park returns the token of a new place in the queue.
+func (q *uploadQueue) park() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expire()
+	q.nextID++
+	token := strconv.FormatUint(q.nextID, 10) + "-" + randomPassKey(12)
+	q.parked[token] = time.Now()
+	q.order = append(q.order, token)
+	return token
+}
+
+// poll returns whether the receiver reopened for the token and otherwise its
+// position in the queue, starting at 1. A token is done once it's told the
+// receiver reopened.
+func (q *uploadQueue) poll(token string) (state string, position int, ok bool) {
+	if q == nil {
+		return "", 0, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expire()
+	if _, ok := q.parked[token]; !ok {
+		return "", 0, false
+	}
+	if !q.closed {
+		q.remove(token)
+		return queueStateOpen, 0, true
+	}
+	q.parked[token] = time.Now()
+	for i, t := range q.order {
+		if t == token {
+			position = i + 1
+		}
+	}
+	return queueStateQueued, position, true
+}
+
+// size returns the number of uploads waiting.
+func (q *uploadQueue) size() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expire()
+	return len(q.order)
+}
+
+func (q *uploadQueue) expire() {
+	for _, token := range append([]string(nil), q.order...) {
+		if time.Since(q.parked[token]) > queueTokenTTL {
+			q.remove(token)
+		}
+	}
+}
+
+func (q *uploadQueue) remove(token string) {
+	delete(q.parked, token)
+	for i, t := range q.order {
+		if t == token {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// parkUpload answers an upload arriving during maintenance with a place in
+// the queue.
+func parkUpload(w http.ResponseWriter, opts receiverOptions, r *http.Request) {
+	token := opts.queue.park()
+	debugLog("Queueing an upload from %s during maintenance", senderName(r))
+	w.Header().Set(queueTokenHeader, token)
+	w.Header().Set("Retry-After", strconv.Itoa(int(queuePollInterval.Seconds())))
+	http.Error(w, "The receiver is in maintenance, the upload is queued", http.StatusServiceUnavailable)
+}
+
+type queueStatus struct {
+	State    string `json:"state"`
+	Position int    `json:"position,omitempty"`
+}
+
+// queueHandler tells a queued sender whether the receiver reopened. It must
+// be behind the auth middleware.
+func queueHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		state, position, ok := opts.queue.poll(strings.TrimPrefix(r.URL.Path, queuePath))
+		if !ok {
+			http.Error(w, "Unknown queue token", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(queueStatus{State: state, Position: position})
+	}
+}
+
+// waitQueued polls the receiver with the token it queued an upload with
+// until it reopens, then returns errRequeued for the upload to be made again.
+func waitQueued(token string, opts sendOptions) error {
+	client := opts.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	lastPosition := 0
+	for {
+		req, err := http.NewRequest(http.MethodGet, opts.url(queuePath+token), nil)
+		if err != nil {
+			return fmt.Errorf("failed to create the http request: %v", err)
+		}
+		req.Header.Set(passKeyHeader, opts.key)
+		req.Header.Set(senderHeader, getDefaultName())
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to poll the upload queue: %v", err)
+		}
+		var status queueStatus
+		if resp.StatusCode == http.StatusNotFound {
+			// the place expired, the upload is queued anew if need be
+			status.State = queueStateOpen
+		} else if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("failed to poll the upload queue, server returned status: %s", resp.Status)
+		} else if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&status); err != nil {
+			resp.Body.Close()
+			return fmt.Errorf("failed to decode the queue status: %v", err)
+		}
+		resp.Body.Close()
+		if status.State == queueStateOpen {
+			fmt.Fprintln(infoOut, "The receiver reopened, uploading")
+			return errRequeued
+		}
+		if status.Position != lastPosition {
+			lastPosition = status.Position
+			fmt.Fprintf(infoOut, "The receiver is in maintenance, queued at position %d\n", status.Position)
+		}
+		time.Sleep(queuePollInterval)
+	}
+}
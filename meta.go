@@ -0,0 +1,96 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The headers carrying the fileMeta of a single file uploaded over HTTP.
+const (
+	modeHeader  = "X-Ftr-Mode"
+	mtimeHeader = "X-Ftr-Mtime"
+)
+
+// fileMeta is the permissions and modification time of a single file, which
+// the receiver restores. Archives carry their own in the tar headers, so
+// both are empty for directories and batches, as they are with older
+// senders.
+type fileMeta struct {
+	// Mode is the octal permission bits, e.g. 0644
+	Mode string `json:"mode,omitempty"`
+	// Mtime is the modification time in RFC 3339
+	Mtime string `json:"mtime,omitempty"`
+}
+
+// statMeta returns the metadata of the file at path, empty if it can't be
+// read.
+func statMeta(path string) fileMeta {
+	fi, err := os.Stat(path)
+	if err != nil {
+		debugLog("Failed to stat %s for its mode and mtime: %v", path, err)
+		return fileMeta{}
+	}
+	return fileMeta{
+		Mode:  fmt.Sprintf("%#o", fi.Mode().Perm()),
+		Mtime: fi.ModTime().UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// tarMeta returns the metadata of a tar entry.
+func tarMeta(h *tar.Header) fileMeta {
+	return fileMeta{
+		Mode:  fmt.Sprintf("%#o", os.FileMode(h.Mode).Perm()),
+		Mtime: h.ModTime.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// metaFromHeader returns the metadata carried by the request headers.
+func metaFromHeader(h http.Header) fileMeta {
+	return fileMeta{Mode: h.Get(modeHeader), Mtime: h.Get(mtimeHeader)}
+}
+
+// setHeader adds the metadata to the request headers.
+func (m fileMeta) setHeader(h http.Header) {
+	if m.Mode != "" {
+		h.Set(modeHeader, m.Mode)
+	}
+	if m.Mtime != "" {
+		h.Set(mtimeHeader, m.Mtime)
+	}
+}
+
+// restore applies the metadata to the received file at path. The mode is
+// limited to the permission bits and always leaves the file readable and
+// writable by the receiver, without the execute bits when noExec is set.
+// Invalid values are ignored, the file keeps its defaults.
+func (m fileMeta) restore(path string, noExec bool) {
+	if m.Mode != "" {
+		mode, err := strconv.ParseUint(m.Mode, 8, 32)
+		if err != nil {
+			debugLog("Ignoring the invalid mode %q of %s", m.Mode, path)
+		} else {
+			perm := os.FileMode(mode).Perm() | 0600
+			if noExec {
+				perm &^= 0111
+			}
+			if err := os.Chmod(longPath(path), perm); err != nil {
+				debugLog("Failed to set the mode of %s: %v", path, err)
+			}
+		}
+	}
+	if m.Mtime == "" {
+		return
+	}
+	t, err := time.Parse(time.RFC3339Nano, m.Mtime)
+	if err != nil {
+		debugLog("Ignoring the invalid mtime %q of %s", m.Mtime, path)
+		return
+	}
+	if err := os.Chtimes(longPath(path), time.Time{}, t); err != nil {
+		debugLog("Failed to set the mtime of %s: %v", path, err)
+	}
+}
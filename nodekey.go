@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const nodeKeyFileName = "node.key"
+
+// loadNodeKey returns the X25519 key pair of this node, creating it in the
+// state dir on first use. Peers know the node by the fingerprint of its
+// public key.
+func loadNodeKey() (*ecdh.PrivateKey, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	file := filepath.Join(dir, nodeKeyFileName)
+	data, err := os.ReadFile(file)
+	if err == nil {
+		return ecdh.X25519().NewPrivateKey(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(file, key.Bytes(), 0600); err != nil {
+		return nil, fmt.Errorf("failed to save the node key: %v", err)
+	}
+	debugLog("Created the node key %s", file)
+	return key, nil
+}
+
+// fingerprint is the short, human comparable form of a public key, such as
+// 3f2a:91c0:5be7:0d14.
+func fingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	h := hex.EncodeToString(sum[:8])
+	return strings.Join([]string{h[0:4], h[4:8], h[8:12], h[12:16]}, ":")
+}
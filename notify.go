@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// windowsNotifyScript shows a balloon tip from the tray, reading the title
+// and body from the environment so they need no quoting.
+const windowsNotifyScript = `Add-Type -AssemblyName System.Windows.Forms
+$n = New-Object System.Windows.Forms.NotifyIcon
+$n.Icon = [System.Drawing.SystemIcons]::Information
+$n.Visible = $true
+$n.ShowBalloonTip(5000, $env:FTR_NOTIFY_TITLE, $env:FTR_NOTIFY_BODY, 'Info')
+Start-Sleep -Seconds 6
+$n.Dispose()`
+
+// notifyCommand returns the command showing a desktop notification on the
+// platform, nil when there is none.
+func notifyCommand(title, body string) *exec.Cmd {
+	switch runtime.GOOS {
+	case "darwin":
+		// passed as arguments rather than spliced into the script
+		return exec.Command("osascript",
+			"-e", "on run argv",
+			"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+			"-e", "end run",
+			title, body)
+	case "windows":
+		cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", windowsNotifyScript)
+		cmd.Env = append(os.Environ(), "FTR_NOTIFY_TITLE="+title, "FTR_NOTIFY_BODY="+body)
+		return cmd
+	}
+	if _, err := exec.LookPath("notify-send"); err != nil {
+		return nil
+	}
+	return exec.Command("notify-send", "--app-name", "ftr", title, body)
+}
+
+// notifyDesktop shows a desktop notification with the title and body.
+func notifyDesktop(title, body string) error {
+	cmd := notifyCommand(title, body)
+	if cmd == nil {
+		return errors.New("no notification tool found")
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", cmd.Args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// notifyReceived tells the desktop a file arrived, without holding up the
+// upload.
+func notifyReceived(sender, file string, size int64) {
+	go func() {
+		if err := notifyDesktop("ftr: received "+file, fmt.Sprintf("%s from %s", formatBytes(size), sender)); err != nil {
+			debugLog("Failed to show the notification of %s: %v", file, err)
+		}
+	}()
+}
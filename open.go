@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// receivedPaths returns where a successful receipt ended up, the last one
+// first for a batch.
+func receivedPaths(e historyEntry) []string {
+	if e.Direction != directionReceive || e.Status != statusOK {
+		return nil
+	}
+	if e.Path != "" {
+		return []string{e.Path}
+	}
+	paths := make([]string, 0, len(e.Paths))
+	for i := len(e.Paths) - 1; i >= 0; i-- {
+		paths = append(paths, e.Paths[i])
+	}
+	return paths
+}
+
+// latestReceived returns the most recently received path that still exists,
+// optionally only from the peer or with a base name matching the pattern.
+func latestReceived(entries []historyEntry, peer, pattern string) (string, error) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if peer != "" && e.Peer != peer {
+			continue
+		}
+		for _, p := range receivedPaths(e) {
+			if pattern != "" {
+				ok, err := filepath.Match(pattern, filepath.Base(p))
+				if err != nil {
+					return "", err
+				}
+				if !ok {
+					continue
+				}
+			}
+			if _, err := os.Stat(p); err == nil {
+				return p, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no received file found")
+}
+
+// openPath opens the path with the desktop's default application.
+func openPath(p string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", p)
+	case "windows":
+		cmd = exec.Command("cmd", "/c", "start", "", p)
+	default:
+		cmd = exec.Command("xdg-open", p)
+	}
+	return cmd.Run()
+}
+
+func runOpen(args []string) {
+	openCmd := flag.NewFlagSet("open", flag.ExitOnError)
+	openCmd.SetOutput(os.Stdout)
+	historyFile := openCmd.String("history-file", defaultHistoryFile(), "the path to the transfer history ledger")
+	from := openCmd.String("from", "", "only consider files received from this peer")
+	printOnly := openCmd.Bool("print", false, "print the path instead of opening it")
+	if err := openCmd.Parse(args); err != nil {
+		exitWithError(1, "Open command failed: %v", err)
+	}
+	if openCmd.NArg() > 1 {
+		fmt.Println("Usage: ftr open [--print] [--from <peer>] [<pattern>]")
+		os.Exit(1)
+	}
+
+	entries, err := readHistory(*historyFile)
+	if err != nil {
+		exitWithError(1, "Failed to read the history: %v", err)
+	}
+	p, err := latestReceived(entries, *from, openCmd.Arg(0))
+	if err != nil {
+		exitWithError(1, "Failed to find the file: %v", err)
+	}
+	if *printOnly {
+		fmt.Println(p)
+		return
+	}
+	if err := openPath(p); err != nil {
+		exitWithError(1, "Failed to open %s: %v", p, err)
+	}
+}
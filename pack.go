@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// packSources writes the archive of the sources to w the way send puts them
+// on the wire: a directory as its tree, several regular files as a batch of
+// base names.
+func packSources(w io.Writer, srcs []string) error {
+	if len(srcs) == 1 {
+		fi, err := os.Stat(srcs[0])
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return writeTarball(w, srcs[0], codecGzip)
+		}
+	}
+	gw, err := gzip.NewWriterLevel(w, gzipLevel)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(gw)
+	seen := map[string]bool{}
+	for _, src := range srcs {
+		name := sourceName(src)
+		if seen[name] {
+			return fmt.Errorf("more than one file named %s", name)
+		}
+		seen[name] = true
+		if err := addFileToTar(tw, src, name); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// listTarball prints the entries of the compressed tarball read from r,
+// failing on the first one extraction would refuse.
+func listTarball(w io.Writer, r io.Reader) error {
+	gr, err := newDecompressor(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		header.Name = entryName(header.Name)
+		if err := checkEntryName(header.Name); err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir, tar.TypeReg:
+		case tar.TypeSymlink:
+			header.Name += " -> " + header.Linkname
+		default:
+			return fmt.Errorf("Unrecognized tar entry type: %v", header.Typeflag)
+		}
+		fmt.Fprintf(w, "%s %12d %s %s\n", header.FileInfo().Mode(), header.Size, header.ModTime.Format("2006-01-02 15:04"), header.Name)
+	}
+}
+
+func runPack(args []string) {
+	packCmd := flag.NewFlagSet("pack", flag.ExitOnError)
+	packCmd.SetOutput(os.Stdout)
+	debug := packCmd.Bool("debug", false, "enable debug log")
+	output := packCmd.String("output", "", "the archive to write, - for stdout, defaults to <name>.tar.gz in the current dir")
+	var excludes patternList
+	packCmd.Var(&excludes, "exclude", "leave the paths matching this gitignore pattern out of directories, repeated or comma separated, on top of their .ftrignore files")
+	links := packCmd.String("links", linksSkip, "what to do with the symlinks in directories: skip them with a warning, preserve the links or follow them")
+	if err := packCmd.Parse(args); err != nil {
+		exitWithError(1, "Pack command failed: %v", err)
+	}
+	debugMode = *debug
+	if err := applyLinkMode(*links); err != nil {
+		exitWithError(1, "Invalid --links: %v", err)
+	}
+	excludePatterns = excludes
+	if packCmd.NArg() < 1 {
+		fmt.Println("Usage: ftr pack [--output <file>] [--links skip|preserve|follow] <dir> | <file>...")
+		os.Exit(1)
+	}
+	srcs := packCmd.Args()
+
+	dst := *output
+	if dst == "" {
+		if len(srcs) > 1 {
+			exitWithError(1, "--output is required to pack several files")
+		}
+		dst = sourceName(srcs[0]) + ".tar.gz"
+	}
+	if dst == "-" {
+		if err := packSources(os.Stdout, srcs); err != nil {
+			exitWithError(1, "Failed to pack: %v", err)
+		}
+		return
+	}
+	file, err := os.OpenFile(longPath(dst), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		exitWithError(1, "Failed to create the archive: %v", err)
+	}
+	err = packSources(file, srcs)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		exitWithError(1, "Failed to pack: %v", err)
+	}
+	fmt.Printf("Packed %d paths into %s\n", len(srcs), dst)
+}
+
+func runUnpack(args []string) {
+	unpackCmd := flag.NewFlagSet("unpack", flag.ExitOnError)
+	unpackCmd.SetOutput(os.Stdout)
+	debug := unpackCmd.Bool("debug", false, "enable debug log")
+	dest := unpackCmd.String("dest", "", "the dir to extract into, defaults to the archive name without .tar.gz like a receiver does")
+	list := unpackCmd.Bool("list", false, "only list and check the entries")
+	force := unpackCmd.Bool("force", false, "overwrite files that already exist")
+	if err := unpackCmd.Parse(args); err != nil {
+		exitWithError(1, "Unpack command failed: %v", err)
+	}
+	debugMode = *debug
+	if unpackCmd.NArg() != 1 {
+		fmt.Println("Usage: ftr unpack [--list] [--dest <dir>] [--force] <archive>|-")
+		os.Exit(1)
+	}
+	src := unpackCmd.Arg(0)
+
+	var r io.Reader = os.Stdin
+	if src != "-" {
+		file, err := os.Open(longPath(src))
+		if err != nil {
+			exitWithError(1, "Failed to open the archive: %v", err)
+		}
+		defer file.Close()
+		r = file
+	}
+	if *list {
+		if err := listTarball(os.Stdout, r); err != nil {
+			exitWithError(1, "Failed to list %s: %v", src, err)
+		}
+		return
+	}
+
+	dst := *dest
+	if dst == "" {
+		dir, err := tarballDir(filepath.Base(src))
+		if err != nil {
+			exitWithError(1, "--dest is required for %s: %v", src, err)
+		}
+		dst = dir
+	}
+	onConflict := conflictFail
+	if *force {
+		onConflict = conflictOverwrite
+	}
+	files, err := extractTarball(r, dst, onConflict, nil)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			exitWithError(1, "Failed to unpack %s: a file already exists in %s, use --force to overwrite it", src, dst)
+		}
+		exitWithError(1, "Failed to unpack %s: %v", src, err)
+	}
+	fmt.Printf("Unpacked %d files into %s\n", len(files), dst)
+}
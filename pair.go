@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const pairedPeersFileName = "paired_peers.json"
+
+const (
+	// pairNone is a peer that isn't paired, which the passkey decides on
+	pairNone = iota
+	// pairOK is a peer presenting the certificate it was paired with
+	pairOK
+	// pairMismatch claims the name of a paired peer without its certificate
+	pairMismatch
+)
+
+func defaultPairedPeersFile() string {
+	dir, err := stateDir()
+	if err != nil {
+		exitWithError(1, "Failed to get the state dir: %v", err)
+	}
+	return filepath.Join(dir, pairedPeersFileName)
+}
+
+// pairedPin returns the fingerprint the peer was paired with, if any.
+func pairedPin(peer string) (string, bool) {
+	pins, err := readPins(defaultPairedPeersFile())
+	if err != nil {
+		debugLog("Failed to read the paired peers: %v", err)
+		return "", false
+	}
+	fp, ok := pins[peer]
+	return fp, ok
+}
+
+// pairings are the certificate fingerprints of the peers paired with this
+// receiver through `ftr pair`. The file is read again whenever it changes,
+// so pairing a peer doesn't need a restart.
+type pairings struct {
+	file string
+
+	mu   sync.Mutex
+	mod  time.Time
+	pins map[string]string
+}
+
+func newPairings(file string) *pairings {
+	return &pairings{file: file, pins: map[string]string{}}
+}
+
+func (p *pairings) load() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fi, err := os.Stat(p.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			debugLog("Failed to stat the paired peers: %v", err)
+		}
+		p.pins, p.mod = map[string]string{}, time.Time{}
+		return p.pins
+	}
+	if fi.ModTime().Equal(p.mod) {
+		return p.pins
+	}
+	pins, err := readPins(p.file)
+	if err != nil {
+		// keep the last good pairings rather than letting everyone in
+		debugLog("Failed to read the paired peers: %v", err)
+		return p.pins
+	}
+	p.pins, p.mod = pins, fi.ModTime()
+	return p.pins
+}
+
+// check tells how a peer claiming the sender name is authenticated by the
+// certificate it presented, state being nil for a plain connection.
+func (p *pairings) check(state *tls.ConnectionState, sender string) int {
+	if p == nil {
+		return pairNone
+	}
+	pins := p.load()
+	if state != nil && len(state.PeerCertificates) > 0 {
+		fp := certFingerprint(state.PeerCertificates[0].Raw)
+		for _, pin := range pins {
+			if pin == fp {
+				return pairOK
+			}
+		}
+	}
+	if _, ok := pins[sender]; ok {
+		return pairMismatch
+	}
+	return pairNone
+}
+
+// identify returns the name of the paired peer whose certificate was
+// presented, empty for a plain connection or an unpaired certificate.
+func (p *pairings) identify(state *tls.ConnectionState) string {
+	if p == nil || state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	fp := certFingerprint(state.PeerCertificates[0].Raw)
+	for peer, pin := range p.load() {
+		if pin == fp {
+			return peer
+		}
+	}
+	return ""
+}
+
+// authorizedConn reports whether a peer may use the inbox: a paired peer
+// presenting its certificate always may, anyone else claiming the name of
+// one never, and the rest need the passkey.
+func (o receiverOptions) authorizedConn(state *tls.ConnectionState, sender, key string) bool {
+	switch o.paired.check(state, sender) {
+	case pairOK:
+		return true
+	case pairMismatch:
+		debugLog("Refusing %s, it's paired but didn't present its certificate", sender)
+		return false
+	}
+	return keyMatches(key, o.key())
+}
+
+func (o receiverOptions) authorized(r *http.Request) bool {
+	return o.authorizedConn(requestTLS(r), r.Header.Get(senderHeader), requestKey(r))
+}
+
+type tlsStateKey struct{}
+
+// tlsConnContext makes the TLS state of a connection the mux listener
+// decrypted available to the requests served on it.
+func tlsConnContext(ctx context.Context, c net.Conn) context.Context {
+	if state := connTLS(c); state != nil {
+		return context.WithValue(ctx, tlsStateKey{}, state)
+	}
+	return ctx
+}
+
+// connTLS returns the state of a TLS connection, or nil for a plain one.
+func connTLS(c net.Conn) *tls.ConnectionState {
+	if pc, ok := c.(*peekedConn); ok {
+		c = pc.Conn
+	}
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	return &state
+}
+
+func requestTLS(r *http.Request) *tls.ConnectionState {
+	state, _ := r.Context().Value(tlsStateKey{}).(*tls.ConnectionState)
+	return state
+}
+
+// fetchCertFingerprint connects to the peer over TLS and returns the
+// fingerprint of the certificate it presents, without trusting it yet.
+func fetchCertFingerprint(addr string, port int) (string, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(addr, strconv.Itoa(port)), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.New("the peer presented no certificate")
+	}
+	return certFingerprint(certs[0].Raw), nil
+}
+
+func runPair(args []string) {
+	pairCmd := flag.NewFlagSet("pair", flag.ExitOnError)
+	pairCmd.SetOutput(os.Stdout)
+	debug := pairCmd.Bool("debug", false, "enable debug log")
+	remove := pairCmd.Bool("remove", false, "unpair the peer")
+	lookupTimeout := pairCmd.Duration("lookup-timeout", defaultLookupTimeoutMs*time.Millisecond, "how long to browse for the peer per attempt")
+	lookupRetries := pairCmd.Int("lookup-retries", defaultLookupRetries, "the number of times to retry a failed peer lookup")
+	if err := pairCmd.Parse(args); err != nil {
+		exitWithError(1, "Pair command failed: %v", err)
+	}
+	debugMode = *debug
+	file := defaultPairedPeersFile()
+	pins, err := readPins(file)
+	if err != nil {
+		exitWithError(1, "Failed to read the paired peers: %v", err)
+	}
+
+	if pairCmd.NArg() == 0 {
+		cert, err := loadTLSCert()
+		if err != nil {
+			exitWithError(1, "Failed to load the TLS certificate: %v", err)
+		}
+		fmt.Printf("This node's fingerprint: %s\n", certFingerprint(cert.Certificate[0]))
+		var names []string
+		for name := range pins {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-20s %s\n", name, pins[name])
+		}
+		return
+	}
+	if pairCmd.NArg() > 2 || (*remove && pairCmd.NArg() != 1) {
+		fmt.Println("Usage: ftr pair [--remove] <peer> [<fingerprint>]")
+		os.Exit(1)
+	}
+	peer := pairCmd.Arg(0)
+
+	if *remove {
+		if _, ok := pins[peer]; !ok {
+			exitWithError(1, "%s isn't paired", peer)
+		}
+		delete(pins, peer)
+		if err := writePins(file, pins); err != nil {
+			exitWithError(1, "Failed to save the paired peers: %v", err)
+		}
+		fmt.Printf("Unpaired %s\n", peer)
+		return
+	}
+
+	fp := pairCmd.Arg(1)
+	if fp == "" {
+		e, err := findPeer(peer, *lookupTimeout, *lookupRetries)
+		if err != nil {
+			exitWithError(1, "Failed to find the peer: %v", err)
+		}
+		if !slices.Contains(e.Text, tlsTXT) {
+			exitWithError(1, "%s doesn't serve TLS", peer)
+		}
+		if fp, err = fetchCertFingerprint(peerAddr(e), e.Port); err != nil {
+			exitWithError(1, "Failed to get the certificate of %s: %v", peer, err)
+		}
+		if !confirm(fmt.Sprintf("Pair with %s, fingerprint %s?", peer, fp), defaultPromptTimeout) {
+			exitWithError(1, "Not paired")
+		}
+	}
+	pins[peer] = fp
+	if err := writePins(file, pins); err != nil {
+		exitWithError(1, "Failed to save the paired peers: %v", err)
+	}
+	fmt.Printf("Paired with %s\n", peer)
+}
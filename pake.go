@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"charleszheng44/filetransfer/internal/nistec"
+)
+
+const (
+	pakePath = "/pake"
+	// pakeTXT is advertised by receivers accepting PAKE uploads
+	pakeTXT = "pake=1"
+	// pakeConfirmHeader carries the sender's proof of the shared key, in
+	// place of the passkey
+	pakeConfirmHeader = "X-Ftr-Pake-Confirm"
+)
+
+// The SPAKE2 group is P-256 with the M and N points of RFC 9382, whose
+// discrete logarithms nobody knows. The sender is A and blinds with M, the
+// receiver is B and blinds with N.
+var (
+	pakeM = mustPakePoint("02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f")
+	pakeN = mustPakePoint("03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49")
+)
+
+const (
+	pakeSenderID   = "ftr-sender"
+	pakeReceiverID = "ftr-receiver"
+)
+
+func mustPakePoint(compressed string) *nistec.P256Point {
+	b, err := hex.DecodeString(compressed)
+	if err != nil {
+		panic(err)
+	}
+	p, err := nistec.NewP256Point().SetBytes(b)
+	if err != nil {
+		panic("invalid SPAKE2 point " + compressed)
+	}
+	return p
+}
+
+// pakeOrder is the order of P-256 as little-endian limbs.
+var pakeOrder = [4]uint64{0xf3b9cac2fc632551, 0xbce6faada7179e84, 0xffffffffffffffff, 0xffffffff00000000}
+
+// pakeScalar reduces the big-endian b modulo the order of the group in
+// constant time, one bit at a time, and returns the 32-byte big-endian
+// result.
+func pakeScalar(b []byte) []byte {
+	var r [4]uint64
+	for _, c := range b {
+		for i := 7; i >= 0; i-- {
+			top := r[3] >> 63
+			r[3] = r[3]<<1 | r[2]>>63
+			r[2] = r[2]<<1 | r[1]>>63
+			r[1] = r[1]<<1 | r[0]>>63
+			r[0] = r[0]<<1 | uint64(c>>i)&1
+			// subtract the order unless r was below it, r stays below it
+			var t [4]uint64
+			var borrow uint64
+			for k := range t {
+				t[k], borrow = bits.Sub64(r[k], pakeOrder[k], borrow)
+			}
+			mask := borrow&^top - 1
+			for k := range r {
+				r[k] = r[k]&^mask | t[k]&mask
+			}
+		}
+	}
+	out := make([]byte, 32)
+	for k := range r {
+		binary.BigEndian.PutUint64(out[24-8*k:], r[k])
+	}
+	return out
+}
+
+// pakePassword maps the passkey of an inbox to the SPAKE2 password scalar w.
+// RFC 9382 asks for a hash at least 128 bits longer than the order, so
+// reducing it is close to uniform.
+func pakePassword(passKey, inbox string) []byte {
+	sum := sha512.Sum512([]byte("ftr-pake\x00" + inbox + "\x00" + passKey))
+	return pakeScalar(sum[:])
+}
+
+// pakeSecret returns a fresh secret scalar.
+func pakeSecret() ([]byte, error) {
+	var b [48]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	return pakeScalar(b[:]), nil
+}
+
+// pakeShare returns the message blinding the public point of the secret
+// with the password, secret*G + w*M from the sender or secret*G + w*N from
+// the receiver.
+func pakeShare(secret, w []byte, blind *nistec.P256Point) ([]byte, error) {
+	p, err := nistec.NewP256Point().ScalarBaseMult(secret)
+	if err != nil {
+		return nil, err
+	}
+	b, err := nistec.NewP256Point().ScalarMult(blind, w)
+	if err != nil {
+		return nil, err
+	}
+	return p.Add(p, b).Bytes(), nil
+}
+
+// pakeShared unblinds the peer's message and multiplies it by the secret.
+// Only a peer that blinded it with the same password ends up at the same
+// point.
+func pakeShared(secret, w, msg []byte, blind *nistec.P256Point) ([]byte, error) {
+	p, err := nistec.NewP256Point().SetBytes(msg)
+	// the point at infinity is the only one encoded in a single byte
+	if err != nil || len(msg) == 1 {
+		return nil, errors.New("invalid SPAKE2 message")
+	}
+	b, err := nistec.NewP256Point().ScalarMult(blind, w)
+	if err != nil {
+		return nil, err
+	}
+	p.Add(p, b.Negate(1))
+	if _, err := p.ScalarMult(p, secret); err != nil {
+		return nil, err
+	}
+	k := p.Bytes()
+	if len(k) == 1 {
+		return nil, errors.New("invalid SPAKE2 message")
+	}
+	return k, nil
+}
+
+// pakeTranscript is the TT of RFC 9382, every part prefixed with its length
+// as a little-endian uint64.
+func pakeTranscript(idA, idB string, msgA, msgB, shared, w []byte) []byte {
+	var tt bytes.Buffer
+	for _, p := range [][]byte{[]byte(idA), []byte(idB), msgA, msgB, shared, w} {
+		binary.Write(&tt, binary.LittleEndian, uint64(len(p)))
+		tt.Write(p)
+	}
+	return tt.Bytes()
+}
+
+// pakeKeys are what both sides derive from a completed exchange: the key the
+// payload is sealed with and the MACs each side proves knowing it with.
+type pakeKeys struct {
+	transfer    []byte
+	senderMAC   []byte
+	receiverMAC []byte
+}
+
+// derivePakeKeys runs the key schedule of RFC 9382 for SHA-256, HKDF and
+// HMAC on the transcript. The additional data goes into the confirmation
+// keys, so the MACs only match if both sides agree on it.
+func derivePakeKeys(tt []byte, aad string) (pakeKeys, error) {
+	sum := sha256.Sum256(tt)
+	ke, ka := sum[:16], sum[16:]
+	kc, err := hkdf.Key(sha256.New, ka, nil, "ConfirmationKeys"+aad, 32)
+	if err != nil {
+		return pakeKeys{}, err
+	}
+	transfer, err := hkdf.Key(sha256.New, ke, nil, "ftr-pake-transfer"+aad, 32)
+	if err != nil {
+		return pakeKeys{}, err
+	}
+	mac := func(key []byte) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write(tt)
+		return h.Sum(nil)
+	}
+	return pakeKeys{transfer: transfer, senderMAC: mac(kc[:16]), receiverMAC: mac(kc[16:])}, nil
+}
+
+// pakeAAD binds the exchange to the file being offered.
+func pakeAAD(o offer) string {
+	return strings.Join([]string{o.Inbox, o.Name, o.Type, o.SHA256, o.Sender, fmt.Sprint(o.Size)}, "\x00")
+}
+
+// pakeOffer starts an exchange for the offered file with the sender's
+// SPAKE2 message.
+type pakeOffer struct {
+	Offer   offer  `json:"offer"`
+	Message []byte `json:"message"`
+}
+
+// pakeReply completes the exchange. The sender proves the shared key at
+// /pake/<ID>/confirm first, and then posts the payload to /pake/<ID> sealed
+// with the derived key, along with its MAC again.
+type pakeReply struct {
+	ID      string `json:"id"`
+	Message []byte `json:"message"`
+}
+
+// pakeConfirmation is the receiver's proof of the shared key, given only to
+// a sender that proved it first, so an offer alone tells nothing about the
+// passkey.
+type pakeConfirmation struct {
+	MAC []byte `json:"mac"`
+}
+
+// pakeHandler serves uploads keyed by a SPAKE2 exchange on the passkey,
+// which is never sent:
+//
+//	POST /pake               exchange the SPAKE2 messages for an offered file
+//	POST /pake/<id>/confirm  trade the sender's MAC for the receiver's
+//	POST /pake/<id>          deliver the sealed payload with the sender's MAC
+func pakeHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, pakePath), "/")
+		if id == "" {
+			handlePakeOffer(w, r, opts)
+			return
+		}
+		if id, ok := strings.CutSuffix(id, "/confirm"); ok {
+			session, ok := pakeSession(w, r, opts, id, false)
+			if !ok {
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(pakeConfirmation{MAC: session.proof})
+			return
+		}
+		session, ok := pakeSession(w, r, opts, id, true)
+		if !ok {
+			return
+		}
+		inbox, _ := opts.inbox(session.Inbox)
+		body, err := openStream(r.Body, session.key, session.SHA256)
+		if err != nil {
+			http.Error(w, "Failed to set up the decryption", http.StatusInternalServerError)
+			return
+		}
+		job, err := receiveUpload(inbox, upload{
+			name:        session.Name,
+			fileType:    session.Type,
+			size:        session.Size,
+			sender:      session.Sender,
+			address:     remoteHost(r.RemoteAddr),
+			body:        body,
+			extract:     wantsExtract(r.Header),
+			onConflict:  conflictHint(r.Header),
+			meta:        metaFromHeader(r.Header),
+			setDeadline: http.NewResponseController(w).SetReadDeadline,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), uploadStatus(err))
+			return
+		}
+		w.Header().Set(transferIDHeader, job.ID)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// pakeSession looks up the exchange id, taking it if take is set, and
+// checks the sender's MAC against it. A wrong MAC burns the exchange, so
+// each offer is a single guess, and is answered 401 for the guard to count
+// it like any wrong passkey.
+func pakeSession(w http.ResponseWriter, r *http.Request, opts receiverOptions, id string, take bool) (*approvedOffer, bool) {
+	lookup := opts.pakes.get
+	if take {
+		lookup = opts.pakes.take
+	}
+	session, ok := lookup(id)
+	if !ok {
+		http.Error(w, "Exchange not found or expired", http.StatusNotFound)
+		return nil, false
+	}
+	mac, err := hex.DecodeString(r.Header.Get(pakeConfirmHeader))
+	if err != nil || !hmac.Equal(mac, session.mac) {
+		opts.pakes.take(id)
+		recordHistory(opts.historyFile, historyEntry{
+			Direction: directionReceive,
+			Peer:      session.Sender,
+			File:      filepath.Base(session.Name),
+			Status:    statusFailed,
+			Error:     "Wrong passkey",
+		})
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	opts.guard.succeed(r.RemoteAddr)
+	return session, true
+}
+
+func handlePakeOffer(w http.ResponseWriter, r *http.Request, opts receiverOptions) {
+	var po pakeOffer
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&po); err != nil || po.Offer.Name == "" {
+		http.Error(w, "Invalid offer", http.StatusBadRequest)
+		return
+	}
+	o := po.Offer
+	inbox, ok := opts.inbox(o.Inbox)
+	if !ok {
+		http.Error(w, "Unknown inbox", http.StatusNotFound)
+		return
+	}
+	if o.Sender == "" {
+		o.Sender = senderName(r)
+	}
+
+	pw := pakePassword(inbox.key(), o.Inbox)
+	secret, err := pakeSecret()
+	if err != nil {
+		http.Error(w, "Failed to start the exchange", http.StatusInternalServerError)
+		return
+	}
+	shared, err := pakeShared(secret, pw, po.Message, pakeM)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg, err := pakeShare(secret, pw, pakeN)
+	if err != nil {
+		http.Error(w, "Failed to start the exchange", http.StatusInternalServerError)
+		return
+	}
+	tt := pakeTranscript(pakeSenderID, pakeReceiverID, po.Message, msg, shared, pw)
+	keys, err := derivePakeKeys(tt, pakeAAD(o))
+	if err != nil {
+		http.Error(w, "Failed to start the exchange", http.StatusInternalServerError)
+		return
+	}
+	id := newTransferID()
+	opts.pakes.add(id, &approvedOffer{offer: o, key: keys.transfer, mac: keys.senderMAC, proof: keys.receiverMAC, expires: time.Now().Add(offerTTL)})
+	debugLog("Started the exchange %s for %s from %s", id, o.Name, o.Sender)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pakeReply{ID: id, Message: msg})
+}
+
+// postPAKE uploads the file at src sealed with a key both sides derive from
+// the passkey through SPAKE2. The passkey itself never leaves the machine,
+// and a receiver not knowing it fails to prove the shared key before any of
+// the payload is sent.
+func postPAKE(src, fileType, hash string, opts sendOptions) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("failed to stat the source file: %v", err)
+	}
+	o := offer{
+		Inbox:  opts.inbox,
+		Name:   filepath.Base(src),
+		Type:   fileType,
+		Size:   fi.Size(),
+		SHA256: hash,
+		Sender: getDefaultName(),
+	}
+	pw := pakePassword(opts.key, opts.inbox)
+	secret, err := pakeSecret()
+	if err != nil {
+		return fmt.Errorf("failed to start the exchange: %v", err)
+	}
+	msg, err := pakeShare(secret, pw, pakeM)
+	if err != nil {
+		return fmt.Errorf("failed to start the exchange: %v", err)
+	}
+	body, err := json.Marshal(pakeOffer{Offer: o, Message: msg})
+	if err != nil {
+		return err
+	}
+	client := opts.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	base := opts.url(pakePath)
+	req, err := http.NewRequest(http.MethodPost, base, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create the http request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(senderHeader, o.Sender)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to start the exchange: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to start the exchange, server returned status: %s", resp.Status)
+	}
+	var reply pakeReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("failed to decode the reply to the exchange: %v", err)
+	}
+	shared, err := pakeShared(secret, pw, reply.Message, pakeN)
+	if err != nil {
+		return err
+	}
+	tt := pakeTranscript(pakeSenderID, pakeReceiverID, msg, reply.Message, shared, pw)
+	keys, err := derivePakeKeys(tt, pakeAAD(o))
+	if err != nil {
+		return fmt.Errorf("failed to derive the transfer key: %v", err)
+	}
+	if err := confirmPAKE(client, base+"/"+reply.ID, o.Sender, keys); err != nil {
+		return err
+	}
+
+	file, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open the source file: %v", err)
+	}
+	defer file.Close()
+	pr, pw2 := io.Pipe()
+	go func() {
+		pw2.CloseWithError(sealStream(pw2, &progressReader{r: file, p: opts.progress}, keys.transfer))
+	}()
+	defer pr.Close()
+	req, err = http.NewRequest(http.MethodPost, base+"/"+reply.ID, &throttledReader{r: pr, t: opts.throttle})
+	if err != nil {
+		return fmt.Errorf("failed to create the http request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(pakeConfirmHeader, hex.EncodeToString(keys.senderMAC))
+	req.Header.Set(senderHeader, o.Sender)
+	if !opts.extract {
+		req.Header.Set(extractHeader, "no")
+	}
+	if opts.onConflict != "" {
+		req.Header.Set(onConflictHeader, opts.onConflict)
+	}
+	opts.meta.setHeader(req.Header)
+	resp, err = client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send the file: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionRequired {
+		return errors.New("the peer asks to confirm every file, send with --confirm")
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to send the file, server returned status: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// confirmPAKE trades the sender's proof of the shared key at the exchange
+// url for the receiver's, and checks that one.
+func confirmPAKE(client *http.Client, url, sender string, keys pakeKeys) error {
+	req, err := http.NewRequest(http.MethodPost, url+"/confirm", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create the http request: %v", err)
+	}
+	req.Header.Set(pakeConfirmHeader, hex.EncodeToString(keys.senderMAC))
+	req.Header.Set(senderHeader, sender)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to confirm the exchange: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errors.New("the peer refused the passkey")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to confirm the exchange, server returned status: %s", resp.Status)
+	}
+	var c pakeConfirmation
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return fmt.Errorf("failed to decode the confirmation of the exchange: %v", err)
+	}
+	if !hmac.Equal(c.MAC, keys.receiverMAC) {
+		return errors.New("the peer doesn't know the passkey, or someone tampered with the exchange")
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestPakeRFC9382 checks the exchange against the P-256, SHA-256, HKDF and
+// HMAC test vector of RFC 9382 Appendix B, with A = "server", B = "client"
+// and no additional data.
+func TestPakeRFC9382(t *testing.T) {
+	w := unhex(t, "2ee57912099d31560b3a44b1184b9b4866e904c49d12ac5042c97dca461b1a5f")
+	x := unhex(t, "43dd0fd7215bdcb482879fca3220c6a968e66d70b1356cac18bb26c84a78d729")
+	y := unhex(t, "dcb60106f276b02606d8ef0a328c02e4b629f84f89786af5befb0bc75b6e66be")
+	wantA := unhex(t, "04a56fa807caaa53a4d28dbb9853b9815c61a411118a6fe516a8798434751470f9010153ac33d0d5f2047ffdb1a3e42c9b4e6be662766e1eeb4116988ede5f912c")
+	wantB := unhex(t, "0406557e482bd03097ad0cbaa5df82115460d951e3451962f1eaf4367a420676d09857ccbc522686c83d1852abfa8ed6e4a1155cf8f1543ceca528afb591a1e0b7")
+	wantK := unhex(t, "0412af7e89717850671913e6b469ace67bd90a4df8ce45c2af19010175e37eed69f75897996d539356e2fa6a406d528501f907e04d97515fbe83db277b715d3325")
+	wantCA := unhex(t, "58ad4aa88e0b60d5061eb6b5dd93e80d9c4f00d127c65b3b35b1b5281fee38f0")
+	wantCB := unhex(t, "d3e2e547f1ae04f2dbdbf0fc4b79f8ecff2dff314b5d32fe9fcef2fb26dc459b")
+
+	pA, err := pakeShare(x, w, pakeM)
+	if err != nil || !bytes.Equal(pA, wantA) {
+		t.Fatalf("pA = %x, %v, want %x", pA, err, wantA)
+	}
+	pB, err := pakeShare(y, w, pakeN)
+	if err != nil || !bytes.Equal(pB, wantB) {
+		t.Fatalf("pB = %x, %v, want %x", pB, err, wantB)
+	}
+	kA, err := pakeShared(x, w, pB, pakeN)
+	if err != nil || !bytes.Equal(kA, wantK) {
+		t.Fatalf("K of A = %x, %v, want %x", kA, err, wantK)
+	}
+	kB, err := pakeShared(y, w, pA, pakeM)
+	if err != nil || !bytes.Equal(kB, wantK) {
+		t.Fatalf("K of B = %x, %v, want %x", kB, err, wantK)
+	}
+	keys, err := derivePakeKeys(pakeTranscript("server", "client", pA, pB, wantK, w), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys.senderMAC, wantCA) {
+		t.Errorf("cA = %x, want %x", keys.senderMAC, wantCA)
+	}
+	if !bytes.Equal(keys.receiverMAC, wantCB) {
+		t.Errorf("cB = %x, want %x", keys.receiverMAC, wantCB)
+	}
+}
+
+func TestPakeScalar(t *testing.T) {
+	n, _ := new(big.Int).SetString("ffffffff00000000ffffffffffffffffbce6faada7179e84f3b9cac2fc632551", 16)
+	inputs := [][]byte{
+		{},
+		n.Bytes(),
+		new(big.Int).Sub(n, big.NewInt(1)).Bytes(),
+		bytes.Repeat([]byte{0xff}, 64),
+	}
+	for range 100 {
+		b := make([]byte, 64)
+		rand.Read(b)
+		inputs = append(inputs, b)
+	}
+	for _, b := range inputs {
+		want := new(big.Int).Mod(new(big.Int).SetBytes(b), n).FillBytes(make([]byte, 32))
+		if got := pakeScalar(b); !bytes.Equal(got, want) {
+			t.Errorf("pakeScalar(%x) = %x, want %x", b, got, want)
+		}
+	}
+}
+
+func TestPakeWrongPasskey(t *testing.T) {
+	exchange := func(senderKey, receiverKey string) (pakeKeys, pakeKeys) {
+		t.Helper()
+		o := offer{Name: "a.txt", Size: 1}
+		wA, wB := pakePassword(senderKey, ""), pakePassword(receiverKey, "")
+		x, _ := pakeSecret()
+		y, _ := pakeSecret()
+		pA, err := pakeShare(x, wA, pakeM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pB, err := pakeShare(y, wB, pakeN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kA, err := pakeShared(x, wA, pB, pakeN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kB, err := pakeShared(y, wB, pA, pakeM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, _ := derivePakeKeys(pakeTranscript(pakeSenderID, pakeReceiverID, pA, pB, kA, wA), pakeAAD(o))
+		b, _ := derivePakeKeys(pakeTranscript(pakeSenderID, pakeReceiverID, pA, pB, kB, wB), pakeAAD(o))
+		return a, b
+	}
+	a, b := exchange("secret", "secret")
+	if !hmac.Equal(a.senderMAC, b.senderMAC) || !hmac.Equal(a.receiverMAC, b.receiverMAC) || !bytes.Equal(a.transfer, b.transfer) {
+		t.Error("the same passkey derived different keys")
+	}
+	a, b = exchange("secret", "guess")
+	if hmac.Equal(a.senderMAC, b.senderMAC) || hmac.Equal(a.receiverMAC, b.receiverMAC) || bytes.Equal(a.transfer, b.transfer) {
+		t.Error("a wrong passkey derived the same keys")
+	}
+}
+
+func TestPakeRejectsInfinity(t *testing.T) {
+	x, _ := pakeSecret()
+	if _, err := pakeShared(x, pakePassword("secret", ""), []byte{0}, pakeN); err == nil {
+		t.Error("accepted the point at infinity as a message")
+	}
+}
+
+// TestPakeGuard checks that a receiver only proves the key to a sender that
+// proved it first, and that wrong MACs lock the address out.
+func TestPakeGuard(t *testing.T) {
+	opts := receiverOptions{passKey: "secret", pakes: newOfferApprovals(), guard: newAuthGuard()}
+	srv := httptest.NewServer(guardMiddleware(opts, pakeHandler(opts)))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+	src := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(src, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	send := sendOptions{key: "guess", addr: u.Hostname(), port: port, client: srv.Client()}
+
+	for i := 0; i <= authFreeFailures; i++ {
+		if err := postPAKE(src, "text/plain", "", send); err == nil || !strings.Contains(err.Error(), "refused") {
+			t.Fatalf("attempt %d: got %v, want the passkey refused", i, err)
+		}
+	}
+	if _, ok := opts.guard.lockedOut(u.Host); !ok {
+		t.Fatal("wrong MACs didn't lock the address out")
+	}
+	body, _ := json.Marshal(pakeOffer{Offer: offer{Name: "a.txt"}, Message: []byte{4}})
+	resp, err := srv.Client().Post(srv.URL+pakePath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("offer from a locked out address answered %s", resp.Status)
+	}
+}
+
+func TestPakeReplyWithholdsMAC(t *testing.T) {
+	opts := receiverOptions{passKey: "secret", pakes: newOfferApprovals()}
+	x, _ := pakeSecret()
+	msg, err := pakeShare(x, pakePassword("guess", ""), pakeM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(pakeOffer{Offer: offer{Name: "a.txt"}, Message: msg})
+	rec := httptest.NewRecorder()
+	pakeHandler(opts)(rec, httptest.NewRequest(http.MethodPost, pakePath, bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("offer answered %d", rec.Code)
+	}
+	var reply map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reply["mac"]; ok {
+		t.Error("the receiver proved the key before the sender did")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	pastePath = "/paste"
+	// pasteSection maps sender names to the paste mode of their snippets
+	pasteSection = "paste"
+	// pasteMaxSize is the largest snippet, larger payloads are files
+	pasteMaxSize = 1 << 20
+)
+
+// The paste modes of a receiver: what it does with the snippets of a sender.
+const (
+	pasteFile      = "file"
+	pastePrint     = "print"
+	pasteClipboard = "clipboard"
+)
+
+// pasteModes are the paste modes of the receiver, per sender. A nil
+// pasteModes keeps every snippet as a file.
+type pasteModes struct {
+	fallback string
+	peers    map[string]string
+}
+
+// loadPasteModes reads the paste modes of the senders under `[paste]`, mode
+// applying to the others:
+//
+//	[paste]
+//	laptop = clipboard
+//	phone = print
+func loadPasteModes(cfg *config, mode string) (*pasteModes, error) {
+	modes := &pasteModes{fallback: mode, peers: map[string]string{}}
+	if err := checkPasteMode(mode); err != nil {
+		return nil, err
+	}
+	for peer, m := range cfg.section(pasteSection) {
+		if err := checkPasteMode(m); err != nil {
+			return nil, fmt.Errorf("[paste] %s: %v", peer, err)
+		}
+		modes.peers[peer] = m
+	}
+	return modes, nil
+}
+
+func checkPasteMode(mode string) error {
+	switch mode {
+	case pasteFile, pastePrint, pasteClipboard:
+		return nil
+	}
+	return fmt.Errorf("unsupported paste mode %s, use file, print or clipboard", mode)
+}
+
+// modeFor returns the paste mode of the sender's snippets.
+func (m *pasteModes) modeFor(sender string) string {
+	if m == nil {
+		return pasteFile
+	}
+	if mode, ok := m.peers[sender]; ok {
+		return mode
+	}
+	return m.fallback
+}
+
+// pasteResult answers a snippet with what the receiver did with it.
+type pasteResult struct {
+	Mode string `json:"mode"`
+	File string `json:"file,omitempty"`
+}
+
+// pasteHandler receives text snippets and prints them, copies them to the
+// clipboard or keeps them in the drop dir, as the paste mode of the sender
+// says.
+func pasteHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		text, err := io.ReadAll(io.LimitReader(r.Body, pasteMaxSize+1))
+		if err != nil {
+			http.Error(w, "Failed to read the snippet", http.StatusBadRequest)
+			return
+		}
+		if len(text) > pasteMaxSize {
+			http.Error(w, "Snippet exceeds the maximum size, send it as a file", http.StatusRequestEntityTooLarge)
+			return
+		}
+		sender := senderName(r)
+		result := pasteResult{Mode: opts.paste.modeFor(sender)}
+		entry := historyEntry{
+			Time:      time.Now(),
+			Direction: directionReceive,
+			Peer:      sender,
+			File:      "snippet",
+			Bytes:     int64(len(text)),
+			Status:    statusOK,
+		}
+		switch result.Mode {
+		case pastePrint:
+			fmt.Printf("Snippet from %s:\n%s\n", sender, strings.TrimRight(printableText(text), "\n"))
+			recordHistory(opts.historyFile, entry)
+		case pasteClipboard:
+			err := writeClipboard(text)
+			if err == nil {
+				fmt.Fprintf(infoOut, "Copied a snippet of %s from %s to the clipboard\n", formatBytes(entry.Bytes), sender)
+				recordHistory(opts.historyFile, entry)
+				break
+			}
+			logger.Warn("Failed to copy the snippet to the clipboard, keeping it as a file", "peer", sender, "error", err)
+			result.Mode = pasteFile
+			fallthrough
+		case pasteFile:
+			job, err := receiveUpload(opts, upload{
+				name:        time.Now().Format("snippet-20060102-150405.txt"),
+				fileType:    fileTypeFile,
+				size:        int64(len(text)),
+				sender:      sender,
+				address:     remoteHost(r.RemoteAddr),
+				certificate: clientCert(r.TLS),
+				body:        bytes.NewReader(text),
+				extract:     true,
+				onConflict:  conflictRename,
+			})
+			if err != nil {
+				http.Error(w, err.Error(), uploadStatus(err))
+				return
+			}
+			result.File = job.File
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// printableText drops the control characters of the text but newlines and
+// tabs, so a snippet can't drive the terminal it's printed to.
+func printableText(text []byte) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || !unicode.IsControl(r) {
+			return r
+		}
+		return -1
+	}, string(text))
+}
+
+func runPaste(args []string) {
+	pasteCmd := flag.NewFlagSet("paste", flag.ExitOnError)
+	pasteCmd.SetOutput(os.Stdout)
+	key := pasteCmd.String("key", "", "pre-shared passkey, defaults to the one of the peer in the [keys] config section")
+	debug := pasteCmd.Bool("debug", false, "enable debug log")
+	configFile := pasteCmd.String("config", defaultConfigFile(), "the path to the config file")
+	lookupTimeout := pasteCmd.Duration("lookup-timeout", defaultLookupTimeoutMs*time.Millisecond, "how long to browse for the peer per attempt")
+	lookupRetries := pasteCmd.Int("lookup-retries", defaultLookupRetries, "the number of times to retry a failed peer lookup")
+	if err := pasteCmd.Parse(args); err != nil {
+		exitWithError(1, "Paste command failed: %v", err)
+	}
+	debugMode = *debug
+	if pasteCmd.NArg() != 1 {
+		fmt.Println("Usage: ftr paste [--key <key>] <peer>")
+		os.Exit(1)
+	}
+	peer := pasteCmd.Arg(0)
+	cfg := mustLoadConfig(*configFile)
+
+	// piped text wins over the clipboard
+	var text []byte
+	var err error
+	if fi, statErr := os.Stdin.Stat(); statErr == nil && fi.Mode()&os.ModeCharDevice == 0 {
+		debugLog("Reading the snippet from stdin")
+		text, err = io.ReadAll(io.LimitReader(os.Stdin, pasteMaxSize+1))
+	} else {
+		debugLog("Reading the snippet from the clipboard")
+		text, err = readClipboard()
+	}
+	if err != nil {
+		exitWithError(1, "Failed to read the snippet: %v", err)
+	}
+	if len(text) == 0 {
+		exitWithError(1, "Nothing to paste")
+	}
+	if len(text) > pasteMaxSize {
+		exitWithError(1, "The snippet is larger than %s, send it as a file", formatBytes(pasteMaxSize))
+	}
+
+	e, err := findPeer(peer, *lookupTimeout, *lookupRetries)
+	if err != nil {
+		exitWithError(1, "Failed to find the peer: %v", err)
+	}
+	tlsConfig := peerTLS(peer, e.Text)
+	req, err := http.NewRequest(http.MethodPost, peerURL(tlsConfig, peerAddr(e), e.Port, pastePath), bytes.NewReader(text))
+	if err != nil {
+		exitWithError(1, "Failed to create the http request: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set(passKeyHeader, peerKey(pasteCmd, cfg, peer, "", *key))
+	req.Header.Set(senderHeader, getDefaultName())
+	resp, err := tlsClient(tlsConfig).Do(req)
+	if err != nil {
+		exitWithError(1, "Failed to send the snippet: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		exitWithError(1, "The peer refused the snippet: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var result pasteResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		exitWithError(1, "Failed to decode the answer of the peer: %v", err)
+	}
+	switch result.Mode {
+	case pastePrint:
+		fmt.Printf("Pasted %s to %s, it printed it\n", formatBytes(int64(len(text))), peer)
+	case pasteClipboard:
+		fmt.Printf("Pasted %s to %s, it's in its clipboard\n", formatBytes(int64(len(text))), peer)
+	default:
+		fmt.Printf("Pasted %s to %s as %s\n", formatBytes(int64(len(text))), peer, result.File)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	peerCacheFileName      = "peers.json"
+	defaultPeerCacheTTLSec = 60
+)
+
+// cachedPeer is what a send learnt about a peer, reused by the sends that
+// follow within the TTL to skip the mDNS lookup.
+type cachedPeer struct {
+	Addr string `json:"addr"`
+	Port int    `json:"port"`
+	// Text holds the TXT records the peer advertises, such as its inboxes
+	Text    []string  `json:"text,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+var peerCacheMu sync.Mutex
+
+func defaultPeerCacheFile() string {
+	dir, err := stateDir()
+	if err != nil {
+		exitWithError(1, "Failed to get the state dir: %v", err)
+	}
+	return filepath.Join(dir, peerCacheFileName)
+}
+
+func readPeerCache(file string) (map[string]cachedPeer, error) {
+	peers := map[string]cachedPeer{}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return peers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+	return peers, nil
+}
+
+// updatePeerCache applies fn to the cache and writes it back, dropping the
+// expired entries.
+func updatePeerCache(file string, fn func(map[string]cachedPeer)) error {
+	peerCacheMu.Lock()
+	defer peerCacheMu.Unlock()
+	peers, err := readPeerCache(file)
+	if err != nil {
+		// a corrupt cache is only a missed shortcut, start over
+		debugLog("Discarding the peer cache: %v", err)
+		peers = map[string]cachedPeer{}
+	}
+	fn(peers)
+	now := time.Now()
+	for name, p := range peers {
+		if now.After(p.Expires) {
+			delete(peers, name)
+		}
+	}
+	data, err := json.Marshal(peers)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	// replace the file atomically as concurrent sends may share it
+	tmp := fmt.Sprintf("%s.%d", file, os.Getpid())
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// cachedLookup returns the cached peer if it hasn't expired.
+func cachedLookup(file, peer string) (cachedPeer, bool) {
+	if file == "" {
+		return cachedPeer{}, false
+	}
+	peers, err := readPeerCache(file)
+	if err != nil {
+		debugLog("Failed to read the peer cache: %v", err)
+		return cachedPeer{}, false
+	}
+	p, ok := peers[peer]
+	if !ok || time.Now().After(p.Expires) {
+		return cachedPeer{}, false
+	}
+	return p, true
+}
+
+func cachePeer(file, peer string, p cachedPeer, ttl time.Duration) {
+	if file == "" || ttl <= 0 {
+		return
+	}
+	p.Expires = time.Now().Add(ttl)
+	if err := updatePeerCache(file, func(peers map[string]cachedPeer) { peers[peer] = p }); err != nil {
+		debugLog("Failed to cache the peer %s: %v", peer, err)
+	}
+}
+
+// evictPeer forgets the peer, e.g. after a send to its cached address failed.
+func evictPeer(file, peer string) {
+	if file == "" {
+		return
+	}
+	if err := updatePeerCache(file, func(peers map[string]cachedPeer) { delete(peers, peer) }); err != nil {
+		debugLog("Failed to evict the peer %s from the cache: %v", peer, err)
+	}
+}
+
+// resolvePeer returns the address of the peer from the cache, or looks it up
+// and caches it for ttl. cached reports whether the cache was used.
+func resolvePeer(peer, cacheFile string, ttl, timeout time.Duration, retries int) (p cachedPeer, cached bool, err error) {
+	if ttl > 0 {
+		if p, ok := cachedLookup(cacheFile, peer); ok {
+			debugLog("Using the cached address %s of %s", net.JoinHostPort(p.Addr, strconv.Itoa(p.Port)), peer)
+			return p, true, nil
+		}
+	}
+	e, err := findPeer(peer, timeout, retries)
+	if err != nil {
+		return p, false, err
+	}
+	p = cachedPeer{Addr: peerAddr(e), Port: e.Port, Text: e.Text}
+	fmt.Fprintf(infoOut, "Found the peer %s with ip %s and port %d\n", e.HostName, p.Addr, e.Port)
+	cachePeer(cacheFile, peer, p, ttl)
+	return p, false, nil
+}
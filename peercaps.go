@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	peerCapsFileName      = "capabilities.json"
+	defaultPeerCapsTTLSec = 24 * 60 * 60
+
+	// versionTXTPrefix advertises protocolVersion, which is bumped whenever
+	// receivers change in a way that makes what senders cached about them
+	// stale
+	versionTXTPrefix = "ver="
+	protocolVersion  = "1"
+)
+
+// peerCaps is what sends learnt about a peer by asking it, keyed by the
+// identity of the peer, so the sends that follow can skip the preflight
+// requests. The cache is dropped when the peer advertises another protocol
+// version or presents another certificate. A nil peerCaps caches nothing.
+type peerCaps struct {
+	Version string `json:"version"`
+	// Fingerprint is the pinned certificate of the peer, empty without TLS
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Dicts are the compression dictionaries the peer holds
+	Dicts   []string  `json:"dicts,omitempty"`
+	Expires time.Time `json:"expires"`
+
+	key   string
+	peer  string
+	tls   bool
+	dirty bool
+}
+
+var peerCapsMu sync.Mutex
+
+func defaultPeerCapsFile() string {
+	dir, err := stateDir()
+	if err != nil {
+		exitWithError(1, "Failed to get the state dir: %v", err)
+	}
+	return filepath.Join(dir, peerCapsFileName)
+}
+
+// advertisedVersion returns the protocol version the peer advertises, empty
+// for receivers older than the version record.
+func advertisedVersion(text []string) string {
+	for _, t := range text {
+		if v, ok := strings.CutPrefix(t, versionTXTPrefix); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// peerCapsKey identifies the peer by its node key when it advertises one, so
+// the cache follows the peer across names and addresses.
+func peerCapsKey(peer string, text []string) string {
+	if node := advertisedNode(text); node != "" {
+		return nodeTXTPrefix + node
+	}
+	return "name=" + peer
+}
+
+func readPeerCaps(file string) (map[string]*peerCaps, error) {
+	caps := map[string]*peerCaps{}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return caps, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &caps); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+	return caps, nil
+}
+
+// loadPeerCaps returns the capabilities cached for the peer, or empty ones
+// to fill in when they're missing, expired or stale. It returns nil without
+// a cache file or with a ttl of 0.
+func loadPeerCaps(file, peer string, text []string, ttl time.Duration) *peerCaps {
+	if file == "" || ttl <= 0 {
+		return nil
+	}
+	fresh := &peerCaps{
+		Version: advertisedVersion(text),
+		key:     peerCapsKey(peer, text),
+		peer:    peer,
+		tls:     slices.Contains(text, tlsTXT),
+	}
+	fresh.Fingerprint = fresh.pinned()
+	all, err := readPeerCaps(file)
+	if err != nil {
+		debugLog("Failed to read the peer capability cache: %v", err)
+		return fresh
+	}
+	c, ok := all[fresh.key]
+	switch {
+	case !ok || time.Now().After(c.Expires):
+		return fresh
+	case c.Version != fresh.Version:
+		debugLog("%s advertises protocol version %q, dropping its cached capabilities", peer, fresh.Version)
+		fresh.dirty = true
+		return fresh
+	case fresh.Fingerprint != "" && c.Fingerprint != fresh.Fingerprint:
+		debugLog("%s presents another certificate, dropping its cached capabilities", peer)
+		fresh.dirty = true
+		return fresh
+	}
+	c.key, c.peer, c.tls = fresh.key, fresh.peer, fresh.tls
+	return c
+}
+
+// pinned returns the fingerprint pinned for the peer, which a first send
+// over TLS only pins once it connects.
+func (c *peerCaps) pinned() string {
+	if !c.tls {
+		return ""
+	}
+	pins, err := readPins(defaultKnownPeersFile())
+	if err != nil {
+		debugLog("Failed to read the pinned certificates: %v", err)
+	}
+	return pins[c.peer]
+}
+
+func (c *peerCaps) holdsDict(id string) bool {
+	return c != nil && slices.Contains(c.Dicts, id)
+}
+
+func (c *peerCaps) addDict(id string) {
+	if c == nil || slices.Contains(c.Dicts, id) {
+		return
+	}
+	c.Dicts = append(c.Dicts, id)
+	c.dirty = true
+}
+
+// save writes the capabilities back when they changed, for ttl from now.
+func (c *peerCaps) save(file string, ttl time.Duration) {
+	if c == nil || !c.dirty {
+		return
+	}
+	c.Fingerprint = c.pinned()
+	c.Expires = time.Now().Add(ttl)
+	err := updatePeerCaps(file, func(all map[string]*peerCaps) { all[c.key] = c })
+	if err != nil {
+		debugLog("Failed to cache the capabilities of the peer: %v", err)
+	}
+}
+
+// forget drops the cached capabilities, e.g. after an upload relying on them
+// failed.
+func (c *peerCaps) forget(file string) {
+	if c == nil {
+		return
+	}
+	err := updatePeerCaps(file, func(all map[string]*peerCaps) { delete(all, c.key) })
+	if err != nil {
+		debugLog("Failed to drop the cached capabilities of the peer: %v", err)
+	}
+}
+
+// updatePeerCaps applies fn to the cache and writes it back, dropping the
+// expired entries.
+func updatePeerCaps(file string, fn func(map[string]*peerCaps)) error {
+	peerCapsMu.Lock()
+	defer peerCapsMu.Unlock()
+	all, err := readPeerCaps(file)
+	if err != nil {
+		debugLog("Discarding the peer capability cache: %v", err)
+		all = map[string]*peerCaps{}
+	}
+	fn(all)
+	now := time.Now()
+	for key, c := range all {
+		if now.After(c.Expires) {
+			delete(all, key)
+		}
+	}
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d", file, os.Getpid())
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,32 @@
+package main
+
+import "flag"
+
+const peerKeysSection = "keys"
+
+// peerKey returns the passkey to send to the peer with: the --key given on
+// the command line or by a profile, or else the one the `[keys]` config
+// section holds for the peer, the "<peer>/<inbox>" entry taking precedence
+// for an inbox:
+//
+//	[keys]
+//	nas = secret
+//	nas/backups = other-secret
+func peerKey(fs *flag.FlagSet, cfg *config, peer, inbox, key string) string {
+	explicit := false
+	fs.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "key" })
+	if explicit {
+		return key
+	}
+	keys := cfg.section(peerKeysSection)
+	if inbox != "" {
+		if k, ok := keys[peer+"/"+inbox]; ok {
+			return k
+		}
+	}
+	if k, ok := keys[peer]; ok {
+		debugLog("Using the key of %s from the config", peer)
+		return k
+	}
+	return key
+}
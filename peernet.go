@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// peerNetwork is how receivers listen, and senders find and reach them. The
+// default goes through sockets and mDNS; a memNetwork keeps everything in
+// the process, so send and receive flows run without either.
+type peerNetwork interface {
+	// Listen accepts the connections to addr, a host:port.
+	Listen(network, addr string) (net.Listener, error)
+	// ListenPacket serves the UDP uploads at addr.
+	ListenPacket(network, addr string) (net.PacketConn, error)
+	// DialContext connects to a receiver at addr, a host:port.
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	// Browse sends the receivers found to entries and closes it once ctx
+	// is done, as zeroconf does.
+	Browse(ctx context.Context, entries chan<- *zeroconf.ServiceEntry) error
+}
+
+// peerNet is the network the receiver, the uploads and the peer lookups go
+// through; other connections always use sockets.
+var peerNet peerNetwork = systemNetwork{}
+
+// systemNetwork is the real network: TCP and UDP sockets, and mDNS.
+type systemNetwork struct{}
+
+func (systemNetwork) Listen(network, addr string) (net.Listener, error) {
+	return net.Listen(network, addr)
+}
+
+func (systemNetwork) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return net.ListenPacket(network, addr)
+}
+
+func (systemNetwork) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func (systemNetwork) Browse(ctx context.Context, entries chan<- *zeroconf.ServiceEntry) error {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		return fmt.Errorf("failed to get the peer resolver: %v", err)
+	}
+	if err := resolver.Browse(ctx, service, domain, entries); err != nil {
+		return fmt.Errorf("failed to browse the peers: %v", err)
+	}
+	return nil
+}
+
+// memNetwork is a peerNetwork in memory. Receivers listen on made up
+// addresses, every dial is a net.Pipe handed to the listener of its address,
+// and browsing finds the receivers advertised with advertise. There is no
+// UDP, so uploads with forward error correction aren't served.
+type memNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+	entries   []*zeroconf.ServiceEntry
+	// nextPort numbers the ports given to :0 and to dialing ends
+	nextPort int
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{listeners: map[string]*memListener{}, nextPort: 40000}
+}
+
+// memHost is the address of every end of a memNetwork; it's a loopback one,
+// as the peers are all in the same process.
+var memHost = net.IPv4(127, 0, 0, 1)
+
+func (n *memNetwork) Listen(network, addr string) (net.Listener, error) {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", p)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if port == 0 {
+		n.nextPort++
+		port = n.nextPort
+	}
+	key := net.JoinHostPort(memHost.String(), strconv.Itoa(port))
+	if _, ok := n.listeners[key]; ok {
+		return nil, fmt.Errorf("listen %s %s: address already in use", network, addr)
+	}
+	l := &memListener{
+		net:   n,
+		addr:  &net.TCPAddr{IP: memHost, Port: port},
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	n.listeners[key] = l
+	return l, nil
+}
+
+func (n *memNetwork) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// DialContext connects to the listener at addr, whatever its host as long as
+// it's an address of the network.
+func (n *memNetwork) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	l, ok := n.listeners[net.JoinHostPort(memHost.String(), port)]
+	n.nextPort++
+	local := &net.TCPAddr{IP: memHost, Port: n.nextPort}
+	n.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %s %s: connection refused", network, addr)
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- memConn{Conn: server, local: l.addr, remote: local}:
+		return memConn{Conn: client, local: local, remote: l.addr}, nil
+	case <-l.done:
+		return nil, fmt.Errorf("dial %s %s: connection refused", network, addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// advertise makes the receiver name listening at port show up in browses
+// with the TXT records.
+func (n *memNetwork) advertise(name string, port int, txt []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.entries = append(n.entries, &zeroconf.ServiceEntry{
+		ServiceRecord: *zeroconf.NewServiceRecord(name, service, domain),
+		HostName:      name + ".local.",
+		Port:          port,
+		Text:          txt,
+		AddrIPv4:      []net.IP{memHost},
+	})
+}
+
+// close closes every listener of the network, which stops the receivers
+// serving on them.
+func (n *memNetwork) close() {
+	n.mu.Lock()
+	var listeners []*memListener
+	for _, l := range n.listeners {
+		listeners = append(listeners, l)
+	}
+	n.mu.Unlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+func (n *memNetwork) Browse(ctx context.Context, entries chan<- *zeroconf.ServiceEntry) error {
+	n.mu.Lock()
+	found := append([]*zeroconf.ServiceEntry(nil), n.entries...)
+	n.mu.Unlock()
+	go func() {
+		defer close(entries)
+		for _, e := range found {
+			select {
+			case entries <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+	return nil
+}
+
+// memListener accepts the connections dialed to its address.
+type memListener struct {
+	net       *memNetwork
+	addr      *net.TCPAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.net.mu.Lock()
+		delete(l.net.listeners, l.addr.String())
+		l.net.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memConn gives a pipe the TCP addresses of its ends.
+type memConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c memConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c memConn) RemoteAddr() net.Addr {
+	return c.remote
+}
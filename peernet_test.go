@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startMemReceiver serves a receiver named name on the in-memory network
+// until the test ends, and returns its drop dir.
+func startMemReceiver(t *testing.T, mem *memNetwork, name, key string) string {
+	t.Helper()
+	state := t.TempDir()
+	opts := receiverOptions{
+		dropDir:     t.TempDir(),
+		passKey:     key,
+		receipts:    newReceiptIndex(0),
+		dictDir:     filepath.Join(state, "dicts"),
+		guests:      newGuestCodes(),
+		links:       newRequestLinks(),
+		control:     newReceiverControl(),
+		chunked:     newChunkedUploads(),
+		activity:    newActivityTracker(0, 0),
+		transfers:   newTransferManager(),
+		load:        newLoadMeter(),
+		events:      newEventHub(),
+		offers:      newOfferApprovals(),
+		pakes:       newOfferApprovals(),
+		extractions: newExtractionSlots(0),
+		autoExtract: true,
+		paired:      newPairings(filepath.Join(state, "paired_peers.json")),
+	}
+	opts.replicator = newReplicator(nil, "", opts.tcp, false)
+	ln, err := listenReceiver(0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.port = ln.Addr().(*net.TCPAddr).Port
+	mem.advertise(name, opts.port, []string{opts.dropDir})
+	server := &http.Server{}
+	errc := make(chan error, 1)
+	go startReceiverServer(opts, ln, server, errc)
+	t.Cleanup(func() {
+		server.Close()
+		select {
+		case err := <-errc:
+			t.Errorf("receiver failed: %v", err)
+		default:
+		}
+	})
+	return opts.dropDir
+}
+
+// useMemNetwork points ftr at a fresh in-memory network for the test.
+func useMemNetwork(t *testing.T) *memNetwork {
+	mem := newMemNetwork()
+	n, out := peerNet, infoOut
+	t.Cleanup(func() {
+		mem.close()
+		peerNet, infoOut = n, out
+	})
+	peerNet, infoOut = mem, io.Discard
+	return mem
+}
+
+func TestMemNetworkSendReceive(t *testing.T) {
+	mem := useMemNetwork(t)
+	dropDir := startMemReceiver(t, mem, "mem", "secret")
+	content := []byte("hello over a pipe\n")
+	src := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := findPeer("mem", time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, transport := range []string{transportHTTP, transportTCP} {
+		t.Run(transport, func(t *testing.T) {
+			opts := sendOptions{
+				key:       "secret",
+				addr:      e.AddrIPv4[0].String(),
+				port:      e.Port,
+				transport: transport,
+				extract:   true,
+				client:    tcpTuning{}.httpClient(nil),
+			}
+			if _, err := sendFile(src, opts); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(filepath.Join(dropDir, "hello.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("received %q, want %q", got, content)
+			}
+			os.Remove(filepath.Join(dropDir, "hello.txt"))
+		})
+	}
+
+	opts := sendOptions{key: "wrong", addr: e.AddrIPv4[0].String(), port: e.Port, transport: transportHTTP, client: tcpTuning{}.httpClient(nil)}
+	if _, err := sendFile(src, opts); err == nil {
+		t.Error("sent with a wrong passkey")
+	}
+}
+
+func TestMemNetworkLookup(t *testing.T) {
+	mem := useMemNetwork(t)
+	if _, err := findPeer("nobody", 50*time.Millisecond, 0); err == nil {
+		t.Error("found a peer that isn't advertised")
+	}
+	mem.advertise("b", 1, nil)
+	mem.advertise("a", 2, nil)
+	names, err := browsePeers(50 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Errorf("browsed %v, want [a b]", names)
+	}
+	if _, err := peerNet.DialContext(t.Context(), "tcp", "127.0.0.1:1"); err == nil {
+		t.Error("dialed a port nobody listens at")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setDontFragment isn't supported here; without it large probes would get
+// through fragmented, so the UDP transport keeps its default packet size.
+func setDontFragment(conn syscall.Conn, ipv6 bool) error {
+	return errors.ErrUnsupported
+}
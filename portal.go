@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const portalPath = "/share/"
+
+type portalEntry struct {
+	Name      string
+	Href      string
+	Dir       bool
+	Size      int64
+	Downloads int
+}
+
+type portalListing struct {
+	Path    string
+	Parent  string
+	Entries []portalEntry
+}
+
+// downloadCounts counts the successful sends of every shared file in the
+// history by path, whether fetched from the portal or with `ftr request`.
+func downloadCounts(historyFile string) map[string]int {
+	counts := map[string]int{}
+	if historyFile == "" {
+		return counts
+	}
+	entries, err := readHistory(historyFile)
+	if err != nil {
+		debugLog("Failed to read the history: %v", err)
+		return counts
+	}
+	for _, e := range entries {
+		if e.Direction == directionSend && e.Status == statusOK && e.Path != "" {
+			counts[e.Path]++
+		}
+	}
+	return counts
+}
+
+// portalHandler lets browsers browse the share dir and download from it,
+// once logged in with the passkey. Downloads are subject to the request
+// policy and recorded in the history like `ftr request`.
+func portalHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !opts.authorized(r) {
+			serveLogin(w, r.URL.Path)
+			return
+		}
+		if opts.shareDir == "" {
+			http.Error(w, "Nothing is shared", http.StatusNotFound)
+			return
+		}
+		// the policy goes first, as with `ftr request`, so a refused browser
+		// can't list the share dir either
+		if opts.requestPolicy != policyAllow && opts.requestPolicy != policyPrompt {
+			http.Error(w, "Downloads are not accepted", http.StatusForbidden)
+			return
+		}
+		rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, portalPath))
+		src := resolveSharePath(opts.shareDir, rel)
+		fi, err := os.Stat(src)
+		if err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if fi.IsDir() && r.URL.Query().Get("archive") == "" {
+			listShareDir(w, opts, rel, src)
+			return
+		}
+		downloadShared(w, r, opts, rel, src, fi)
+	}
+}
+
+func listShareDir(w http.ResponseWriter, opts receiverOptions, rel, src string) {
+	dirEntries, err := os.ReadDir(src)
+	if err != nil {
+		http.Error(w, "Failed to list the directory", http.StatusInternalServerError)
+		return
+	}
+	counts := downloadCounts(opts.historyFile)
+	listing := portalListing{Path: rel}
+	if rel != "/" {
+		listing.Parent = portalPath + strings.TrimPrefix(path.Dir(rel), "/")
+	}
+	for _, d := range dirEntries {
+		fi, err := d.Info()
+		if err != nil {
+			continue
+		}
+		p := path.Join(rel, d.Name())
+		e := portalEntry{
+			Name:      d.Name(),
+			Href:      portalPath + strings.TrimPrefix(p, "/"),
+			Dir:       d.IsDir(),
+			Downloads: counts[filepath.Join(src, d.Name())],
+		}
+		if !e.Dir {
+			e.Size = fi.Size()
+		}
+		listing.Entries = append(listing.Entries, e)
+	}
+	sort.Slice(listing.Entries, func(i, j int) bool {
+		a, b := listing.Entries[i], listing.Entries[j]
+		if a.Dir != b.Dir {
+			return a.Dir
+		}
+		return a.Name < b.Name
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := portalPage.Execute(w, listing); err != nil {
+		debugLog("Failed to render the share listing: %v", err)
+	}
+}
+
+func downloadShared(w http.ResponseWriter, r *http.Request, opts receiverOptions, rel, src string, fi os.FileInfo) {
+	requester := senderName(r)
+	entry := historyEntry{Direction: directionSend, Peer: requester, File: rel, Path: src, Status: statusFailed}
+	if opts.requestPolicy == policyPrompt && !confirm(fmt.Sprintf("%s wants to download %s from the browser. Allow it?", requester, rel), defaultPromptTimeout) {
+		entry.Error = "Download declined"
+		recordHistory(opts.historyFile, entry)
+		http.Error(w, entry.Error, http.StatusForbidden)
+		return
+	}
+
+	name := fi.Name()
+	if fi.IsDir() {
+		name += ".tar.gz"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	start := time.Now()
+	written, err := serveShared(w, src, fi)
+	entry.Bytes = written
+	entry.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.Status = statusOK
+		fmt.Fprintf(infoOut, "%s downloaded %s\n", requester, rel)
+	}
+	recordHistory(opts.historyFile, entry)
+}
+
+var portalPage = template.Must(template.New("portal").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>ftr share {{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+</style></head>
+<body>
+<h1>{{.Path}}</h1>
+{{if .Parent}}<p><a href="{{.Parent}}">..</a></p>{{end}}
+<table>
+<tr><th>Name</th><th>Size</th><th>Downloads</th><th></th></tr>
+{{range .Entries}}<tr>
+<td><a href="{{.Href}}">{{.Name}}{{if .Dir}}/{{end}}</a></td>
+<td>{{if not .Dir}}{{.Size}}{{end}}</td>
+<td>{{.Downloads}}</td>
+<td>{{if .Dir}}<a href="{{.Href}}?archive=1">.tar.gz</a>{{end}}</td>
+</tr>{{end}}
+</table>
+</body></html>
+`))
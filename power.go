@@ -0,0 +1,69 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// powerCheckInterval is how often deferred work checks whether the machine
+// is back on mains power.
+const powerCheckInterval = time.Minute
+
+// The compression levels of the archives and dictionary compressed uploads,
+// lowered to save power.
+var (
+	gzipLevel = gzip.DefaultCompression
+	zstdLevel = zstd.SpeedDefault
+)
+
+// powerSaving is set on battery or in power-save mode unless --force, for
+// transfers to go easy on the CPU.
+var powerSaving bool
+
+// lowPower reports whether the machine runs on battery or in a power-save
+// mode, and which. Machines without a battery, or where the state can't be
+// read, never are.
+func lowPower() (bool, string) {
+	low, reason, err := powerState()
+	if err != nil {
+		debugLog("Failed to read the power state: %v", err)
+		return false, ""
+	}
+	return low, reason
+}
+
+// applyPowerSaving lowers the compression levels and the threads on low power
+// unless forced, and reports whether it did.
+func applyPowerSaving(force bool) bool {
+	low, reason := lowPower()
+	if !low || force {
+		return false
+	}
+	powerSaving = true
+	gzipLevel = gzip.BestSpeed
+	zstdLevel = zstd.SpeedFastest
+	threads := min(runtime.GOMAXPROCS(0), 2)
+	runtime.GOMAXPROCS(threads)
+	codecThreads = threads
+	fmt.Fprintf(infoOut, "Saving power %s: compressing faster on %d threads, --force not to\n", reason, threads)
+	return true
+}
+
+// waitForPower blocks while the machine is on low power, for deferrable
+// work such as replication.
+func waitForPower(what string) {
+	low, reason := lowPower()
+	if !low {
+		return
+	}
+	fmt.Fprintf(infoOut, "Deferring %s %s until the machine is back on mains power\n", what, reason)
+	for low {
+		time.Sleep(powerCheckInterval)
+		low, _ = lowPower()
+	}
+	fmt.Fprintf(infoOut, "Back on mains power, resuming %s\n", what)
+}
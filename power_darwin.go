@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// powerState asks pmset whether the Mac draws from its battery or is in Low
+// Power Mode.
+func powerState() (bool, string, error) {
+	out, err := exec.Command("pmset", "-g").Output()
+	if err != nil {
+		return false, "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if f := strings.Fields(line); len(f) == 2 && f[0] == "lowpowermode" && f[1] == "1" {
+			return true, "in Low Power Mode", nil
+		}
+	}
+	out, err = exec.Command("pmset", "-g", "batt").Output()
+	if err != nil {
+		return false, "", err
+	}
+	if strings.Contains(string(out), "'Battery Power'") {
+		return true, "on battery", nil
+	}
+	return false, "", nil
+}
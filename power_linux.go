@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	powerSupplyDir  = "/sys/class/power_supply"
+	platformProfile = "/sys/firmware/acpi/platform_profile"
+)
+
+// powerState reads the power supplies from sysfs: the machine is on battery
+// when no mains supply is online and a battery discharges, and in power-save
+// mode under the low-power platform profile.
+func powerState() (bool, string, error) {
+	if profile, err := os.ReadFile(platformProfile); err == nil && strings.TrimSpace(string(profile)) == "low-power" {
+		return true, "in the low-power profile", nil
+	}
+	supplies, err := os.ReadDir(powerSupplyDir)
+	if os.IsNotExist(err) {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	read := func(supply, attr string) string {
+		b, _ := os.ReadFile(filepath.Join(powerSupplyDir, supply, attr))
+		return strings.TrimSpace(string(b))
+	}
+	discharging := false
+	for _, s := range supplies {
+		switch read(s.Name(), "type") {
+		case "Mains", "USB":
+			if read(s.Name(), "online") == "1" {
+				return false, "", nil
+			}
+		case "Battery":
+			// peripherals such as mice report their batteries too
+			if read(s.Name(), "scope") != "Device" && read(s.Name(), "status") == "Discharging" {
+				discharging = true
+			}
+		}
+	}
+	if discharging {
+		return true, "on battery", nil
+	}
+	return false, "", nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// powerState isn't supported here; the machine is taken to be on mains power.
+func powerState() (bool, string, error) {
+	return false, "", nil
+}
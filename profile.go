@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+const (
+	profileSectionPrefix = "profile"
+	profilePeerKey       = "peer"
+)
+
+// applyProfile applies the `[profile.<name>]` config section to the flags of
+// fs. Every key but "peer" names a flag; it only takes effect when the flag
+// wasn't given on the command line. The profile's peer, if any, is returned.
+// Without such a section, the builtin profile of the name is applied.
+//
+//	[profile.backup]
+//	peer = nas
+//	key = secret
+//	retries = 3
+func applyProfile(fs *flag.FlagSet, cfg *config, name string) (string, error) {
+	sec := cfg.section(profileSectionPrefix + "." + name)
+	if sec == nil {
+		sec = builtinProfiles[fs.Name()][name]
+	}
+	if sec == nil {
+		return "", fmt.Errorf("profile %s not found", name)
+	}
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for k, v := range sec {
+		if k == profilePeerKey {
+			continue
+		}
+		if fs.Lookup(k) == nil {
+			return "", fmt.Errorf("profile %s: unknown setting %s", name, k)
+		}
+		if explicit[k] {
+			continue
+		}
+		if err := fs.Set(k, v); err != nil {
+			return "", fmt.Errorf("profile %s: invalid %s: %v", name, k, err)
+		}
+	}
+	return sec[profilePeerKey], nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	progressInterval = 200 * time.Millisecond
+	progressBarWidth = 30
+)
+
+// progress draws a live bar of an upload on stderr with the bytes sent, the
+// throughput and the ETA. A nil progress draws nothing, so transports can
+// report to it unconditionally.
+type progress struct {
+	name string
+	// total is the payload size, -1 when streamed without knowing it
+	total int64
+	sent  atomic.Int64
+	// report is called with the bytes sent in place of drawing the bar, nil
+	// to draw it
+	report func(sent, total int64)
+
+	mu    sync.Mutex
+	start time.Time
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// stderrIsTerminal reports whether a bar on stderr would be seen rather than
+// end up in a log.
+func stderrIsTerminal() bool {
+	fi, err := os.Stderr.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func startProgress(name string, total int64, report func(sent, total int64)) *progress {
+	p := &progress{name: name, total: total, report: report, start: time.Now(), stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				if p.report != nil {
+					p.report(p.sent.Load(), p.total)
+					continue
+				}
+				fmt.Fprintf(os.Stderr, "\r%s\033[K", p.line())
+			}
+		}
+	}()
+	return p
+}
+
+func (p *progress) add(n int) {
+	if p != nil {
+		p.sent.Add(int64(n))
+	}
+}
+
+// restart starts counting over for another attempt of the upload.
+func (p *progress) restart() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.start = time.Now()
+	p.mu.Unlock()
+	p.sent.Store(0)
+}
+
+func (p *progress) line() string {
+	sent := p.sent.Load()
+	p.mu.Lock()
+	elapsed := time.Since(p.start)
+	p.mu.Unlock()
+	rate := 0.0
+	if secs := elapsed.Seconds(); secs > 0 {
+		rate = float64(sent) / secs
+	}
+	if p.total < 0 {
+		return fmt.Sprintf("%s %s %s", p.name, formatBytes(sent), formatRate(rate))
+	}
+	frac := 1.0
+	if p.total > 0 {
+		frac = min(float64(sent)/float64(p.total), 1)
+	}
+	filled := int(frac * progressBarWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	eta := "--:--"
+	if rate > 0 {
+		left := time.Duration(float64(max(p.total-sent, 0)) / rate * float64(time.Second))
+		eta = formatClock(left)
+	}
+	return fmt.Sprintf("%s [%s] %3.0f%% %s/%s %s ETA %s",
+		p.name, bar, frac*100, formatBytes(sent), formatBytes(p.total), formatRate(rate), eta)
+}
+
+// finish removes the bar and, when the upload went through, leaves a summary
+// line in its place.
+func (p *progress) finish(err error) {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	if p.report != nil {
+		return
+	}
+	fmt.Fprint(os.Stderr, "\r\033[K")
+	if err != nil {
+		return
+	}
+	sent := p.sent.Load()
+	p.mu.Lock()
+	elapsed := time.Since(p.start)
+	p.mu.Unlock()
+	rate := 0.0
+	if secs := elapsed.Seconds(); secs > 0 {
+		rate = float64(sent) / secs
+	}
+	fmt.Fprintf(os.Stderr, "Sent %s: %s in %s, %s\n", p.name, formatBytes(sent), formatDuration(elapsed), formatRate(rate))
+}
+
+// progressReader counts what's read through it towards p.
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.p.add(n)
+	return n, err
+}
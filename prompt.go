@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultPromptTimeout = time.Minute
+
+var (
+	promptMu    sync.Mutex
+	promptOnce  sync.Once
+	promptLines chan string
+)
+
+// confirm asks the user at the terminal a yes/no question, answering no when
+// nobody replies before the timeout. Questions from concurrent requests are
+// asked one at a time.
+func confirm(question string, timeout time.Duration) bool {
+	promptOnce.Do(func() {
+		promptLines = make(chan string)
+		go func() {
+			scanner := bufio.NewScanner(os.Stdin)
+			for scanner.Scan() {
+				promptLines <- scanner.Text()
+			}
+			close(promptLines)
+		}()
+	})
+
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	select {
+	case line, ok := <-promptLines:
+		if !ok {
+			return false
+		}
+		answer := strings.ToLower(strings.TrimSpace(line))
+		return answer == "y" || answer == "yes"
+	case <-time.After(timeout):
+		fmt.Fprintln(os.Stderr, "\nNo answer, declining")
+		return false
+	}
+}
+
+// readLine prints the prompt and reads a line from the terminal.
+func readLine(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readPassword is readLine without echoing what's typed, and reports whether
+// it read from a terminal.
+func readPassword(prompt string) (string, bool, error) {
+	restore, tty := noEcho(os.Stdin)
+	if !tty {
+		line, err := readLine(prompt)
+		return line, false, err
+	}
+	line, err := readLine(prompt)
+	restore()
+	// the newline wasn't echoed either
+	fmt.Fprintln(os.Stderr)
+	return line, true, err
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// provenanceExt is the suffix of the sidecar next to a received file.
+const provenanceExt = ".ftrmeta"
+
+// provenance records where a received file came from, in a sidecar next to
+// it with join --provenance so it survives the history ledger.
+type provenance struct {
+	Sender string `json:"sender"`
+	// Address is where the upload came from, Certificate the fingerprint of
+	// the TLS certificate the sender presented, if any
+	Address     string    `json:"address,omitempty"`
+	Certificate string    `json:"certificate,omitempty"`
+	Receiver    string    `json:"receiver"`
+	Inbox       string    `json:"inbox,omitempty"`
+	TransferID  string    `json:"transfer_id"`
+	File        string    `json:"file"`
+	Received    time.Time `json:"received"`
+	Bytes       int64     `json:"bytes"`
+	SHA256      string    `json:"sha256,omitempty"`
+}
+
+// clientCert returns the fingerprint of the certificate the peer presented,
+// empty for a plain connection or none.
+func clientCert(state *tls.ConnectionState) string {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return certFingerprint(state.PeerCertificates[0].Raw)
+}
+
+func isProvenanceFile(path string) bool {
+	return strings.HasSuffix(path, provenanceExt)
+}
+
+// recordProvenance writes the sidecar of every path the upload was stored
+// at.
+func recordProvenance(opts receiverOptions, u upload, job *transferJob, entry historyEntry) {
+	p := provenance{
+		Sender:      u.sender,
+		Address:     u.address,
+		Certificate: u.certificate,
+		Receiver:    getDefaultName(),
+		Inbox:       opts.name,
+		TransferID:  job.ID,
+		File:        entry.File,
+		Received:    time.Now(),
+		Bytes:       entry.Bytes,
+	}
+	paths := entry.Paths
+	if entry.Path != "" {
+		paths = []string{entry.Path}
+		p.SHA256 = entry.Hash
+	}
+	for _, path := range paths {
+		if err := writeProvenance(path, p); err != nil {
+			logger.Warn("Failed to record the provenance", "path", path, "error", err)
+		}
+	}
+}
+
+func writeProvenance(path string, p provenance) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + provenanceExt + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path+provenanceExt)
+}
+
+func readProvenance(path string) (provenance, error) {
+	var p provenance
+	data, err := os.ReadFile(path + provenanceExt)
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal(data, &p)
+	return p, err
+}
+
+// findProvenance returns the provenance of the file, or of the received
+// directory it's in, from its sidecar or else from the history ledger.
+// received is the path the provenance is about.
+func findProvenance(path string, history []historyEntry) (p provenance, received string, ok bool) {
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if p, err := readProvenance(dir); err == nil {
+			return p, dir, true
+		}
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	// the ledger has no sidecars to fall back on for files received without
+	// --provenance, the latest receipt wins
+	for i := len(history) - 1; i >= 0; i-- {
+		e := history[i]
+		if e.Direction != directionReceive || e.Status != statusOK {
+			continue
+		}
+		for _, r := range append([]string{e.Path}, e.Paths...) {
+			if r == "" || (r != path && !strings.HasPrefix(path, r+string(filepath.Separator))) {
+				continue
+			}
+			p = provenance{Sender: e.Peer, File: e.File, Received: e.Time, Bytes: e.Bytes}
+			if r == e.Path {
+				p.SHA256 = e.Hash
+			}
+			return p, r, true
+		}
+	}
+	return p, "", false
+}
+
+func runWhois(args []string) {
+	whoisCmd := flag.NewFlagSet("whois", flag.ExitOnError)
+	whoisCmd.SetOutput(os.Stdout)
+	historyFile := whoisCmd.String("history-file", defaultHistoryFile(), "the path to the transfer history ledger")
+	jsonOutput := whoisCmd.Bool("json", false, "print the provenance as JSON")
+	if err := whoisCmd.Parse(args); err != nil {
+		exitWithError(1, "Whois command failed: %v", err)
+	}
+	if whoisCmd.NArg() != 1 {
+		fmt.Println("Usage: ftr whois [--json] <file>")
+		os.Exit(1)
+	}
+	path, err := filepath.Abs(whoisCmd.Arg(0))
+	if err != nil {
+		exitWithError(1, "Failed to resolve %s: %v", whoisCmd.Arg(0), err)
+	}
+	history, err := readHistory(*historyFile)
+	if err != nil {
+		exitWithError(1, "Failed to read the history: %v", err)
+	}
+	p, received, ok := findProvenance(path, history)
+	if !ok {
+		exitWithError(1, "No record of receiving %s", path)
+	}
+	if *jsonOutput {
+		if err := json.NewEncoder(os.Stdout).Encode(p); err != nil {
+			exitWithError(1, "Failed to encode the provenance: %v", err)
+		}
+		return
+	}
+
+	fmt.Printf("File:      %s\n", path)
+	if received != path {
+		fmt.Printf("Part of:   %s\n", received)
+	}
+	var details []string
+	if p.Address != "" {
+		details = append(details, p.Address)
+	}
+	if p.Certificate != "" {
+		details = append(details, "certificate "+p.Certificate)
+	}
+	from := p.Sender
+	if len(details) > 0 {
+		from += " (" + strings.Join(details, ", ") + ")"
+	}
+	fmt.Printf("Sender:    %s\n", from)
+	into := ""
+	if p.Inbox != "" {
+		into = " into inbox " + p.Inbox
+	}
+	if p.Receiver != "" {
+		into += " on " + p.Receiver
+	}
+	fmt.Printf("Received:  %s as %s%s\n", p.Received.Local().Format("2006-01-02 15:04:05"), p.File, into)
+	if p.TransferID != "" {
+		fmt.Printf("Transfer:  %s\n", p.TransferID)
+	}
+	if p.SHA256 == "" || received != path {
+		return
+	}
+	state := "unchanged since it was received"
+	if hash, err := hashFile(path); err != nil || hash != p.SHA256 {
+		state = "modified since it was received"
+	}
+	fmt.Printf("SHA-256:   %s (%s)\n", p.SHA256, state)
+}
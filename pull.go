@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	offeredSection = "offered"
+	getPath        = "/get/"
+)
+
+// offeredFiles maps the names peers may pull with `ftr get` to the files or
+// directories they stand for. Offering a file is consent to anyone with the
+// passkey fetching it, so unlike the share dir it isn't subject to the
+// request policy.
+type offeredFiles map[string]string
+
+// loadOffered reads the files offered under `[offered]` and with --offer, a
+// comma-separated list of paths offered by their base names:
+//
+//	[offered]
+//	build = /home/me/out/app.tar.gz
+//	photos = /home/me/Pictures
+func loadOffered(cfg *config, list string) (offeredFiles, error) {
+	offered := offeredFiles{}
+	add := func(name, p string) error {
+		if name == "" || name == "." || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("invalid offer name %q", name)
+		}
+		if _, ok := offered[name]; ok {
+			return fmt.Errorf("%s is offered twice", name)
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(abs); err != nil {
+			return err
+		}
+		offered[name] = abs
+		return nil
+	}
+	for name, p := range cfg.section(offeredSection) {
+		if err := add(name, p); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if err := add(filepath.Base(filepath.Clean(p)), p); err != nil {
+			return nil, err
+		}
+	}
+	return offered, nil
+}
+
+// names returns the offered names, sorted.
+func (o offeredFiles) names() []string {
+	var names []string
+	for name := range o {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolve returns the path of an offered file, or of a file under an offered
+// directory for "<name>/<path>", without letting it escape the offer.
+func (o offeredFiles) resolve(p string) (string, bool) {
+	name, rest, _ := strings.Cut(strings.Trim(path.Clean("/"+p), "/"), "/")
+	root, ok := o[name]
+	if !ok {
+		return "", false
+	}
+	if rest == "" {
+		return root, true
+	}
+	return resolveSharePath(root, rest), true
+}
+
+// getHandler serves the offered files peers pull with `ftr get`, streamed
+// as the response body like `ftr request` does, with a directory sent as a
+// gzipped tarball.
+func getHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p := strings.TrimPrefix(r.URL.Path, getPath)
+		requester := senderName(r)
+		entry := historyEntry{Direction: directionSend, Peer: requester, File: p, Status: statusFailed}
+		fail := func(msg string, code int) {
+			entry.Error = msg
+			recordHistory(opts.historyFile, entry)
+			http.Error(w, msg, code)
+		}
+
+		src, ok := opts.offered.resolve(p)
+		if !ok {
+			fail("File not offered", http.StatusNotFound)
+			return
+		}
+		entry.Path = src
+		fi, err := os.Stat(src)
+		if err != nil {
+			fail("File not found", http.StatusNotFound)
+			return
+		}
+
+		start := time.Now()
+		written, err := serveShared(w, src, fi)
+		entry.Bytes = written
+		entry.DurationMs = time.Since(start).Milliseconds()
+		if err != nil {
+			// the status line is already out, the requester sees a short body
+			entry.Error = err.Error()
+			recordHistory(opts.historyFile, entry)
+			return
+		}
+		entry.Status = statusOK
+		recordHistory(opts.historyFile, entry)
+		fmt.Fprintf(infoOut, "%s pulled %s\n", requester, p)
+	}
+}
+
+func runGet(args []string) {
+	getCmd := flag.NewFlagSet("get", flag.ExitOnError)
+	getCmd.SetOutput(os.Stdout)
+	key := getCmd.String("key", "", "pre-shared passkey, defaults to the one of the peer in the [keys] config section")
+	debug := getCmd.Bool("debug", false, "enable debug log")
+	dropDir := getCmd.String("dropdir", defaultDropDir(), "the dir to store the pulled file in")
+	historyFile := getCmd.String("history-file", defaultHistoryFile(), "the path to the transfer history ledger, empty to disable")
+	configFile := getCmd.String("config", defaultConfigFile(), "the path to the config file")
+	lookupTimeout := getCmd.Duration("lookup-timeout", defaultLookupTimeoutMs*time.Millisecond, "how long to browse for the peer per attempt")
+	lookupRetries := getCmd.Int("lookup-retries", defaultLookupRetries, "the number of times to retry a failed peer lookup")
+	if err := getCmd.Parse(args); err != nil {
+		exitWithError(1, "Get command failed: %v", err)
+	}
+	debugMode = *debug
+	pos := getCmd.Args()
+	if len(pos) != 1 {
+		fmt.Println("Usage: ftr get [--key <key>] <peer>:<name>[/<path>]")
+		os.Exit(1)
+	}
+	peer, p, ok := strings.Cut(pos[0], ":")
+	if !ok || peer == "" || strings.Trim(p, "/") == "" {
+		exitWithError(1, "Expected <peer>:<name>, got %s", pos[0])
+	}
+	cfg := mustLoadConfig(*configFile)
+
+	e, err := findPeer(peer, *lookupTimeout, *lookupRetries)
+	if err != nil {
+		exitWithError(1, "Failed to find the peer: %v", err)
+	}
+	var elems []string
+	for _, elem := range strings.Split(strings.Trim(p, "/"), "/") {
+		elems = append(elems, url.PathEscape(elem))
+	}
+	tlsConfig := peerTLS(peer, e.Text)
+	req, err := http.NewRequest(http.MethodGet, peerURL(tlsConfig, peerAddr(e), e.Port, getPath+strings.Join(elems, "/")), nil)
+	if err != nil {
+		exitWithError(1, "Failed to create the http request: %v", err)
+	}
+	req.Header.Set(passKeyHeader, peerKey(getCmd, cfg, peer, "", *key))
+	req.Header.Set(senderHeader, getDefaultName())
+	fmt.Printf("Pulling %s from %s...\n", p, peer)
+	resp, err := tlsClient(tlsConfig).Do(req)
+	if err != nil {
+		exitWithError(1, "Failed to send the request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		exitWithError(1, "The peer refused to send %s: %s: %s", p, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if err := receiveServed(resp, peer, *dropDir, *historyFile); err != nil {
+		exitWithError(1, "Failed to receive the file: %v", err)
+	}
+	fmt.Printf("Received %s into %s\n", p, *dropDir)
+}
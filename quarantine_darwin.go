@@ -0,0 +1,18 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const quarantineAttr = "com.apple.quarantine"
+
+// quarantineFile sets the same quarantine attribute browsers set on
+// downloads, so Gatekeeper prompts before the file is first opened.
+func quarantineFile(path, sender string) error {
+	// flags;timestamp;agent;event id
+	value := fmt.Sprintf("0081;%08x;ftr (%s);", time.Now().Unix(), sender)
+	return unix.Setxattr(path, quarantineAttr, []byte(value), 0)
+}
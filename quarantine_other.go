@@ -0,0 +1,8 @@
+//go:build !darwin
+
+package main
+
+// quarantineFile is a no-op, only macOS has Gatekeeper quarantine.
+func quarantineFile(path, sender string) error {
+	return nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	transportHTTP = "http"
+	transportTCP  = "tcp"
+	rawMagic      = "FTR1"
+	// rawMaxHeaderSize bounds the JSON header of a raw upload
+	rawMaxHeaderSize = 64 << 10
+	rawPeekTimeout   = 10 * time.Second
+	// rawHeaderTimeout bounds how long a raw upload may take to send its
+	// header, so silent connections don't pile up
+	rawHeaderTimeout = 30 * time.Second
+)
+
+// rawHeader precedes the payload of a raw TCP upload. On the wire an upload is
+// the magic, the big-endian uint32 length of the JSON encoded header, the
+// header and then exactly Size bytes of payload. The receiver answers with a
+// single "<status code> <message>\n" line and closes the connection.
+type rawHeader struct {
+	Key    string `json:"key"`
+	Inbox  string `json:"inbox,omitempty"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Sender string `json:"sender"`
+	Size   int64  `json:"size"`
+	// NoExtract asks for a directory to be delivered as a tarball
+	NoExtract bool `json:"no_extract,omitempty"`
+	// Dict is the id of the zstd dictionary the payload is compressed with
+	Dict string `json:"dict,omitempty"`
+	// OnConflict is the conflict policy the sender asks for
+	OnConflict string `json:"on_conflict,omitempty"`
+	// SHA256 is the hash of the file the payload is checked against
+	SHA256 string `json:"sha256,omitempty"`
+	fileMeta
+}
+
+// rawMuxListener serves raw TCP uploads itself and hands every other
+// connection to the HTTP server.
+type rawMuxListener struct {
+	net.Listener
+	opts  receiverOptions
+	conns chan net.Conn
+	errs  chan error
+	// done is closed with the listener, nobody calls Accept anymore
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newRawMuxListener(ln net.Listener, opts receiverOptions) *rawMuxListener {
+	l := &rawMuxListener{
+		Listener: ln,
+		opts:     opts,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *rawMuxListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.route(conn)
+	}
+}
+
+func (l *rawMuxListener) route(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(rawPeekTimeout))
+	magic, err := br.Peek(len(rawMagic))
+	conn.SetReadDeadline(time.Time{})
+	_, secure := conn.(*tls.Conn)
+	if err == nil && magic[0] == tlsHandshakeRecord && l.opts.tls != nil && !secure {
+		// the decrypted stream is an HTTP request or raw upload in turn
+		l.route(tls.Server(&peekedConn{Conn: conn, r: br}, l.opts.tls.config))
+		return
+	}
+	raw := err == nil && string(magic) == rawMagic
+	if !secure && !l.opts.tls.allowsPlain(conn.RemoteAddr()) {
+		debugLog("Refusing the plain connection from %s", conn.RemoteAddr())
+		if raw {
+			fmt.Fprintf(conn, "%d TLS required\n", http.StatusUpgradeRequired)
+		} else {
+			fmt.Fprint(conn, "HTTP/1.1 426 Upgrade Required\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		}
+		conn.Close()
+		return
+	}
+	if raw {
+		handleRawUpload(conn, br, l.opts)
+		return
+	}
+	select {
+	case l.conns <- &peekedConn{Conn: conn, r: br}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// relayed serves a connection a relay handed over as if it was accepted.
+func (l *rawMuxListener) relayed(conn net.Conn) {
+	l.route(conn)
+}
+
+func (l *rawMuxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *rawMuxListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// peekedConn replays the bytes buffered while sniffing the protocol.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func readRawHeader(r io.Reader) (*rawHeader, error) {
+	magic := make([]byte, len(rawMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != rawMagic {
+		return nil, errors.New("bad magic")
+	}
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if n > rawMaxHeaderSize {
+		return nil, fmt.Errorf("header of %d bytes is too large", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	var hdr rawHeader
+	if err := json.Unmarshal(buf, &hdr); err != nil {
+		return nil, err
+	}
+	return &hdr, nil
+}
+
+func handleRawUpload(conn net.Conn, r *bufio.Reader, opts receiverOptions) {
+	defer conn.Close()
+	respond := func(err error) {
+		msg := "OK"
+		if err != nil {
+			msg = err.Error()
+		}
+		fmt.Fprintf(conn, "%d %s\n", uploadStatus(err), msg)
+	}
+
+	addr := conn.RemoteAddr().String()
+	refuse := func(auth string, status int, msg string, hdr *rawHeader) {
+		e := auditEntry{Address: remoteHost(addr), Auth: auth, Outcome: auditRefused, Status: status}
+		if hdr != nil {
+			e.Sender, e.Inbox, e.File, e.Size = hdr.Sender, hdr.Inbox, hdr.Name, hdr.Size
+		}
+		opts.audit.record(e)
+		respond(newUploadError(status, msg))
+	}
+	if !opts.permitsConn(addr, connTLS(conn)) {
+		refuse(authDenied, http.StatusForbidden, "Forbidden", nil)
+		return
+	}
+	if _, locked := opts.guard.lockedOut(addr); locked {
+		refuse(authLockedOut, http.StatusTooManyRequests, "Too many wrong passkeys, try again later", nil)
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(rawHeaderTimeout))
+	hdr, err := readRawHeader(r)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		debugLog("Invalid raw upload from %s: %v", conn.RemoteAddr(), err)
+		respond(newUploadError(http.StatusBadRequest, "Invalid raw upload header"))
+		return
+	}
+	inbox, ok := opts.inbox(hdr.Inbox)
+	if !ok {
+		respond(newUploadError(http.StatusNotFound, "Unknown inbox"))
+		return
+	}
+	if !inbox.authorizedConn(connTLS(conn), hdr.Sender, hdr.Key) {
+		c, ok := inbox.guests.claim(hdr.Key)
+		if !ok {
+			if hdr.Key != "" {
+				opts.guard.fail(addr, hdr.Sender)
+			}
+			refuse(authRejected, http.StatusUnauthorized, "Unauthorized", hdr)
+			return
+		}
+		inbox = guestOptions(inbox, c)
+	} else if hdr.Key != "" {
+		opts.guard.succeed(addr)
+	}
+	sender := hdr.Sender
+	if sender == "" {
+		sender = remoteHost(addr)
+	}
+	body := &rawPayload{r: r, left: hdr.Size}
+	_, err = receiveUpload(inbox, upload{
+		name:        hdr.Name,
+		fileType:    hdr.Type,
+		size:        hdr.Size,
+		sender:      sender,
+		address:     remoteHost(conn.RemoteAddr().String()),
+		certificate: clientCert(connTLS(conn)),
+		body:        body,
+		extract:     !hdr.NoExtract,
+		dict:        hdr.Dict,
+		onConflict:  hdr.OnConflict,
+		hash:        hdr.SHA256,
+		meta:        hdr.fileMeta,
+		setDeadline: conn.SetReadDeadline,
+	})
+	if err == nil {
+		// the upload has to consume exactly the size announced, what it
+		// left unread is trailing payload, or a short one if it never came
+		if n, rerr := io.Copy(io.Discard, body); rerr != nil {
+			err = rerr
+		} else if n > 0 {
+			err = newUploadError(http.StatusBadRequest, "Unexpected trailing payload")
+		}
+	}
+	respond(err)
+}
+
+// rawPayload reads the payload of a raw upload, the size announced in its
+// header, failing the read once the connection ends before all of it came.
+type rawPayload struct {
+	r    io.Reader
+	left int64
+}
+
+func (p *rawPayload) Read(b []byte) (int, error) {
+	if p.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > p.left {
+		b = b[:p.left]
+	}
+	n, err := p.r.Read(b)
+	p.left -= int64(n)
+	if err == io.EOF && p.left > 0 {
+		err = newUploadError(http.StatusBadRequest, "Payload shorter than announced")
+	}
+	return n, err
+}
+
+// postRaw uploads the file at src over a single raw TCP connection. The
+// returned bool reports whether the failure is worth retrying.
+func postRaw(src, fileType string, opts sendOptions) (bool, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return false, fmt.Errorf("failed to open the source file: %v", err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat the source file: %v", err)
+	}
+
+	var dictID string
+	if opts.dict != nil {
+		dictID = opts.dict.id
+	}
+	hdr, err := json.Marshal(rawHeader{
+		Key:        opts.key,
+		Inbox:      opts.inbox,
+		Name:       filepath.Base(src),
+		Type:       fileType,
+		Sender:     getDefaultName(),
+		Size:       fi.Size(),
+		NoExtract:  !opts.extract,
+		Dict:       dictID,
+		OnConflict: opts.onConflict,
+		SHA256:     opts.hash,
+		fileMeta:   opts.meta,
+	})
+	if err != nil {
+		return false, err
+	}
+	var preamble bytes.Buffer
+	preamble.WriteString(rawMagic)
+	binary.Write(&preamble, binary.BigEndian, uint32(len(hdr)))
+	preamble.Write(hdr)
+
+	conn, err := opts.tcp.dial(net.JoinHostPort(opts.addr, strconv.Itoa(opts.port)))
+	if err != nil {
+		return true, fmt.Errorf("failed to connect to the peer: %v", err)
+	}
+	if opts.tls != nil {
+		conn = tls.Client(conn, opts.tls)
+	}
+	defer conn.Close()
+
+	var payload io.Reader = io.MultiReader(&preamble, &progressReader{r: file, p: opts.progress})
+	if opts.throttle != nil {
+		payload = &throttledReader{r: payload, t: opts.throttle}
+	}
+	_, writeErr := io.Copy(conn, payload)
+	if c, ok := conn.(interface{ CloseWrite() error }); ok && writeErr == nil {
+		c.CloseWrite()
+	}
+	// the receiver may have rejected the upload before reading all of it, so
+	// its answer takes precedence over a write error
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		if writeErr != nil {
+			return true, fmt.Errorf("failed to send the file: %v", writeErr)
+		}
+		return true, fmt.Errorf("failed to read the response: %v", err)
+	}
+	codeStr, msg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	code, err := strconv.Atoi(codeStr)
+	if err != nil {
+		return false, fmt.Errorf("invalid response from the peer: %q", line)
+	}
+	if code != http.StatusOK {
+		return retryableStatus(code), statusError(code, fmt.Sprintf("%d %s", code, msg))
+	}
+	return false, nil
+}
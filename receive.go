@@ -0,0 +1,940 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// receiverOptions holds the settings of the receiver server started by `join`.
+type receiverOptions struct {
+	port        int
+	dropDir     string
+	passKey     string
+	historyFile string
+	// name is the inbox name, empty for the default inbox
+	name    string
+	maxSize int64
+	quota   int64
+	// quotaDir is what the quota is counted over when uploads go to a dir
+	// inside the drop dir, empty for the drop dir itself
+	quotaDir string
+	inboxes  []receiverOptions
+	// ephemeral keeps payloads in memory and pipes them to ephemeralCmd, or
+	// stdout, instead of the drop dir
+	ephemeral    bool
+	ephemeralCmd string
+	tcp          tcpTuning
+	// tls terminates HTTPS and TLS wrapped raw uploads on the shared port,
+	// nil to serve plain connections only
+	tls *receiverTLS
+	// paired are the peers let in by their certificate instead of the
+	// passkey, shared by all inboxes
+	paired *pairings
+	// quarantine marks received files as downloaded from the network, only
+	// honored on macOS
+	quarantine bool
+	// snapshots keeps that many dated snapshots of a directory received
+	// repeatedly instead of extracting over the previous copy, 0 to disable
+	snapshots int
+	// keepArchive keeps the tarball of a directory upload after extraction
+	keepArchive bool
+	// autoExtract extracts directory uploads, otherwise the tarball is
+	// delivered as is. Batches of small files are always unpacked.
+	autoExtract bool
+	// onConflict is the conflict policy for uploads whose name is taken,
+	// which senders may ask to change but not to overwrite
+	onConflict string
+	// shareDir holds the files peers may ask for with `ftr request`, subject
+	// to requestPolicy
+	shareDir      string
+	requestPolicy string
+	// offered are the files peers may pull with `ftr get`
+	offered offeredFiles
+	// chunked holds the open chunked uploads of all inboxes
+	chunked *chunkedUploads
+	// links are the request links collecting files into the default drop
+	// dir from browsers
+	links *requestLinks
+	// confirm asks the user to accept every upload, offered with the
+	// sender fingerprint and file hash, and offers holds the accepted ones
+	confirm bool
+	offers  *offerApprovals
+	// pakes holds the SPAKE2 exchanges waiting for their payload
+	pakes *offerApprovals
+	// extractions bounds the directories and batches extracted at once
+	extractions extractionSlots
+	// journal records every extracted file so a crash leaves no doubt
+	// about which are complete
+	journal bool
+	// stallTimeout aborts an upload no byte arrived for this long, 0 to wait
+	// indefinitely
+	stallTimeout time.Duration
+	// guests are the one-time codes accepted instead of the passkey, only
+	// on the default inbox
+	guests *guestCodes
+	// control holds the state changed at runtime from the dashboard, shared
+	// by all inboxes
+	control *receiverControl
+	// queue parks the uploads of all inboxes while in maintenance
+	queue *uploadQueue
+	// dictDir holds the zstd dictionaries senders may compress uploads
+	// with, shared by all inboxes
+	dictDir string
+	// provenance writes a sidecar with the origin of every received file
+	provenance bool
+	// notify shows a desktop notification for every received file
+	notify bool
+	// onReceive is the command run for every received file, with {path}
+	// standing for its path, and webhook the URL it's posted to
+	onReceive string
+	webhook   string
+	// allowSync lets `ftr sync` overwrite and delete files
+	allowSync bool
+	// strictNames only accepts single files with plain names, and
+	// rejectExecutables refuses single files that are programs or scripts
+	strictNames       bool
+	rejectExecutables bool
+	// dropOnly serves the upload endpoints only, shared by all inboxes
+	dropOnly bool
+	// advertised is the name and TXT records the receiver advertises
+	advertised peerInfo
+	// relay is the relay the receiver registers with, nil without --relay
+	relay *relayEndpoint
+	// linkLocal refuses the peers that aren't on the link, whose traffic
+	// went through a gateway
+	linkLocal bool
+	// guard locks out the addresses guessing the passkey, shared by all
+	// inboxes
+	guard *authGuard
+	// audit records every transfer attempt, shared by all inboxes
+	audit *auditLog
+	// access keeps the senders out that --allow and --deny don't let in,
+	// shared by all inboxes
+	access *accessList
+	// paste decides what happens to the text snippets of each sender
+	paste *pasteModes
+	// receipts suppresses identical files re-uploaded within its window
+	receipts *receiptIndex
+	// replicator forwards completed uploads of all inboxes downstream
+	replicator *replicator
+	// load measures how fast all inboxes store uploads, for the pace advice
+	// given to senders
+	load *loadMeter
+	// events streams what all inboxes receive to local tools
+	events *eventHub
+	// transfers tracks the uploads of all inboxes
+	transfers *transferManager
+	// activity is shared by all inboxes to shut the receiver down when idle
+	activity *activityTracker
+}
+
+// key returns the current passkey of the inbox.
+func (o receiverOptions) key() string {
+	return o.control.key(o.name, o.passKey)
+}
+
+// inbox returns the options of the named inbox, empty for the default one.
+func (o receiverOptions) inbox(name string) (receiverOptions, bool) {
+	if name == "" {
+		return o, true
+	}
+	for _, inbox := range o.inboxes {
+		if inbox.name == name {
+			return inbox, true
+		}
+	}
+	return receiverOptions{}, false
+}
+
+// upload is an incoming file, independent of the transport it arrived on.
+type upload struct {
+	name     string
+	fileType string
+	// size is the expected payload size, or -1 when unknown
+	size   int64
+	sender string
+	// address and certificate identify the sender's connection, when known
+	address     string
+	certificate string
+	body        io.Reader
+	// extract is false when the sender asked for a directory archive to be
+	// delivered as is
+	extract bool
+	// dict is the id of the zstd dictionary the body is compressed with
+	dict string
+	// approved is true for the payload of an offer accepted in confirm mode
+	approved bool
+	// onConflict is the conflict policy the sender asks for, if any
+	onConflict string
+	// hash is the SHA-256 the sender computed of the payload, checked before
+	// it's kept, empty when the sender didn't announce one
+	hash string
+	// meta is the mode and mtime the sender had for a single file
+	meta fileMeta
+	// setDeadline sets the read deadline of the connection the body comes
+	// from, nil when it can't stall
+	setDeadline func(time.Time) error
+}
+
+// uploadError is a failed upload along with the HTTP status describing it.
+type uploadError struct {
+	code int
+	msg  string
+}
+
+func (e *uploadError) Error() string {
+	return e.msg
+}
+
+func newUploadError(code int, msg string) error {
+	return &uploadError{code: code, msg: msg}
+}
+
+// uploadStatus returns the HTTP status code for the result of an upload.
+func uploadStatus(err error) int {
+	var ue *uploadError
+	if errors.As(err, &ue) {
+		return ue.code
+	}
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// receiveUpload stores the upload according to opts as a job of the transfer
+// manager and records the outcome in the history.
+func receiveUpload(opts receiverOptions, u upload) (job *transferJob, err error) {
+	opts.activity.begin()
+	defer func() { opts.activity.end(err == nil) }()
+	job = opts.transfers.start(opts.name, u)
+	defer func() { opts.transfers.finish(job, err) }()
+	// audited as announced, before the body and size are changed below
+	defer func(u upload) { opts.audit.auditUpload(opts, u, job.Bytes, err) }(u)
+	defer func() { logUpload(job, err) }()
+	if opts.control.isPaused() {
+		return job, newUploadError(http.StatusServiceUnavailable, "The receiver is paused")
+	}
+	if opts.control.isClosing() {
+		return job, newUploadError(http.StatusServiceUnavailable, "The receiver is shutting down")
+	}
+	// HTTP uploads are queued before they get here, the others retry
+	if opts.queue.inMaintenance() {
+		return job, newUploadError(http.StatusServiceUnavailable, "The receiver is in maintenance")
+	}
+	if opts.confirm && !u.approved {
+		return job, newUploadError(http.StatusPreconditionRequired, "Confirmation required, send with --confirm")
+	}
+	opts.control.seen(u.sender)
+	opts.load.begin()
+	defer opts.load.end()
+	if opts.stallTimeout > 0 && u.setDeadline != nil {
+		u.body = &stallReader{r: u.body, timeout: opts.stallTimeout, setDeadline: u.setDeadline}
+		defer func() {
+			// a stalled connection stays expired so the rest of the request
+			// isn't waited for either
+			if !errors.Is(err, errUploadStalled) {
+				u.setDeadline(time.Time{})
+			}
+		}()
+	}
+	u.body = opts.load.meter(&jobReader{r: u.body, job: job, m: opts.transfers})
+	if u.dict != "" {
+		dec, err := dictReader(opts.dictDir, u.dict, u.body)
+		if err != nil {
+			return job, err
+		}
+		defer dec.Close()
+		// the size on the wire says nothing about the decompressed size
+		u.body, u.size = dec, -1
+	}
+
+	event := receiveEvent{Type: eventStarted, Transfer: job.ID, Inbox: opts.name, Sender: u.sender, File: u.name}
+	opts.events.publish(event)
+
+	start := time.Now()
+	entry := historyEntry{Direction: directionReceive, Peer: u.sender, File: u.name}
+	if opts.ephemeral {
+		err = receiveEphemeral(opts, u, &entry)
+	} else {
+		event.Paths, err = storeUpload(opts, u, &entry)
+	}
+	entry.DurationMs = time.Since(start).Milliseconds()
+	entry.Status = statusOK
+	event.Type = eventReceived
+	if errors.Is(err, errUploadStalled) {
+		entry.Status = statusStalled
+		entry.Error = err.Error()
+		event.Type = eventFailed
+	} else if err != nil {
+		entry.Status = statusFailed
+		entry.Error = err.Error()
+		event.Type = eventFailed
+	}
+	for i, p := range event.Paths {
+		if abs, err := filepath.Abs(p); err == nil {
+			event.Paths[i] = abs
+		}
+	}
+	if err == nil && entry.Path == "" {
+		entry.Paths = event.Paths
+	}
+	recordHistory(opts.historyFile, entry)
+	if err == nil && opts.provenance && !entry.Duplicate && !entry.Skipped {
+		recordProvenance(opts, u, job, entry)
+	}
+	if err == nil && opts.notify && !entry.Duplicate && !entry.Skipped {
+		notifyReceived(u.sender, entry.File, entry.Bytes)
+	}
+	event.File, event.Bytes, event.Hash = entry.File, entry.Bytes, entry.Hash
+	if err == nil && !entry.Duplicate && !entry.Skipped {
+		runReceiveHooks(opts, receiveHook{Transfer: job.ID, Inbox: opts.name, Sender: u.sender, File: entry.File, Paths: event.Paths, Size: entry.Bytes, Hash: entry.Hash})
+	}
+	event.Duplicate, event.Skipped, event.Error = entry.Duplicate, entry.Skipped, entry.Error
+	opts.events.publish(event)
+	return job, err
+}
+
+// quotaUsage returns what the drop dir holds against its quota. The staging
+// files of chunked uploads are left out: they're sized for the whole payload
+// when the upload opens, which is when it's checked against the quota, and
+// count once it completes.
+func quotaUsage(opts receiverOptions) (int64, error) {
+	dir := opts.dropDir
+	if opts.quotaDir != "" {
+		dir = opts.quotaDir
+	}
+	return dirSize(dir, filepath.Join(dir, chunkedStagingDir))
+}
+
+// limitUpload caps the body at the smaller of the max upload size and the
+// space left in the quota. The returned limit is -1 when there is none.
+func limitUpload(opts receiverOptions, u upload) (io.Reader, int64, error) {
+	limit := int64(-1)
+	if opts.maxSize > 0 {
+		if u.size > opts.maxSize {
+			return nil, 0, newUploadError(http.StatusRequestEntityTooLarge, "File exceeds the maximum upload size")
+		}
+		limit = opts.maxSize
+	}
+	if opts.quota > 0 {
+		used, err := quotaUsage(opts)
+		if err != nil {
+			return nil, 0, newUploadError(http.StatusInternalServerError, "Failed to check the drop dir quota")
+		}
+		remaining := opts.quota - used
+		if remaining < 0 || u.size > remaining {
+			return nil, 0, newUploadError(http.StatusInsufficientStorage, "Drop dir quota exceeded")
+		}
+		if limit < 0 || remaining < limit {
+			limit = remaining
+		}
+	}
+	if limit < 0 {
+		return u.body, limit, nil
+	}
+	return io.LimitReader(u.body, limit+1), limit, nil
+}
+
+// uploadSlack leaves room for the multipart framing around the file of a
+// request when judging it by its Content-Length.
+const uploadSlack = 64 << 10
+
+// checkContentLength refuses a request whose Content-Length already tells it
+// won't fit, before any of it is read: a file larger than the max upload size
+// or a request larger than the space left in the quota. limitUpload still
+// holds the parts to the limits as they're written.
+func checkContentLength(opts receiverOptions, r *http.Request) error {
+	size := r.ContentLength - uploadSlack
+	if size <= 0 {
+		return nil
+	}
+	// ftr senders post a single file per request, browsers may post several
+	if opts.maxSize > 0 && r.Header.Get(fileTypeHeader) != "" && size > opts.maxSize {
+		return newUploadError(http.StatusRequestEntityTooLarge, "File exceeds the maximum upload size")
+	}
+	if opts.quota > 0 {
+		used, err := quotaUsage(opts)
+		if err == nil && size > opts.quota-used {
+			return newUploadError(http.StatusInsufficientStorage, "Drop dir quota exceeded")
+		}
+	}
+	return nil
+}
+
+func storeUpload(opts receiverOptions, u upload, entry *historyEntry) ([]string, error) {
+	dropDir := opts.dropDir
+	debugLog("Receiving file %s", u.name)
+	fileName := filepath.Base(u.name)
+	entry.File = fileName
+	if fileName == "" || fileName == "." || fileName == ".." || fileName == string(filepath.Separator) {
+		return nil, newUploadError(http.StatusBadRequest, "Invalid file name")
+	}
+	var err error
+	if u.body, err = screenUpload(opts, u, fileName); err != nil {
+		return nil, err
+	}
+
+	body, limit, err := limitUpload(opts, u)
+	if err != nil {
+		return nil, err
+	}
+
+	fileType := u.fileType
+	if fileType == fileTypeDir && !(opts.autoExtract && u.extract) {
+		debugLog("Keeping the archive %s as is", fileName)
+		fileType = fileTypeFile
+	}
+
+	// a directory taken by an earlier upload is extracted over unless it's
+	// to be renamed or skipped, snapshots never conflict
+	policy := conflictPolicy(opts, u.onConflict)
+	target := fileName
+	if fileType == fileTypeDir {
+		if target, err = tarballDir(fileName); err != nil || opts.snapshots > 0 {
+			target = ""
+		}
+	}
+	if target != "" && fileType != fileTypeBatch {
+		if _, err := os.Lstat(filepath.Join(dropDir, target)); err == nil {
+			switch policy {
+			case conflictSkip:
+				debugLog("Skipping %s, it already exists", fileName)
+				written, err := copyPooled(io.Discard, body)
+				if err != nil {
+					return nil, newUploadError(http.StatusInternalServerError, "Failed to read the file on server")
+				}
+				entry.Bytes = written
+				entry.Skipped = true
+				return []string{filepath.Join(dropDir, target)}, nil
+			case conflictRename:
+				fileName = freeName(dropDir, fileName)
+				entry.File = fileName
+				debugLog("Storing the upload as %s, the name is taken", fileName)
+			}
+		}
+	}
+
+	// keep the tarball of a directory next to the extracted copy if asked to
+	dstPath := filepath.Join(dropDir, fileName)
+	savePath := dstPath
+	// files land in a temp file first when a retry may turn out to be an
+	// identical copy of a recent receipt, or when they replace one only
+	// once complete
+	staged := fileType == fileTypeFile && (opts.receipts != nil || policy == conflictOverwrite)
+	var archive io.Writer = io.Discard
+	if fileType == fileTypeFile || (fileType == fileTypeDir && opts.keepArchive) {
+		if _, err := os.Stat(dstPath); err == nil && !staged {
+			return nil, newUploadError(http.StatusConflict, "File already exists")
+		}
+		var dst *os.File
+		if staged {
+			dst, err = os.CreateTemp(dropDir, "."+fileName+".*.part")
+		} else {
+			dst, err = os.Create(dstPath)
+		}
+		if err != nil {
+			return nil, newUploadError(http.StatusInternalServerError, "Failed to create the file on server")
+		}
+		savePath = dst.Name()
+		debugLog("Saving the file to %s", savePath)
+		defer dst.Close()
+		archive = dst
+	}
+
+	// directories and batches are extracted straight from the body, the
+	// tarball itself only hits the disk with --keep-archive
+	hasher := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(archive, hasher)}
+	r := io.TeeReader(body, counter)
+	// delivered are the top-level paths the upload ended up at
+	var received, delivered []string
+	var journal *extractJournal
+	if fileType != fileTypeFile {
+		opts.extractions.acquire()
+		defer opts.extractions.release()
+		if opts.journal {
+			if journal, err = openExtractJournal(dropDir, fileName); err != nil {
+				return nil, newUploadError(http.StatusInternalServerError, "Failed to journal the extraction on server")
+			}
+			defer journal.close()
+		}
+	}
+	switch fileType {
+	case fileTypeFile:
+		delivered = []string{dstPath}
+	case fileTypeDir:
+		debugLog("The received file is a directory, unzipping and untarring it")
+		var dir string
+		if opts.snapshots > 0 {
+			dir, received, err = extractSnapshot(opts, fileName, r, journal)
+		} else if dir, err = tarballDir(fileName); err == nil {
+			dir = filepath.Join(dropDir, dir)
+			received, err = extractTarball(r, dir, conflictOverwrite, journal)
+		}
+		delivered = []string{dir}
+	case fileTypeBatch:
+		debugLog("The received file is a batch, unpacking it into %s", dropDir)
+		received, err = extractTarball(r, dropDir, policy, journal)
+		delivered = received
+	}
+	if err == nil {
+		// drain what the tar reader left, such as the gzip trailer, so the
+		// size and hash cover the whole payload
+		_, err = copyPooled(io.Discard, r)
+	}
+	if archive != io.Discard {
+		received = append(received, savePath)
+	}
+	written := counter.n
+	tooLarge := limit >= 0 && written > limit
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if err == nil && !tooLarge {
+		err = checkHash(u, hash)
+	}
+	if err != nil || tooLarge {
+		for _, p := range received {
+			os.Remove(p)
+		}
+		var maxBytesErr *http.MaxBytesError
+		var uploadErr *uploadError
+		switch {
+		case errors.Is(err, errTransferCancelled):
+			return nil, newUploadError(http.StatusGone, "Transfer cancelled")
+		case errors.Is(err, errUploadStalled):
+			debugLog("Aborting %s, nothing arrived for %v", fileName, opts.stallTimeout)
+			return nil, errUploadStalled
+		case errors.As(err, &maxBytesErr):
+			return nil, newUploadError(http.StatusRequestEntityTooLarge, "Upload exceeds the maximum request size")
+		case tooLarge:
+			if opts.maxSize > 0 && written > opts.maxSize {
+				return nil, newUploadError(http.StatusRequestEntityTooLarge, "File exceeds the maximum upload size")
+			}
+			return nil, newUploadError(http.StatusInsufficientStorage, "Drop dir quota exceeded")
+		case errors.As(err, &uploadErr):
+			return nil, err
+		case errors.Is(err, fs.ErrExist):
+			return nil, newUploadError(http.StatusConflict, "File already exists")
+		case fileType == fileTypeFile:
+			return nil, newUploadError(http.StatusInternalServerError, "Failed to save the file on server")
+		default:
+			return nil, newUploadError(http.StatusInternalServerError, "Failed to unzip and untar the file on server")
+		}
+	}
+	debugLog("Received %d bytes of %s", written, fileName)
+	entry.Bytes = written
+	entry.Hash = hash
+
+	if staged {
+		archive.(*os.File).Close()
+		if prev, ok := opts.receipts.lookup(dropDir, entry.Hash, written); ok {
+			debugLog("Dropping %s, identical to %s received recently", fileName, prev)
+			os.Remove(savePath)
+			entry.Duplicate = true
+			return []string{prev}, nil
+		}
+		if _, err := os.Stat(dstPath); err == nil {
+			switch policy {
+			case conflictOverwrite:
+				debugLog("Overwriting %s", dstPath)
+			case conflictRename:
+				fileName = freeName(dropDir, fileName)
+				entry.File = fileName
+				dstPath = filepath.Join(dropDir, fileName)
+				delivered = []string{dstPath}
+			default:
+				os.Remove(savePath)
+				return nil, newUploadError(http.StatusConflict, "File already exists")
+			}
+		}
+		if err := os.Rename(savePath, dstPath); err != nil {
+			os.Remove(savePath)
+			return nil, newUploadError(http.StatusInternalServerError, "Failed to save the file on server")
+		}
+		received = []string{dstPath}
+	}
+	if fileType == fileTypeFile {
+		u.meta.restore(dstPath, opts.rejectExecutables)
+		opts.receipts.add(dropDir, entry.Hash, dstPath, written)
+		if abs, err := filepath.Abs(dstPath); err == nil {
+			entry.Path = abs
+		}
+	}
+
+	if opts.quarantine {
+		for _, p := range received {
+			if err := quarantineFile(p, entry.Peer); err != nil {
+				debugLog("Failed to quarantine %s: %v", p, err)
+			}
+		}
+	}
+	opts.replicator.enqueue(delivered)
+	return delivered, nil
+}
+
+// extractSnapshot extracts the directory tarball read from r into a new dated
+// snapshot dir, returned along with the files it holds, and prunes the
+// snapshots beyond the retention count.
+func extractSnapshot(opts receiverOptions, tarball string, r io.Reader, journal *extractJournal) (string, []string, error) {
+	name, err := tarballDir(tarball)
+	if err != nil {
+		return "", nil, err
+	}
+	dst := snapshotDir(opts.dropDir, name, time.Now())
+	debugLog("Extracting %s as the snapshot %s", tarball, dst)
+	received, err := extractTarball(r, dst, conflictOverwrite, journal)
+	if err != nil {
+		return dst, received, err
+	}
+	if err := pruneSnapshots(opts.dropDir, name, opts.snapshots); err != nil {
+		debugLog("Failed to prune the snapshots of %s: %v", name, err)
+	}
+	return dst, received, nil
+}
+
+// senderName returns the name the sender claims, falling back to its address.
+func senderName(r *http.Request) string {
+	if name := r.Header.Get(senderHeader); name != "" {
+		return name
+	}
+	return remoteHost(r.RemoteAddr)
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// uploadResult is the outcome of one file of an upload request.
+type uploadResult struct {
+	ID    string        `json:"id"`
+	File  string        `json:"file"`
+	State transferState `json:"state"`
+	Bytes int64         `json:"bytes"`
+	Error string        `json:"error,omitempty"`
+}
+
+func getFileDropHandler(opts receiverOptions) (http.HandlerFunc, error) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if opts.queue.inMaintenance() {
+			parkUpload(w, opts, r)
+			return
+		}
+		if err := checkContentLength(opts, r); err != nil {
+			recordHistory(opts.historyFile, historyEntry{
+				Direction: directionReceive,
+				Peer:      senderName(r),
+				Status:    statusFailed,
+				Error:     err.Error(),
+			})
+			http.Error(w, err.Error(), uploadStatus(err))
+			return
+		}
+
+		fileType := fileTypeFile
+		if isDirectory(r.Header) {
+			fileType = fileTypeDir
+		} else if isBatch(r.Header) {
+			fileType = fileTypeBatch
+		}
+
+		rc := http.NewResponseController(w)
+		// every "file" part of the request is an independent transfer job
+		var results []uploadResult
+		status := http.StatusOK
+		mr, err := r.MultipartReader()
+		for err == nil {
+			var part *multipart.Part
+			part, err = mr.NextPart()
+			if err != nil {
+				break
+			}
+			if part.FormName() != "file" {
+				part.Close()
+				continue
+			}
+			job, uploadErr := receiveUpload(opts, upload{
+				name:        part.FileName(),
+				fileType:    fileType,
+				size:        -1,
+				sender:      senderName(r),
+				address:     remoteHost(r.RemoteAddr),
+				certificate: clientCert(r.TLS),
+				body:        part,
+				extract:     wantsExtract(r.Header),
+				onConflict:  conflictHint(r.Header),
+				dict:        r.Header.Get(dictHeader),
+				hash:        r.Header.Get(sha256Header),
+				meta:        metaFromHeader(r.Header),
+				setDeadline: rc.SetReadDeadline,
+			})
+			part.Close()
+			results = append(results, uploadResult{
+				ID:    job.ID,
+				File:  job.File,
+				State: job.State,
+				Bytes: job.Bytes,
+				Error: job.Error,
+			})
+			if uploadErr != nil && status == http.StatusOK {
+				status = uploadStatus(uploadErr)
+			}
+		}
+		if len(results) == 0 {
+			err := newUploadError(http.StatusBadRequest, "Failed to get the file from form")
+			recordHistory(opts.historyFile, historyEntry{
+				Direction: directionReceive,
+				Peer:      senderName(r),
+				Status:    statusFailed,
+				Error:     err.Error(),
+			})
+			http.Error(w, err.Error(), uploadStatus(err))
+			return
+		}
+
+		if len(results) == 1 {
+			w.Header().Set(transferIDHeader, results[0].ID)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(results)
+	}, nil
+}
+
+// authMiddleware only lets requests from paired peers or carrying the
+// current passkey through, in the header or, for browsers, the cookie set by
+// the dashboard login.
+func authMiddleware(opts receiverOptions, next http.Handler) (http.Handler, error) {
+	if opts.key() == "" {
+		return nil, errors.New("the passkey is empty")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !opts.authorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), nil
+}
+
+// prepareInbox creates the drop dir of an inbox unless it's ephemeral.
+func prepareInbox(opts receiverOptions) error {
+	if opts.ephemeral {
+		return nil
+	}
+	if err := mkDirIfNotExist(opts.dropDir); err != nil {
+		return fmt.Errorf("failed to create the drop dir %s: %v", opts.dropDir, err)
+	}
+	debugLog("The drop dir %s is ready", opts.dropDir)
+	return nil
+}
+
+// newInboxHandler prepares the drop dir of an inbox, recovering what the
+// last run left behind, and returns its authenticated upload handler.
+func newInboxHandler(opts receiverOptions) (http.Handler, error) {
+	if err := prepareInbox(opts); err != nil {
+		return nil, err
+	}
+	// only on start, other uploads may be extracting into the dir later on
+	if !opts.ephemeral {
+		if err := recoverExtractions(opts.dropDir); err != nil {
+			return nil, fmt.Errorf("failed to recover the interrupted extractions in %s: %v", opts.dropDir, err)
+		}
+	}
+
+	handler, err := getFileDropHandler(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the file drop handler: %v", err)
+	}
+
+	handlerWithAuth, err := authMiddleware(opts, handler)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the auth middleware: %v", err)
+	}
+	return guestMiddleware(opts, handlerWithAuth)
+}
+
+// listenReceiver listens for the receiver on port, over IPv4 and IPv6. With
+// fallback set a port that can't be bound, usually since it's taken, gives
+// way to any free one, whose number is advertised instead.
+func listenReceiver(port int, fallback bool) (net.Listener, error) {
+	ln, err := peerNet.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err == nil || !fallback {
+		return ln, err
+	}
+	debugLog("Failed to listen at port %d: %v", port, err)
+	ln, err = peerNet.Listen("tcp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(infoOut, "The port %d is not available, listening at %d instead\n", port, ln.Addr().(*net.TCPAddr).Port)
+	return ln, nil
+}
+
+// startReceiverServer serves the endpoints of the receiver on ln with server
+// until it's shut down.
+func startReceiverServer(opts receiverOptions, ln net.Listener, server *http.Server, errChan chan<- error) {
+	debugLog("Starting the receiver server at port %d, drop dir %s and passkey %s", opts.port, opts.dropDir, opts.passKey)
+	mux := http.NewServeMux()
+	handler, err := newInboxHandler(opts)
+	if err != nil {
+		errChan <- err
+		return
+	}
+	mux.Handle("/", webUIHandler(handler))
+	if err := opts.chunked.restore(opts); err != nil {
+		errChan <- fmt.Errorf("failed to restore the chunked uploads: %v", err)
+		return
+	}
+	// senders post to /upload, which the chunked uploads under /upload/
+	// would otherwise redirect
+	mux.Handle("/upload", handler)
+	adminHandler, err := authMiddleware(opts, transfersHandler(opts.transfers))
+	if err != nil {
+		errChan <- fmt.Errorf("failed to get the auth middleware: %v", err)
+		return
+	}
+	mux.Handle("/transfers", adminHandler)
+	mux.Handle("/transfers/", adminHandler)
+	catalogHandler, err := authMiddleware(opts, historyHandler(opts))
+	if err != nil {
+		errChan <- fmt.Errorf("failed to get the auth middleware: %v", err)
+		return
+	}
+	mux.Handle(historyPath, catalogHandler)
+	reqHandler, err := authMiddleware(opts, requestHandler(opts))
+	if err != nil {
+		errChan <- fmt.Errorf("failed to get the auth middleware: %v", err)
+		return
+	}
+	mux.Handle("/request", reqHandler)
+	getAPI, err := authMiddleware(opts, getHandler(opts))
+	if err != nil {
+		errChan <- fmt.Errorf("failed to get the auth middleware: %v", err)
+		return
+	}
+	mux.Handle(getPath, getAPI)
+	listAPI, err := authMiddleware(opts, listHandler(opts))
+	if err != nil {
+		errChan <- fmt.Errorf("failed to get the auth middleware: %v", err)
+		return
+	}
+	mux.Handle(listPath, listAPI)
+	queueAPI, err := authMiddleware(opts, queueHandler(opts))
+	if err != nil {
+		errChan <- fmt.Errorf("failed to get the auth middleware: %v", err)
+		return
+	}
+	mux.Handle(queuePath, queueAPI)
+	guestHandler, err := authMiddleware(opts, guestCodesHandler(opts.guests))
+	if err != nil {
+		errChan <- fmt.Errorf("failed to get the auth middleware: %v", err)
+		return
+	}
+	mux.Handle(guestCodesPath, guestHandler)
+	linksHandler, err := authMiddleware(opts, requestLinksHandler(opts.links))
+	if err != nil {
+		errChan <- fmt.Errorf("failed to get the auth middleware: %v", err)
+		return
+	}
+	mux.Handle(requestLinksPath, linksHandler)
+	mux.Handle(requestLinkPrefix, requestLinkHandler(opts))
+	mux.Handle(dashboardPath, dashboardHandler(opts))
+	dashboardAPI, err := authMiddleware(opts, dashboardAPIHandler(opts))
+	if err != nil {
+		errChan <- fmt.Errorf("failed to get the auth middleware: %v", err)
+		return
+	}
+	mux.Handle(dashboardPath+"/", dashboardAPI)
+	mux.Handle(portalPath, portalHandler(opts))
+	mux.Handle(chunkedUploadsPath, chunkedUploadsHandler(opts))
+	mux.Handle(pacePath, paceHandler(opts))
+	mux.Handle(manifestPath, manifestHandler(opts))
+	mux.Handle(syncPath, syncHandler(opts))
+	mux.Handle(infoPath, infoHandler(opts))
+	eventsAPI, err := authMiddleware(opts, eventsHandler(opts.events))
+	if err != nil {
+		errChan <- fmt.Errorf("failed to get the auth middleware: %v", err)
+		return
+	}
+	mux.Handle(eventsPath, eventsAPI)
+	pasteAPI, err := authMiddleware(opts, pasteHandler(opts))
+	if err != nil {
+		errChan <- fmt.Errorf("failed to get the auth middleware: %v", err)
+		return
+	}
+	mux.Handle(pastePath, pasteAPI)
+	mux.Handle(offersPath, offersHandler(opts))
+	mux.Handle(offersPath+"/", offersHandler(opts))
+	mux.Handle(pakePath, pakeHandler(opts))
+	mux.Handle(pakePath+"/", pakeHandler(opts))
+	mux.Handle(dictsPath, dictsHandler(opts))
+	mux.Handle(dictsPath+"/", dictsHandler(opts))
+	mux.Handle(chunkedUploadPrefix, chunkedUploadHandler(opts))
+	for _, inbox := range opts.inboxes {
+		debugLog("Serving inbox %s with drop dir %s", inbox.name, inbox.dropDir)
+		handler, err := newInboxHandler(inbox)
+		if err != nil {
+			errChan <- fmt.Errorf("inbox %s: %v", inbox.name, err)
+			return
+		}
+		mux.Handle(inboxPath(inbox.name), handler)
+		if err := opts.chunked.restore(inbox); err != nil {
+			errChan <- fmt.Errorf("inbox %s: failed to restore the chunked uploads: %v", inbox.name, err)
+			return
+		}
+	}
+
+	// UDP uploads with forward error correction use the same port number,
+	// on networks that have UDP
+	packets, err := peerNet.ListenPacket("udp", fmt.Sprintf(":%d", opts.port))
+	switch {
+	case err == nil:
+		go func() {
+			if err := serveFEC(opts, packets); err != nil {
+				logger.Error("Failed to serve UDP uploads", "error", err)
+			}
+		}()
+	case !errors.Is(err, errors.ErrUnsupported):
+		logger.Error("Failed to serve UDP uploads", "error", err)
+	}
+
+	// raw TCP uploads share the port with HTTP and are told apart by their
+	// first bytes
+	if opts.linkLocal {
+		ln = linkLocalListener{ln}
+	}
+	rawLn := newRawMuxListener(tunedListener{Listener: ln, tuning: opts.tcp}, opts)
+	if opts.relay != nil {
+		go opts.relay.serveRelayed(opts.advertised, rawLn.relayed)
+	}
+	var root http.Handler = mux
+	if opts.dropOnly {
+		root = dropOnlyMiddleware(mux)
+	}
+	root = accessMiddleware(opts, guardMiddleware(opts, root))
+	server.Handler = root
+	server.ConnContext = tlsConnContext
+	if err := server.Serve(rawLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		errChan <- fmt.Errorf("failed to start the http server: %v", err)
+		return
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRelayPort = 8845
+	// relayHelloTimeout bounds the wait for the first line of a connection
+	relayHelloTimeout = 10 * time.Second
+	// relayDialTimeout bounds the wait of a sender for the receiver to
+	// connect back to the relay
+	relayDialTimeout = 10 * time.Second
+	// relayRetryDelay is how long a receiver that lost the relay waits
+	// before registering again
+	relayRetryDelay = 5 * time.Second
+	maxRelayLine    = 64 << 10
+)
+
+// The operations a connection to the relay starts with.
+const (
+	// relayRegister keeps the connection of a receiver open to be asked to
+	// connect back for its senders
+	relayRegister = "register"
+	// relayLookup asks for the TXT records of a registered receiver
+	relayLookup = "lookup"
+	// relayConnect asks for the connection to be spliced with one the
+	// receiver opens back
+	relayConnect = "connect"
+	// relayAccept is the connection a receiver opens back for a sender
+	relayAccept = "accept"
+)
+
+// relayHello is the JSON line a connection to the relay starts with.
+type relayHello struct {
+	Op   string `json:"op"`
+	Key  string `json:"key"`
+	Name string `json:"name,omitempty"`
+	// TXT are the records of the receiver registering, as it advertises
+	// them over mDNS
+	TXT []string `json:"txt,omitempty"`
+	// ID is the dial a receiver accepts
+	ID string `json:"id,omitempty"`
+}
+
+// relayReply answers the register, lookup and connect operations.
+type relayReply struct {
+	Error string   `json:"error,omitempty"`
+	TXT   []string `json:"txt,omitempty"`
+}
+
+// relayDial asks a registered receiver to connect back for a sender.
+type relayDial struct {
+	ID string `json:"id"`
+	// Address is the one of the sender, which the receiver applies its
+	// access rules to
+	Address string `json:"address"`
+}
+
+func writeRelayLine(w io.Writer, v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+func readRelayLine(br *bufio.Reader, v any) error {
+	line, err := br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return errors.New("relay message too long")
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
+
+// relayServer lets senders reach receivers they can't discover or connect
+// to, on another subnet or behind NAT. Receivers keep a connection to it
+// open, and every connection a sender opens to one of them is spliced with
+// one the receiver opens back, so neither has to accept connections from
+// the other. The payload goes through as is, TLS and all; the relay only
+// holds the relay key, not the passkeys.
+type relayServer struct {
+	key     string
+	mu      sync.Mutex
+	peers   map[string]*relayPeer
+	pending map[string]chan net.Conn
+}
+
+// relayPeer is a registered receiver.
+type relayPeer struct {
+	txt []string
+	// mu serializes the dials written to conn
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newRelayServer(key string) *relayServer {
+	return &relayServer{key: key, peers: map[string]*relayPeer{}, pending: map[string]chan net.Conn{}}
+}
+
+func (s *relayServer) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *relayServer) handle(conn net.Conn) {
+	br := bufio.NewReaderSize(conn, maxRelayLine)
+	var hello relayHello
+	conn.SetReadDeadline(time.Now().Add(relayHelloTimeout))
+	err := readRelayLine(br, &hello)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		debugLog("Dropping the relay connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if !keyMatches(hello.Key, s.key) {
+		logger.Warn("Wrong relay key", "address", remoteHost(conn.RemoteAddr().String()), "op", hello.Op, "name", hello.Name)
+		writeRelayLine(conn, relayReply{Error: "wrong relay key"})
+		conn.Close()
+		return
+	}
+	switch hello.Op {
+	case relayRegister:
+		s.register(conn, br, hello)
+	case relayLookup:
+		defer conn.Close()
+		peer, ok := s.peer(hello.Name)
+		if !ok {
+			writeRelayLine(conn, relayReply{Error: "unknown peer " + hello.Name})
+			return
+		}
+		writeRelayLine(conn, relayReply{TXT: peer.txt})
+	case relayConnect:
+		s.connect(conn, br, hello)
+	case relayAccept:
+		s.mu.Lock()
+		ch, ok := s.pending[hello.ID]
+		delete(s.pending, hello.ID)
+		s.mu.Unlock()
+		if !ok {
+			debugLog("Dropping the connection for the unknown dial %s", hello.ID)
+			conn.Close()
+			return
+		}
+		ch <- &peekedConn{Conn: conn, r: br}
+	default:
+		writeRelayLine(conn, relayReply{Error: "unknown operation " + hello.Op})
+		conn.Close()
+	}
+}
+
+func (s *relayServer) peer(name string) (*relayPeer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer, ok := s.peers[name]
+	return peer, ok
+}
+
+// register keeps the receiver registered until its connection drops. A
+// name stays with the receiver that registered it while that one is
+// connected, so another holder of the relay key can't take over its
+// senders; a receiver that vanished without closing its connection is let
+// go of once the TCP keep-alives the listener enables go unanswered.
+func (s *relayServer) register(conn net.Conn, br *bufio.Reader, hello relayHello) {
+	defer conn.Close()
+	if hello.Name == "" {
+		writeRelayLine(conn, relayReply{Error: "no name to register"})
+		return
+	}
+	peer := &relayPeer{txt: hello.TXT, conn: conn}
+	s.mu.Lock()
+	if _, ok := s.peers[hello.Name]; ok {
+		s.mu.Unlock()
+		logger.Warn("Refused to register a name already registered", "name", hello.Name, "address", remoteHost(conn.RemoteAddr().String()))
+		writeRelayLine(conn, relayReply{Error: hello.Name + " is already registered"})
+		return
+	}
+	s.peers[hello.Name] = peer
+	s.mu.Unlock()
+	if err := writeRelayLine(conn, relayReply{}); err != nil {
+		return
+	}
+	logger.Info("Registered a peer", "name", hello.Name, "address", remoteHost(conn.RemoteAddr().String()))
+	// nothing more comes from the receiver, this returns once it's gone
+	io.Copy(io.Discard, br)
+	s.mu.Lock()
+	if s.peers[hello.Name] == peer {
+		delete(s.peers, hello.Name)
+	}
+	s.mu.Unlock()
+	logger.Info("Unregistered a peer", "name", hello.Name)
+}
+
+// connect asks the receiver to connect back and splices the sender's
+// connection with the one it opens.
+func (s *relayServer) connect(conn net.Conn, br *bufio.Reader, hello relayHello) {
+	defer conn.Close()
+	peer, ok := s.peer(hello.Name)
+	if !ok {
+		writeRelayLine(conn, relayReply{Error: "unknown peer " + hello.Name})
+		return
+	}
+	id := newTransferID()
+	ch := make(chan net.Conn, 1)
+	s.mu.Lock()
+	s.pending[id] = ch
+	s.mu.Unlock()
+	peer.mu.Lock()
+	err := writeRelayLine(peer.conn, relayDial{ID: id, Address: conn.RemoteAddr().String()})
+	peer.mu.Unlock()
+	var back net.Conn
+	if err == nil {
+		select {
+		case back = <-ch:
+		case <-time.After(relayDialTimeout):
+		}
+	}
+	if back == nil {
+		s.mu.Lock()
+		delete(s.pending, id)
+		s.mu.Unlock()
+		// the receiver may have made it just in time
+		select {
+		case late := <-ch:
+			late.Close()
+		default:
+		}
+		writeRelayLine(conn, relayReply{Error: hello.Name + " didn't connect back"})
+		return
+	}
+	defer back.Close()
+	if err := writeRelayLine(conn, relayReply{TXT: peer.txt}); err != nil {
+		return
+	}
+	debugLog("Relaying %s to %s", conn.RemoteAddr(), hello.Name)
+	spliceConns(&peekedConn{Conn: conn, r: br}, back)
+}
+
+// spliceConns copies between a and b both ways until either side is done.
+func spliceConns(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+// relayEndpoint is a relay senders and receivers go through, by its address
+// and key.
+type relayEndpoint struct {
+	addr string
+	key  string
+}
+
+func newRelayEndpoint(addr, key string) (*relayEndpoint, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, fmt.Sprint(defaultRelayPort))
+	}
+	if key == "" {
+		return nil, errors.New("--relay-key is required with --relay")
+	}
+	return &relayEndpoint{addr: addr, key: key}, nil
+}
+
+// open connects to the relay and starts the operation, returning the
+// connection and the reply. An accept gets no reply, what follows is the
+// sender's.
+func (r *relayEndpoint) open(ctx context.Context, hello relayHello) (net.Conn, relayReply, error) {
+	var reply relayReply
+	dialer := &net.Dialer{Timeout: relayHelloTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return nil, reply, err
+	}
+	hello.Key = r.key
+	br := bufio.NewReaderSize(conn, maxRelayLine)
+	// the reply to a connect waits for the receiver to connect back
+	conn.SetDeadline(time.Now().Add(relayHelloTimeout + relayDialTimeout))
+	if err = writeRelayLine(conn, hello); err == nil && hello.Op != relayAccept {
+		err = readRelayLine(br, &reply)
+	}
+	conn.SetDeadline(time.Time{})
+	if err == nil && reply.Error != "" {
+		err = errors.New(reply.Error)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, reply, fmt.Errorf("relay %s: %v", r.addr, err)
+	}
+	return &peekedConn{Conn: conn, r: br}, reply, nil
+}
+
+// lookup returns the peer's TXT records as it registered them.
+func (r *relayEndpoint) lookup(peer string) (cachedPeer, error) {
+	conn, reply, err := r.open(context.Background(), relayHello{Op: relayLookup, Name: peer})
+	if err != nil {
+		return cachedPeer{}, err
+	}
+	conn.Close()
+	host, port, _ := net.SplitHostPort(r.addr)
+	p := cachedPeer{Addr: host, Text: reply.TXT}
+	fmt.Sscan(port, &p.Port)
+	return p, nil
+}
+
+// httpClient returns a client whose every connection goes to the peer
+// through the relay.
+func (r *relayEndpoint) httpClient(peer string, tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, _, err := r.open(ctx, relayHello{Op: relayConnect, Name: peer})
+		if err != nil {
+			return nil, err
+		}
+		return bandwidth.conn(simulation.conn(conn)), nil
+	}
+	return &http.Client{Transport: transport}
+}
+
+// serveRelayed keeps the receiver registered with the relay by its info,
+// handing the connections of the senders it relays to route. It never
+// returns.
+func (r *relayEndpoint) serveRelayed(info peerInfo, route func(net.Conn)) {
+	for {
+		err := r.register(info, route)
+		logger.Warn("Lost the relay, registering again", "relay", r.addr, "error", err, "retry", relayRetryDelay)
+		time.Sleep(relayRetryDelay)
+	}
+}
+
+func (r *relayEndpoint) register(info peerInfo, route func(net.Conn)) error {
+	conn, _, err := r.open(context.Background(), relayHello{Op: relayRegister, Name: info.Name, TXT: info.TXT})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	logger.Info("Registered with the relay", "relay", r.addr, "name", info.Name)
+	br := bufio.NewReaderSize(conn, maxRelayLine)
+	for {
+		var dial relayDial
+		if err := readRelayLine(br, &dial); err != nil {
+			return err
+		}
+		go func() {
+			back, _, err := r.open(context.Background(), relayHello{Op: relayAccept, ID: dial.ID})
+			if err != nil {
+				debugLog("Failed to connect back to the relay for %s: %v", dial.Address, err)
+				return
+			}
+			route(&relayedConn{Conn: back, remote: relayedAddr(dial.Address, back)})
+		}()
+	}
+}
+
+// relayedConn is a connection from a sender through the relay, which
+// reports the sender's address as its remote one.
+type relayedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *relayedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func relayedAddr(addr string, conn net.Conn) net.Addr {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return conn.RemoteAddr()
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+func runRelay(args []string) {
+	relayCmd := flag.NewFlagSet("relay", flag.ExitOnError)
+	relayCmd.SetOutput(os.Stdout)
+	port := relayCmd.Int("port", defaultRelayPort, "the port the relay listens at")
+	key := relayCmd.String("key", "", "the relay key receivers and senders have to present")
+	debug := relayCmd.Bool("debug", false, "enable debug log")
+	logLevelName := relayCmd.String("log-level", "info", "the least severe messages to log: debug, info, warn or error")
+	logFormat := relayCmd.String("log-format", "text", "the format of the log: text or json")
+	if err := relayCmd.Parse(args); err != nil {
+		exitWithError(1, "Relay command failed: %v", err)
+	}
+	debugMode = *debug
+	if err := setupLogging(*logLevelName, *logFormat, os.Stderr); err != nil {
+		exitWithError(1, "Invalid logging: %v", err)
+	}
+	if *key == "" {
+		exitWithError(1, "The relay key is required, pass it with --key")
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+	if err != nil {
+		exitWithError(1, "Failed to listen at port %d: %v", *port, err)
+	}
+	logger.Info("Relaying", "port", *port)
+	if err := newRelayServer(*key).serve(ln); err != nil {
+		exitWithError(1, "Relay error: %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	replicateSectionPrefix = "replicate"
+	defaultReplicaRetries  = 2
+	replicaQueueSize       = 64
+)
+
+// replicaTarget is a downstream destination every completed upload is
+// forwarded to, read from a `[replicate.<name>]` config section. It is either
+// a peer:
+//
+//	[replicate.nas]
+//	peer = nas
+//	key = secret
+//	inbox = backups
+//	transport = tcp
+//
+// or a dir, such as a mounted storage backend:
+//
+//	[replicate.offsite]
+//	dir = /mnt/offsite/ftr
+type replicaTarget struct {
+	name      string
+	peer      string
+	key       string
+	inbox     string
+	transport string
+	dir       string
+	retries   int
+}
+
+// replicator forwards uploads to the replica targets in the background so
+// the sender doesn't wait for the fan-out. A nil replicator does nothing.
+type replicator struct {
+	targets     []replicaTarget
+	historyFile string
+	tcp         tcpTuning
+	queue       chan []string
+	// force replicates on battery too, instead of deferring until the
+	// machine is back on mains power
+	force bool
+}
+
+func loadReplicaTargets(cfg *config) ([]replicaTarget, error) {
+	var targets []replicaTarget
+	for _, name := range cfg.subsections(replicateSectionPrefix) {
+		sec := cfg.section(replicateSectionPrefix + "." + name)
+		t := replicaTarget{
+			name:      name,
+			peer:      sec["peer"],
+			key:       sec["key"],
+			inbox:     sec["inbox"],
+			transport: sec["transport"],
+			dir:       sec["dir"],
+			retries:   defaultReplicaRetries,
+		}
+		if (t.peer == "") == (t.dir == "") {
+			return nil, fmt.Errorf("replica %s: exactly one of peer or dir is required", name)
+		}
+		switch t.transport {
+		case "":
+			t.transport = transportHTTP
+		case transportHTTP, transportTCP:
+		default:
+			return nil, fmt.Errorf("replica %s: unsupported transport %s", name, t.transport)
+		}
+		if v, ok := sec["retries"]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("replica %s: invalid retries %q", name, v)
+			}
+			t.retries = n
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// newReplicator starts forwarding to the targets, or returns nil if there
+// are none.
+func newReplicator(targets []replicaTarget, historyFile string, tcp tcpTuning, force bool) *replicator {
+	if len(targets) == 0 {
+		return nil
+	}
+	r := &replicator{
+		targets:     targets,
+		historyFile: historyFile,
+		tcp:         tcp,
+		queue:       make(chan []string, replicaQueueSize),
+		force:       force,
+	}
+	go r.run()
+	return r
+}
+
+// enqueue schedules the delivered paths of an upload for replication.
+func (r *replicator) enqueue(paths []string) {
+	if r == nil || len(paths) == 0 {
+		return
+	}
+	r.queue <- paths
+}
+
+func (r *replicator) run() {
+	for paths := range r.queue {
+		if !r.force {
+			waitForPower("replication")
+		}
+		for _, t := range r.targets {
+			for _, p := range paths {
+				start := time.Now()
+				report, err := r.replicate(t, p)
+				if err != nil {
+					logger.Warn("Failed to replicate", "path", p, "peer", t.name, "error", err)
+				} else {
+					debugLog("Replicated %s to %s", p, t.name)
+				}
+				recordSend(r.historyFile, t.name, filepath.Base(p), start, report, err)
+			}
+		}
+	}
+}
+
+func (r *replicator) replicate(t replicaTarget, src string) (*transferReport, error) {
+	if t.dir != "" {
+		size, err := copyTree(src, filepath.Join(t.dir, filepath.Base(src)))
+		if err != nil {
+			return nil, err
+		}
+		return &transferReport{Source: src, OriginalBytes: size}, nil
+	}
+	// replicas may come and go, so a lookup failure is retried as well
+	p, _, err := resolvePeer(t.peer, defaultPeerCacheFile(), defaultPeerCacheTTLSec*time.Second,
+		defaultLookupTimeoutMs*time.Millisecond, defaultLookupRetries)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := peerTLS(t.peer, p.Text)
+	return sendFile(src, sendOptions{
+		key:       t.key,
+		addr:      p.Addr,
+		port:      p.Port,
+		retries:   t.retries,
+		inbox:     t.inbox,
+		tls:       tlsConfig,
+		client:    r.tcp.httpClient(tlsConfig),
+		transport: t.transport,
+		tcp:       r.tcp,
+		extract:   true,
+		codec:     peerCodec(p.Text),
+	})
+}
+
+// copyTree copies the file or directory src to dst and returns the number of
+// bytes copied.
+func copyTree(src, dst string) (int64, error) {
+	var total int64
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		n, err := copyFile(path, target)
+		total += n
+		return err
+	})
+	return total, err
+}
+
+func copyFile(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
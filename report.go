@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// transferReport summarizes a single send once it has completed.
+type transferReport struct {
+	Peer            string  `json:"peer"`
+	Source          string  `json:"source"`
+	OriginalBytes   int64   `json:"original_bytes"`
+	CompressedBytes int64   `json:"compressed_bytes"`
+	Ratio           float64 `json:"ratio"`
+	DurationMs      int64   `json:"duration_ms"`
+	ThroughputBps   float64 `json:"throughput_bytes_per_sec"`
+	Retries         int     `json:"retries"`
+	// Hash is the SHA-256 of the uploaded payload
+	Hash string `json:"sha256"`
+}
+
+func (r *transferReport) finish(elapsed time.Duration) {
+	r.DurationMs = elapsed.Milliseconds()
+	if r.OriginalBytes > 0 {
+		r.Ratio = float64(r.CompressedBytes) / float64(r.OriginalBytes)
+	}
+	if secs := elapsed.Seconds(); secs > 0 {
+		r.ThroughputBps = float64(r.OriginalBytes) / secs
+	}
+}
+
+func printReport(w io.Writer, format string, r *transferReport) error {
+	switch format {
+	case "json":
+		return json.NewEncoder(w).Encode(r)
+	case "text":
+		fmt.Fprintf(w, "Peer:            %s\n", r.Peer)
+		fmt.Fprintf(w, "Source:          %s\n", r.Source)
+		fmt.Fprintf(w, "Original size:   %s (%d bytes)\n", formatBytes(r.OriginalBytes), r.OriginalBytes)
+		fmt.Fprintf(w, "Compressed size: %s (%d bytes)\n", formatBytes(r.CompressedBytes), r.CompressedBytes)
+		fmt.Fprintf(w, "Ratio:           %.2f\n", r.Ratio)
+		fmt.Fprintf(w, "Duration:        %s\n", formatDuration(time.Duration(r.DurationMs)*time.Millisecond))
+		fmt.Fprintf(w, "Throughput:      %s\n", formatRate(r.ThroughputBps))
+		fmt.Fprintf(w, "Retries:         %d\n", r.Retries)
+		fmt.Fprintf(w, "SHA-256:         %s\n", r.Hash)
+		return nil
+	default:
+		return fmt.Errorf("unsupported report format: %s", format)
+	}
+}
+
+// dirSize returns the total size of the regular files under dir, leaving out
+// the dirs in skip.
+func dirSize(dir string, skip ...string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && slices.Contains(skip, path) {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
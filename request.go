@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	policyAllow    = "allow"
+	policyDeny     = "deny"
+	policyPrompt   = "prompt"
+	fileNameHeader = "X-Ftr-File-Name"
+)
+
+// fileRequest asks a peer to send back a file from its share dir.
+type fileRequest struct {
+	Path string `json:"path"`
+}
+
+// resolveSharePath maps a requested path onto the share dir without letting
+// it escape.
+func resolveSharePath(shareDir, p string) string {
+	return filepath.Join(shareDir, filepath.Clean("/"+p))
+}
+
+// requestHandler serves files of the share dir that peers ask for, subject to
+// the request policy. The file is streamed back as the response body, with a
+// directory sent as a gzipped tarball.
+func requestHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req fileRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil || req.Path == "" {
+			http.Error(w, "Invalid file request", http.StatusBadRequest)
+			return
+		}
+		requester := senderName(r)
+		entry := historyEntry{Direction: directionSend, Peer: requester, File: req.Path, Status: statusFailed}
+		fail := func(msg string, code int) {
+			entry.Error = msg
+			recordHistory(opts.historyFile, entry)
+			http.Error(w, msg, code)
+		}
+
+		if opts.shareDir == "" {
+			fail("Nothing is shared", http.StatusNotFound)
+			return
+		}
+		// the policy goes first, a refused requester can't tell which
+		// paths exist
+		switch opts.requestPolicy {
+		case policyAllow:
+		case policyPrompt:
+			if !confirm(fmt.Sprintf("%s requests %s. Send it?", requester, req.Path), defaultPromptTimeout) {
+				fail("Request declined", http.StatusForbidden)
+				return
+			}
+		default:
+			fail("Requests are not accepted", http.StatusForbidden)
+			return
+		}
+		src := resolveSharePath(opts.shareDir, req.Path)
+		entry.Path = src
+		fi, err := os.Stat(src)
+		if err != nil {
+			fail("File not found", http.StatusNotFound)
+			return
+		}
+
+		start := time.Now()
+		written, err := serveShared(w, src, fi)
+		entry.Bytes = written
+		entry.DurationMs = time.Since(start).Milliseconds()
+		if err != nil {
+			// the status line is already out, the requester sees a short body
+			entry.Error = err.Error()
+			recordHistory(opts.historyFile, entry)
+			return
+		}
+		entry.Status = statusOK
+		recordHistory(opts.historyFile, entry)
+		fmt.Fprintf(infoOut, "Sent %s to %s\n", req.Path, requester)
+	}
+}
+
+// serveShared streams the file at src as the response body, or a gzipped
+// tarball if it's a directory, and returns the number of bytes written.
+func serveShared(w http.ResponseWriter, src string, fi os.FileInfo) (int64, error) {
+	name := filepath.Base(src)
+	if fi.IsDir() {
+		w.Header().Set(fileTypeHeader, fileTypeDir)
+		w.Header().Set(fileNameHeader, name+".tar.gz")
+		cw := &countingWriter{w: w}
+		err := writeTarball(cw, src, codecGzip)
+		return cw.n, err
+	}
+	w.Header().Set(fileTypeHeader, fileTypeFile)
+	w.Header().Set(fileNameHeader, name)
+	w.Header().Set("Content-Length", fmt.Sprint(fi.Size()))
+	f, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func runRequest(args []string) {
+	requestCmd := flag.NewFlagSet("request", flag.ExitOnError)
+	requestCmd.SetOutput(os.Stdout)
+	key := requestCmd.String("key", "", "pre-shared passkey of the peer")
+	debug := requestCmd.Bool("debug", false, "enable debug log")
+	dropDir := requestCmd.String("dropdir", defaultDropDir(), "the dir to store the requested file in")
+	historyFile := requestCmd.String("history-file", defaultHistoryFile(), "the path to the transfer history ledger, empty to disable")
+	lookupTimeout := requestCmd.Duration("lookup-timeout", defaultLookupTimeoutMs*time.Millisecond, "how long to browse for the peer per attempt")
+	lookupRetries := requestCmd.Int("lookup-retries", defaultLookupRetries, "the number of times to retry a failed peer lookup")
+	if err := requestCmd.Parse(args); err != nil {
+		exitWithError(1, "Request command failed: %v", err)
+	}
+	debugMode = *debug
+	pos := requestCmd.Args()
+	if len(pos) != 2 {
+		fmt.Println("Usage: ftr request --key <key> <peer> <path>")
+		os.Exit(1)
+	}
+	peer, p := pos[0], pos[1]
+
+	e, err := findPeer(peer, *lookupTimeout, *lookupRetries)
+	if err != nil {
+		exitWithError(1, "Failed to find the peer: %v", err)
+	}
+	body, err := json.Marshal(fileRequest{Path: p})
+	if err != nil {
+		exitWithError(1, "Failed to encode the request: %v", err)
+	}
+	tlsConfig := peerTLS(peer, e.Text)
+	req, err := http.NewRequest(http.MethodPost, peerURL(tlsConfig, peerAddr(e), e.Port, "/request"), bytes.NewReader(body))
+	if err != nil {
+		exitWithError(1, "Failed to create the http request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(passKeyHeader, *key)
+	req.Header.Set(senderHeader, getDefaultName())
+	fmt.Printf("Asking %s for %s...\n", peer, p)
+	resp, err := tlsClient(tlsConfig).Do(req)
+	if err != nil {
+		exitWithError(1, "Failed to send the request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		exitWithError(1, "The peer refused the request: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	if err := receiveServed(resp, peer, *dropDir, *historyFile); err != nil {
+		exitWithError(1, "Failed to receive the file: %v", err)
+	}
+	fmt.Printf("Received %s into %s\n", p, *dropDir)
+}
+
+// receiveServed stores the file a peer served as the response into dropDir,
+// as if the peer had uploaded it.
+func receiveServed(resp *http.Response, peer, dropDir, historyFile string) error {
+	opts := receiverOptions{dropDir: dropDir, historyFile: historyFile, quarantine: true, autoExtract: true}
+	if err := prepareInbox(opts); err != nil {
+		return fmt.Errorf("failed to prepare the drop dir: %v", err)
+	}
+	_, err := receiveUpload(opts, upload{
+		name:     resp.Header.Get(fileNameHeader),
+		fileType: resp.Header.Get(fileTypeHeader),
+		size:     resp.ContentLength,
+		sender:   peer,
+		body:     resp.Body,
+		extract:  true,
+	})
+	return err
+}
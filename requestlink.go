@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	requestLinksPath          = "/request-links"
+	requestLinkPrefix         = "/r/"
+	requestLinkTokenLength    = 16
+	defaultRequestLinkTTL     = 24 * time.Hour
+	defaultRequestLinkMaxSize = "1GB"
+)
+
+// requestLink lets whoever opens it in a browser upload files once into a
+// subdir of the default drop dir, the inverse of a share link.
+type requestLink struct {
+	Token   string    `json:"token"`
+	Dir     string    `json:"dir"`
+	Note    string    `json:"note,omitempty"`
+	Expires time.Time `json:"expires"`
+	MaxSize int64     `json:"max_size"`
+}
+
+// requestLinks holds the unused request links. A nil store has none.
+type requestLinks struct {
+	mu    sync.Mutex
+	links map[string]requestLink
+}
+
+func newRequestLinks() *requestLinks {
+	return &requestLinks{links: map[string]requestLink{}}
+}
+
+func (s *requestLinks) mint(dir, note string, ttl time.Duration, maxSize int64) requestLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for token, l := range s.links {
+		if now.After(l.Expires) {
+			delete(s.links, token)
+		}
+	}
+	l := requestLink{
+		Token:   randomPassKey(requestLinkTokenLength),
+		Dir:     dir,
+		Note:    note,
+		Expires: now.Add(ttl),
+		MaxSize: maxSize,
+	}
+	s.links[l.Token] = l
+	return l
+}
+
+func (s *requestLinks) get(token string) (requestLink, bool) {
+	if s == nil {
+		return requestLink{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[token]
+	if !ok || time.Now().After(l.Expires) {
+		return requestLink{}, false
+	}
+	return l, true
+}
+
+// claim uses up the link so it can't be submitted twice at once.
+func (s *requestLinks) claim(token string) (requestLink, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[token]
+	if !ok || time.Now().After(l.Expires) {
+		return requestLink{}, false
+	}
+	delete(s.links, token)
+	return l, true
+}
+
+// release gives back a claimed link whose upload failed, so the person it
+// was sent to can try again.
+func (s *requestLinks) release(l requestLink) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.links[l.Token] = l
+}
+
+type requestLinkRequest struct {
+	Dir     string `json:"dir"`
+	Note    string `json:"note"`
+	TTL     string `json:"ttl"`
+	MaxSize int64  `json:"max_size"`
+}
+
+// requestLinksHandler mints request links for the authenticated user.
+func requestLinksHandler(s *requestLinks) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req requestLinkRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request link request", http.StatusBadRequest)
+			return
+		}
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 || req.MaxSize <= 0 {
+			http.Error(w, "Invalid request link request", http.StatusBadRequest)
+			return
+		}
+		l := s.mint(filepath.ToSlash(filepath.Clean("/"+req.Dir)), req.Note, ttl, req.MaxSize)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(l)
+	}
+}
+
+type requestLinkPage struct {
+	Note     string
+	Dir      string
+	MaxSize  int64
+	Expires  string
+	Received []string
+	Error    string
+}
+
+// requestLinkHandler serves the upload form of a request link and stores
+// what is submitted with it into the link's subdir of the drop dir.
+func requestLinkHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.URL.Path, requestLinkPrefix)
+		l, ok := opts.links.get(token)
+		if !ok {
+			http.Error(w, "This link has expired or was already used", http.StatusNotFound)
+			return
+		}
+		page := requestLinkPage{Note: l.Note, Dir: l.Dir, MaxSize: l.MaxSize, Expires: l.Expires.Local().Format(time.RFC1123)}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if l, ok = opts.links.claim(token); !ok {
+				http.Error(w, "This link has expired or was already used", http.StatusNotFound)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, l.MaxSize+guestRequestSlack)
+			page.Received, page.Error = receiveLinkUpload(opts, l, w, r)
+			if len(page.Received) == 0 {
+				opts.links.release(l)
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := requestLinkForm.Execute(w, page); err != nil {
+			debugLog("Failed to render the request link page: %v", err)
+		}
+	}
+}
+
+// receiveLinkUpload stores the files of the form, returning the names of the
+// ones received and the first error.
+func receiveLinkUpload(opts receiverOptions, l requestLink, w http.ResponseWriter, r *http.Request) ([]string, string) {
+	linkOpts := opts
+	linkOpts.dropDir = resolveSharePath(opts.dropDir, l.Dir)
+	// the files still count against the quota of the whole inbox
+	linkOpts.quotaDir = opts.dropDir
+	if linkOpts.maxSize <= 0 || l.MaxSize < linkOpts.maxSize {
+		linkOpts.maxSize = l.MaxSize
+	}
+	if err := prepareInbox(linkOpts); err != nil {
+		return nil, "Failed to prepare the upload dir"
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "Invalid upload"
+	}
+	sender := remoteHost(r.RemoteAddr)
+	rc := http.NewResponseController(w)
+	var received []string
+	firstErr := ""
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		switch part.FormName() {
+		case "name":
+			// the form puts the name before the files
+			name, _ := io.ReadAll(io.LimitReader(part, 256))
+			if s := strings.TrimSpace(string(name)); s != "" {
+				sender = s
+			}
+		case "file":
+			if part.FileName() == "" {
+				break
+			}
+			_, err := receiveUpload(linkOpts, upload{
+				name:     part.FileName(),
+				fileType: fileTypeFile,
+				size:     -1,
+				sender:   sender,
+				address:  remoteHost(r.RemoteAddr),
+				body:     part,
+				extract:  true,
+				// minting the link was the receiver's approval
+				approved:    true,
+				setDeadline: rc.SetReadDeadline,
+			})
+			if err != nil {
+				if firstErr == "" {
+					firstErr = fmt.Sprintf("%s: %v", part.FileName(), err)
+				}
+				break
+			}
+			received = append(received, part.FileName())
+			fmt.Fprintf(infoOut, "Received %s from %s through a request link\n", part.FileName(), sender)
+		}
+		part.Close()
+	}
+	if len(received) == 0 && firstErr == "" {
+		firstErr = "No file was selected"
+	}
+	return received, firstErr
+}
+
+var requestLinkForm = template.Must(template.New("request-link").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>ftr upload</title>
+<style>
+body { font-family: sans-serif; margin: 2em; max-width: 40em; }
+input, button { font-size: 1em; margin: 0.4em 0; }
+.error { color: #b00; }
+</style></head>
+<body>
+{{if .Received}}
+<h1>Thank you!</h1>
+<p>Received:</p>
+<ul>{{range .Received}}<li>{{.}}</li>{{end}}</ul>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{else}}
+<h1>Send files</h1>
+{{if .Note}}<p>{{.Note}}</p>{{end}}
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" enctype="multipart/form-data">
+<p><label>Your name <input type="text" name="name"></label></p>
+<p><input type="file" name="file" multiple required></p>
+<p><button type="submit">Upload</button></p>
+</form>
+<p><small>Up to {{.MaxSize}} bytes in total. This link works once and expires {{.Expires}}.</small></p>
+{{end}}
+</body></html>
+`))
+
+// lanAddrs returns the IPv4 addresses peers on the LAN may reach this host at.
+func lanAddrs() []string {
+	var addrs []string
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range ifAddrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				addrs = append(addrs, ipNet.IP.String())
+			}
+		}
+	}
+	return addrs
+}
+
+// printQR renders the text as a QR code on the terminal if qrencode is
+// installed.
+func printQR(text string) {
+	if _, err := exec.LookPath("qrencode"); err != nil {
+		debugLog("qrencode is not installed, not printing a QR code")
+		return
+	}
+	cmd := exec.Command("qrencode", "-t", "ANSIUTF8", text)
+	cmd.Stdout = os.Stdout
+	if err := cmd.Run(); err != nil {
+		debugLog("Failed to print the QR code: %v", err)
+	}
+}
+
+func runRequestLink(args []string) {
+	linkCmd := flag.NewFlagSet("request-link", flag.ExitOnError)
+	linkCmd.SetOutput(os.Stdout)
+	key := linkCmd.String("key", "", "the passkey of the local receiver")
+	port := linkCmd.Int("port", defaultPort, "the port of the local receiver")
+	dir := linkCmd.String("dir", "", "the subdir of the drop dir to store the files in")
+	note := linkCmd.String("note", "", "a message shown above the upload form")
+	ttl := linkCmd.Duration("ttl", defaultRequestLinkTTL, "how long the link stays valid")
+	maxSize := linkCmd.String("max-size", defaultRequestLinkMaxSize, "the most the link allows to upload")
+	debug := linkCmd.Bool("debug", false, "enable debug log")
+	applyUnits := unitFlags(linkCmd)
+	if err := linkCmd.Parse(args); err != nil {
+		exitWithError(1, "Request-link command failed: %v", err)
+	}
+	debugMode = *debug
+	applyUnits()
+	size, err := parseSize(*maxSize)
+	if err != nil || size <= 0 {
+		exitWithError(1, "Invalid --max-size: %s", *maxSize)
+	}
+
+	body, err := json.Marshal(requestLinkRequest{Dir: *dir, Note: *note, TTL: ttl.String(), MaxSize: size})
+	if err != nil {
+		exitWithError(1, "Failed to encode the request: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d%s", *port, requestLinksPath), bytes.NewReader(body))
+	if err != nil {
+		exitWithError(1, "Failed to create the request: %v", err)
+	}
+	req.Header.Set(passKeyHeader, *key)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Timeout: guestRequestTimeout}).Do(req)
+	if err != nil {
+		exitWithError(1, "Failed to reach the receiver: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		exitWithError(1, "The receiver refused to create a link: %s %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var l requestLink
+	if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+		exitWithError(1, "Failed to decode the request link: %v", err)
+	}
+
+	addrs := lanAddrs()
+	if len(addrs) == 0 {
+		addrs = []string{"127.0.0.1"}
+	}
+	fmt.Printf("Request link for %s (valid until %s, up to %s):\n", l.Dir, l.Expires.Local().Format(time.Kitchen), formatBytes(l.MaxSize))
+	for _, a := range addrs {
+		fmt.Printf("  http://%s%s\n", net.JoinHostPort(a, fmt.Sprint(*port)), requestLinkPrefix+l.Token)
+	}
+	printQR(fmt.Sprintf("http://%s%s", net.JoinHostPort(addrs[0], fmt.Sprint(*port)), requestLinkPrefix+l.Token))
+}
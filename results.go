@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+const webhookTimeout = 10 * time.Second
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// emitSendResult writes the outcome of a send as a JSON line to resultFile
+// and posts it to webhook, for automation wrapping `ftr send`. Failures are
+// reported but don't fail the send.
+func emitSendResult(entry historyEntry, resultFile, webhook string) {
+	if resultFile != "" {
+		if err := appendHistory(resultFile, entry); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write the send result to %s: %v\n", resultFile, err)
+		}
+	}
+	if webhook != "" {
+		if err := postWebhook(webhook, entry); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to post the send result to %s: %v\n", webhook, err)
+		}
+	}
+}
+
+func postWebhook(url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned status: %s", resp.Status)
+	}
+	return nil
+}
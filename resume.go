@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// nodeHeader carries the fingerprint of the sender's node key, which a
+	// chunked upload is bound to instead of the address it came from
+	nodeHeader = "X-Ftr-Node"
+	// nodeTXTPrefix advertises the fingerprint of the receiver's node key so
+	// a sender finding it again at another address knows it's the same peer
+	nodeTXTPrefix = "node="
+
+	// pendingUploadsFileName keeps the chunked uploads a send didn't finish,
+	// for `ftr send --resume` to continue
+	pendingUploadsFileName = "uploads.json"
+
+	defaultChunkSize    = "8MiB"
+	defaultResumeWindow = 2 * time.Minute
+	reconnectInterval   = time.Second
+)
+
+// nodeFingerprint returns the fingerprint of the local node key, or "" when
+// there is none to be had.
+func nodeFingerprint() string {
+	key, err := loadNodeKey()
+	if err != nil {
+		debugLog("Failed to load the node key: %v", err)
+		return ""
+	}
+	return fingerprint(key.PublicKey().Bytes())
+}
+
+// advertisedNode returns the node fingerprint among the TXT records of a peer.
+func advertisedNode(text []string) string {
+	for _, t := range text {
+		if fp, ok := strings.CutPrefix(t, nodeTXTPrefix); ok {
+			return fp
+		}
+	}
+	return ""
+}
+
+// chunkedSender uploads a file through the chunked upload API of the peer.
+// When the network drops, e.g. a laptop roaming to another access point, it
+// looks the peer up again by name and continues the same upload wherever the
+// peer turns up, as long as it advertises the same node key.
+type chunkedSender struct {
+	opts sendOptions
+	node string
+	id   string
+}
+
+// send makes one request to the peer. The returned bool reports whether the
+// failure may go away at another address or a moment later.
+func (s *chunkedSender) send(method, urlPath string, body []byte, out any) (bool, error) {
+	url := s.opts.url(urlPath)
+	req, err := http.NewRequest(method, url, &throttledReader{r: bytes.NewReader(body), t: s.opts.throttle})
+	if err != nil {
+		return false, fmt.Errorf("failed to create the http request: %v", err)
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set(passKeyHeader, s.opts.key)
+	req.Header.Set(senderHeader, getDefaultName())
+	if s.node != "" {
+		req.Header.Set(nodeHeader, s.node)
+	}
+	resp, err := s.opts.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("failed to send the http request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode >= http.StatusInternalServerError && resp.StatusCode != http.StatusInsufficientStorage,
+			fmt.Errorf("server returned status: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		return false, json.NewDecoder(resp.Body).Decode(out)
+	}
+	return false, nil
+}
+
+// call makes the request, reconnecting to the peer until the request goes
+// through or it has failed for longer than the resume window.
+func (s *chunkedSender) call(method, urlPath string, body []byte, out any) error {
+	var failingSince time.Time
+	for {
+		retry, err := s.send(method, urlPath, body, out)
+		if err == nil || !retry {
+			return err
+		}
+		if failingSince.IsZero() {
+			failingSince = time.Now()
+		}
+		if time.Since(failingSince) > s.opts.resumeWindow {
+			return fmt.Errorf("gave up resuming after %v: %v", s.opts.resumeWindow, err)
+		}
+		debugLog("Reconnecting to %s after error: %v", s.opts.peer, err)
+		time.Sleep(reconnectInterval)
+		if err := s.reconnect(); err != nil {
+			var moved *peerChangedError
+			if errors.As(err, &moved) {
+				return err
+			}
+			debugLog("Failed to find %s again: %v", s.opts.peer, err)
+		}
+	}
+}
+
+// peerChangedError is a peer name now taken by another node, which must not
+// get the rest of the upload.
+type peerChangedError struct {
+	peer, want, got string
+}
+
+func (e *peerChangedError) Error() string {
+	return fmt.Sprintf("the peer %s now has the node key %s instead of %s", e.peer, e.got, e.want)
+}
+
+// reconnect looks the peer up again and points the sender at its address.
+func (s *chunkedSender) reconnect() error {
+	e, err := lookupPeer(s.opts.peer, s.opts.lookupTimeout)
+	if err != nil {
+		return err
+	}
+	if got := advertisedNode(e.Text); s.opts.peerNode != "" && got != s.opts.peerNode {
+		return &peerChangedError{peer: s.opts.peer, want: s.opts.peerNode, got: got}
+	}
+	addr := peerAddr(e)
+	if addr != s.opts.addr || e.Port != s.opts.port {
+		fmt.Fprintf(infoOut, "Continuing with %s at its new address %s\n", s.opts.peer, net.JoinHostPort(addr, strconv.Itoa(e.Port)))
+	}
+	s.opts.addr, s.opts.port = addr, e.Port
+	return nil
+}
+
+// pendingUpload is a chunked upload a send didn't finish, by the peer, inbox
+// and hash of the payload.
+type pendingUpload struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Updated time.Time `json:"updated"`
+}
+
+func defaultPendingUploadsFile() string {
+	dir, err := stateDir()
+	if err != nil {
+		exitWithError(1, "Failed to get the state dir: %v", err)
+	}
+	return filepath.Join(dir, pendingUploadsFileName)
+}
+
+func pendingKey(peer, inbox, hash string) string {
+	return peer + "/" + inbox + "/" + hash
+}
+
+// updatePendingUploads applies fn to the pending uploads and writes them
+// back, dropping the ones the receiver has given up on by now.
+func updatePendingUploads(file string, fn func(map[string]pendingUpload)) error {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	pending := map[string]pendingUpload{}
+	if data, err := os.ReadFile(file); err == nil {
+		if err := json.Unmarshal(data, &pending); err != nil {
+			debugLog("Discarding the pending uploads: %v", err)
+			pending = map[string]pendingUpload{}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	fn(pending)
+	for k, p := range pending {
+		if time.Since(p.Updated) > chunkedUploadIdleTTL {
+			delete(pending, k)
+		}
+	}
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d", file, os.Getpid())
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+var pendingMu sync.Mutex
+
+func lookupPendingUpload(file, key string) (pendingUpload, bool) {
+	var found pendingUpload
+	ok := false
+	err := updatePendingUploads(file, func(pending map[string]pendingUpload) {
+		found, ok = pending[key]
+	})
+	if err != nil {
+		debugLog("Failed to read the pending uploads: %v", err)
+	}
+	return found, ok
+}
+
+func setPendingUpload(file, key string, p *pendingUpload) {
+	err := updatePendingUploads(file, func(pending map[string]pendingUpload) {
+		if p == nil {
+			delete(pending, key)
+		} else {
+			pending[key] = *p
+		}
+	})
+	if err != nil {
+		debugLog("Failed to save the pending uploads: %v", err)
+	}
+}
+
+// postChunked uploads src in chunks of opts.chunkSize, surviving changes of
+// the peer's address for up to opts.resumeWindow. The upload is remembered
+// until it completes, and with opts.resume an unfinished one of the same
+// payload to the same peer continues with the chunks it's missing.
+func postChunked(src, fileType, hash string, size int64, opts sendOptions) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open the source file: %v", err)
+	}
+	defer file.Close()
+
+	s := &chunkedSender{opts: opts, node: nodeFingerprint()}
+	key := pendingKey(opts.peer, opts.inbox, hash)
+	var c chunkedUpload
+	if opts.resume {
+		if p, ok := lookupPendingUpload(opts.pendingFile, key); ok {
+			err := s.call(http.MethodGet, chunkedUploadPrefix+p.ID, nil, &c)
+			switch {
+			case err != nil:
+				fmt.Fprintf(infoOut, "Starting %s over, the peer can't resume it: %v\n", path.Base(src), err)
+				c = chunkedUpload{}
+			case c.Size != size:
+				fmt.Fprintf(infoOut, "Starting %s over, the peer has another size for it\n", path.Base(src))
+				c = chunkedUpload{}
+			default:
+				fmt.Fprintf(infoOut, "Resuming %s with %d of %d chunks to go\n", path.Base(src), len(c.missing()), len(c.Received))
+			}
+		}
+	}
+	if c.ID == "" {
+		open, err := json.Marshal(chunkedUploadRequest{
+			Name:       path.Base(src),
+			Type:       fileType,
+			Size:       size,
+			ChunkSize:  opts.chunkSize,
+			Hash:       hash,
+			Inbox:      opts.inbox,
+			OnConflict: opts.onConflict,
+			fileMeta:   opts.meta,
+		})
+		if err != nil {
+			return err
+		}
+		if err := s.call(http.MethodPost, chunkedUploadsPath, open, &c); err != nil {
+			return fmt.Errorf("failed to open the chunked upload: %v", err)
+		}
+	}
+	s.id = c.ID
+	setPendingUpload(opts.pendingFile, key, &pendingUpload{ID: c.ID, Name: path.Base(src), Updated: time.Now()})
+	debugLog("Uploading %s as the chunked upload %s in %d chunks", src, c.ID, len(c.Received))
+
+	// a resumed upload keeps the chunk size it was opened with
+	buf := make([]byte, c.ChunkSize)
+	for n, got := range c.Received {
+		off := int64(n) * c.ChunkSize
+		chunk := buf[:min(c.ChunkSize, size-off)]
+		if got {
+			opts.progress.add(len(chunk))
+			continue
+		}
+		if _, err := file.ReadAt(chunk, off); err != nil {
+			return fmt.Errorf("failed to read the source file: %v", err)
+		}
+		if err := s.call(http.MethodPut, fmt.Sprintf("%s%s/chunk/%d", chunkedUploadPrefix, s.id, n), chunk, nil); err != nil {
+			return fmt.Errorf("failed to upload chunk %d, send again with --resume to continue: %v", n, err)
+		}
+		opts.progress.add(len(chunk))
+	}
+	if err := s.call(http.MethodPost, chunkedUploadPrefix+s.id+"/complete", nil, nil); err != nil {
+		return fmt.Errorf("failed to complete the upload: %v", err)
+	}
+	setPendingUpload(opts.pendingFile, key, nil)
+	return nil
+}
@@ -0,0 +1,1025 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	defaultBatchThreshold = "1MiB"
+	defaultLookupRetries  = 2
+)
+
+// sendOptions holds the settings shared by every upload of a `send` run.
+type sendOptions struct {
+	key     string
+	addr    string
+	port    int
+	retries int
+	inbox   string
+	// endpoint is the path uploads are posted to, empty for the upload
+	// endpoint of the inbox
+	endpoint string
+	client   *http.Client
+	// tls pins the certificate of a peer serving HTTPS, nil to talk plain
+	// HTTP and raw TCP
+	tls *tls.Config
+	// transport is transportHTTP, transportTCP, transportUDP or transportSSH
+	transport string
+	tcp       tcpTuning
+	// sshCommand and remoteFtr are the local ssh client and the remote ftr
+	// binary used by transportSSH, addr is then the ssh destination
+	sshCommand string
+	remoteFtr  string
+	// fecData and fecParity are the shards per block and udpRateMbps the
+	// sending rate of transportUDP
+	fecData     int
+	fecParity   int
+	udpRateMbps int
+	// udpMTU fixes the datagram size of transportUDP, 0 to probe the path
+	udpMTU int
+	// extract is false to have a directory delivered as a tarball
+	extract bool
+	// onConflict is the conflict policy asked of the receiver, empty for
+	// its own
+	onConflict string
+	// dict compresses regular files with a zstd dictionary the peer holds
+	dict *zstdDict
+	// codec compresses the archives of directories and batches, the best
+	// the peer extracts. A pinned codec, asked for with --codec, is used for
+	// archives of files that are compressed already too.
+	codec       string
+	codecPinned bool
+	// hash is the SHA-256 of the file being uploaded, which the receiver
+	// verifies, empty when it's only known once sent
+	hash string
+	// meta is the mode and mtime of a single file being uploaded, restored
+	// by the receiver
+	meta fileMeta
+	// backpressure keeps HTTP and TCP uploads to the rate the receiver
+	// asks for, through throttle while an upload is running
+	backpressure bool
+	throttle     *throttle
+	// confirm offers each file to the receiver and waits for the user there
+	// to accept it before uploading it encrypted, over HTTP only
+	confirm bool
+	// pake seals each file with a key both sides derive from the passkey,
+	// which is never sent, over HTTP only
+	pake bool
+	// peer and peerNode are the name of the receiver and the node key it
+	// advertises, which let an HTTP upload of more than chunkSize bytes go
+	// in chunks that survive the peer moving to another address for up to
+	// resumeWindow
+	peer          string
+	peerNode      string
+	chunkSize     int64
+	resumeWindow  time.Duration
+	lookupTimeout time.Duration
+	// showProgress draws a progress bar of every upload, which transports
+	// report to through progress
+	showProgress bool
+	progress     *progress
+	// events receives the steps of every upload, of eventFile to eventPeer,
+	// in place of the progress bar
+	events    *sendEvents
+	eventPeer string
+	eventFile string
+	// resume continues the unfinished chunked upload of the same payload
+	// recorded in pendingFile
+	resume      bool
+	pendingFile string
+}
+
+func sendFile(src string, opts sendOptions) (*transferReport, error) {
+	start := time.Now()
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat the source file: %v", err)
+	}
+	report := &transferReport{Source: src, OriginalBytes: fi.Size()}
+	fileType := fileTypeFile
+	if fi.IsDir() {
+		fileType = fileTypeDir
+		report.OriginalBytes, err = dirSize(src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute the size of the source directory: %v", err)
+		}
+		if !opts.codecPinned {
+			opts.codec = archiveCodec(opts.codec, src)
+		}
+		if opts.streamsArchives() {
+			if err := streamDir(src, report, opts); err != nil {
+				return nil, err
+			}
+			report.finish(time.Since(start))
+			fmt.Fprintln(infoOut, "File sent successfully")
+			return report, nil
+		}
+		debugLog("The source %s is a directory, zipping and tarring it", src)
+		opts.emitEvent(sendEvent{Type: sendEventCompressing})
+		src, err = zipTar(src, opts.codec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to zip and tar the source directory: %v", err)
+		}
+		defer os.RemoveAll(filepath.Dir(src))
+	}
+
+	if err := uploadFile(src, fileType, report, opts); err != nil {
+		return nil, err
+	}
+	report.finish(time.Since(start))
+	fmt.Fprintln(infoOut, "File sent successfully")
+	return report, nil
+}
+
+// sendBatch packs the files into a single archive that the receiver unpacks
+// straight into its drop dir, saving a request per file.
+func sendBatch(files []string, opts sendOptions) (*transferReport, error) {
+	start := time.Now()
+	report := &transferReport{Source: fmt.Sprintf("%d files", len(files))}
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat the source file: %v", err)
+		}
+		report.OriginalBytes += fi.Size()
+	}
+	debugLog("Batching %d small files into a single archive", len(files))
+	if !opts.codecPinned {
+		opts.codec = archiveCodec(opts.codec, files...)
+	}
+	if opts.streamsArchives() {
+		if err := streamBatch(files, batchNames(files), report, opts); err != nil {
+			return nil, err
+		}
+		report.finish(time.Since(start))
+		fmt.Fprintf(infoOut, "%d files sent successfully\n", len(files))
+		return report, nil
+	}
+	opts.emitEvent(sendEvent{Type: sendEventCompressing})
+	tarball, err := zipTarFiles(files, opts.codec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to zip and tar the batch: %v", err)
+	}
+	defer os.Remove(tarball)
+
+	if err := uploadFile(tarball, fileTypeBatch, report, opts); err != nil {
+		return nil, err
+	}
+	report.finish(time.Since(start))
+	fmt.Fprintf(infoOut, "%d files sent successfully\n", len(files))
+	return report, nil
+}
+
+// uploadFile posts the file at src, retrying transient failures.
+func uploadFile(src, fileType string, report *transferReport, opts sendOptions) (err error) {
+	hash, err := hashFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to hash the source file: %v", err)
+	}
+	report.Hash = hash
+	opts.hash = hash
+	if fileType == fileTypeFile {
+		opts.meta = statMeta(src)
+	}
+	// directories and batches are gzipped already, and a confirmed or PAKE
+	// upload has to match the hash the receiver was offered
+	if fileType != fileTypeFile || opts.confirm || opts.pake {
+		opts.dict = nil
+	}
+	if opts.dict != nil {
+		debugLog("Compressing %s with the dictionary %s", src, opts.dict.id)
+		opts.emitEvent(sendEvent{Type: sendEventCompressing})
+		src, err = compressWithDict(src, opts.dict)
+		if err != nil {
+			return fmt.Errorf("failed to compress the source file: %v", err)
+		}
+		defer os.RemoveAll(filepath.Dir(src))
+	}
+	// asking for the pace would send the passkey
+	if opts.backpressure && !opts.pake && (opts.transport == transportHTTP || opts.transport == transportTCP) {
+		opts.throttle = &throttle{}
+		stop := followPace(opts.throttle, opts)
+		defer stop()
+	}
+	if opts.showProgress || opts.events != nil {
+		fi, err := os.Stat(src)
+		if err != nil {
+			return fmt.Errorf("failed to stat the source file: %v", err)
+		}
+		opts.progress = startProgress(filepath.Base(src), fi.Size(), opts.progressEvents())
+		defer func() { opts.progress.finish(err) }()
+	}
+	if opts.confirm {
+		fi, err := os.Stat(src)
+		if err != nil {
+			return fmt.Errorf("failed to stat the source file: %v", err)
+		}
+		report.CompressedBytes = fi.Size()
+		return postConfirmed(src, fileType, hash, opts)
+	}
+	if opts.pake {
+		fi, err := os.Stat(src)
+		if err != nil {
+			return fmt.Errorf("failed to stat the source file: %v", err)
+		}
+		report.CompressedBytes = fi.Size()
+		return postPAKE(src, fileType, hash, opts)
+	}
+	if opts.transport == transportTCP || opts.transport == transportSSH || opts.transport == transportUDP {
+		fi, err := os.Stat(src)
+		if err != nil {
+			return fmt.Errorf("failed to stat the source file: %v", err)
+		}
+		report.CompressedBytes = fi.Size()
+		post := postRaw
+		switch opts.transport {
+		case transportSSH:
+			post = postSSH
+		case transportUDP:
+			post = func(src, fileType string, opts sendOptions) (bool, error) {
+				return postUDP(src, fileType, hash, opts)
+			}
+		}
+		return withRetries(report, opts.retries, func() (bool, error) {
+			opts.progress.restart()
+			return post(src, fileType, opts)
+		})
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("failed to stat the source file: %v", err)
+	}
+	// chunked uploads are always extracted and carry no dictionary
+	if opts.peer != "" && opts.chunkSize > 0 && fi.Size() > opts.chunkSize && opts.extract && opts.dict == nil {
+		report.CompressedBytes = fi.Size()
+		return postChunked(src, fileType, hash, fi.Size(), opts)
+	}
+
+	file, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open the source file: %v", err)
+	}
+	defer file.Close()
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	part, err := w.CreateFormFile("file", path.Base(src))
+	if err != nil {
+		return fmt.Errorf("failed to create form file: %v", err)
+	}
+	written, err := io.Copy(part, file)
+	if err != nil {
+		return fmt.Errorf("failed to copy the file content to form: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close the multipart writer: %v", err)
+	}
+	report.CompressedBytes = written
+
+	return withRetries(report, opts.retries, func() (bool, error) {
+		opts.progress.restart()
+		return postFile(bytes.NewReader(body.Bytes()), int64(body.Len()), w.FormDataContentType(), fileType, opts)
+	})
+}
+
+// streamsArchives reports whether directories and batches go straight into
+// the request body as they're archived, over plain HTTP. The other transports
+// need the size or hash of the archive up front.
+func (o sendOptions) streamsArchives() bool {
+	return o.transport == transportHTTP && !o.confirm && !o.pake
+}
+
+// streamDir uploads the tarball of the directory src as it's being written,
+// so nothing lands on disk. A retry archives the directory again.
+func streamDir(src string, report *transferReport, opts sendOptions) error {
+	return streamArchive(sourceName(src)+tarballExt(opts.codec), fileTypeDir, report, opts, func(w io.Writer) error {
+		return writeTarball(w, src, opts.codec)
+	})
+}
+
+// streamBatch uploads the batch of the files, each under the name at the same
+// index, as it's being written.
+func streamBatch(files, names []string, report *transferReport, opts sendOptions) error {
+	return streamArchive("ftr-batch"+tarballExt(opts.codec), fileTypeBatch, report, opts, func(w io.Writer) error {
+		return writeBatch(w, files, names, opts.codec)
+	})
+}
+
+// streamArchive uploads the archive named name that write produces, piping
+// it into the request body. A retry writes it again.
+func streamArchive(name, fileType string, report *transferReport, opts sendOptions, write func(io.Writer) error) (err error) {
+	if opts.backpressure {
+		opts.throttle = &throttle{}
+		stop := followPace(opts.throttle, opts)
+		defer stop()
+	}
+	if opts.showProgress || opts.events != nil {
+		opts.progress = startProgress(name, -1, opts.progressEvents())
+		defer func() { opts.progress.finish(err) }()
+	}
+	return withRetries(report, opts.retries, func() (bool, error) {
+		opts.progress.restart()
+		pr, pw := io.Pipe()
+		// unblocks the archiver when the request ends early
+		defer pr.Close()
+		w := multipart.NewWriter(pw)
+		hasher := sha256.New()
+		counter := &countingWriter{w: hasher}
+		go func() {
+			part, err := w.CreateFormFile("file", name)
+			if err == nil {
+				err = write(io.MultiWriter(part, counter))
+			}
+			if err == nil {
+				err = w.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		retry, err := postFile(pr, -1, w.FormDataContentType(), fileType, opts)
+		if err == nil {
+			report.CompressedBytes = counter.n
+			report.Hash = hex.EncodeToString(hasher.Sum(nil))
+		}
+		return retry, err
+	})
+}
+
+// url returns the URL of path on the peer.
+func (o sendOptions) url(path string) string {
+	return peerURL(o.tls, o.addr, o.port, path)
+}
+
+// withRetries calls attempt until it succeeds, fails permanently or the
+// retries are used up, counting the retries in the report.
+func withRetries(report *transferReport, retries int, attempt func() (bool, error)) error {
+	for {
+		retry, err := attempt()
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, errRequeued) {
+			continue
+		}
+		if !retry || report.Retries >= retries {
+			return err
+		}
+		report.Retries++
+		debugLog("Retrying the upload (%d/%d) after error: %v", report.Retries, retries, err)
+	}
+}
+
+// postFile uploads the multipart body of size bytes, -1 if unknown, once. The
+// returned bool reports whether the failure is transient and the upload is
+// worth retrying.
+func postFile(body io.Reader, size int64, contentType, fileType string, opts sendOptions) (bool, error) {
+	url := opts.url("/upload")
+	if opts.endpoint != "" {
+		url = opts.url(opts.endpoint)
+	} else if opts.inbox != "" {
+		url = opts.url(inboxPath(opts.inbox))
+	}
+	req, err := http.NewRequest(http.MethodPost, url, &throttledReader{r: &progressReader{r: body, p: opts.progress}, t: opts.throttle})
+	if err != nil {
+		return false, fmt.Errorf("failed to create the http request: %v", err)
+	}
+	req.ContentLength = size
+	if size > 0 {
+		// hold the body back until the peer has looked at the size, it
+		// refuses files over its max upload size or quota up front
+		req.Header.Set("Expect", "100-continue")
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(passKeyHeader, opts.key)
+	req.Header.Set(fileTypeHeader, fileType)
+	req.Header.Set(senderHeader, getDefaultName())
+	if !opts.extract {
+		req.Header.Set(extractHeader, "no")
+	}
+	if opts.onConflict != "" {
+		req.Header.Set(onConflictHeader, opts.onConflict)
+	}
+	if opts.dict != nil {
+		req.Header.Set(dictHeader, opts.dict.id)
+	}
+	if opts.hash != "" {
+		req.Header.Set(sha256Header, opts.hash)
+	}
+	opts.meta.setHeader(req.Header)
+
+	client := opts.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("failed to send the http request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionRequired {
+		return false, errors.New("the peer asks to confirm every file, send with --confirm")
+	}
+	if token := resp.Header.Get(queueTokenHeader); resp.StatusCode == http.StatusServiceUnavailable && token != "" {
+		return false, waitQueued(token, opts)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return retryableStatus(resp.StatusCode), statusError(resp.StatusCode, resp.Status)
+	}
+	return false, nil
+}
+
+// lookupPeer browses the network for the named peer until the timeout.
+func lookupPeer(peer string, timeout time.Duration) (*zeroconf.ServiceEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	entries := make(chan *zeroconf.ServiceEntry)
+	if err := peerNet.Browse(ctx, entries); err != nil {
+		return nil, err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to find the peer %s in %v", peer, timeout)
+		case e, ok := <-entries:
+			if !ok {
+				return nil, fmt.Errorf("failed to find the peer %s in %v", peer, timeout)
+			}
+			if e.Instance == peer && peerAddr(e) != "" {
+				return e, nil
+			}
+		}
+	}
+}
+
+// peerAddr returns the address to reach the peer at: an IPv4 one when it has
+// any, as on most LANs, and otherwise an IPv6 one, routable before link-local.
+func peerAddr(e *zeroconf.ServiceEntry) string {
+	if len(e.AddrIPv4) > 0 {
+		return e.AddrIPv4[0].String()
+	}
+	for _, ip := range e.AddrIPv6 {
+		if !ip.IsLinkLocalUnicast() {
+			return ip.String()
+		}
+	}
+	if len(e.AddrIPv6) > 0 {
+		return e.AddrIPv6[0].String()
+	}
+	return ""
+}
+
+// findPeer looks the peer up, retrying with the same timeout before giving up.
+func findPeer(peer string, timeout time.Duration, retries int) (*zeroconf.ServiceEntry, error) {
+	for attempt := 0; ; attempt++ {
+		e, err := lookupPeer(peer, timeout)
+		if err == nil {
+			return e, nil
+		}
+		if attempt >= retries {
+			return nil, fmt.Errorf("peer %s not found after %d attempts of %v", peer, attempt+1, timeout)
+		}
+		debugLog("Retrying the lookup of %s (%d/%d): %v", peer, attempt+1, retries, err)
+	}
+}
+
+func recordSend(historyFile, peer, file string, start time.Time, report *transferReport, err error) historyEntry {
+	entry := historyEntry{
+		Time:       time.Now(),
+		Direction:  directionSend,
+		Peer:       peer,
+		File:       file,
+		DurationMs: time.Since(start).Milliseconds(),
+		Status:     statusOK,
+	}
+	if err != nil {
+		entry.Status = statusFailed
+		entry.Error = err.Error()
+	} else {
+		entry.Bytes = report.OriginalBytes
+		entry.DurationMs = report.DurationMs
+		entry.Hash = report.Hash
+	}
+	recordHistory(historyFile, entry)
+	return entry
+}
+
+func runSend(args []string) {
+	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	sendCmd.SetOutput(os.Stdout)
+	key := sendCmd.String("key", "", "pre-shared passkey, defaults to the one of the peer in the [keys] config section")
+	debug := sendCmd.Bool("debug", false, "enable debug log")
+	retries := sendCmd.Int("retries", 0, "the number of times to retry a failed upload")
+	reportFormat := sendCmd.String("report", "text", "the format of the post-transfer report (text or json)")
+	historyFile := sendCmd.String("history-file", defaultHistoryFile(), "the path to the transfer history ledger, empty to disable")
+	inbox := sendCmd.String("inbox", "", "the inbox on the peer to upload to, empty for the default one")
+	configFile := sendCmd.String("config", defaultConfigFile(), "the path to the config file")
+	extract := sendCmd.Bool("extract", true, "let the receiver extract a directory, otherwise it's delivered as a .tar.gz")
+	onConflict := sendCmd.String("on-conflict", "", "ask the receiver to fail, rename or skip an upload whose name is taken, or to overwrite it where it allows that")
+	profile := sendCmd.String("profile", "", "apply the settings of the named [profile.<name>] config section")
+	resultFile := sendCmd.String("result-file", "", "append a JSON result record of each send to this file")
+	resultWebhook := sendCmd.String("result-webhook", "", "post a JSON result record of each send to this URL")
+	transport := sendCmd.String("transport", transportHTTP, "the transport to upload with (http, tcp or udp)")
+	fecData := sendCmd.Int("fec-data", defaultFECData, "the data shards per block with --transport udp")
+	fecParity := sendCmd.Int("fec-parity", defaultFECParity, "the parity shards per block with --transport udp, any fec-data shards of a block rebuild it")
+	udpRate := sendCmd.Int("udp-rate", defaultUDPRateMbps, "the sending rate in Mbit/s with --transport udp, 0 for no limit")
+	udpMTU := sendCmd.Int("udp-mtu", 0, "the path MTU with --transport udp, 0 to probe it")
+	lookupTimeout := sendCmd.Duration("lookup-timeout", defaultLookupTimeoutMs*time.Millisecond, "how long to browse for the peer per attempt")
+	peerCacheTTL := sendCmd.Duration("peer-cache-ttl", defaultPeerCacheTTLSec*time.Second, "reuse the address of a peer found within this long, 0 to always look it up")
+	force := sendCmd.Bool("force", false, "compress and upload at full speed on battery or in power-save mode")
+	compress := sendCmd.String("compress", "", "how hard to compress directories and batches (none, fast or best), defaults to a balance")
+	limit := sendCmd.String("limit", "", "cap the upload bandwidth of all peers together, e.g. 10MB/s, empty for no limit")
+	stdinName := sendCmd.String("name", "", "the name of the file read from stdin when the path is -")
+	var excludes patternList
+	sendCmd.Var(&excludes, "exclude", "leave the paths matching this gitignore pattern out of directories, repeated or comma separated, on top of their .ftrignore files")
+	links := sendCmd.String("links", linksSkip, "what to do with the symlinks in directories: skip them with a warning, preserve the links or follow them")
+	codecFlag := sendCmd.String("codec", "", "compress directories and batches with this codec and optional level, e.g. zstd:3 or gzip:9, when the peer supports it")
+	capsCacheTTL := sendCmd.Duration("caps-cache-ttl", defaultPeerCapsTTLSec*time.Second, "reuse what a peer supports learnt within this long, 0 to always ask it")
+	lookupRetries := sendCmd.Int("lookup-retries", defaultLookupRetries, "the number of times to retry a failed peer lookup")
+	via := sendCmd.String("via", "", "set to ssh to upload through ssh, the peer is then an ssh destination such as user@host")
+	sshCommand := sendCmd.String("ssh-command", "ssh", "the ssh client used with --via ssh")
+	remoteFtr := sendCmd.String("remote-ftr", "ftr", "the path to ftr on the remote host used with --via ssh")
+	confirmMode := sendCmd.Bool("confirm", false, "offer each file and wait for the receiver to accept it, implied by peers in confirm mode")
+	pakeMode := sendCmd.Bool("pake", false, "encrypt each file end to end with a key derived from the passkey, without sending the passkey")
+	noProgress := sendCmd.Bool("no-progress", false, "don't draw a progress bar, it's only drawn when stderr is a terminal anyway")
+	events := sendCmd.Bool("events", false, "write the steps and progress of every upload to stdout as JSON lines, in place of the report")
+	backpressure := sendCmd.Bool("backpressure", true, "slow down to the rate the receiver can store at")
+	dictRef := sendCmd.String("dict", "", "compress files with this zstd dictionary, a file or the id of one from `ftr dict`")
+	chunkSize := sendCmd.String("chunk-size", defaultChunkSize, "upload larger files over http in chunks of this size that survive the peer changing address, 0 to disable")
+	resume := sendCmd.Bool("resume", false, "continue where an interrupted send of the same file to the peer left off")
+	resumeWindow := sendCmd.Duration("resume-window", defaultResumeWindow, "how long a chunked upload keeps looking for a peer that dropped off the network")
+	batchThreshold := sendCmd.String("batch-threshold", defaultBatchThreshold, "files smaller than this are packed into a single archive when sending several paths, 0 to disable")
+	all := sendCmd.Bool("all", false, "send to every peer on the network at once, every argument is then a path")
+	peerList := sendCmd.String("peers", "", "send to these comma-separated peers at once, wildcards match the peers on the network")
+	to := sendCmd.String("to", "", "send to the receiver at this host:port without discovering it, every argument is then a path")
+	relay := sendCmd.String("relay", "", "go through the relay at this host:port to peers that can't be found on the network")
+	relayKey := sendCmd.String("relay-key", "", "the key of the relay given with --relay")
+	watch := sendCmd.Bool("watch", false, "keep watching the directory and send the files created or changed in it")
+	debounce := sendCmd.Duration("debounce", defaultWatchDebounce, "with --watch, send a file once it was left alone this long")
+	applyUnits := unitFlags(sendCmd)
+	applySimulation := simulationFlags(sendCmd)
+	if err := sendCmd.Parse(args); err != nil {
+		exitWithError(1, "Send command failed: %v", err)
+	}
+	cfg := mustLoadConfig(*configFile)
+	profilePeer := ""
+	if *profile != "" {
+		var err error
+		if profilePeer, err = applyProfile(sendCmd, cfg, *profile); err != nil {
+			exitWithError(1, "Failed to apply the profile: %v", err)
+		}
+	}
+	debugMode = *debug
+	applyUnits()
+	if *reportFormat != "text" && *reportFormat != "json" {
+		exitWithError(1, "Unsupported report format: %s", *reportFormat)
+	}
+	if *transport != transportHTTP && *transport != transportTCP && *transport != transportUDP {
+		exitWithError(1, "Unsupported transport: %s", *transport)
+	}
+	if *via != "" && *via != transportSSH {
+		exitWithError(1, "Unsupported --via: %s", *via)
+	}
+	if *onConflict != "" {
+		if _, err := parseConflictPolicy(*onConflict); err != nil {
+			exitWithError(1, "Invalid --on-conflict: %v", err)
+		}
+	}
+	threshold, err := parseSize(*batchThreshold)
+	if err != nil {
+		exitWithError(1, "Invalid batch threshold: %v", err)
+	}
+	if *udpMTU != 0 && (*udpMTU < fecMinMTU || *udpMTU > fecMaxMTU) {
+		exitWithError(1, "The UDP MTU must be between %d and %d", fecMinMTU, fecMaxMTU)
+	}
+	chunkBytes, err := parseSize(*chunkSize)
+	if err != nil {
+		exitWithError(1, "Invalid chunk size: %v", err)
+	}
+	if chunkBytes != 0 && (chunkBytes < minChunkSize || chunkBytes > maxChunkSize) {
+		exitWithError(1, "The chunk size must be between %d and %d bytes", minChunkSize, maxChunkSize)
+	}
+	// keep stdout clean for the machine-readable report
+	if *reportFormat == "json" || *events {
+		infoOut = os.Stderr
+	}
+	var eventSink *sendEvents
+	if *events {
+		eventSink = newSendEvents(os.Stdout)
+	}
+	applySimulation()
+	if err := applyBandwidthLimit(*limit); err != nil {
+		exitWithError(1, "Invalid --limit: %v", err)
+	}
+	applyPowerSaving(*force)
+	// an explicit mode or codec wins over power saving
+	if *compress != "" && *codecFlag != "" {
+		exitWithError(1, "--compress and --codec can't be used together")
+	}
+	codec, err := applyCompression(*compress)
+	if err != nil {
+		exitWithError(1, "Invalid --compress: %v", err)
+	}
+	if err := applyLinkMode(*links); err != nil {
+		exitWithError(1, "Invalid --links: %v", err)
+	}
+	excludePatterns = excludes
+	wantedCodec := ""
+	if *codecFlag != "" {
+		if wantedCodec, err = parseCodec(*codecFlag); err != nil {
+			exitWithError(1, "Invalid --codec: %v", err)
+		}
+	}
+	broadcasting := *all || *peerList != ""
+	if broadcasting && *via == transportSSH {
+		exitWithError(1, "--all and --peers are not supported with --via ssh")
+	}
+	if *all && *peerList != "" {
+		exitWithError(1, "--all and --peers can't be used together")
+	}
+	if *to != "" && (broadcasting || *via != "" || *relay != "") {
+		exitWithError(1, "--to can't be used with --all, --peers, --via or --relay")
+	}
+	pos := sendCmd.Args()
+	// a profile with a peer makes every argument a path
+	if profilePeer != "" && !broadcasting && *to == "" {
+		pos = append(pos, profilePeer)
+	}
+	var srcs, peers []string
+	if *to != "" {
+		if len(pos) < 1 {
+			fmt.Println("Usage: ftr send [--key <key>] --to <host:port> <path>...")
+			os.Exit(1)
+		}
+		if peerKey(sendCmd, cfg, *to, *inbox, *key) == "" {
+			exitWithError(1, "--to needs --key or a key for %s in the [keys] config section", *to)
+		}
+		srcs, peers = pos, []string{*to}
+		debugLog("Sending %v to %s", srcs, *to)
+	} else if broadcasting {
+		if len(pos) < 1 {
+			fmt.Println("Usage: ftr send [--key <key>] --all|--peers <peer>,... <path>...")
+			os.Exit(1)
+		}
+		srcs = pos
+		var err error
+		if peers, err = broadcastTargets(*all, *peerList, *lookupTimeout); err != nil {
+			exitWithError(1, "Failed to find the peers: %v", err)
+		}
+		debugLog("Broadcasting %v to %v", srcs, peers)
+	} else {
+		if len(pos) < 2 {
+			fmt.Println("Usage: ftr send [--key <key>] <path>... <peer>|@<group>")
+			os.Exit(1)
+		}
+		var target string
+		srcs, target = pos[:len(pos)-1], pos[len(pos)-1]
+		debugLog("Sending %v to %s", srcs, target)
+
+		peers = []string{target}
+		if name, ok := strings.CutPrefix(target, groupPrefix); ok {
+			if *via == transportSSH {
+				exitWithError(1, "Groups are not supported with --via ssh")
+			}
+			var err error
+			if peers, err = expandGroup(cfg, name, *lookupTimeout); err != nil {
+				exitWithError(1, "Failed to expand the group: %v", err)
+			}
+			debugLog("Group %s expands to %v", name, peers)
+		}
+	}
+	fromStdin := slices.Contains(srcs, stdinSource)
+	if fromStdin {
+		switch {
+		case len(srcs) > 1:
+			exitWithError(1, "- can't be sent along with other paths")
+		case *stdinName == "":
+			exitWithError(1, "--name is required to send from stdin")
+		case *stdinName != filepath.Base(*stdinName) || *stdinName == "." || *stdinName == "..":
+			exitWithError(1, "--name must be a file name, not a path: %s", *stdinName)
+		case len(peers) > 1:
+			exitWithError(1, "stdin can only be sent to a single peer")
+		}
+		srcs = nil
+	}
+	relayAt, err := newRelayEndpoint(*relay, *relayKey)
+	if err != nil {
+		exitWithError(1, "Invalid relay: %v", err)
+	}
+	if *watch {
+		switch {
+		case len(srcs) != 1:
+			exitWithError(1, "--watch takes a single directory")
+		case *resume:
+			exitWithError(1, "--watch can't be used with --resume")
+		}
+		if fi, err := os.Stat(srcs[0]); err != nil || !fi.IsDir() {
+			exitWithError(1, "--watch takes a directory, %s is not one", srcs[0])
+		}
+		// every file is its own upload so its failure is known
+		threshold = 0
+		// a changed file goes again under the same name, which the
+		// receiver would refuse by default
+		if *onConflict == "" {
+			*onConflict = conflictRename
+		}
+	}
+	var dict *zstdDict
+	if *dictRef != "" {
+		if *transport != transportHTTP && *transport != transportTCP {
+			exitWithError(1, "--dict is only supported with --transport http or tcp")
+		}
+		var err error
+		if dict, err = resolveDict(defaultDictDir(), *dictRef); err != nil {
+			exitWithError(1, "Failed to load the dictionary: %v", err)
+		}
+	}
+	singles, batch, err := planUploads(srcs, threshold)
+	if err != nil {
+		exitWithError(1, "Failed to send the file: %v", err)
+	}
+	tcp := mustLoadTCPTuning(cfg)
+	peerCacheFile := defaultPeerCacheFile()
+	capsFile := defaultPeerCapsFile()
+	// serializes the reports of concurrent sends, and guards failedNames,
+	// the uploads that failed to any peer
+	var outputMu sync.Mutex
+	failedNames := map[string]bool{}
+
+	// sendTo uploads the sources to the peer, reporting each file. A failed
+	// upload doesn't stop the ones that follow.
+	sendTo := func(peer string, singles, batch []string) error {
+		var names []string
+		if len(batch) > 0 {
+			names = append(names, fmt.Sprintf("batch of %d files", len(batch)))
+		}
+		for _, src := range singles {
+			names = append(names, filepath.Base(src))
+		}
+		if fromStdin {
+			names = append(names, *stdinName)
+		}
+		opts := sendOptions{
+			key:         peerKey(sendCmd, cfg, peer, *inbox, *key),
+			retries:     *retries,
+			inbox:       *inbox,
+			transport:   *transport,
+			extract:     *extract,
+			onConflict:  *onConflict,
+			fecData:     *fecData,
+			fecParity:   *fecParity,
+			udpRateMbps: *udpRate,
+			udpMTU:      *udpMTU,
+			// the bars of concurrent uploads would draw over each other
+			showProgress: !*noProgress && !broadcasting && stderrIsTerminal(),
+			events:       eventSink,
+			eventPeer:    peer,
+			resume:       *resume,
+			pendingFile:  defaultPendingUploadsFile(),
+			backpressure: *backpressure,
+			confirm:      *confirmMode,
+			pake:         *pakeMode,
+			tcp:          tcp,
+			client:       tcp.httpClient(nil),
+		}
+		for _, name := range names {
+			opts.eventFile = name
+			opts.emitEvent(sendEvent{Type: sendEventQueued})
+		}
+		// fail reports the uploads failed when the peer can't be sent to
+		fail := func(err error) error {
+			outputMu.Lock()
+			defer outputMu.Unlock()
+			for _, name := range names {
+				failedNames[name] = true
+				opts.eventFile = name
+				opts.emitEvent(sendEvent{Type: sendEventFailed, Error: err.Error()})
+			}
+			return err
+		}
+		usedCache := false
+		var caps *peerCaps
+		// the TXT record of the peer, none over ssh
+		var advertised []string
+		if *via == transportSSH {
+			opts.transport = transportSSH
+			opts.addr = peer
+			opts.sshCommand = *sshCommand
+			opts.remoteFtr = *remoteFtr
+		} else {
+			var p cachedPeer
+			var cached, relayed bool
+			// the name the certificate is pinned and the capabilities
+			// cached by, the address of a peer given with --to is no name
+			name := peer
+			var err error
+			if *to != "" {
+				var info peerInfo
+				info, p, err = probeDirect(peer)
+				// the name is only the receiver's word for it: it's used
+				// when the upload can check it against a pinned
+				// certificate, and never picks a key from the config
+				if err == nil && hasPin(info.Name) {
+					name = info.Name
+				}
+			} else {
+				p, cached, err = resolvePeer(peer, peerCacheFile, *peerCacheTTL, *lookupTimeout, *lookupRetries)
+			}
+			if err != nil && relayAt != nil {
+				debugLog("Failed to find %s on the network, asking the relay: %v", peer, err)
+				p, err = relayAt.lookup(peer)
+				relayed = err == nil
+			}
+			if err != nil {
+				return fail(fmt.Errorf("failed to find the peer: %v", err))
+			}
+			usedCache = cached
+			opts.addr = p.Addr
+			opts.port = p.Port
+			// chunked uploads find a peer that moved by its name on the
+			// network
+			if *to == "" {
+				opts.peer = peer
+			}
+			opts.peerNode = advertisedNode(p.Text)
+			advertised = p.Text
+			opts.tls = peerTLS(name, p.Text)
+			opts.client = tcp.httpClient(opts.tls)
+			caps = loadPeerCaps(capsFile, name, p.Text, *capsCacheTTL)
+			opts.chunkSize = chunkBytes
+			opts.resumeWindow = *resumeWindow
+			opts.lookupTimeout = *lookupTimeout
+			if relayed {
+				if opts.transport != transportHTTP {
+					return fail(errors.New("only --transport http goes through a relay"))
+				}
+				fmt.Fprintf(infoOut, "%s is not on the network, sending through the relay %s\n", peer, relayAt.addr)
+				// whoever registered the name with the relay picked the
+				// TXT records, which mustn't turn off TLS
+				opts.tls = pinnedTLSConfig(name, defaultKnownPeersFile())
+				opts.client = relayAt.httpClient(peer, opts.tls)
+				// chunked uploads look for the peer on the network again
+				// when it drops off
+				opts.chunkSize = 0
+			}
+			if slices.Contains(p.Text, confirmTXT) {
+				opts.confirm = true
+			}
+			if opts.pake && !slices.Contains(p.Text, pakeTXT) {
+				return fail(fmt.Errorf("%s doesn't support --pake", peer))
+			}
+		}
+		opts.codec = peerCodec(advertised)
+		switch {
+		case codec != "":
+			opts.codec = codec
+		case wantedCodec != "" && slices.Contains(advertisedCodecs(advertised), wantedCodec):
+			opts.codec = wantedCodec
+			opts.codecPinned = true
+		case wantedCodec != "":
+			fmt.Fprintf(os.Stderr, "%s doesn't support %s, compressing with %s\n", peer, wantedCodec, opts.codec)
+		}
+		if opts.confirm && opts.transport != transportHTTP {
+			return fail(errors.New("confirmed uploads are only supported with --transport http"))
+		}
+		if opts.pake && (opts.transport != transportHTTP || opts.confirm) {
+			return fail(errors.New("--pake is only supported with --transport http, and not with --confirm"))
+		}
+		if dict != nil && !opts.pake {
+			// a peer without dictionary support still gets the files
+			if caps.holdsDict(dict.id) {
+				debugLog("%s held the dictionary %s when last asked", peer, dict.id)
+				opts.dict = dict
+			} else if err := negotiateDict(dict, opts); err != nil {
+				fmt.Fprintf(os.Stderr, "Sending to %s without the dictionary: %v\n", peer, err)
+			} else {
+				opts.dict = dict
+				caps.addDict(dict.id)
+			}
+		}
+
+		failures := 0
+		finish := func(name string, start time.Time, report *transferReport, err error) {
+			entry := recordSend(*historyFile, peer, name, start, report, err)
+			emitSendResult(entry, *resultFile, *resultWebhook)
+			opts.eventFile = name
+			if err != nil {
+				opts.emitEvent(sendEvent{Type: sendEventFailed, Error: err.Error()})
+			} else {
+				report.Peer = peer
+				opts.emitEvent(sendEvent{Type: sendEventDone, Report: report})
+			}
+			outputMu.Lock()
+			defer outputMu.Unlock()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to send %s to %s: %v\n", name, peer, err)
+				failedNames[name] = true
+				failures++
+				return
+			}
+			if *events {
+				return
+			}
+			if err := printReport(os.Stdout, *reportFormat, report); err != nil {
+				exitWithError(1, "Failed to print the transfer report: %v", err)
+			}
+		}
+
+		fmt.Fprintln(infoOut, "Start sending the file...")
+		if len(batch) > 0 {
+			start := time.Now()
+			opts.eventFile = names[0]
+			report, err := sendBatch(batch, opts)
+			finish(names[0], start, report, err)
+		}
+		for _, src := range singles {
+			start := time.Now()
+			opts.eventFile = filepath.Base(src)
+			report, err := sendFile(src, opts)
+			finish(filepath.Base(src), start, report, err)
+		}
+		if fromStdin {
+			start := time.Now()
+			opts.eventFile = *stdinName
+			report, err := sendStdin(*stdinName, opts)
+			finish(*stdinName, start, report, err)
+		}
+		if failures > 0 {
+			// the peer may have moved or changed, look it up and ask it
+			// again next time
+			if usedCache {
+				evictPeer(peerCacheFile, peer)
+			}
+			caps.forget(capsFile)
+			return fmt.Errorf("%d of %d uploads failed", failures, len(names))
+		}
+		caps.save(capsFile, *capsCacheTTL)
+		return nil
+	}
+
+	// sendAll sends the sources to every peer, reporting whether any send
+	// failed
+	sendAll := func(singles, batch []string) bool {
+		if broadcasting {
+			fmt.Fprintf(infoOut, "Sending to %d peers...\n", len(peers))
+			limit := 0
+			if powerSaving {
+				limit = 1
+			}
+			return printPeerStatus(infoOut, broadcast(peers, limit, func(peer string) error {
+				return sendTo(peer, singles, batch)
+			})) > 0
+		}
+		failed := false
+		for _, peer := range peers {
+			if len(peers) > 1 {
+				fmt.Fprintf(infoOut, "Sending to %s...\n", peer)
+			}
+			if err := sendTo(peer, singles, batch); err != nil {
+				// one unreachable member doesn't hold up the rest of a group
+				if len(peers) == 1 && !*watch {
+					exitWithError(1, "Failed to send to %s: %v", peer, err)
+				}
+				fmt.Fprintf(os.Stderr, "Failed to send to %s: %v\n", peer, err)
+				failed = true
+			}
+		}
+		return failed
+	}
+
+	if *watch {
+		watchDir(srcs[0], *debounce, func(files []string) []string {
+			clear(failedNames)
+			sendAll(files, nil)
+			var failed []string
+			for _, f := range files {
+				if failedNames[filepath.Base(f)] {
+					failed = append(failed, f)
+				}
+			}
+			return failed
+		})
+	}
+	if sendAll(singles, batch) {
+		os.Exit(1)
+	}
+}
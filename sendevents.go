@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	sendEventQueued      = "queued"
+	sendEventCompressing = "compressing"
+	sendEventUploading   = "uploading"
+	sendEventVerifying   = "verifying"
+	sendEventDone        = "done"
+	sendEventFailed      = "failed"
+)
+
+// sendEvent is a step of an upload of `send --events`, for front-ends that
+// render the progress themselves. An upload is queued, may be compressing,
+// is uploading until all bytes are out and then verifying until the peer has
+// stored and checked them, and ends done or failed.
+type sendEvent struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Peer string    `json:"peer"`
+	File string    `json:"file"`
+	// Bytes and Total are the bytes sent so far and the payload size, -1
+	// when streamed without knowing it, while uploading
+	Bytes  int64           `json:"bytes,omitempty"`
+	Total  int64           `json:"total,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Report *transferReport `json:"report,omitempty"`
+}
+
+// sendEvents writes the events of the uploads of a send as JSON lines. A nil
+// sendEvents writes nothing.
+type sendEvents struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newSendEvents(w io.Writer) *sendEvents {
+	return &sendEvents{enc: json.NewEncoder(w)}
+}
+
+func (s *sendEvents) emit(e sendEvent) {
+	if s == nil {
+		return
+	}
+	e.Time = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(e); err != nil {
+		debugLog("Failed to write the send event: %v", err)
+	}
+}
+
+// emitEvent emits the event for the upload opts is set up for.
+func (o sendOptions) emitEvent(e sendEvent) {
+	if o.events == nil {
+		return
+	}
+	e.Peer = o.eventPeer
+	e.File = o.eventFile
+	o.events.emit(e)
+}
+
+// progressEvents returns the func a progress reports to in place of drawing
+// a bar, which emits the upload's progress as it changes and then that it's
+// being verified, or nil without events.
+func (o sendOptions) progressEvents() func(sent, total int64) {
+	if o.events == nil {
+		return nil
+	}
+	last := int64(-1)
+	return func(sent, total int64) {
+		if sent == last {
+			return
+		}
+		last = sent
+		if total >= 0 && sent >= total {
+			o.emitEvent(sendEvent{Type: sendEventVerifying})
+			return
+		}
+		o.emitEvent(sendEvent{Type: sendEventUploading, Bytes: sent, Total: total})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	defaultDrainTimeout = 30 * time.Second
+	// drainPoll is how often the shutdown checks for transfers still running
+	drainPoll = 100 * time.Millisecond
+	// cancelGrace bounds the wait for cancelled transfers to remove what
+	// they staged
+	cancelGrace = 5 * time.Second
+	// responseGrace bounds the wait for the answers to finished uploads to
+	// go out, long-lived requests such as the event stream never end
+	responseGrace = time.Second
+)
+
+// drainReceiver shuts the receiver down on a signal: it leaves mDNS so no new
+// sender finds it, stops accepting connections, refuses new uploads on the
+// open ones and lets the transfers in flight finish within timeout. The ones
+// still running then are cancelled, which removes their partial files.
+// Another signal cancels them right away. Chunked uploads keep their chunks
+// to be resumed after a restart.
+func drainReceiver(opts receiverOptions, adv *advertiser, server *http.Server, timeout time.Duration, sigs <-chan os.Signal) {
+	adv.shutdown()
+	opts.control.close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	closed := make(chan struct{})
+	go func() {
+		// closes the listener and waits for the requests being served
+		server.Shutdown(ctx)
+		close(closed)
+	}()
+
+	if active := opts.transfers.active(); active > 0 {
+		fmt.Fprintf(infoOut, "Waiting up to %v for %d transfers to finish, interrupt again to cancel them\n", timeout, active)
+		if !waitTransfers(opts.transfers, timeout, sigs) {
+			n := opts.transfers.cancelAll()
+			fmt.Fprintf(infoOut, "Cancelled %d transfers still running\n", n)
+			if !waitTransfers(opts.transfers, cancelGrace, sigs) {
+				logger.Warn("Transfers didn't stop in time, their partial files may be left", "transfers", opts.transfers.active())
+			}
+		}
+	}
+	select {
+	case <-closed:
+	case <-time.After(responseGrace):
+		debugLog("Some requests are still being served, closing them")
+	}
+}
+
+// waitTransfers waits until no transfer is running, reporting false when
+// the timeout or a signal came first.
+func waitTransfers(m *transferManager, timeout time.Duration, sigs <-chan os.Signal) bool {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	for m.active() > 0 {
+		select {
+		case sig := <-sigs:
+			fmt.Fprintf(infoOut, "Received %v again\n", sig)
+			return false
+		case <-deadline:
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// simRetransmitDelay is what a lost TCP segment costs, the minimum
+// retransmission timeout of TCP.
+const simRetransmitDelay = 200 * time.Millisecond
+
+// errSimulatedFailure cuts the connection that reached --fail-at-byte.
+var errSimulatedFailure = errors.New("simulated network failure")
+
+// netSimulation degrades the connections of this process to reproduce flaky
+// networks. It applies to what this end sends: every write is held back by
+// latency and lost with the probability loss, which delays a TCP write by a
+// retransmission and drops a UDP datagram. The first connection that carries
+// failAt bytes either way is cut, once per process.
+type netSimulation struct {
+	latency time.Duration
+	loss    float64
+	failAt  int64
+	failed  atomic.Bool
+}
+
+// simulation is set by the hidden --simulate-* flags, nil on a real network.
+var simulation *netSimulation
+
+// simulationFlags registers --simulate-latency, --simulate-loss and
+// --fail-at-byte on fs and leaves them out of its usage, as they are only
+// meant for reproducing bugs and testing. The returned func applies them once
+// fs is parsed.
+func simulationFlags(fs *flag.FlagSet) func() {
+	latency := fs.Duration("simulate-latency", 0, "hold back every write by this long")
+	loss := fs.Float64("simulate-loss", 0, "lose this fraction of the writes, between 0 and 1")
+	failAt := fs.Int64("fail-at-byte", 0, "cut the first connection that carries this many bytes, 0 to never")
+	hidden := map[string]bool{"simulate-latency": true, "simulate-loss": true, "fail-at-byte": true}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+		visible.SetOutput(fs.Output())
+		fs.VisitAll(func(f *flag.Flag) {
+			if !hidden[f.Name] {
+				visible.Var(f.Value, f.Name, f.Usage)
+				visible.Lookup(f.Name).DefValue = f.DefValue
+			}
+		})
+		visible.PrintDefaults()
+	}
+	return func() {
+		if *latency < 0 || *loss < 0 || *loss > 1 || *failAt < 0 {
+			exitWithError(1, "Invalid network simulation: the latency and byte must not be negative and the loss must be between 0 and 1")
+		}
+		if *latency == 0 && *loss == 0 && *failAt == 0 {
+			return
+		}
+		simulation = &netSimulation{latency: *latency, loss: *loss, failAt: *failAt}
+		fmt.Fprintf(infoOut, "Simulating a latency of %v, a loss of %.1f%% and a failure at byte %d\n", *latency, *loss*100, *failAt)
+	}
+}
+
+// conn returns conn degraded by the simulation, or as is with none.
+func (s *netSimulation) conn(conn net.Conn) net.Conn {
+	if s == nil {
+		return conn
+	}
+	_, datagram := conn.(net.PacketConn)
+	return &simConn{Conn: conn, sim: s, datagram: datagram}
+}
+
+// packetConn returns conn degraded by the simulation, or as is with none.
+func (s *netSimulation) packetConn(conn net.PacketConn) net.PacketConn {
+	if s == nil {
+		return conn
+	}
+	return &simPacketConn{PacketConn: conn, sim: s}
+}
+
+// lost reports whether the next write is lost.
+func (s *netSimulation) lost() bool {
+	return s.loss > 0 && rand.Float64() < s.loss
+}
+
+// cut reports whether a connection that carried total bytes is the one to
+// fail.
+func (s *netSimulation) cut(total int64) bool {
+	return s.failAt > 0 && total >= s.failAt && s.failed.CompareAndSwap(false, true)
+}
+
+// later sends a copy of the datagram p with send after the latency, so that
+// delaying datagrams doesn't slow down the sender.
+func (s *netSimulation) later(p []byte, send func([]byte)) {
+	if s.latency <= 0 {
+		send(p)
+		return
+	}
+	p = append([]byte(nil), p...)
+	time.AfterFunc(s.latency, func() { send(p) })
+}
+
+// simConn is a connection degraded by a netSimulation.
+type simConn struct {
+	net.Conn
+	sim *netSimulation
+	// datagram is set for a connected UDP socket, whose lost writes are
+	// dropped rather than retransmitted
+	datagram bool
+	mu       sync.Mutex
+	total    int64
+	cutOff   bool
+}
+
+// count adds n bytes to the connection and reports whether it's to be cut.
+func (c *simConn) count(n int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total += int64(n)
+	if !c.cutOff && c.sim.cut(c.total) {
+		c.cutOff = true
+	}
+	return c.cutOff
+}
+
+func (c *simConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.count(n) {
+		c.Conn.Close()
+		return n, errSimulatedFailure
+	}
+	return n, err
+}
+
+func (c *simConn) Write(p []byte) (int, error) {
+	if c.count(len(p)) {
+		c.Conn.Close()
+		return 0, errSimulatedFailure
+	}
+	if c.datagram {
+		if !c.sim.lost() {
+			c.sim.later(p, func(p []byte) { c.Conn.Write(p) })
+		}
+		return len(p), nil
+	}
+	delay := c.sim.latency
+	if c.sim.lost() {
+		delay += simRetransmitDelay
+	}
+	time.Sleep(delay)
+	return c.Conn.Write(p)
+}
+
+// simPacketConn is a UDP socket whose datagrams are delayed and lost by a
+// netSimulation.
+type simPacketConn struct {
+	net.PacketConn
+	sim *netSimulation
+}
+
+func (c *simPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.sim.lost() {
+		c.sim.later(p, func(p []byte) { c.PacketConn.WriteTo(p, addr) })
+	}
+	return len(p), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const snapshotSeparator = "@"
+
+// snapshotDir returns a fresh dir for a snapshot of the directory name, e.g.
+// "project@2024-05-01", adding the time of day when that's taken.
+func snapshotDir(dropDir, name string, now time.Time) string {
+	dir := filepath.Join(dropDir, name+snapshotSeparator+now.Format("2006-01-02"))
+	if _, err := os.Stat(dir); err == nil {
+		dir = filepath.Join(dropDir, name+snapshotSeparator+now.Format("2006-01-02_150405.000"))
+	}
+	return dir
+}
+
+// pruneSnapshots removes the oldest snapshots of name beyond the retention
+// count. Snapshot suffixes sort chronologically.
+func pruneSnapshots(dropDir, name string, keep int) error {
+	entries, err := os.ReadDir(dropDir)
+	if err != nil {
+		return err
+	}
+	var snapshots []string
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), name+snapshotSeparator) {
+			snapshots = append(snapshots, e.Name())
+		}
+	}
+	if len(snapshots) <= keep {
+		return nil
+	}
+	sort.Strings(snapshots)
+	for _, s := range snapshots[:len(snapshots)-keep] {
+		debugLog("Removing the snapshot %s", s)
+		if err := os.RemoveAll(filepath.Join(dropDir, s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
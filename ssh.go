@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	transportSSH = "ssh"
+	// sshConnectionFailed is the exit status ssh uses for its own errors
+	sshConnectionFailed = 255
+)
+
+// shellQuote quotes s for a POSIX shell, as ssh runs the remote command
+// through the login shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// postSSH pipes the file at src into `ftr receive --stdin` on the remote host
+// through the system ssh client, so existing keys, agents and ProxyJump
+// settings in ~/.ssh/config apply. The returned bool reports whether the
+// failure is worth retrying.
+func postSSH(src, fileType string, opts sendOptions) (bool, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return false, fmt.Errorf("failed to open the source file: %v", err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat the source file: %v", err)
+	}
+
+	remote := []string{
+		opts.remoteFtr, "receive", "--stdin",
+		"--name", filepath.Base(src),
+		"--type", fileType,
+		"--size", strconv.FormatInt(fi.Size(), 10),
+		"--extract=" + strconv.FormatBool(opts.extract),
+	}
+	if opts.hash != "" {
+		remote = append(remote, "--sha256", opts.hash)
+	}
+	if opts.meta.Mode != "" {
+		remote = append(remote, "--mode", opts.meta.Mode, "--mtime", opts.meta.Mtime)
+	}
+	for i := range remote {
+		remote[i] = shellQuote(remote[i])
+	}
+	cmd := exec.Command(opts.sshCommand, opts.addr, strings.Join(remote, " "))
+	cmd.Stdin = bandwidth.reader(&progressReader{r: file, p: opts.progress})
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	debugLog("Running %v", cmd.Args)
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		retry := !errors.As(err, &exitErr) || exitErr.ExitCode() == sshConnectionFailed
+		return retry, fmt.Errorf("failed to send the file over ssh: %v: %s", err, strings.TrimSpace(out.String()))
+	}
+	return false, nil
+}
+
+// sshSender returns the address of the ssh client connecting to this host.
+func sshSender() string {
+	if client := os.Getenv("SSH_CLIENT"); client != "" {
+		return strings.Fields(client)[0]
+	}
+	return "ssh"
+}
+
+// runReceive stores a single payload read from stdin, the remote end of
+// `ftr send --via ssh`. Authentication is left to ssh.
+func runReceive(args []string) {
+	receiveCmd := flag.NewFlagSet("receive", flag.ExitOnError)
+	receiveCmd.SetOutput(os.Stdout)
+	stdin := receiveCmd.Bool("stdin", false, "read the payload from stdin")
+	name := receiveCmd.String("name", "", "the name of the received file")
+	fileType := receiveCmd.String("type", fileTypeFile, "the type of the payload (file, dir or batch)")
+	size := receiveCmd.Int64("size", -1, "the size of the payload, -1 if unknown")
+	dropDir := receiveCmd.String("dropdir", defaultDropDir(), "the path to the default drop dir")
+	historyFile := receiveCmd.String("history-file", defaultHistoryFile(), "the path to the transfer history ledger, empty to disable")
+	quarantine := receiveCmd.Bool("quarantine", true, "set the com.apple.quarantine attribute on received files (macOS only)")
+	extract := receiveCmd.Bool("extract", true, "extract a directory, otherwise keep the .tar.gz as is")
+	hash := receiveCmd.String("sha256", "", "the SHA-256 of the payload, checked before it's kept")
+	mode := receiveCmd.String("mode", "", "the octal permissions of a single file, restored once received")
+	mtime := receiveCmd.String("mtime", "", "the RFC 3339 modification time of a single file, restored once received")
+	debug := receiveCmd.Bool("debug", false, "enable debug log")
+	if err := receiveCmd.Parse(args); err != nil {
+		exitWithError(1, "Receive command failed: %v", err)
+	}
+	debugMode = *debug
+	if !*stdin {
+		exitWithError(1, "Only --stdin is supported")
+	}
+	if *name == "" {
+		exitWithError(1, "--name is required")
+	}
+
+	opts := receiverOptions{
+		dropDir:     *dropDir,
+		historyFile: *historyFile,
+		quarantine:  *quarantine,
+		autoExtract: true,
+	}
+	if err := prepareInbox(opts); err != nil {
+		exitWithError(1, "Failed to prepare the drop dir: %v", err)
+	}
+	if _, err := receiveUpload(opts, upload{
+		name:     *name,
+		fileType: *fileType,
+		size:     *size,
+		sender:   sshSender(),
+		body:     os.Stdin,
+		extract:  *extract,
+		hash:     *hash,
+		meta:     fileMeta{Mode: *mode, Mtime: *mtime},
+	}); err != nil {
+		exitWithError(1, "Failed to receive the file: %v", err)
+	}
+}
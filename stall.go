@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+const defaultStallTimeout = 2 * time.Minute
+
+// errUploadStalled fails an upload no byte arrived for within the stall
+// timeout, e.g. because the sender went to sleep.
+var errUploadStalled = newUploadError(http.StatusRequestTimeout, "Upload stalled")
+
+// stallReader aborts an upload that stops making progress. The connection it
+// comes from only gets timeout long for every read, so a silent sender
+// releases the connection and the staged file instead of holding them
+// indefinitely.
+type stallReader struct {
+	r       io.Reader
+	timeout time.Duration
+	// setDeadline sets the read deadline of the connection
+	setDeadline func(time.Time) error
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	if err := s.setDeadline(start.Add(s.timeout)); err != nil {
+		debugLog("Failed to set the read deadline: %v", err)
+	}
+	n, err := s.r.Read(p)
+	// the timeout may come back wrapped in whatever decodes the body, so
+	// it's told apart by the time the read took
+	if err != nil && err != io.EOF && time.Since(start) >= s.timeout {
+		return n, errUploadStalled
+	}
+	return n, err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+type peerStats struct {
+	Peer          string  `json:"peer"`
+	BytesSent     int64   `json:"bytes_sent"`
+	BytesReceived int64   `json:"bytes_received"`
+	Transfers     int     `json:"transfers"`
+	Failures      int     `json:"failures"`
+	FailureRate   float64 `json:"failure_rate"`
+	AvgSpeedBps   float64 `json:"avg_speed_bytes_per_sec"`
+
+	totalMs    int64
+	speedBytes int64
+}
+
+type hourStats struct {
+	Hour      int `json:"hour"`
+	Transfers int `json:"transfers"`
+}
+
+type usageStats struct {
+	Peers        []*peerStats `json:"peers"`
+	BusiestHours []hourStats  `json:"busiest_hours"`
+	Transfers    int          `json:"transfers"`
+	Failures     int          `json:"failures"`
+	FailureRate  float64      `json:"failure_rate"`
+	AvgSpeedBps  float64      `json:"avg_speed_bytes_per_sec"`
+}
+
+func computeStats(entries []historyEntry) *usageStats {
+	stats := &usageStats{}
+	byPeer := map[string]*peerStats{}
+	var hours [24]int
+	var totalMs, speedBytes int64
+	for _, e := range entries {
+		ps, ok := byPeer[e.Peer]
+		if !ok {
+			ps = &peerStats{Peer: e.Peer}
+			byPeer[e.Peer] = ps
+		}
+		ps.Transfers++
+		stats.Transfers++
+		hours[e.Time.Local().Hour()]++
+		if e.Status != statusOK {
+			ps.Failures++
+			stats.Failures++
+			continue
+		}
+		if e.Direction == directionSend {
+			ps.BytesSent += e.Bytes
+		} else {
+			ps.BytesReceived += e.Bytes
+		}
+		if e.DurationMs > 0 {
+			ps.totalMs += e.DurationMs
+			ps.speedBytes += e.Bytes
+			totalMs += e.DurationMs
+			speedBytes += e.Bytes
+		}
+	}
+
+	for _, ps := range byPeer {
+		ps.FailureRate = float64(ps.Failures) / float64(ps.Transfers)
+		if ps.totalMs > 0 {
+			ps.AvgSpeedBps = float64(ps.speedBytes) / (float64(ps.totalMs) / 1000)
+		}
+		stats.Peers = append(stats.Peers, ps)
+	}
+	sort.Slice(stats.Peers, func(i, j int) bool {
+		a, b := stats.Peers[i], stats.Peers[j]
+		if a.BytesSent+a.BytesReceived != b.BytesSent+b.BytesReceived {
+			return a.BytesSent+a.BytesReceived > b.BytesSent+b.BytesReceived
+		}
+		return a.Peer < b.Peer
+	})
+
+	for h, n := range hours {
+		if n > 0 {
+			stats.BusiestHours = append(stats.BusiestHours, hourStats{Hour: h, Transfers: n})
+		}
+	}
+	sort.SliceStable(stats.BusiestHours, func(i, j int) bool {
+		return stats.BusiestHours[i].Transfers > stats.BusiestHours[j].Transfers
+	})
+
+	if stats.Transfers > 0 {
+		stats.FailureRate = float64(stats.Failures) / float64(stats.Transfers)
+	}
+	if totalMs > 0 {
+		stats.AvgSpeedBps = float64(speedBytes) / (float64(totalMs) / 1000)
+	}
+	return stats
+}
+
+func printStatsTable(stats *usageStats, topHours int) {
+	fmt.Printf("Transfers: %d  Failures: %d (%s%%)  Average speed: %s\n\n",
+		stats.Transfers, stats.Failures, formatDecimal(stats.FailureRate*100), formatRate(stats.AvgSpeedBps))
+
+	fmt.Printf(
+		"%-20s %-15s %-15s %-10s %-10s %-15s\n",
+		"Peer", "Sent", "Received", "Transfers", "Failed", "AvgSpeed",
+	)
+	for _, ps := range stats.Peers {
+		fmt.Printf(
+			"%-20s %-15s %-15s %-10d %-10s %-15s\n",
+			ps.Peer, formatBytes(ps.BytesSent), formatBytes(ps.BytesReceived), ps.Transfers,
+			formatDecimal(ps.FailureRate*100)+"%", formatRate(ps.AvgSpeedBps),
+		)
+	}
+
+	fmt.Printf("\n%-10s %-10s\n", "Hour", "Transfers")
+	for i, hs := range stats.BusiestHours {
+		if i >= topHours {
+			break
+		}
+		fmt.Printf("%-10s %-10d\n", fmt.Sprintf("%02d:00", hs.Hour), hs.Transfers)
+	}
+}
+
+func runStats(args []string) {
+	statsCmd := flag.NewFlagSet("stats", flag.ExitOnError)
+	statsCmd.SetOutput(os.Stdout)
+	historyFile := statsCmd.String("history-file", defaultHistoryFile(), "the path to the transfer history ledger")
+	jsonOutput := statsCmd.Bool("json", false, "print the statistics as JSON")
+	topHours := statsCmd.Int("top-hours", 5, "the number of busiest hours to show")
+	applyUnits := unitFlags(statsCmd)
+	if err := statsCmd.Parse(args); err != nil {
+		exitWithError(1, "Stats command failed: %v", err)
+	}
+	applyUnits()
+
+	entries, err := readHistory(*historyFile)
+	if err != nil {
+		exitWithError(1, "Failed to read the history: %v", err)
+	}
+	stats := computeStats(entries)
+	if *jsonOutput {
+		if err := json.NewEncoder(os.Stdout).Encode(stats); err != nil {
+			exitWithError(1, "Failed to encode the statistics: %v", err)
+		}
+		return
+	}
+	printStatsTable(stats, *topHours)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stdinSource is the source of send reading the file from stdin, e.g.
+// `tar c . | ftr send --name backup.tar - peer`.
+const stdinSource = "-"
+
+// sendStdin uploads what's read from stdin as the file name. Over plain HTTP
+// it streams as it's read, of unknown size and without retries since stdin
+// can't be read twice. The other transports and confirmed or PAKE uploads
+// need the size or hash up front and get it spooled to a temp file first.
+func sendStdin(name string, opts sendOptions) (*transferReport, error) {
+	if opts.transport != transportHTTP || opts.confirm || opts.pake {
+		return spoolStdin(name, opts)
+	}
+	start := time.Now()
+	report := &transferReport{Source: stdinSource}
+	if err := streamStdin(name, report, opts); err != nil {
+		return nil, err
+	}
+	report.OriginalBytes = report.CompressedBytes
+	report.finish(time.Since(start))
+	fmt.Fprintln(infoOut, "File sent successfully")
+	return report, nil
+}
+
+// streamStdin uploads stdin in the body of a single request, like streamDir
+// does the tarball of a directory.
+func streamStdin(name string, report *transferReport, opts sendOptions) (err error) {
+	if opts.backpressure {
+		opts.throttle = &throttle{}
+		stop := followPace(opts.throttle, opts)
+		defer stop()
+	}
+	if opts.showProgress || opts.events != nil {
+		opts.progress = startProgress(name, -1, opts.progressEvents())
+		defer func() { opts.progress.finish(err) }()
+	}
+	pr, pw := io.Pipe()
+	// unblocks the copy when the request ends early
+	defer pr.Close()
+	w := multipart.NewWriter(pw)
+	hasher := sha256.New()
+	counter := &countingWriter{w: hasher}
+	go func() {
+		part, err := w.CreateFormFile("file", name)
+		if err == nil {
+			_, err = copyPooled(io.MultiWriter(part, counter), os.Stdin)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	if _, err := postFile(pr, -1, w.FormDataContentType(), fileTypeFile, opts); err != nil {
+		return err
+	}
+	report.CompressedBytes = counter.n
+	report.Hash = hex.EncodeToString(hasher.Sum(nil))
+	return nil
+}
+
+// spoolStdin writes stdin to a temp file named name and sends that.
+func spoolStdin(name string, opts sendOptions) (*transferReport, error) {
+	dir, err := os.MkdirTemp("", "ftr-stdin-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, name)
+	f, err := os.Create(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the temp file: %v", err)
+	}
+	debugLog("Spooling stdin to %s, --transport %s needs the size up front", src, opts.transport)
+	_, err = copyPooled(f, os.Stdin)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stdin: %v", err)
+	}
+	report, err := sendFile(src, opts)
+	if report != nil {
+		report.Source = stdinSource
+	}
+	return report, err
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const syncPath = "/sync"
+
+// syncDeletion lists the files, relative to the synced dir, that `ftr sync
+// --delete` asks the peer to remove, and the peer answers with the ones it
+// removed.
+type syncDeletion struct {
+	Paths []string `json:"paths"`
+}
+
+// syncHandler lets `ftr sync` update a dir in the drop dir of the inbox given
+// by the `inbox` query parameter, on a receiver run with --allow-sync:
+//
+//	POST /sync                 a batch upload, overwriting the files it replaces
+//	DELETE /sync?path=<dir>    a syncDeletion, removing its files from dir
+//
+// Unlike the upload endpoints it overwrites and deletes files, which is why
+// the receiver has to opt in.
+func syncHandler(opts receiverOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		inbox, ok := opts.inbox(r.URL.Query().Get("inbox"))
+		if !ok {
+			http.Error(w, "Unknown inbox", http.StatusNotFound)
+			return
+		}
+		if !inbox.authorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !inbox.allowSync {
+			http.Error(w, "The receiver doesn't allow sync", http.StatusForbidden)
+			return
+		}
+		if inbox.ephemeral {
+			http.Error(w, "The inbox keeps no files", http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			deleteSynced(inbox, w, r)
+			return
+		}
+		if !isBatch(r.Header) {
+			http.Error(w, "Sync uploads are batches", http.StatusBadRequest)
+			return
+		}
+		inbox.onConflict = conflictOverwrite
+		handler, err := getFileDropHandler(inbox)
+		if err != nil {
+			http.Error(w, "Failed to get the file drop handler", http.StatusInternalServerError)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// deleteSynced removes the regular files of the syncDeletion from the dir,
+// along with their provenance sidecars and the directories left empty.
+func deleteSynced(opts receiverOptions, w http.ResponseWriter, r *http.Request) {
+	var req syncDeletion
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxManifestProbeSize)).Decode(&req); err != nil {
+		http.Error(w, "Invalid sync deletion", http.StatusBadRequest)
+		return
+	}
+	dir := strings.TrimPrefix(path.Clean("/"+r.URL.Query().Get("path")), "/")
+	root := resolveSharePath(opts.dropDir, dir)
+	deleted := syncDeletion{Paths: []string{}}
+	for _, p := range req.Paths {
+		name := strings.TrimPrefix(path.Clean("/"+p), "/")
+		if name == "" || strings.HasPrefix(name, journalDir+"/") {
+			continue
+		}
+		if err := throughSymlink(opts.dropDir, path.Join(dir, name)); err != nil {
+			debugLog("Not deleting %s: %v", name, err)
+			continue
+		}
+		file := filepath.Join(root, filepath.FromSlash(name))
+		if fi, err := os.Lstat(file); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			debugLog("Failed to delete %s: %v", file, err)
+			continue
+		}
+		os.Remove(file + provenanceExt)
+		removeEmptyDirs(filepath.Dir(file), root)
+		deleted.Paths = append(deleted.Paths, name)
+	}
+	logger.Info("Deleted files for ftr sync", "peer", senderName(r), "inbox", opts.name, "dir", dir, "files", len(deleted.Paths))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deleted)
+}
+
+// removeEmptyDirs removes dir and its parents up to, but not including, root
+// as long as they're empty.
+func removeEmptyDirs(dir, root string) {
+	for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// deleteRemote asks the peer to remove the files, relative to dir, and
+// returns the ones it removed.
+func deleteRemote(addr string, port int, tlsConfig *tls.Config, key, inbox, dir string, paths []string) ([]string, error) {
+	q := url.Values{"path": {dir}}
+	if inbox != "" {
+		q.Set("inbox", inbox)
+	}
+	body, err := json.Marshal(syncDeletion{Paths: paths})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodDelete, peerURL(tlsConfig, addr, port, syncPath+"?"+q.Encode()), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(passKeyHeader, key)
+	req.Header.Set(senderHeader, getDefaultName())
+	resp, err := tlsClient(tlsConfig).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned status: %s", resp.Status)
+	}
+	var deleted syncDeletion
+	if err := json.NewDecoder(resp.Body).Decode(&deleted); err != nil {
+		return nil, err
+	}
+	return deleted.Paths, nil
+}
+
+func runSync(args []string) {
+	syncCmd := flag.NewFlagSet("sync", flag.ExitOnError)
+	syncCmd.SetOutput(os.Stdout)
+	key := syncCmd.String("key", "", "pre-shared passkey of the peer")
+	inbox := syncCmd.String("inbox", "", "the inbox on the peer to sync to, empty for the default one")
+	deleteExtra := syncCmd.Bool("delete", false, "remove the files only the peer has from its copy")
+	dryRun := syncCmd.Bool("dry-run", false, "only print what would be transferred and deleted")
+	retries := syncCmd.Int("retries", 0, "the number of times to retry a failed upload")
+	historyFile := syncCmd.String("history-file", defaultHistoryFile(), "the path to the transfer history ledger, empty to disable")
+	noProgress := syncCmd.Bool("no-progress", false, "don't draw the progress bar")
+	debug := syncCmd.Bool("debug", false, "enable debug log")
+	lookupTimeout := syncCmd.Duration("lookup-timeout", defaultLookupTimeoutMs*time.Millisecond, "how long to browse for the peer per attempt")
+	lookupRetries := syncCmd.Int("lookup-retries", defaultLookupRetries, "the number of times to retry a failed peer lookup")
+	peerCacheTTL := syncCmd.Duration("peer-cache-ttl", defaultPeerCacheTTLSec*time.Second, "reuse the address of a peer found within this long, 0 to always look it up")
+	if err := syncCmd.Parse(args); err != nil {
+		exitWithError(1, "Sync command failed: %v", err)
+	}
+	debugMode = *debug
+	peer, remoteDir, ok := strings.Cut(syncCmd.Arg(1), ":")
+	if syncCmd.NArg() != 2 || !ok || peer == "" {
+		fmt.Println("Usage: ftr sync --key <key> [--delete] [--dry-run] <localdir> <peer>:<remotedir>")
+		os.Exit(1)
+	}
+	localDir := syncCmd.Arg(0)
+	remoteDir = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(remoteDir)), "/")
+
+	if fi, err := os.Stat(localDir); err != nil || !fi.IsDir() {
+		exitWithError(1, "The source %s is not a directory", localDir)
+	}
+	local, err := buildManifest(localDir)
+	if err != nil {
+		exitWithError(1, "Failed to list %s: %v", localDir, err)
+	}
+	peerCacheFile := defaultPeerCacheFile()
+	p, cached, err := resolvePeer(peer, peerCacheFile, *peerCacheTTL, *lookupTimeout, *lookupRetries)
+	if err != nil {
+		exitWithError(1, "Failed to find the peer: %v", err)
+	}
+	tlsConfig := peerTLS(peer, p.Text)
+	remote, err := fetchManifest(p.Addr, p.Port, tlsConfig, *key, *inbox, remoteDir, local)
+	if err != nil {
+		if cached {
+			evictPeer(peerCacheFile, peer)
+		}
+		exitWithError(1, "Failed to get the manifest of %s: %v", syncCmd.Arg(1), err)
+	}
+
+	counts := map[string]int{}
+	var files, names, extra []string
+	for _, d := range diffManifests(local, remote) {
+		if d.Change == diffMissing {
+			if !*deleteExtra {
+				continue
+			}
+			extra = append(extra, d.Path)
+		} else {
+			files = append(files, filepath.Join(localDir, filepath.FromSlash(d.Path)))
+			names = append(names, path.Join(remoteDir, d.Path))
+		}
+		counts[d.Change]++
+		fmt.Printf("%s %s\n", d.Change, d.Path)
+	}
+	if *dryRun {
+		fmt.Printf("%d to add, %d to update, %d to delete on %s\n", counts[diffAdded], counts[diffUpdated], counts[diffMissing], peer)
+		return
+	}
+
+	if len(files) > 0 {
+		start := time.Now()
+		report := &transferReport{Peer: peer, Source: localDir}
+		err := syncFiles(files, names, report, sendOptions{
+			key:          *key,
+			addr:         p.Addr,
+			port:         p.Port,
+			retries:      *retries,
+			endpoint:     syncPath + inboxQuery(*inbox),
+			tls:          tlsConfig,
+			client:       tlsClient(tlsConfig),
+			transport:    transportHTTP,
+			extract:      true,
+			codec:        peerCodec(p.Text),
+			showProgress: !*noProgress && stderrIsTerminal(),
+		})
+		recordSend(*historyFile, peer, localDir, start, report, err)
+		if err != nil {
+			exitWithError(1, "Failed to sync %s to %s: %v", localDir, syncCmd.Arg(1), err)
+		}
+	}
+	deleted := 0
+	if len(extra) > 0 {
+		removed, err := deleteRemote(p.Addr, p.Port, tlsConfig, *key, *inbox, remoteDir, extra)
+		if err != nil {
+			exitWithError(1, "Failed to delete the extraneous files of %s: %v", syncCmd.Arg(1), err)
+		}
+		deleted = len(removed)
+	}
+	fmt.Printf("%d added, %d updated, %d deleted on %s\n", counts[diffAdded], counts[diffUpdated], deleted, peer)
+}
+
+// syncFiles uploads the files as a batch in which each is named after its
+// path on the peer.
+func syncFiles(files, names []string, report *transferReport, opts sendOptions) error {
+	start := time.Now()
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return fmt.Errorf("failed to stat the source file: %v", err)
+		}
+		report.OriginalBytes += fi.Size()
+	}
+	opts.codec = archiveCodec(opts.codec, files...)
+	if opts.streamsArchives() {
+		if err := streamBatch(files, names, report, opts); err != nil {
+			return err
+		}
+		report.finish(time.Since(start))
+		return nil
+	}
+	tarball, err := zipTarNamed(files, names, opts.codec)
+	if err != nil {
+		return fmt.Errorf("failed to zip and tar the changed files: %v", err)
+	}
+	defer os.Remove(tarball)
+	if err := uploadFile(tarball, fileTypeBatch, report, opts); err != nil {
+		return err
+	}
+	report.finish(time.Since(start))
+	return nil
+}
+
+// inboxQuery returns the query string selecting the inbox, empty for the
+// default one.
+func inboxQuery(inbox string) string {
+	if inbox == "" {
+		return ""
+	}
+	return "?" + url.Values{"inbox": {inbox}}.Encode()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	tcpSection = "tcp"
+	// defaultDSCP marks transfers as low-priority bulk data (CS1) so managed
+	// networks can shape them below interactive traffic
+	defaultDSCP = 8
+)
+
+// tcpTuning holds the socket options applied to transfer connections. They
+// are read from the `[tcp]` config section:
+//
+//	[tcp]
+//	nodelay = true
+//	send-buffer = 4MiB
+//	recv-buffer = 4MiB
+//	congestion = bbr
+//	dscp = cs1
+type tcpTuning struct {
+	// noDelay is nil to keep the Go default
+	noDelay    *bool
+	sendBuffer int
+	recvBuffer int
+	// congestion is the congestion control algorithm, only honored on Linux
+	congestion string
+	// dscp is the DSCP codepoint set on the IP header, -1 to keep the OS
+	// default
+	dscp int
+}
+
+func loadTCPTuning(cfg *config) (tcpTuning, error) {
+	t := tcpTuning{dscp: defaultDSCP}
+	sec := cfg.section(tcpSection)
+	if v, ok := sec["nodelay"]; ok {
+		noDelay, err := strconv.ParseBool(v)
+		if err != nil {
+			return t, fmt.Errorf("invalid nodelay %q", v)
+		}
+		t.noDelay = &noDelay
+	}
+	for key, dst := range map[string]*int{"send-buffer": &t.sendBuffer, "recv-buffer": &t.recvBuffer} {
+		if v, ok := sec[key]; ok {
+			size, err := parseSize(v)
+			if err != nil {
+				return t, fmt.Errorf("invalid %s: %v", key, err)
+			}
+			*dst = int(size)
+		}
+	}
+	t.congestion = sec["congestion"]
+	if v, ok := sec["dscp"]; ok {
+		dscp, err := parseDSCP(v)
+		if err != nil {
+			return t, err
+		}
+		t.dscp = dscp
+	}
+	return t, nil
+}
+
+// parseDSCP parses a DSCP codepoint given as a number (0-63), a class name
+// such as "cs1", "af21" or "ef", or "none" to leave the marking alone.
+func parseDSCP(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch {
+	case s == "none":
+		return -1, nil
+	case s == "ef":
+		return 46, nil
+	case s == "le":
+		return 1, nil
+	case len(s) == 3 && s[:2] == "cs" && s[2] >= '0' && s[2] <= '7':
+		return int(s[2]-'0') * 8, nil
+	case len(s) == 4 && s[:2] == "af" && s[2] >= '1' && s[2] <= '4' && s[3] >= '1' && s[3] <= '3':
+		return int(s[2]-'0')*8 + int(s[3]-'0')*2, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 63 {
+		return 0, fmt.Errorf("invalid dscp %q", s)
+	}
+	return n, nil
+}
+
+func mustLoadTCPTuning(cfg *config) tcpTuning {
+	t, err := loadTCPTuning(cfg)
+	if err != nil {
+		exitWithError(1, "Invalid tcp configuration: %v", err)
+	}
+	return t
+}
+
+func (t tcpTuning) apply(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if t.noDelay != nil {
+		if err := tcpConn.SetNoDelay(*t.noDelay); err != nil {
+			return err
+		}
+	}
+	if t.sendBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(t.sendBuffer); err != nil {
+			return err
+		}
+	}
+	if t.recvBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(t.recvBuffer); err != nil {
+			return err
+		}
+	}
+	if t.dscp >= 0 {
+		if err := setDSCP(tcpConn, t.dscp); err != nil {
+			return fmt.Errorf("failed to set the dscp to %d: %v", t.dscp, err)
+		}
+	}
+	if t.congestion != "" {
+		if err := setCongestionControl(tcpConn, t.congestion); err != nil {
+			return fmt.Errorf("failed to set the congestion control to %s: %v", t.congestion, err)
+		}
+	}
+	return nil
+}
+
+// dial opens a tuned TCP connection to addr.
+func (t tcpTuning) dial(addr string) (net.Conn, error) {
+	conn, err := peerNet.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return bandwidth.conn(simulation.conn(conn)), nil
+}
+
+// httpClient returns a client whose connections are tuned, speaking HTTPS
+// with tlsConfig if set.
+func (t tcpTuning) httpClient(tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := peerNet.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.apply(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return bandwidth.conn(simulation.conn(conn)), nil
+	}
+	return &http.Client{Transport: transport}
+}
+
+// tunedListener applies the tuning to every accepted connection.
+type tunedListener struct {
+	net.Listener
+	tuning tcpTuning
+}
+
+func (l tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.tuning.apply(conn); err != nil {
+		debugLog("Failed to tune the connection from %s: %v", conn.RemoteAddr(), err)
+	}
+	return bandwidth.conn(simulation.conn(conn)), nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+func setCongestionControl(conn *net.TCPConn, algo string) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, algo)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// setCongestionControl is a no-op where the algorithm can't be chosen per
+// socket.
+func setCongestionControl(conn *net.TCPConn, algo string) error {
+	debugLog("Ignoring congestion control %s, only supported on Linux", algo)
+	return nil
+}
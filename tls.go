@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	tlsCertFileName    = "tls.crt"
+	tlsKeyFileName     = "tls.key"
+	knownPeersFileName = "known_peers.json"
+	// tlsTXT is advertised by receivers serving HTTPS
+	tlsTXT = "tls=1"
+	// tlsHandshakeRecord is the first byte of a TLS ClientHello, which tells
+	// TLS connections apart from plain HTTP and raw uploads on the shared port
+	tlsHandshakeRecord = 0x16
+	tlsCertValidity    = 10 * 365 * 24 * time.Hour
+)
+
+// loadTLSCert returns the self-signed certificate the receiver serves HTTPS
+// with, creating it in the state dir on first use. Senders don't check it
+// against any CA but pin its fingerprint on the first connection instead.
+func loadTLSCert() (tls.Certificate, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certFile := filepath.Join(dir, tlsCertFileName)
+	keyFile := filepath.Join(dir, tlsKeyFileName)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		return cert, nil
+	}
+	if !os.IsNotExist(err) {
+		return tls.Certificate{}, err
+	}
+	certPEM, keyPEM, err := generateTLSCert(getDefaultName())
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to save the tls key: %v", err)
+	}
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to save the tls certificate: %v", err)
+	}
+	debugLog("Created the tls certificate %s", certFile)
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// generateTLSCert returns a new self-signed ECDSA certificate for name and
+// its key, PEM encoded.
+func generateTLSCert(name string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(tlsCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// certFingerprint is the SHA-256 of a DER encoded certificate, which is what
+// senders pin.
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+var knownPeersMu sync.Mutex
+
+func defaultKnownPeersFile() string {
+	dir, err := stateDir()
+	if err != nil {
+		exitWithError(1, "Failed to get the state dir: %v", err)
+	}
+	return filepath.Join(dir, knownPeersFileName)
+}
+
+// readPins reads a file of certificate fingerprints by peer name.
+func readPins(file string) (map[string]string, error) {
+	peers := map[string]string{}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return peers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+	return peers, nil
+}
+
+// pinPeer checks the certificate fingerprint of the peer against the one
+// pinned in the known peers file, pinning it if the peer is new.
+func pinPeer(file, peer, fp string) error {
+	knownPeersMu.Lock()
+	defer knownPeersMu.Unlock()
+	// unlike the peer cache, a corrupt file must not silently drop the pins
+	peers, err := readPins(file)
+	if err != nil {
+		return err
+	}
+	if pinned, ok := peers[peer]; ok {
+		if pinned != fp {
+			return fmt.Errorf("the certificate of %s changed from %s to %s, remove it from %s if that's expected", peer, pinned, fp, file)
+		}
+		return nil
+	}
+	peers[peer] = fp
+	if err := writePins(file, peers); err != nil {
+		return err
+	}
+	fmt.Fprintf(infoOut, "Trusting the certificate of %s with fingerprint %s\n", peer, fp)
+	return nil
+}
+
+// writePins replaces the file of fingerprints by peer name atomically.
+func writePins(file string, pins map[string]string) error {
+	data, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d", file, os.Getpid())
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// pinnedTLSConfig returns the client config for the peer, which accepts its
+// self-signed certificate as long as the fingerprint matches the one it was
+// paired with, or else the one pinned on first contact. The local
+// certificate goes along for receivers that know this node as paired.
+func pinnedTLSConfig(peer, knownPeersFile string) *tls.Config {
+	config := &tls.Config{
+		// the certificate is verified against the pin below instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("the peer presented no certificate")
+			}
+			fp := certFingerprint(rawCerts[0])
+			if pin, ok := pairedPin(peer); ok {
+				if pin != fp {
+					return fmt.Errorf("the certificate of %s doesn't match the one it was paired with, pair again if it changed", peer)
+				}
+				return nil
+			}
+			return pinPeer(knownPeersFile, peer, fp)
+		},
+	}
+	if cert, err := loadTLSCert(); err == nil {
+		config.Certificates = []tls.Certificate{cert}
+	} else {
+		debugLog("Failed to load the tls certificate: %v", err)
+	}
+	return config
+}
+
+// hasPin reports whether a certificate was pinned for the peer, by pairing
+// or on first contact.
+func hasPin(peer string) bool {
+	if _, ok := pairedPin(peer); ok {
+		return true
+	}
+	pins, err := readPins(defaultKnownPeersFile())
+	if err != nil {
+		debugLog("Failed to read the known peers: %v", err)
+		return false
+	}
+	_, ok := pins[peer]
+	return ok
+}
+
+// peerTLS returns the client config pinning the certificate of the peer, or
+// nil when its TXT records don't advertise HTTPS. Anyone on the network can
+// answer for the TXT records, so a peer with a pinned certificate gets HTTPS
+// regardless, and one that no longer serves it fails the handshake instead
+// of receiving the passkey in the clear.
+func peerTLS(peer string, text []string) *tls.Config {
+	if slices.Contains(text, tlsTXT) {
+		return pinnedTLSConfig(peer, defaultKnownPeersFile())
+	}
+	if hasPin(peer) {
+		fmt.Fprintf(os.Stderr, "%s doesn't advertise HTTPS but its certificate is pinned, insisting on HTTPS\n", peer)
+		return pinnedTLSConfig(peer, defaultKnownPeersFile())
+	}
+	return nil
+}
+
+// peerURL returns the URL of path on the peer, over HTTPS when tlsConfig is
+// set.
+func peerURL(tlsConfig *tls.Config, addr string, port int, path string) string {
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(addr, strconv.Itoa(port)) + path
+}
+
+// tlsClient returns a client for one-off requests to a peer, plain when
+// tlsConfig is nil.
+func tlsClient(tlsConfig *tls.Config) *http.Client {
+	if tlsConfig == nil {
+		return http.DefaultClient
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}
+}
+
+// receiverTLS holds what the receiver needs to terminate TLS on the shared
+// port.
+type receiverTLS struct {
+	config *tls.Config
+	// plain still accepts plain HTTP and raw uploads from other hosts, for
+	// browsers and senders without TLS support. Loopback is always allowed.
+	plain bool
+}
+
+func newReceiverTLS(cert tls.Certificate, plain bool) *receiverTLS {
+	return &receiverTLS{
+		config: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+			// paired peers present their certificate, anyone else may not
+			// have one and is left to the passkey
+			ClientAuth: tls.RequestClientCert,
+		},
+		plain: plain,
+	}
+}
+
+// allowsPlain reports whether an unencrypted connection from addr is served.
+func (t *receiverTLS) allowsPlain(addr net.Addr) bool {
+	if t == nil || t.plain {
+		return true
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.IsLoopback()
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type transferState string
+
+const (
+	stateReceiving   transferState = "receiving"
+	stateDone        transferState = "done"
+	stateFailed      transferState = "failed"
+	stateCancelled   transferState = "cancelled"
+	stateStalled     transferState = "stalled"
+	maxFinishedJobs                = 100
+	transferIDHeader               = "X-Ftr-Transfer-Id"
+)
+
+var errTransferCancelled = errors.New("transfer cancelled")
+
+// transferJob is a single upload tracked by the transfer manager.
+type transferJob struct {
+	ID       string        `json:"id"`
+	Inbox    string        `json:"inbox,omitempty"`
+	Sender   string        `json:"sender"`
+	File     string        `json:"file"`
+	Type     string        `json:"type"`
+	State    transferState `json:"state"`
+	Bytes    int64         `json:"bytes"`
+	Started  time.Time     `json:"started"`
+	Finished *time.Time    `json:"finished,omitempty"`
+	Error    string        `json:"error,omitempty"`
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// transferManager tracks every upload as an independent job so concurrent
+// uploads can be listed and cancelled one by one. A nil manager tracks jobs
+// without remembering them.
+type transferManager struct {
+	mu       sync.Mutex
+	jobs     map[string]*transferJob
+	finished []string
+}
+
+func newTransferManager() *transferManager {
+	return &transferManager{jobs: map[string]*transferJob{}}
+}
+
+func newTransferID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		exitWithError(1, "Failed to generate a transfer id: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (m *transferManager) start(inbox string, u upload) *transferJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &transferJob{
+		ID:      newTransferID(),
+		Inbox:   inbox,
+		Sender:  u.sender,
+		File:    u.name,
+		Type:    u.fileType,
+		State:   stateReceiving,
+		Started: time.Now(),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	if m != nil {
+		m.mu.Lock()
+		m.jobs[job.ID] = job
+		m.mu.Unlock()
+	}
+	return job
+}
+
+func (m *transferManager) finish(job *transferJob, err error) {
+	if m != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+	}
+	now := time.Now()
+	job.Finished = &now
+	switch {
+	case errors.Is(err, errTransferCancelled) || job.ctx.Err() != nil:
+		job.State = stateCancelled
+	case errors.Is(err, errUploadStalled):
+		job.State = stateStalled
+		job.Error = err.Error()
+	case err != nil:
+		job.State = stateFailed
+		job.Error = err.Error()
+	default:
+		job.State = stateDone
+	}
+	job.cancel()
+	if m == nil {
+		return
+	}
+	// only the most recent finished jobs are kept around for reporting
+	m.finished = append(m.finished, job.ID)
+	if len(m.finished) > maxFinishedJobs {
+		delete(m.jobs, m.finished[0])
+		m.finished = m.finished[1:]
+	}
+}
+
+func (m *transferManager) addBytes(job *transferJob, n int64) {
+	if m != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+	}
+	job.Bytes += n
+}
+
+// snapshot returns copies of the jobs, oldest first.
+func (m *transferManager) snapshot() []transferJob {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]transferJob, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Started.Before(jobs[j].Started) })
+	return jobs
+}
+
+func (m *transferManager) get(id string) (transferJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return transferJob{}, false
+	}
+	return *job, true
+}
+
+func (m *transferManager) cancelJob(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok || job.State != stateReceiving {
+		return false
+	}
+	job.cancel()
+	return true
+}
+
+// active returns the number of jobs still receiving.
+func (m *transferManager) active() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, job := range m.jobs {
+		if job.State == stateReceiving {
+			n++
+		}
+	}
+	return n
+}
+
+// cancelAll cancels the running jobs, returning how many there were.
+func (m *transferManager) cancelAll() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, job := range m.jobs {
+		if job.State == stateReceiving {
+			job.cancel()
+			n++
+		}
+	}
+	return n
+}
+
+// jobReader counts the bytes received for a job and stops once it's
+// cancelled.
+type jobReader struct {
+	r   io.Reader
+	job *transferJob
+	m   *transferManager
+}
+
+func (jr *jobReader) Read(p []byte) (int, error) {
+	if jr.job.ctx.Err() != nil {
+		return 0, errTransferCancelled
+	}
+	n, err := jr.r.Read(p)
+	jr.m.addBytes(jr.job, int64(n))
+	return n, err
+}
+
+// transfersHandler serves the jobs of the manager:
+//
+//	GET    /transfers       list all jobs
+//	GET    /transfers/<id>  a single job
+//	DELETE /transfers/<id>  cancel a running job
+func transfersHandler(m *transferManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/transfers"), "/")
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && id == "":
+			json.NewEncoder(w).Encode(m.snapshot())
+		case r.Method == http.MethodGet:
+			job, ok := m.get(id)
+			if !ok {
+				http.Error(w, "Transfer not found", http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(job)
+		case r.Method == http.MethodDelete && id != "":
+			if !m.cancelJob(id) {
+				http.Error(w, "Transfer not found or not running", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	unitsIEC = "iec"
+	unitsSI  = "si"
+	// unitsEnv picks the units when neither --si nor --iec is given
+	unitsEnv = "FTR_UNITS"
+)
+
+// sizeUnits is how sizes are printed: powers of 1024 with KiB, MiB, ... or
+// powers of 1000 with kB, MB, ...
+var sizeUnits = unitsIEC
+
+// commaLocales are the languages writing a decimal comma, by the language
+// part of the locale.
+var commaLocales = map[string]bool{
+	"bg": true, "ca": true, "cs": true, "da": true, "de": true, "el": true,
+	"es": true, "et": true, "fi": true, "fr": true, "hr": true, "hu": true,
+	"id": true, "is": true, "it": true, "lt": true, "lv": true, "nb": true,
+	"nl": true, "nn": true, "no": true, "pl": true, "pt": true, "ro": true,
+	"ru": true, "sk": true, "sl": true, "sr": true, "sv": true, "tr": true,
+	"uk": true, "vi": true,
+}
+
+// unitFlags registers --si and --iec on fs. The returned func applies them,
+// or else $FTR_UNITS, once fs is parsed.
+func unitFlags(fs *flag.FlagSet) func() {
+	si := fs.Bool("si", false, "print sizes in powers of 1000 (kB, MB, ...)")
+	iec := fs.Bool("iec", false, "print sizes in powers of 1024 (KiB, MiB, ...), the default")
+	return func() {
+		switch {
+		case *si && *iec:
+			exitWithError(1, "--si and --iec are mutually exclusive")
+		case *si:
+			sizeUnits = unitsSI
+		case *iec:
+			sizeUnits = unitsIEC
+		case os.Getenv(unitsEnv) == unitsSI:
+			sizeUnits = unitsSI
+		}
+	}
+}
+
+// decimalSeparator returns the decimal separator of the locale the
+// environment selects for numbers.
+func decimalSeparator() string {
+	locale := ""
+	for _, env := range []string{"LC_ALL", "LC_NUMERIC", "LANG"} {
+		if locale = os.Getenv(env); locale != "" {
+			break
+		}
+	}
+	lang, _, _ := strings.Cut(locale, "_")
+	lang, _, _ = strings.Cut(lang, ".")
+	if commaLocales[strings.ToLower(lang)] {
+		return ","
+	}
+	return "."
+}
+
+// formatDecimal renders f with one decimal in the locale's notation.
+func formatDecimal(f float64) string {
+	return strings.Replace(fmt.Sprintf("%.1f", f), ".", decimalSeparator(), 1)
+}
+
+// formatBytes renders n in the selected units, such as 12.3 MiB or 12.9 MB.
+func formatBytes(n int64) string {
+	unit, prefixes, suffix := int64(1024), "KMGTPE", "iB"
+	if sizeUnits == unitsSI {
+		unit, prefixes, suffix = 1000, "kMGTPE", "B"
+	}
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := unit, 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%s %c%s", formatDecimal(float64(n)/float64(div)), prefixes[exp], suffix)
+}
+
+// formatRate renders a throughput in bytes per second.
+func formatRate(bps float64) string {
+	return formatBytes(int64(bps)) + "/s"
+}
+
+// formatDuration renders d to the precision that matters at its scale:
+// 850ms, 12.3s, 4m05s or 2h03m.
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	case d < time.Minute:
+		return formatDecimal(d.Seconds()) + "s"
+	case d < time.Hour:
+		s := int64(d.Round(time.Second).Seconds())
+		return fmt.Sprintf("%dm%02ds", s/60, s%60)
+	default:
+		m := int64(d.Round(time.Minute).Minutes())
+		return fmt.Sprintf("%dh%02dm", m/60, m%60)
+	}
+}
+
+// formatClock renders d as m:ss, or h:mm:ss from an hour on.
+func formatClock(d time.Duration) string {
+	s := int64(d.Round(time.Second).Seconds())
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
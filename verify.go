@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	verifyOK       = "ok"
+	verifyModified = "modified"
+	verifyMissing  = "missing"
+)
+
+// latestReceipts returns the last successful receipt of every file the
+// ledger knows the path and hash of, keyed by path.
+func latestReceipts(entries []historyEntry) map[string]historyEntry {
+	receipts := map[string]historyEntry{}
+	for _, e := range entries {
+		if e.Direction != directionReceive || e.Status != statusOK || e.Path == "" || e.Hash == "" {
+			continue
+		}
+		receipts[e.Path] = e
+	}
+	return receipts
+}
+
+// verifyReceipt re-hashes the received file and compares it to the ledger.
+func verifyReceipt(e historyEntry) (string, error) {
+	hash, err := hashFile(e.Path)
+	if os.IsNotExist(err) {
+		return verifyMissing, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if hash != e.Hash {
+		return verifyModified, nil
+	}
+	return verifyOK, nil
+}
+
+func runVerify(args []string) {
+	verifyCmd := flag.NewFlagSet("verify", flag.ExitOnError)
+	verifyCmd.SetOutput(os.Stdout)
+	historyFile := verifyCmd.String("history-file", defaultHistoryFile(), "the path to the transfer history ledger")
+	all := verifyCmd.Bool("all", false, "verify every received file in the history")
+	if err := verifyCmd.Parse(args); err != nil {
+		exitWithError(1, "Verify command failed: %v", err)
+	}
+	if *all == (verifyCmd.NArg() > 0) {
+		fmt.Println("Usage: ftr verify [--history-file <file>] <path>... | --all")
+		os.Exit(1)
+	}
+
+	entries, err := readHistory(*historyFile)
+	if err != nil {
+		exitWithError(1, "Failed to read the history: %v", err)
+	}
+	receipts := latestReceipts(entries)
+
+	var paths []string
+	if *all {
+		for p := range receipts {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+	} else {
+		for _, p := range verifyCmd.Args() {
+			abs, err := filepath.Abs(p)
+			if err != nil {
+				exitWithError(1, "Failed to resolve %s: %v", p, err)
+			}
+			paths = append(paths, abs)
+		}
+	}
+
+	failed := false
+	for _, p := range paths {
+		e, ok := receipts[p]
+		if !ok {
+			fmt.Printf("%-10s %s\n", "unknown", p)
+			failed = true
+			continue
+		}
+		status, err := verifyReceipt(e)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to verify %s: %v\n", p, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%-10s %s\n", status, p)
+		if status != verifyOK {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
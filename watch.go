@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultWatchDebounce = 2 * time.Second
+	// watchPollInterval is how often the directory is read while a file is
+	// settling or waiting to be sent again, or all the time where there are
+	// no change events
+	watchPollInterval = 500 * time.Millisecond
+	// watchRescanInterval is how often it's read anyway while waiting for
+	// change events, in case some went missing
+	watchRescanInterval = time.Minute
+	// watchRetryDelay is how long a file that failed to send waits before
+	// the next attempt, and watchMaxAttempts how many it gets before it's
+	// only sent again once it changes
+	watchRetryDelay  = 30 * time.Second
+	watchMaxAttempts = 3
+)
+
+// watchedFile is the last seen state of a file of a watched directory.
+type watchedFile struct {
+	size  int64
+	mtime time.Time
+	// changed is when the size or mtime were last seen changing
+	changed time.Time
+	// sent is true once this version was sent, or given up on
+	sent     bool
+	attempts int
+	retryAt  time.Time
+}
+
+// watchDir watches the regular files right in dir and calls send with the
+// ones created or changed since the watch started, once they were left alone
+// for debounce so a file being written isn't sent half done. Hidden files and
+// the ones --exclude or the .ftrignore of dir leave out are skipped. send
+// returns the files that failed, which are tried again after
+// watchRetryDelay. It never returns.
+//
+// The directory is read again on every change event, and polled while a
+// file settles. Where the platform has no change events, it's polled all the
+// time.
+func watchDir(dir string, debounce time.Duration, send func(files []string) []string) {
+	fmt.Fprintf(infoOut, "Watching %s for new and changed files\n", dir)
+	events, err := dirEvents(dir)
+	if err != nil {
+		debugLog("Polling %s for changes: %v", dir, err)
+	}
+	files := map[string]*watchedFile{}
+	first := true
+	for {
+		now := time.Now()
+		rules := newIgnoreRules(excludePatterns)
+		if err := rules.load(dir, ""); err != nil {
+			debugLog("Failed to read the ignore rules of %s: %v", dir, err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			debugLog("Failed to read the watched dir %s: %v", dir, err)
+		}
+		seen := map[string]bool{}
+		for _, e := range entries {
+			name := e.Name()
+			if !e.Type().IsRegular() || strings.HasPrefix(name, ".") || rules.ignored(name, false) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			seen[name] = true
+			f, ok := files[name]
+			if ok && f.size == info.Size() && f.mtime.Equal(info.ModTime()) {
+				continue
+			}
+			// what's there when the watch starts was sent already
+			files[name] = &watchedFile{size: info.Size(), mtime: info.ModTime(), changed: now, sent: first}
+		}
+		for name := range files {
+			if !seen[name] {
+				delete(files, name)
+			}
+		}
+		first = false
+
+		var due []string
+		for name, f := range files {
+			if !f.sent && now.Sub(f.changed) >= debounce && !now.Before(f.retryAt) {
+				due = append(due, filepath.Join(dir, name))
+			}
+		}
+		if len(due) > 0 {
+			debugLog("Sending the changed files %v", due)
+			failed := map[string]bool{}
+			for _, p := range send(due) {
+				failed[p] = true
+			}
+			for _, p := range due {
+				f := files[filepath.Base(p)]
+				if !failed[p] {
+					f.sent = true
+					continue
+				}
+				f.attempts++
+				if f.attempts >= watchMaxAttempts {
+					logger.Warn("Giving up on the file until it changes again", "file", p, "attempts", f.attempts)
+					f.sent = true
+					continue
+				}
+				f.retryAt = time.Now().Add(watchRetryDelay)
+			}
+		}
+
+		settling := false
+		for _, f := range files {
+			settling = settling || !f.sent
+		}
+		if events == nil || settling {
+			time.Sleep(watchPollInterval)
+			continue
+		}
+		select {
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+			}
+		case <-time.After(watchRescanInterval):
+		}
+	}
+}
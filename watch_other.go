@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// dirEvents isn't supported here, the watch polls the directory instead.
+func dirEvents(dir string) (<-chan struct{}, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+)
+
+// webUIHandler serves the upload page to browsers getting the root of the
+// receiver, leaving every other request to next, the upload handler.
+func webUIHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(webUIPage))
+	})
+}
+
+// webUIPage lets someone without the CLI, e.g. on a phone, drop files with
+// the passkey. Each file is posted to /upload on its own with the passkey
+// and sender headers, as ftr send does, so it meets the same auth and
+// policies.
+const webUIPage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>ftr upload</title>
+<style>
+body { font-family: sans-serif; margin: 2em; max-width: 40em; }
+input, button { font-size: 1em; margin: 0.4em 0; }
+#drop { border: 2px dashed #999; border-radius: 0.5em; padding: 2em; text-align: center; }
+#drop.over { border-color: #06c; background: #eef5ff; }
+.error { color: #b00; }
+.ok { color: #080; }
+</style></head>
+<body>
+<h1>Send files</h1>
+<p><label>Passkey <input type="password" id="key" autofocus></label></p>
+<p><label>Your name <input type="text" id="name"></label></p>
+<div id="drop">
+<p>Drop files here or</p>
+<input type="file" id="files" multiple>
+</div>
+<ul id="results"></ul>
+<script>
+const drop = document.getElementById("drop");
+const results = document.getElementById("results");
+for (const id of ["key", "name"]) {
+  const input = document.getElementById(id);
+  input.value = sessionStorage.getItem("ftr_" + id) || "";
+  input.onchange = () => sessionStorage.setItem("ftr_" + id, input.value);
+}
+drop.ondragover = e => { e.preventDefault(); drop.classList.add("over"); };
+drop.ondragleave = () => drop.classList.remove("over");
+drop.ondrop = e => {
+  e.preventDefault();
+  drop.classList.remove("over");
+  send(e.dataTransfer.files);
+};
+document.getElementById("files").onchange = e => {
+  send(e.target.files);
+  e.target.value = "";
+};
+async function send(files) {
+  for (const file of files) {
+    await upload(file);
+  }
+}
+function upload(file) {
+  const item = document.createElement("li");
+  item.textContent = file.name + ": 0%";
+  results.appendChild(item);
+  const form = new FormData();
+  form.append("file", file, file.name);
+  const xhr = new XMLHttpRequest();
+  xhr.open("POST", "/upload");
+  xhr.setRequestHeader("X-Ftr-Passkey", document.getElementById("key").value);
+  const name = document.getElementById("name").value.trim();
+  if (name) {
+    xhr.setRequestHeader("X-Ftr-Sender", name);
+  }
+  xhr.upload.onprogress = e => {
+    if (e.lengthComputable) {
+      item.textContent = file.name + ": " + Math.floor(100 * e.loaded / e.total) + "%";
+    }
+  };
+  return new Promise(resolve => {
+    xhr.onloadend = () => {
+      if (xhr.status >= 200 && xhr.status < 300) {
+        item.textContent = file.name + ": received";
+        item.className = "ok";
+      } else {
+        item.textContent = file.name + ": " + (xhr.status ? xhr.responseText.trim() || xhr.statusText : "connection failed");
+        item.className = "error";
+      }
+      resolve();
+    };
+    xhr.send(form);
+  });
+}
+</script>
+</body></html>
+`